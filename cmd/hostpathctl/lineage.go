@@ -0,0 +1,78 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+)
+
+const (
+	typeVolume   = state.LineageVolume
+	typeSnapshot = state.LineageSnapshot
+)
+
+func runLineage(c *ctl, args []string) error {
+	flags := newFlagSet(c, "lineage")
+	output := outputFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := validateOutput(*output); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("lineage needs the ID of a volume or snapshot")
+	}
+	root, err := state.Lineage(c.state, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *output == outputJSON {
+		return writeJSON(c.stdout, root)
+	}
+	if root.DeletedParent != "" {
+		fmt.Fprintf(c.stdout, "(deleted %s)\n", root.DeletedParent)
+	}
+	writeTree(c.stdout, root, "", "")
+	return nil
+}
+
+// writeTree writes a node and its children, one per line.
+func writeTree(w io.Writer, n *state.LineageNode, prefix, childPrefix string) {
+	line := fmt.Sprintf("%s%s/%s", prefix, n.Type, n.ID)
+	if n.Name != "" {
+		line += fmt.Sprintf(" (%s)", n.Name)
+	}
+	if n.DeletionDeferred {
+		line += " [deletion deferred]"
+	}
+	if n.Selected {
+		line += " *"
+	}
+	fmt.Fprintln(w, line)
+	for i, child := range n.Children {
+		if i == len(n.Children)-1 {
+			writeTree(w, child, childPrefix+"└── ", childPrefix+"    ")
+		} else {
+			writeTree(w, child, childPrefix+"├── ", childPrefix+"│   ")
+		}
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// filter selects the records which are listed. Empty fields match
+// all records.
+type filter struct {
+	name   string
+	kind   string
+	node   string
+	source string
+}
+
+func (f filter) matchName(name string) bool {
+	return f.name == "" || strings.Contains(name, f.name)
+}
+
+func (f filter) matchNode(node string) bool {
+	return f.node == "" || f.node == node
+}
+
+func runList(c *ctl, args []string) error {
+	flags := newFlagSet(c, "list")
+	output := outputFlag(flags)
+	var f filter
+	flags.StringVar(&f.name, "name", "", "only list records whose name contains this string")
+	flags.StringVar(&f.kind, "kind", "", "only list volumes of this storage kind")
+	flags.StringVar(&f.node, "node", "", "only list volumes and snapshots on this node")
+	flags.StringVar(&f.source, "source", "", "only list volumes cloned or restored from this volume or snapshot, and snapshots of this volume")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := validateOutput(*output); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("list needs exactly one of volumes, snapshots or groupsnapshots")
+	}
+
+	switch flags.Arg(0) {
+	case "volumes":
+		volumes := []state.Volume{}
+		for _, vol := range c.state.GetVolumes() {
+			if f.matchName(vol.VolName) && f.matchNode(vol.NodeID) &&
+				(f.kind == "" || f.kind == vol.Kind) &&
+				(f.source == "" || f.source == vol.ParentVolID || f.source == vol.ParentSnapID) {
+				volumes = append(volumes, vol)
+			}
+		}
+		if *output == outputJSON {
+			return writeJSON(c.stdout, volumes)
+		}
+		return writeTable(c.stdout, []string{"ID", "NAME", "SIZE", "ACCESS", "KIND", "NODE", "SOURCE", "STAGED", "PUBLISHED"}, len(volumes), func(i int) []string {
+			vol := volumes[i]
+			return []string{vol.VolID, vol.VolName, fmt.Sprint(vol.VolSize), accessType(vol), vol.Kind, vol.NodeID,
+				volumeSource(vol), strings.Join(vol.Staged, ","), strings.Join(vol.Published, ",")}
+		})
+	case "snapshots":
+		snapshots := []state.Snapshot{}
+		for _, snapshot := range c.state.GetSnapshots() {
+			if f.matchName(snapshot.Name) && f.matchNode(snapshot.NodeID) &&
+				(f.source == "" || f.source == snapshot.VolID) {
+				snapshots = append(snapshots, snapshot)
+			}
+		}
+		if *output == outputJSON {
+			return writeJSON(c.stdout, snapshots)
+		}
+		return writeTable(c.stdout, []string{"ID", "NAME", "SOURCE", "SIZE", "READY", "CREATED", "GROUP"}, len(snapshots), func(i int) []string {
+			snapshot := snapshots[i]
+			return []string{snapshot.Id, snapshot.Name, snapshot.VolID, fmt.Sprint(snapshot.SizeBytes), fmt.Sprint(snapshot.ReadyToUse),
+				formatTime(snapshot.CreationTime), snapshot.GroupSnapshotID}
+		})
+	case "groupsnapshots":
+		groups := []state.GroupSnapshot{}
+		for _, group := range c.state.GetGroupSnapshots() {
+			if f.matchName(group.Name) && (f.source == "" || contains(group.SourceVolumeIDs, f.source)) {
+				groups = append(groups, group)
+			}
+		}
+		if *output == outputJSON {
+			return writeJSON(c.stdout, groups)
+		}
+		return writeTable(c.stdout, []string{"ID", "NAME", "SNAPSHOTS", "SOURCES", "READY", "CREATED"}, len(groups), func(i int) []string {
+			group := groups[i]
+			return []string{group.Id, group.Name, strings.Join(group.SnapshotIDs, ","), strings.Join(group.SourceVolumeIDs, ","),
+				fmt.Sprint(group.ReadyToUse), formatTime(group.CreationTime)}
+		})
+	default:
+		return fmt.Errorf("cannot list %q, must be volumes, snapshots or groupsnapshots", flags.Arg(0))
+	}
+}
+
+func accessType(vol state.Volume) string {
+	switch {
+	case vol.VolAccessType == state.BlockAccess:
+		return "block"
+	case vol.BlockBacked:
+		return "mount (block-backed)"
+	default:
+		return "mount"
+	}
+}
+
+// volumeSource returns the volume or snapshot from which a volume
+// was cloned or restored.
+func volumeSource(vol state.Volume) string {
+	switch {
+	case vol.ParentVolID != "":
+		return "volume/" + vol.ParentVolID
+	case vol.ParentSnapID != "":
+		return "snapshot/" + vol.ParentSnapID
+	default:
+		return ""
+	}
+}
+
+func formatTime(t *timestamppb.Timestamp) string {
+	if t == nil {
+		return ""
+	}
+	return t.AsTime().UTC().Format(time.RFC3339)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// writeTable writes rows aligned in columns.
+func writeTable(w io.Writer, header []string, rows int, row func(i int) []string) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for i := 0; i < rows; i++ {
+		fmt.Fprintln(tw, strings.Join(row(i), "\t"))
+	}
+	return tw.Flush()
+}
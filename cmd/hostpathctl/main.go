@@ -0,0 +1,156 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command hostpathctl inspects and repairs the state of a hostpath
+// driver. It works offline: every command takes the lock on the state
+// file and fails while a driver is running against the same state
+// directory.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+)
+
+const (
+	// stateFile is the name of the state file in the state directory.
+	stateFile = "state.json"
+
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+const usage = `Usage: hostpathctl [-statedir DIR] COMMAND [OPTIONS]
+
+Commands:
+  list volumes|snapshots|groupsnapshots   list state records
+  lineage ID                              show the clone and snapshot lineage of a volume or snapshot
+  orphans                                 find files without records and records without files
+  force-unstage VOLUME-ID                 clear the staged and published paths of a volume
+  promote VOLUME-ID                       make a replica writable after the node of its source volume failed
+  export [-f FILE]                        write the state as JSON
+  import -f FILE                          replace the state with an exported one
+  compact                                 remove duplicate and stale records from the state file
+  parameters                              list the supported StorageClass and VolumeSnapshotClass parameters
+  trash                                   list deleted volumes and snapshots which can be restored
+  undelete [-id NEW-ID] [-name NAME] ID   restore a volume or snapshot from the trash
+
+Run "hostpathctl COMMAND -h" for the options of a command.
+`
+
+// command is a subcommand which works on the locked state unless
+// it is stateless.
+type command struct {
+	name      string
+	run       func(c *ctl, args []string) error
+	stateless bool
+}
+
+var commands = []command{
+	{"list", runList, false},
+	{"lineage", runLineage, false},
+	{"orphans", runOrphans, false},
+	{"force-unstage", runForceUnstage, false},
+	{"promote", runPromote, false},
+	{"export", runExport, false},
+	{"import", runImport, false},
+	{"compact", runCompact, false},
+	{"parameters", runParameters, true},
+	{"trash", runTrash, false},
+	{"undelete", runUndelete, false},
+}
+
+// ctl is the context of a command.
+type ctl struct {
+	stateDir string
+	state    state.State
+	stdout   io.Writer
+}
+
+func (c *ctl) statePath() string {
+	return filepath.Join(c.stateDir, stateFile)
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintf(os.Stderr, "hostpathctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run parses the global options, locks the state and runs the command.
+func run(args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("hostpathctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() { fmt.Fprint(stderr, usage) }
+	stateDir := flags.String("statedir", "/csi-data-dir", "directory in which the driver stores its state and data")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("no command given")
+	}
+
+	for _, cmd := range commands {
+		if cmd.name != flags.Arg(0) {
+			continue
+		}
+		c := &ctl{stateDir: *stateDir, stdout: stdout}
+		if cmd.stateless {
+			return cmd.run(c, flags.Args()[1:])
+		}
+		lock, err := state.Lock(c.statePath())
+		if err != nil {
+			if errors.Is(err, state.ErrLocked) {
+				return fmt.Errorf("%w, stop the driver before using hostpathctl", err)
+			}
+			return err
+		}
+		defer lock.Unlock()
+		if c.state, err = state.New(c.statePath()); err != nil {
+			return err
+		}
+		return cmd.run(c, flags.Args()[1:])
+	}
+	flags.Usage()
+	return fmt.Errorf("unknown command %q", flags.Arg(0))
+}
+
+// newFlagSet returns the flags of a command.
+func newFlagSet(c *ctl, name string) *flag.FlagSet {
+	flags := flag.NewFlagSet("hostpathctl "+name, flag.ContinueOnError)
+	flags.SetOutput(c.stdout)
+	return flags
+}
+
+// outputFlag adds the -o option.
+func outputFlag(flags *flag.FlagSet) *string {
+	return flags.String("o", outputTable, "output format, table or json")
+}
+
+func validateOutput(output string) error {
+	if output != outputTable && output != outputJSON {
+		return fmt.Errorf("invalid output format %q, must be %q or %q", output, outputTable, outputJSON)
+	}
+	return nil
+}
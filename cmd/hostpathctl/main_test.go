@@ -0,0 +1,316 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bearcat-panda/csi-demo/pkg/hostpath"
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+	"github.com/stretchr/testify/require"
+)
+
+// setupStateDir creates a state directory with a volume "src", its
+// snapshot "snap", a volume "restored" from that snapshot and a clone
+// "clone" of "src".
+func setupStateDir(t *testing.T) string {
+	dir := t.TempDir()
+	s, err := state.New(filepath.Join(dir, stateFile))
+	require.NoError(t, err)
+	for _, vol := range []state.Volume{
+		{VolID: "src", VolName: "pvc-src", VolSize: 1024, Kind: "fast"},
+		{VolID: "restored", VolName: "pvc-restored", VolSize: 1024, ParentSnapID: "snap", Staged: state.Strings{"/stage"}, Published: state.Strings{"/publish"}},
+		{VolID: "clone", VolName: "pvc-clone", VolSize: 2048, ParentVolID: "src"},
+	} {
+		vol.VolPath = filepath.Join(dir, vol.VolID)
+		require.NoError(t, os.Mkdir(vol.VolPath, 0755))
+		require.NoError(t, s.UpdateVolume(vol))
+	}
+	snapshot := state.Snapshot{Id: "snap", Name: "snapshot-1", VolID: "src", Path: filepath.Join(dir, "snap.snap"), ReadyToUse: true}
+	require.NoError(t, os.WriteFile(snapshot.Path, nil, 0644))
+	require.NoError(t, s.UpdateSnapshot(snapshot))
+	return dir
+}
+
+func runCtl(t *testing.T, dir string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	err := run(append([]string{"-statedir", dir}, args...), &stdout, &stderr)
+	return stdout.String(), err
+}
+
+func TestList(t *testing.T) {
+	dir := setupStateDir(t)
+
+	out, err := runCtl(t, dir, "list", "volumes")
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 4)
+	require.Regexp(t, `^ID\s+NAME\s+SIZE`, lines[0])
+	require.Contains(t, out, "snapshot/snap")
+
+	out, err = runCtl(t, dir, "list", "-o", "json", "-source", "src", "volumes")
+	require.NoError(t, err)
+	var volumes []state.Volume
+	require.NoError(t, json.Unmarshal([]byte(out), &volumes))
+	require.Len(t, volumes, 1)
+	require.Equal(t, "clone", volumes[0].VolID)
+
+	out, err = runCtl(t, dir, "list", "-kind", "fast", "-o", "json", "volumes")
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal([]byte(out), &volumes))
+	require.Len(t, volumes, 1)
+	require.Equal(t, "src", volumes[0].VolID)
+
+	out, err = runCtl(t, dir, "list", "-name", "nothing", "-o", "json", "snapshots")
+	require.NoError(t, err)
+	require.Equal(t, "[]\n", out)
+
+	_, err = runCtl(t, dir, "list", "disks")
+	require.Error(t, err)
+	_, err = runCtl(t, dir, "list", "-o", "yaml", "volumes")
+	require.Error(t, err)
+}
+
+func TestLineage(t *testing.T) {
+	dir := setupStateDir(t)
+
+	out, err := runCtl(t, dir, "lineage", "restored")
+	require.NoError(t, err)
+	require.Equal(t, `volume/src (pvc-src)
+├── volume/clone (pvc-clone)
+└── snapshot/snap (snapshot-1)
+    └── volume/restored (pvc-restored) *
+`, out)
+
+	out, err = runCtl(t, dir, "lineage", "-o", "json", "snap")
+	require.NoError(t, err)
+	var root state.LineageNode
+	require.NoError(t, json.Unmarshal([]byte(out), &root))
+	require.Equal(t, "src", root.ID)
+	require.Len(t, root.Children, 2)
+	require.True(t, root.Children[1].Selected)
+
+	_, err = runCtl(t, dir, "lineage", "unknown")
+	require.Error(t, err)
+}
+
+func TestOrphans(t *testing.T) {
+	dir := setupStateDir(t)
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "clone")))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "gone.snap"), nil, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "src.img"), nil, 0644))
+
+	out, err := runCtl(t, dir, "orphans", "-o", "json")
+	require.NoError(t, err)
+	var orphans []orphan
+	require.NoError(t, json.Unmarshal([]byte(out), &orphans))
+	require.Equal(t, []orphan{
+		{Type: "file", Name: "gone.snap", Reason: "no volume or snapshot gone"},
+		{Type: typeVolume, Name: "clone", Reason: "data " + filepath.Join(dir, "clone") + " is missing"},
+	}, orphans)
+
+	_, err = runCtl(t, dir, "orphans", "-delete")
+	require.NoError(t, err)
+	require.NoFileExists(t, filepath.Join(dir, "gone.snap"))
+	require.FileExists(t, filepath.Join(dir, "src.img"))
+}
+
+func TestForceUnstage(t *testing.T) {
+	dir := setupStateDir(t)
+
+	out, err := runCtl(t, dir, "force-unstage", "restored")
+	require.NoError(t, err)
+	require.Contains(t, out, "removed staged path /stage")
+	require.Contains(t, out, "removed published path /publish")
+
+	s, err := state.New(filepath.Join(dir, stateFile))
+	require.NoError(t, err)
+	vol, err := s.GetVolumeByID("restored")
+	require.NoError(t, err)
+	require.Empty(t, vol.Staged)
+	require.Empty(t, vol.Published)
+
+	_, err = runCtl(t, dir, "force-unstage", "unknown")
+	require.Error(t, err)
+}
+
+func TestExportImport(t *testing.T) {
+	dir := setupStateDir(t)
+	file := filepath.Join(t.TempDir(), "export.json")
+	_, err := runCtl(t, dir, "export", "-f", file)
+	require.NoError(t, err)
+
+	// Importing into a state which is not empty needs -force.
+	_, err = runCtl(t, dir, "import", "-f", file)
+	require.ErrorContains(t, err, "-force")
+
+	empty := t.TempDir()
+	out, err := runCtl(t, empty, "import", "-f", file)
+	require.NoError(t, err)
+	require.Contains(t, out, "imported 3 volumes, 1 snapshots and 0 group snapshots")
+	original, err := runCtl(t, dir, "export")
+	require.NoError(t, err)
+	imported, err := runCtl(t, empty, "export")
+	require.NoError(t, err)
+	require.Equal(t, original, imported)
+
+	invalid := filepath.Join(t.TempDir(), "invalid.json")
+	require.NoError(t, os.WriteFile(invalid, []byte(`{"Volumes": [{"VolID": "a"}, {"VolID": "a"}]}`), 0644))
+	_, err = runCtl(t, t.TempDir(), "import", "-f", invalid)
+	require.ErrorContains(t, err, `volume ID "a" is also used`)
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	// A state file which was edited by hand.
+	data := `{
+  "Volumes": [{"VolID": "a"}, {"VolID": "a"}],
+  "Snapshots": [{"Id": "s1", "VolID": "a", "ReadyToUse": true}, {"Id": "s2", "VolID": "gone"}],
+  "GroupSnapshots": [{"Id": "g", "SnapshotIDs": ["s2"]}]
+}`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, stateFile), []byte(data), 0600))
+
+	out, err := runCtl(t, dir, "compact")
+	require.NoError(t, err)
+	require.Contains(t, out, "removed 3 records")
+
+	s, err := state.New(filepath.Join(dir, stateFile))
+	require.NoError(t, err)
+	require.Len(t, s.GetVolumes(), 1)
+	require.Len(t, s.GetSnapshots(), 1)
+	require.Empty(t, s.GetGroupSnapshots())
+}
+
+func TestLocked(t *testing.T) {
+	dir := setupStateDir(t)
+	lock, err := state.Lock(filepath.Join(dir, stateFile))
+	require.NoError(t, err)
+	_, err = runCtl(t, dir, "list", "volumes")
+	require.ErrorIs(t, err, state.ErrLocked)
+	require.ErrorContains(t, err, "stop the driver")
+
+	require.NoError(t, lock.Unlock())
+	_, err = runCtl(t, dir, "list", "volumes")
+	require.NoError(t, err)
+}
+
+func TestParameters(t *testing.T) {
+	// The driver may be running, the parameters do not depend on the state.
+	dir := setupStateDir(t)
+	lock, err := state.Lock(filepath.Join(dir, stateFile))
+	require.NoError(t, err)
+	defer lock.Unlock()
+
+	out, err := runCtl(t, dir, "parameters")
+	require.NoError(t, err)
+	require.Regexp(t, `(?m)^StorageClass\s+provisioning\s+thin\|thick\s+thick\s+false`, out)
+	require.Regexp(t, `(?m)^StorageClass\s+snapshotSchedule\s+string\s+true`, out)
+
+	out, err = runCtl(t, dir, "parameters", "-o", "json")
+	require.NoError(t, err)
+	var classes []struct {
+		Class      string
+		Parameters []hostpath.Parameter
+	}
+	require.NoError(t, json.Unmarshal([]byte(out), &classes))
+	require.Equal(t, "StorageClass", classes[0].Class)
+	require.Len(t, classes[0].Parameters, len(hostpath.VolumeParameters()))
+}
+
+func TestTrashUndelete(t *testing.T) {
+	dir := setupStateDir(t)
+	trashDir := filepath.Join(dir, state.TrashDirName)
+	gone := state.Volume{VolID: "gone", VolName: "pvc-gone", VolPath: "/csi-data-dir/gone", Published: state.Strings{"/publish"},
+		Quota: hostpath.QuotaProject, ProjectID: 1 << 24}
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "gone"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "gone", "data"), []byte("hello"), 0644))
+	_, err := state.MoveToTrash(trashDir, state.TrashEntry{DeletedAt: time.Now(), Volume: &gone, DataName: "gone"}, filepath.Join(dir, "gone"))
+	require.NoError(t, err)
+	old := state.Snapshot{Id: "old", Name: "snapshot-1", VolID: "src", Path: "/csi-data-dir/old.snap", GroupSnapshotID: "group", ReadyToUse: true}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "old.snap"), nil, 0644))
+	_, err = state.MoveToTrash(trashDir, state.TrashEntry{DeletedAt: time.Now(), Snapshot: &old, DataName: "old.snap"}, filepath.Join(dir, "old.snap"))
+	require.NoError(t, err)
+
+	out, err := runCtl(t, dir, "trash")
+	require.NoError(t, err)
+	require.Regexp(t, `(?m)^volume\s+gone\s+pvc-gone\s`, out)
+	require.Regexp(t, `(?m)^snapshot\s+old\s+snapshot-1\s`, out)
+
+	_, err = runCtl(t, dir, "undelete", "missing")
+	require.ErrorContains(t, err, `no volume or snapshot with ID "missing"`)
+	_, err = runCtl(t, dir, "undelete", "-id", "src", "gone")
+	require.ErrorContains(t, err, `ID "src" is used by a volume`)
+	_, err = runCtl(t, dir, "undelete", "old")
+	require.ErrorContains(t, err, `name "snapshot-1" is used by snapshot snap`)
+
+	_, err = runCtl(t, dir, "undelete", "gone")
+	require.NoError(t, err)
+	_, err = runCtl(t, dir, "undelete", "-id", "new", "-name", "snapshot-2", "old")
+	require.NoError(t, err)
+
+	s, err := state.New(filepath.Join(dir, stateFile))
+	require.NoError(t, err)
+	vol, err := s.GetVolumeByID("gone")
+	require.NoError(t, err)
+	require.Equal(t, "/csi-data-dir/gone", vol.VolPath)
+	require.Empty(t, vol.Published)
+	require.Equal(t, hostpath.QuotaProject, vol.Quota, "project quota is kept")
+	require.Equal(t, uint32(1<<24), vol.ProjectID)
+	data, err := os.ReadFile(filepath.Join(dir, "gone", "data"))
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+	snapshot, err := s.GetSnapshotByID("new")
+	require.NoError(t, err)
+	require.Equal(t, "snapshot-2", snapshot.Name)
+	require.Equal(t, "/csi-data-dir/new.snap", snapshot.Path)
+	require.Empty(t, snapshot.GroupSnapshotID)
+	require.FileExists(t, filepath.Join(dir, "new.snap"))
+
+	out, err = runCtl(t, dir, "trash", "-o", "json")
+	require.NoError(t, err)
+	require.JSONEq(t, "[]", out)
+}
+
+func TestPromote(t *testing.T) {
+	dir := setupStateDir(t)
+	s, err := state.New(filepath.Join(dir, stateFile))
+	require.NoError(t, err)
+	replica := state.Volume{VolID: "replica", VolName: "pvc-replica", VolPath: filepath.Join(dir, "replica"), VolSize: 1024,
+		Replication: state.Replication{Role: state.ReplicationReplica, Peer: "node-1", SyncTime: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}}
+	require.NoError(t, s.UpdateVolume(replica))
+
+	out, err := runCtl(t, dir, "promote", "replica")
+	require.NoError(t, err)
+	require.Equal(t, "promoted replica replica of volume on node node-1, data is from 2024-01-02T03:04:05Z\n", out)
+	s, err = state.New(filepath.Join(dir, stateFile))
+	require.NoError(t, err)
+	vol, err := s.GetVolumeByID("replica")
+	require.NoError(t, err)
+	require.Equal(t, state.ReplicationPromoted, vol.Replication.Role)
+
+	out, err = runCtl(t, dir, "promote", "replica")
+	require.NoError(t, err)
+	require.Contains(t, out, "already promoted")
+	_, err = runCtl(t, dir, "promote", "src")
+	require.ErrorContains(t, err, "not a replica")
+}
@@ -0,0 +1,378 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+)
+
+// resources has the same JSON encoding as the state file.
+type resources struct {
+	Volumes        []state.Volume
+	Snapshots      []state.Snapshot
+	GroupSnapshots []state.GroupSnapshot
+}
+
+func currentResources(s state.State) resources {
+	return resources{
+		Volumes:        s.GetVolumes(),
+		Snapshots:      s.GetSnapshots(),
+		GroupSnapshots: s.GetGroupSnapshots(),
+	}
+}
+
+// validate checks that all records have unique, non-empty IDs.
+func (r resources) validate() error {
+	ids := map[string]string{}
+	check := func(typ, id string) error {
+		if id == "" {
+			return fmt.Errorf("%s without ID", typ)
+		}
+		if other, ok := ids[id]; ok {
+			return fmt.Errorf("%s ID %q is also used by a %s", typ, id, other)
+		}
+		ids[id] = typ
+		return nil
+	}
+	for _, vol := range r.Volumes {
+		if err := check(typeVolume, vol.VolID); err != nil {
+			return err
+		}
+	}
+	for _, snapshot := range r.Snapshots {
+		if err := check(typeSnapshot, snapshot.Id); err != nil {
+			return err
+		}
+	}
+	for _, group := range r.GroupSnapshots {
+		if err := check("group snapshot", group.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeState replaces the state file. The new content is written to a
+// temporary file and checked before it is renamed, so the state file is
+// never left partially written.
+func (c *ctl) writeState(r resources) error {
+	data, err := json.Marshal(&r)
+	if err != nil {
+		return err
+	}
+	tmp := c.statePath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if _, err := state.New(tmp); err != nil {
+		return fmt.Errorf("verify new state: %v", err)
+	}
+	if err := os.Rename(tmp, c.statePath()); err != nil {
+		return err
+	}
+	c.state, err = state.New(c.statePath())
+	return err
+}
+
+// orphan is a file in the state directory without a record, or a
+// record whose data is missing.
+type orphan struct {
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+func runOrphans(c *ctl, args []string) error {
+	flags := newFlagSet(c, "orphans")
+	output := outputFlag(flags)
+	remove := flags.Bool("delete", false, "delete files which do not belong to any volume or snapshot")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := validateOutput(*output); err != nil {
+		return err
+	}
+
+	orphans, err := c.findOrphans()
+	if err != nil {
+		return err
+	}
+	if *remove {
+		for i, o := range orphans {
+			if o.Type != "file" {
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(c.stateDir, o.Name)); err != nil {
+				return err
+			}
+			orphans[i].Reason += ", deleted"
+		}
+	}
+	if *output == outputJSON {
+		return writeJSON(c.stdout, orphans)
+	}
+	return writeTable(c.stdout, []string{"TYPE", "NAME", "REASON"}, len(orphans), func(i int) []string {
+		return []string{orphans[i].Type, orphans[i].Name, orphans[i].Reason}
+	})
+}
+
+// findOrphans compares the state directory with the records.
+func (c *ctl) findOrphans() ([]orphan, error) {
+	orphans := []orphan{}
+	// The data of a volume or snapshot is stored in files whose name
+	// starts with its ID: the directory or block file of a volume,
+	// the image of a loop volume and the snapshot file.
+	ids := map[string]bool{}
+	local := func(path string) bool {
+		return path != "" && filepath.Clean(filepath.Dir(path)) == filepath.Clean(c.stateDir)
+	}
+	missing := func(path string) bool {
+		_, err := os.Lstat(path)
+		return errors.Is(err, os.ErrNotExist)
+	}
+	for _, vol := range c.state.GetVolumes() {
+		ids[vol.VolID] = true
+		if !vol.Remote && local(vol.VolPath) && missing(vol.VolPath) {
+			orphans = append(orphans, orphan{Type: typeVolume, Name: vol.VolID, Reason: "data " + vol.VolPath + " is missing"})
+		}
+	}
+	for _, snapshot := range c.state.GetSnapshots() {
+		ids[snapshot.Id] = true
+		if snapshot.ReadyToUse && !snapshot.Remote && local(snapshot.Path) && missing(snapshot.Path) {
+			orphans = append(orphans, orphan{Type: typeSnapshot, Name: snapshot.Id, Reason: "data " + snapshot.Path + " is missing"})
+		}
+	}
+
+	entries, err := os.ReadDir(c.stateDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, stateFile) || strings.HasPrefix(name, ".") {
+			continue
+		}
+		id := name
+		if i := strings.Index(name, "."); i > 0 {
+			id = name[:i]
+		}
+		if !ids[id] {
+			orphans = append(orphans, orphan{Type: "file", Name: name, Reason: "no volume or snapshot " + id})
+		}
+	}
+	sort.SliceStable(orphans, func(i, j int) bool { return orphans[i].Type < orphans[j].Type })
+	return orphans, nil
+}
+
+func runForceUnstage(c *ctl, args []string) error {
+	flags := newFlagSet(c, "force-unstage")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("force-unstage needs the ID of a volume")
+	}
+	vol, err := c.state.GetVolumeByID(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if len(vol.Staged) == 0 && len(vol.Published) == 0 {
+		fmt.Fprintf(c.stdout, "volume %s is neither staged nor published\n", vol.VolID)
+		return nil
+	}
+	for _, path := range vol.Published {
+		fmt.Fprintf(c.stdout, "removed published path %s\n", path)
+	}
+	for _, path := range vol.Staged {
+		fmt.Fprintf(c.stdout, "removed staged path %s\n", path)
+	}
+	vol.Published = nil
+	vol.Staged = nil
+	if err := c.state.UpdateVolume(vol); err != nil {
+		return err
+	}
+	fmt.Fprintln(c.stdout, "mounts and loop devices were not touched, clean them up manually if they still exist")
+	return nil
+}
+
+// runPromote turns a replica into a normal volume, like the Promote
+// call of the replication service. Afterwards the replica rejects
+// data from its source volume.
+func runPromote(c *ctl, args []string) error {
+	flags := newFlagSet(c, "promote")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("promote needs the ID of a replica")
+	}
+	vol, err := c.state.GetVolumeByID(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	switch vol.Replication.Role {
+	case state.ReplicationPromoted:
+		fmt.Fprintf(c.stdout, "replica %s is already promoted\n", vol.VolID)
+		return nil
+	case state.ReplicationReplica:
+	default:
+		return fmt.Errorf("volume %s is not a replica", vol.VolID)
+	}
+	vol.Replication.Role = state.ReplicationPromoted
+	if err := c.state.UpdateVolume(vol); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "promoted replica %s of volume on node %s, data is from %s\n", vol.VolID, vol.Replication.Peer, vol.Replication.SyncTime.UTC().Format(time.RFC3339))
+	return nil
+}
+
+func runExport(c *ctl, args []string) error {
+	flags := newFlagSet(c, "export")
+	file := flags.String("f", "", "file to write to instead of stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return writeJSON(c.stdout, currentResources(c.state))
+	}
+	var buffer bytes.Buffer
+	if err := writeJSON(&buffer, currentResources(c.state)); err != nil {
+		return err
+	}
+	return os.WriteFile(*file, buffer.Bytes(), 0600)
+}
+
+func runImport(c *ctl, args []string) error {
+	flags := newFlagSet(c, "import")
+	file := flags.String("f", "", "file with exported state")
+	force := flags.Bool("force", false, "replace a state which is not empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errors.New("import needs a file, use -f")
+	}
+	data, err := os.ReadFile(*file)
+	if err != nil {
+		return err
+	}
+	var r resources
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&r); err != nil {
+		return fmt.Errorf("decode %s: %v", *file, err)
+	}
+	if err := r.validate(); err != nil {
+		return fmt.Errorf("invalid state in %s: %v", *file, err)
+	}
+	current := currentResources(c.state)
+	if !*force && len(current.Volumes)+len(current.Snapshots)+len(current.GroupSnapshots) > 0 {
+		return errors.New("the state is not empty, use -force to replace it")
+	}
+	if err := c.writeState(r); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "imported %d volumes, %d snapshots and %d group snapshots\n", len(r.Volumes), len(r.Snapshots), len(r.GroupSnapshots))
+	return nil
+}
+
+// runCompact rewrites the state file without duplicate records,
+// incomplete snapshots of deleted volumes, which the driver would
+// remove when it starts, and group snapshots without snapshots.
+func runCompact(c *ctl, args []string) error {
+	flags := newFlagSet(c, "compact")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	current := currentResources(c.state)
+	var compacted resources
+	removed := 0
+
+	volumes := map[string]bool{}
+	for _, vol := range current.Volumes {
+		if volumes[vol.VolID] {
+			fmt.Fprintf(c.stdout, "removed duplicate volume %s\n", vol.VolID)
+			removed++
+			continue
+		}
+		volumes[vol.VolID] = true
+		compacted.Volumes = append(compacted.Volumes, vol)
+	}
+	snapshots := map[string]bool{}
+	for _, snapshot := range current.Snapshots {
+		switch {
+		case snapshots[snapshot.Id]:
+			fmt.Fprintf(c.stdout, "removed duplicate snapshot %s\n", snapshot.Id)
+		case !snapshot.ReadyToUse && !volumes[snapshot.VolID]:
+			fmt.Fprintf(c.stdout, "removed incomplete snapshot %s of deleted volume %s\n", snapshot.Id, snapshot.VolID)
+		default:
+			snapshots[snapshot.Id] = true
+			compacted.Snapshots = append(compacted.Snapshots, snapshot)
+			continue
+		}
+		removed++
+	}
+	groups := map[string]bool{}
+	for _, group := range current.GroupSnapshots {
+		remaining := 0
+		for _, id := range group.SnapshotIDs {
+			if snapshots[id] {
+				remaining++
+			}
+		}
+		switch {
+		case groups[group.Id]:
+			fmt.Fprintf(c.stdout, "removed duplicate group snapshot %s\n", group.Id)
+		case remaining == 0:
+			fmt.Fprintf(c.stdout, "removed group snapshot %s without snapshots\n", group.Id)
+		default:
+			groups[group.Id] = true
+			compacted.GroupSnapshots = append(compacted.GroupSnapshots, group)
+			continue
+		}
+		removed++
+	}
+
+	before, err := os.Stat(c.statePath())
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintln(c.stdout, "no state file")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := c.writeState(compacted); err != nil {
+		return err
+	}
+	after, err := os.Stat(c.statePath())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "removed %d records, state file shrank from %d to %d bytes\n", removed, before.Size(), after.Size())
+	return nil
+}
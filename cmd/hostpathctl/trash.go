@@ -0,0 +1,163 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bearcat-panda/csi-demo/pkg/hostpath"
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+)
+
+func (c *ctl) trashDir() string {
+	return filepath.Join(c.stateDir, state.TrashDirName)
+}
+
+func runTrash(c *ctl, args []string) error {
+	flags := newFlagSet(c, "trash")
+	output := outputFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := validateOutput(*output); err != nil {
+		return err
+	}
+	entries, err := state.ListTrash(c.trashDir())
+	if err != nil {
+		return err
+	}
+	if *output == outputJSON {
+		if entries == nil {
+			entries = []state.TrashEntry{}
+		}
+		return writeJSON(c.stdout, entries)
+	}
+	return writeTable(c.stdout, []string{"TYPE", "ID", "NAME", "DELETED"}, len(entries), func(i int) []string {
+		entry := entries[i]
+		return []string{entry.Type, entry.ID(), entry.Name(), entry.DeletedAt.UTC().Format(time.RFC3339)}
+	})
+}
+
+func runUndelete(c *ctl, args []string) error {
+	flags := newFlagSet(c, "undelete")
+	newID := flags.String("id", "", "restore under this ID instead of the original one")
+	newName := flags.String("name", "", "restore under this name instead of the original one")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("undelete needs the ID of a volume or snapshot in the trash")
+	}
+	entries, err := state.ListTrash(c.trashDir())
+	if err != nil {
+		return err
+	}
+	var entry *state.TrashEntry
+	for i := range entries {
+		if entries[i].ID() == flags.Arg(0) {
+			entry = &entries[i]
+		}
+	}
+	if entry == nil {
+		return fmt.Errorf("no volume or snapshot with ID %q in the trash", flags.Arg(0))
+	}
+
+	id, name := entry.ID(), entry.Name()
+	if *newID != "" {
+		id = *newID
+	}
+	if *newName != "" {
+		name = *newName
+	}
+	if _, err := c.state.GetVolumeByID(id); err == nil {
+		return fmt.Errorf("ID %q is used by a volume, choose another one with -id", id)
+	}
+	if _, err := c.state.GetSnapshotByID(id); err == nil {
+		return fmt.Errorf("ID %q is used by a snapshot, choose another one with -id", id)
+	}
+
+	// The data keeps its file name, only the ID in it changes.
+	dataName := strings.Replace(entry.DataName, entry.ID(), id, 1)
+	dataPath := filepath.Join(c.stateDir, dataName)
+	if _, err := os.Lstat(dataPath); err == nil {
+		return fmt.Errorf("%s already exists", dataPath)
+	}
+	hasData := true
+	if _, err := os.Lstat(entry.DataPath()); errors.Is(err, os.ErrNotExist) {
+		hasData = false
+		fmt.Fprintf(c.stdout, "%s %s has no data in the trash, restoring only its record\n", entry.Type, entry.ID())
+	}
+
+	var update func() error
+	if entry.Volume != nil {
+		vol := *entry.Volume
+		if other, err := c.state.GetVolumeByName(name); err == nil {
+			return fmt.Errorf("name %q is used by volume %s, choose another one with -name", name, other.VolID)
+		}
+		vol.VolID, vol.VolName = id, name
+		// The state may have been written with a different path to
+		// the state directory, for example inside a container.
+		vol.VolPath = filepath.Join(filepath.Dir(vol.VolPath), id)
+		// The volume was unstaged and detached before it was deleted,
+		// and its replica is gone.
+		vol.Staged, vol.Published, vol.Attached = nil, nil, false
+		vol.Replication = state.Replication{}
+		vol.DeletionDeferred = false
+		// The image is mounted again when the driver starts. A project
+		// quota stays on the directory while it is in the trash, so the
+		// restored volume keeps its size limit.
+		if vol.Quota == hostpath.QuotaLoop {
+			if err := os.Mkdir(filepath.Join(c.stateDir, id), 0777); err != nil {
+				return err
+			}
+		}
+		update = func() error { return c.state.UpdateVolume(vol) }
+	} else {
+		snapshot := *entry.Snapshot
+		if other, err := c.state.GetSnapshotByName(name); err == nil {
+			return fmt.Errorf("name %q is used by snapshot %s, choose another one with -name", name, other.Id)
+		}
+		snapshot.Id, snapshot.Name = id, name
+		snapshot.Path = filepath.Join(filepath.Dir(snapshot.Path), dataName)
+		// The group snapshot was deleted together with its members.
+		snapshot.GroupSnapshotID = ""
+		snapshot.DeletionDeferred = false
+		update = func() error { return c.state.UpdateSnapshot(snapshot) }
+	}
+
+	if hasData {
+		if err := os.Rename(entry.DataPath(), dataPath); err != nil {
+			return err
+		}
+	}
+	if err := update(); err != nil {
+		if hasData {
+			os.Rename(dataPath, entry.DataPath())
+		}
+		return err
+	}
+	if err := entry.Remove(); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "restored %s %s as %s %q\n", entry.Type, entry.ID(), id, name)
+	return nil
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package agent defines the gRPC API with which a central controller
+// provisions hostpath volumes and snapshots on remote nodes. The API
+// reuses the CSI request and response messages, so a node agent is
+// simply a node-local hostpath driver which serves a subset of its
+// controller and node services under a different service name.
+package agent
+
+import (
+	"context"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+)
+
+// ServiceName is the full name of the node agent gRPC service.
+const ServiceName = "hostpath.agent.v1.NodeAgent"
+
+// NodeAgentServer is the server API of a node agent.
+type NodeAgentServer interface {
+	// NodeGetInfo returns the node ID and topology of the node.
+	NodeGetInfo(context.Context, *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error)
+	// GetCapacity returns the remaining capacity of the node.
+	GetCapacity(context.Context, *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error)
+	// CreateVolume creates a volume on the node.
+	CreateVolume(context.Context, *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error)
+	// DeleteVolume deletes a volume on the node.
+	DeleteVolume(context.Context, *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error)
+	// CreateSnapshot creates a snapshot of a volume on the node.
+	CreateSnapshot(context.Context, *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error)
+	// DeleteSnapshot deletes a snapshot on the node.
+	DeleteSnapshot(context.Context, *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error)
+	// ControllerModifyVolume changes the mutable parameters of a volume on the node.
+	ControllerModifyVolume(context.Context, *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error)
+	// ControllerPublishVolume attaches a volume to the node.
+	ControllerPublishVolume(context.Context, *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error)
+	// ControllerUnpublishVolume detaches a volume from the node.
+	ControllerUnpublishVolume(context.Context, *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error)
+	// ValidateVolumeCapabilities checks whether a volume on the node
+	// supports the capabilities.
+	ValidateVolumeCapabilities(context.Context, *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error)
+}
+
+// NodeAgentClient is the client API of a node agent.
+type NodeAgentClient interface {
+	NodeGetInfo(ctx context.Context, in *csi.NodeGetInfoRequest, opts ...grpc.CallOption) (*csi.NodeGetInfoResponse, error)
+	GetCapacity(ctx context.Context, in *csi.GetCapacityRequest, opts ...grpc.CallOption) (*csi.GetCapacityResponse, error)
+	CreateVolume(ctx context.Context, in *csi.CreateVolumeRequest, opts ...grpc.CallOption) (*csi.CreateVolumeResponse, error)
+	DeleteVolume(ctx context.Context, in *csi.DeleteVolumeRequest, opts ...grpc.CallOption) (*csi.DeleteVolumeResponse, error)
+	CreateSnapshot(ctx context.Context, in *csi.CreateSnapshotRequest, opts ...grpc.CallOption) (*csi.CreateSnapshotResponse, error)
+	DeleteSnapshot(ctx context.Context, in *csi.DeleteSnapshotRequest, opts ...grpc.CallOption) (*csi.DeleteSnapshotResponse, error)
+	ControllerModifyVolume(ctx context.Context, in *csi.ControllerModifyVolumeRequest, opts ...grpc.CallOption) (*csi.ControllerModifyVolumeResponse, error)
+	ControllerPublishVolume(ctx context.Context, in *csi.ControllerPublishVolumeRequest, opts ...grpc.CallOption) (*csi.ControllerPublishVolumeResponse, error)
+	ControllerUnpublishVolume(ctx context.Context, in *csi.ControllerUnpublishVolumeRequest, opts ...grpc.CallOption) (*csi.ControllerUnpublishVolumeResponse, error)
+	ValidateVolumeCapabilities(ctx context.Context, in *csi.ValidateVolumeCapabilitiesRequest, opts ...grpc.CallOption) (*csi.ValidateVolumeCapabilitiesResponse, error)
+}
+
+type nodeAgentClient struct {
+	cc grpc.ClientConnInterface
+}
+
+// NewNodeAgentClient returns a client for the node agent behind the
+// connection.
+func NewNodeAgentClient(cc grpc.ClientConnInterface) NodeAgentClient {
+	return &nodeAgentClient{cc: cc}
+}
+
+func (c *nodeAgentClient) NodeGetInfo(ctx context.Context, in *csi.NodeGetInfoRequest, opts ...grpc.CallOption) (*csi.NodeGetInfoResponse, error) {
+	out := new(csi.NodeGetInfoResponse)
+	return out, c.cc.Invoke(ctx, fullMethod("NodeGetInfo"), in, out, opts...)
+}
+
+func (c *nodeAgentClient) GetCapacity(ctx context.Context, in *csi.GetCapacityRequest, opts ...grpc.CallOption) (*csi.GetCapacityResponse, error) {
+	out := new(csi.GetCapacityResponse)
+	return out, c.cc.Invoke(ctx, fullMethod("GetCapacity"), in, out, opts...)
+}
+
+func (c *nodeAgentClient) CreateVolume(ctx context.Context, in *csi.CreateVolumeRequest, opts ...grpc.CallOption) (*csi.CreateVolumeResponse, error) {
+	out := new(csi.CreateVolumeResponse)
+	return out, c.cc.Invoke(ctx, fullMethod("CreateVolume"), in, out, opts...)
+}
+
+func (c *nodeAgentClient) DeleteVolume(ctx context.Context, in *csi.DeleteVolumeRequest, opts ...grpc.CallOption) (*csi.DeleteVolumeResponse, error) {
+	out := new(csi.DeleteVolumeResponse)
+	return out, c.cc.Invoke(ctx, fullMethod("DeleteVolume"), in, out, opts...)
+}
+
+func (c *nodeAgentClient) CreateSnapshot(ctx context.Context, in *csi.CreateSnapshotRequest, opts ...grpc.CallOption) (*csi.CreateSnapshotResponse, error) {
+	out := new(csi.CreateSnapshotResponse)
+	return out, c.cc.Invoke(ctx, fullMethod("CreateSnapshot"), in, out, opts...)
+}
+
+func (c *nodeAgentClient) DeleteSnapshot(ctx context.Context, in *csi.DeleteSnapshotRequest, opts ...grpc.CallOption) (*csi.DeleteSnapshotResponse, error) {
+	out := new(csi.DeleteSnapshotResponse)
+	return out, c.cc.Invoke(ctx, fullMethod("DeleteSnapshot"), in, out, opts...)
+}
+
+func (c *nodeAgentClient) ControllerModifyVolume(ctx context.Context, in *csi.ControllerModifyVolumeRequest, opts ...grpc.CallOption) (*csi.ControllerModifyVolumeResponse, error) {
+	out := new(csi.ControllerModifyVolumeResponse)
+	return out, c.cc.Invoke(ctx, fullMethod("ControllerModifyVolume"), in, out, opts...)
+}
+
+func (c *nodeAgentClient) ControllerPublishVolume(ctx context.Context, in *csi.ControllerPublishVolumeRequest, opts ...grpc.CallOption) (*csi.ControllerPublishVolumeResponse, error) {
+	out := new(csi.ControllerPublishVolumeResponse)
+	return out, c.cc.Invoke(ctx, fullMethod("ControllerPublishVolume"), in, out, opts...)
+}
+
+func (c *nodeAgentClient) ControllerUnpublishVolume(ctx context.Context, in *csi.ControllerUnpublishVolumeRequest, opts ...grpc.CallOption) (*csi.ControllerUnpublishVolumeResponse, error) {
+	out := new(csi.ControllerUnpublishVolumeResponse)
+	return out, c.cc.Invoke(ctx, fullMethod("ControllerUnpublishVolume"), in, out, opts...)
+}
+
+func (c *nodeAgentClient) ValidateVolumeCapabilities(ctx context.Context, in *csi.ValidateVolumeCapabilitiesRequest, opts ...grpc.CallOption) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	out := new(csi.ValidateVolumeCapabilitiesResponse)
+	return out, c.cc.Invoke(ctx, fullMethod("ValidateVolumeCapabilities"), in, out, opts...)
+}
+
+// RegisterNodeAgentServer registers the node agent service with
+// the gRPC server.
+func RegisterNodeAgentServer(s grpc.ServiceRegistrar, srv NodeAgentServer) {
+	s.RegisterService(&NodeAgentServiceDesc, srv)
+}
+
+// NodeAgentServiceDesc is the grpc.ServiceDesc of the node agent
+// service.
+var NodeAgentServiceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*NodeAgentServer)(nil),
+	Methods: []grpc.MethodDesc{
+		unaryMethod("NodeGetInfo", NodeAgentServer.NodeGetInfo),
+		unaryMethod("GetCapacity", NodeAgentServer.GetCapacity),
+		unaryMethod("CreateVolume", NodeAgentServer.CreateVolume),
+		unaryMethod("DeleteVolume", NodeAgentServer.DeleteVolume),
+		unaryMethod("CreateSnapshot", NodeAgentServer.CreateSnapshot),
+		unaryMethod("DeleteSnapshot", NodeAgentServer.DeleteSnapshot),
+		unaryMethod("ControllerModifyVolume", NodeAgentServer.ControllerModifyVolume),
+		unaryMethod("ControllerPublishVolume", NodeAgentServer.ControllerPublishVolume),
+		unaryMethod("ControllerUnpublishVolume", NodeAgentServer.ControllerUnpublishVolume),
+		unaryMethod("ValidateVolumeCapabilities", NodeAgentServer.ValidateVolumeCapabilities),
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+func fullMethod(method string) string {
+	return "/" + ServiceName + "/" + method
+}
+
+// unaryMethod returns the description of a unary method which
+// decodes the request and calls the server implementation,
+// like the code generated by protoc-gen-go-grpc does.
+func unaryMethod[Req, Resp any](method string, call func(NodeAgentServer, context.Context, *Req) (*Resp, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: method,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := new(Req)
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			if interceptor == nil {
+				return call(srv.(NodeAgentServer), ctx, in)
+			}
+			info := &grpc.UnaryServerInfo{
+				Server:     srv,
+				FullMethod: fullMethod(method),
+			}
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return call(srv.(NodeAgentServer), ctx, req.(*Req))
+			}
+			return interceptor(ctx, in, info, handler)
+		},
+	}
+}
@@ -0,0 +1,161 @@
+package hostpath
+
+import (
+	"fmt"
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// hostpath 卷只存在于一个节点上, 只支持单节点的访问模式
+var supportedAccessModes = map[csi.VolumeCapability_AccessMode_Mode]bool{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:        true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:   true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER: true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:  true,
+}
+
+// 目录形式的 mount 卷通过 bind mount 发布, 只能使用与文件系统无关的挂载选项
+var bindMountFlags = map[string]bool{
+	"ro":          true,
+	"rw":          true,
+	"nosuid":      true,
+	"suid":        true,
+	"nodev":       true,
+	"dev":         true,
+	"noexec":      true,
+	"exec":        true,
+	"noatime":     true,
+	"atime":       true,
+	"nodiratime":  true,
+	"diratime":    true,
+	"relatime":    true,
+	"norelatime":  true,
+	"strictatime": true,
+	"sync":        true,
+	"async":       true,
+}
+
+// 驱动自己决定的挂载选项, 不能通过卷的能力指定
+var reservedMountFlags = map[string]bool{
+	"bind":    true,
+	"rbind":   true,
+	"remount": true,
+	"loop":    true,
+}
+
+// validateVolumeCapabilities 检查卷能否以 caps 中的每一种能力使用, 返回的错误说明了不支持的原因。
+// vol 为 nil 时(CreateVolume)按照驱动的配置检查将要创建的卷。
+func (hp *hostpath) validateVolumeCapabilities(caps []*csi.VolumeCapability, vol *state.Volume) error {
+	if len(caps) == 0 {
+		return fmt.Errorf("volume capabilities missing")
+	}
+
+	var accessTypeMount, accessTypeBlock bool
+	for i, cap := range caps {
+		if cap == nil {
+			return fmt.Errorf("volume capability #%d is empty", i)
+		}
+		if err := hp.validateVolumeCapability(cap, vol); err != nil {
+			return err
+		}
+		if cap.GetBlock() != nil {
+			accessTypeBlock = true
+		}
+		if cap.GetMount() != nil {
+			accessTypeMount = true
+		}
+	}
+
+	// 一个卷只能是块卷或者 mount 卷
+	if accessTypeBlock && accessTypeMount {
+		return fmt.Errorf("cannot have both block and mount access type")
+	}
+	return nil
+}
+
+// validateVolumeCapability 检查单个能力的访问类型, 访问模式, fsType 和挂载选项
+func (hp *hostpath) validateVolumeCapability(cap *csi.VolumeCapability, vol *state.Volume) error {
+	mode := cap.GetAccessMode().GetMode()
+	if cap.GetAccessMode() == nil || mode == csi.VolumeCapability_AccessMode_UNKNOWN {
+		return fmt.Errorf("access mode missing")
+	}
+	if !supportedAccessModes[mode] {
+		return fmt.Errorf("access mode %s is not supported, hostpath volumes are only accessible on a single node", mode)
+	}
+
+	switch {
+	case cap.GetBlock() != nil:
+		if vol != nil && vol.VolAccessType != state.BlockAccess {
+			return fmt.Errorf("volume %s is a mount volume and cannot be used with block access type", vol.VolID)
+		}
+		return nil
+	case cap.GetMount() != nil:
+		if vol != nil && vol.VolAccessType != state.MountAccess {
+			return fmt.Errorf("volume %s is a block volume and cannot be used with mount access type", vol.VolID)
+		}
+	default:
+		return fmt.Errorf("access type missing, must be block or mount")
+	}
+
+	// 只有由块文件支持的 mount 卷有自己的文件系统
+	blockBacked := hp.config.BlockBackedMountVolumes
+	if vol != nil {
+		blockBacked = vol.BlockBacked
+	}
+
+	mnt := cap.GetMount()
+	fsType := mnt.GetFsType()
+	if blockBacked {
+		if fsType != "" && !supportedFsTypes[fsType] {
+			return fmt.Errorf("fsType %q is not supported, must be one of %s", fsType, strings.Join(sets.List(sets.KeySet(supportedFsTypes)), ", "))
+		}
+		if vol != nil && vol.FsType != "" && fsType != "" && fsType != vol.FsType {
+			return fmt.Errorf("volume %s is formatted as %s, cannot use it as %s", vol.VolID, vol.FsType, fsType)
+		}
+	} else if fsType != "" {
+		return fmt.Errorf("fsType %q is not supported, mount volumes are directories on the host filesystem", fsType)
+	}
+
+	for _, flag := range mnt.GetMountFlags() {
+		name, _, _ := strings.Cut(flag, "=")
+		switch {
+		case name == "" || strings.ContainsAny(flag, ", \t\n"):
+			return fmt.Errorf("invalid mount flag %q", flag)
+		case reservedMountFlags[name]:
+			return fmt.Errorf("mount flag %q is set by the driver and cannot be requested", flag)
+		case !blockBacked && !bindMountFlags[flag]:
+			return fmt.Errorf("mount flag %q is not supported for bind mounted directories, must be one of %s", flag, strings.Join(sets.List(sets.KeySet(bindMountFlags)), ", "))
+		}
+	}
+	return nil
+}
+
+// convertCapabilities 返回保存在卷的状态中的能力
+func convertCapabilities(caps []*csi.VolumeCapability) []state.VolumeCapability {
+	result := make([]state.VolumeCapability, 0, len(caps))
+	for _, cap := range caps {
+		result = append(result, state.VolumeCapability{
+			AccessMode: cap.GetAccessMode().GetMode().String(),
+			FsType:     cap.GetMount().GetFsType(),
+			MountFlags: cap.GetMount().GetMountFlags(),
+		})
+	}
+	return result
+}
+
+// equalCapabilities 判断两组能力是否相同, 与顺序无关
+func equalCapabilities(a, b []state.VolumeCapability) bool {
+	keys := func(caps []state.VolumeCapability) []string {
+		result := make([]string, 0, len(caps))
+		for _, cap := range caps {
+			result = append(result, fmt.Sprintf("%s/%s/%s", cap.AccessMode, cap.FsType, strings.Join(cap.MountFlags, ",")))
+		}
+		sort.Strings(result)
+		return result
+	}
+	return slices.Equal(keys(a), keys(b))
+}
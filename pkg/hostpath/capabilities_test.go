@@ -0,0 +1,195 @@
+package hostpath
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// mountCapability 返回测试中使用的 mount 卷的能力
+func mountCapability(flags ...string) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: flags}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+}
+
+// blockCapability 返回测试中使用的块卷的能力
+func blockCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+}
+
+func TestValidateVolumeCapabilities(t *testing.T) {
+	withMode := func(cap *csi.VolumeCapability, mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+		cap.AccessMode = &csi.VolumeCapability_AccessMode{Mode: mode}
+		return cap
+	}
+	withFsType := func(cap *csi.VolumeCapability, fsType string) *csi.VolumeCapability {
+		cap.GetMount().FsType = fsType
+		return cap
+	}
+	directory := &state.Volume{VolID: "dir", VolAccessType: state.MountAccess}
+	blockBacked := &state.Volume{VolID: "fs", VolAccessType: state.MountAccess, BlockBacked: true, FsType: "ext4"}
+	block := &state.Volume{VolID: "block", VolAccessType: state.BlockAccess}
+
+	testcases := map[string]struct {
+		caps   []*csi.VolumeCapability
+		vol    *state.Volume
+		config Config
+		err    string
+	}{
+		"mount": {
+			caps: []*csi.VolumeCapability{mountCapability("ro", "noatime")},
+			vol:  directory,
+		},
+		"block": {
+			caps: []*csi.VolumeCapability{blockCapability()},
+			vol:  block,
+		},
+		"single node multi writer": {
+			caps: []*csi.VolumeCapability{withMode(mountCapability(), csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER)},
+			vol:  directory,
+		},
+		"empty": {
+			err: "volume capabilities missing",
+		},
+		"missing access mode": {
+			caps: []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}},
+			err:  "access mode missing",
+		},
+		"missing access type": {
+			caps: []*csi.VolumeCapability{{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER}}},
+			err:  "access type missing, must be block or mount",
+		},
+		"multi node": {
+			caps: []*csi.VolumeCapability{withMode(mountCapability(), csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)},
+			err:  "access mode MULTI_NODE_MULTI_WRITER is not supported, hostpath volumes are only accessible on a single node",
+		},
+		"block and mount": {
+			caps: []*csi.VolumeCapability{mountCapability(), blockCapability()},
+			err:  "cannot have both block and mount access type",
+		},
+		"block capability for mount volume": {
+			caps: []*csi.VolumeCapability{blockCapability()},
+			vol:  directory,
+			err:  "volume dir is a mount volume and cannot be used with block access type",
+		},
+		"mount capability for block volume": {
+			caps: []*csi.VolumeCapability{mountCapability()},
+			vol:  block,
+			err:  "volume block is a block volume and cannot be used with mount access type",
+		},
+		"fsType for directory": {
+			caps: []*csi.VolumeCapability{withFsType(mountCapability(), "ext4")},
+			vol:  directory,
+			err:  `fsType "ext4" is not supported, mount volumes are directories on the host filesystem`,
+		},
+		"fsType for new block-backed volume": {
+			caps:   []*csi.VolumeCapability{withFsType(mountCapability(), "xfs")},
+			config: Config{BlockBackedMountVolumes: true},
+		},
+		"unsupported fsType": {
+			caps:   []*csi.VolumeCapability{withFsType(mountCapability(), "btrfs")},
+			config: Config{BlockBackedMountVolumes: true},
+			err:    `fsType "btrfs" is not supported, must be one of ext3, ext4, xfs`,
+		},
+		"different fsType": {
+			caps: []*csi.VolumeCapability{withFsType(mountCapability(), "xfs")},
+			vol:  blockBacked,
+			err:  "volume fs is formatted as ext4, cannot use it as xfs",
+		},
+		"filesystem mount flag": {
+			caps: []*csi.VolumeCapability{mountCapability("data=ordered")},
+			vol:  blockBacked,
+		},
+		"filesystem mount flag for directory": {
+			caps: []*csi.VolumeCapability{mountCapability("data=ordered")},
+			vol:  directory,
+			err:  `mount flag "data=ordered" is not supported for bind mounted directories, must be one of async, atime, dev, diratime, exec, noatime, nodev, nodiratime, noexec, norelatime, nosuid, relatime, ro, rw, strictatime, suid, sync`,
+		},
+		"reserved mount flag": {
+			caps: []*csi.VolumeCapability{mountCapability("bind")},
+			vol:  blockBacked,
+			err:  `mount flag "bind" is set by the driver and cannot be requested`,
+		},
+		"invalid mount flag": {
+			caps: []*csi.VolumeCapability{mountCapability("ro,nodev")},
+			vol:  blockBacked,
+			err:  `invalid mount flag "ro,nodev"`,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			hp := &hostpath{config: tc.config}
+			err := hp.validateVolumeCapabilities(tc.caps, tc.vol)
+			if tc.err == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tc.err)
+			}
+		})
+	}
+}
+
+func TestValidateVolumeCapabilitiesRPC(t *testing.T) {
+	hp := newTestDriver(t, func(cfg *Config) {
+		cfg.EnableAttach = true
+	})
+	ctx := context.Background()
+
+	_, err := hp.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "vol",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability("bind")},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err), "create with reserved mount flag: %v", err)
+
+	resp, err := hp.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "vol",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+	})
+	require.NoError(t, err)
+	volID := resp.GetVolume().GetVolumeId()
+
+	validate, err := hp.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           volID,
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability("noexec")},
+	})
+	require.NoError(t, err)
+	require.NotNil(t, validate.GetConfirmed())
+	require.Len(t, validate.GetConfirmed().GetVolumeCapabilities(), 1)
+
+	validate, err = hp.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           volID,
+		VolumeCapabilities: []*csi.VolumeCapability{blockCapability()},
+	})
+	require.NoError(t, err)
+	require.Nil(t, validate.GetConfirmed())
+	require.Equal(t, "volume "+volID+" is a mount volume and cannot be used with block access type", validate.GetMessage())
+
+	_, err = hp.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           "no-such-volume",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = hp.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: volID, NodeId: "node", VolumeCapability: blockCapability()})
+	require.Equal(t, codes.InvalidArgument, status.Code(err), "publish with block capability: %v", err)
+	_, err = hp.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: volID, NodeId: "node", VolumeCapability: mountCapability()})
+	require.NoError(t, err)
+	_, err = hp.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: volID, NodeId: "node", VolumeCapability: mountCapability(), Readonly: true})
+	require.Equal(t, codes.AlreadyExists, status.Code(err), "publish with different readonly flag: %v", err)
+	_, err = hp.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: volID, NodeId: "node"})
+	require.NoError(t, err)
+	vol, err := hp.state.GetVolumeByID(volID)
+	require.NoError(t, err)
+	require.False(t, vol.Attached)
+}
@@ -0,0 +1,356 @@
+package hostpath
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"io/fs"
+	"k8s.io/klog/v2"
+	utilexec "k8s.io/utils/exec"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// copyMethod 表示在 StateDir 所在的文件系统上复制数据的方式
+type copyMethod int
+
+const (
+	// 使用 FICLONE 让目标文件与源文件共享数据块(写时复制), 例如 XFS(reflink=1) 和 btrfs
+	copyReflink copyMethod = iota
+	// 使用 copy_file_range 在内核中复制数据
+	copyFileRange
+	// 在用户态流式复制数据
+	copyStream
+)
+
+// copyResult 描述复制到新卷的数据
+type copyResult struct {
+	// 新卷与源共享数据块
+	shared bool
+	// 复制的数据量, 空洞不计算在内. 共享的数据块按源文件实际分配的大小计算
+	bytes int64
+}
+
+// copyChunkSize 是复制数据时两次检查是否被取消之间最多复制的字节数
+const copyChunkSize = 64 * 1024 * 1024
+
+func (m copyMethod) String() string {
+	switch m {
+	case copyReflink:
+		return "reflink"
+	case copyFileRange:
+		return "copy_file_range"
+	default:
+		return "stream"
+	}
+}
+
+// detectCopyMethod 在 dir 中创建临时文件, 检测文件系统支持的最快的复制方式
+func detectCopyMethod(dir string) copyMethod {
+	src, err := os.CreateTemp(dir, ".copy-probe-")
+	if err != nil {
+		klog.Warningf("failed to detect copy method in %s: %v", dir, err)
+		return copyStream
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+
+	dst, err := os.CreateTemp(dir, ".copy-probe-")
+	if err != nil {
+		klog.Warningf("failed to detect copy method in %s: %v", dir, err)
+		return copyStream
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	data := bytes.Repeat([]byte{1}, 4096)
+	if _, err := src.Write(data); err != nil {
+		klog.Warningf("failed to detect copy method in %s: %v", dir, err)
+		return copyStream
+	}
+
+	if err := unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())); err == nil {
+		return copyReflink
+	}
+	var srcOff, dstOff int64
+	if _, err := unix.CopyFileRange(int(src.Fd()), &srcOff, int(dst.Fd()), &dstOff, len(data), 0); err == nil {
+		return copyFileRange
+	}
+	return copyStream
+}
+
+// cloneFile 将 src 的内容复制到 dst. dst 已经存在时不会被截短, 这样块文件保持原来的大小。
+// 按 method 依次尝试 reflink, copy_file_range 和流式复制, 返回 dst 是否与 src 共享数据块和复制的数据量。
+// ctx 被取消时复制在下一块数据之前停止。
+func cloneFile(ctx context.Context, method copyMethod, src, dst string) (copyResult, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return copyResult{}, err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return copyResult{}, err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE, info.Mode().Perm())
+	if err != nil {
+		return copyResult{}, err
+	}
+	defer out.Close()
+	dstInfo, err := out.Stat()
+	if err != nil {
+		return copyResult{}, err
+	}
+
+	result, err := copyFileData(ctx, method, in, out, info)
+	if err != nil {
+		return copyResult{}, fmt.Errorf("failed to copy %s to %s: %w", src, dst, err)
+	}
+
+	// reflink 会把目标文件的大小改为源文件的大小, 块文件需要保持申请的大小
+	if outInfo, err := out.Stat(); err != nil {
+		return copyResult{}, err
+	} else if outInfo.Size() < dstInfo.Size() {
+		if err := out.Truncate(dstInfo.Size()); err != nil {
+			return copyResult{}, err
+		}
+	}
+	return result, out.Close()
+}
+
+func copyFileData(ctx context.Context, method copyMethod, in, out *os.File, info fs.FileInfo) (copyResult, error) {
+	if method == copyReflink {
+		err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd()))
+		if err == nil {
+			result := copyResult{shared: true}
+			if st, ok := info.Sys().(*syscall.Stat_t); ok {
+				// st_blocks 的单位总是 512 字节
+				result.bytes = st.Blocks * 512
+			}
+			return result, nil
+		}
+		klog.V(4).Infof("reflink of %s failed, falling back to copy_file_range: %v", in.Name(), err)
+	}
+
+	if method <= copyFileRange {
+		copied, err := copySparse(ctx, in, out, info.Size(), func(off, length int64) error {
+			return copyRange(in, out, off, length)
+		})
+		if err == nil || ctx.Err() != nil || errors.Is(err, io.ErrUnexpectedEOF) {
+			return copyResult{bytes: copied}, err
+		}
+		klog.V(4).Infof("copy_file_range of %s failed, falling back to streaming copy: %v", in.Name(), err)
+	}
+
+	copied, err := copySparse(ctx, in, out, info.Size(), func(off, length int64) error {
+		n, err := io.Copy(io.NewOffsetWriter(out, off), io.NewSectionReader(in, off, length))
+		if err == nil && n < length {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	})
+	return copyResult{bytes: copied}, err
+}
+
+// copySparse 只复制 in 中包含数据的区域, 空洞不会被写入, 这样稀疏文件复制后仍然是稀疏的。
+// 文件系统不支持 SEEK_DATA 时复制整个文件。数据按 copyChunkSize 分块复制, 每一块之前检查 ctx。
+// 返回复制的数据量。
+func copySparse(ctx context.Context, in, out *os.File, size int64, copyData func(off, length int64) error) (int64, error) {
+	var copied int64
+	var off int64
+	for off < size {
+		data, err := unix.Seek(int(in.Fd()), off, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			// off 之后只有空洞
+			break
+		}
+		if err != nil {
+			data = off
+		}
+		hole, err := unix.Seek(int(in.Fd()), data, unix.SEEK_HOLE)
+		if err != nil || hole > size {
+			hole = size
+		}
+		for ; data < hole; data += copyChunkSize {
+			if err := ctx.Err(); err != nil {
+				return copied, err
+			}
+			length := min(copyChunkSize, hole-data)
+			if err := copyData(data, length); err != nil {
+				return copied, err
+			}
+			copied += length
+		}
+		off = hole
+	}
+
+	// 文件末尾的空洞通过调整文件大小保留
+	info, err := out.Stat()
+	if err != nil {
+		return copied, err
+	}
+	if info.Size() < size {
+		return copied, out.Truncate(size)
+	}
+	return copied, nil
+}
+
+// copyRange 使用 copy_file_range 复制从 off 开始的 length 字节。
+// 使用显式的偏移量, 不会改变文件的读写位置。
+func copyRange(in, out *os.File, off, length int64) error {
+	srcOff, dstOff := off, off
+	end := off + length
+	for srcOff < end {
+		chunk := end - srcOff
+		if chunk > 1<<30 {
+			chunk = 1 << 30
+		}
+		n, err := unix.CopyFileRange(int(in.Fd()), &srcOff, int(out.Fd()), &dstOff, int(chunk), 0)
+		if err != nil {
+			return err
+		}
+		// 源文件在复制期间变短了, 不能把缺少数据的副本当作成功
+		if n == 0 {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	return nil
+}
+
+// cloneTree 将 srcDir 中的所有内容复制到已经存在的 dstDir, 保留权限, 属主和修改时间,
+// 效果与 "cp -a srcDir/. dstDir/" 相同。返回是否所有文件都与源文件共享数据块和复制的数据量。
+func cloneTree(ctx context.Context, method copyMethod, srcDir, dstDir string) (copyResult, error) {
+	result := copyResult{shared: true}
+	files := 0
+	var dirs []string
+	var dirInfos []fs.FileInfo
+
+	err := filepath.WalkDir(srcDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dstDir, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		mode := info.Mode()
+		switch {
+		case mode.IsDir():
+			if rel != "." {
+				if err := os.Mkdir(target, mode.Perm()); err != nil && !os.IsExist(err) {
+					return err
+				}
+			}
+			// 目录的修改时间在其中的内容复制完成后再设置
+			dirs = append(dirs, target)
+			dirInfos = append(dirInfos, info)
+		case mode&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			file, err := cloneFile(ctx, method, path, target)
+			if err != nil {
+				return err
+			}
+			result.shared = result.shared && file.shared
+			result.bytes += file.bytes
+			files++
+		default:
+			st, ok := info.Sys().(*syscall.Stat_t)
+			if !ok {
+				return fmt.Errorf("unsupported file type %v of %s", mode.Type(), path)
+			}
+			if err := unix.Mknod(target, st.Mode, int(st.Rdev)); err != nil {
+				return err
+			}
+		}
+		if mode.IsDir() {
+			return nil
+		}
+		return copyAttributes(target, info)
+	})
+	if err != nil {
+		return copyResult{}, err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := copyAttributes(dirs[i], dirInfos[i]); err != nil {
+			return copyResult{}, err
+		}
+	}
+	result.shared = result.shared && files > 0
+	return result, nil
+}
+
+// copyAttributes 将 info 中的属主, 权限和修改时间应用到 target 上
+func copyAttributes(target string, info fs.FileInfo) error {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		if err := os.Lchown(target, int(st.Uid), int(st.Gid)); err != nil {
+			return err
+		}
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		return nil
+	}
+	if err := os.Chmod(target, info.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(target, info.ModTime(), info.ModTime())
+}
+
+// countingReader 记录从 r 读取的数据量和第一个读取错误
+type countingReader struct {
+	r     io.Reader
+	bytes int64
+	err   error
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.bytes += int64(n)
+	if err != nil && err != io.EOF && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// extractArchive 将 r 中的 .tar.gz 归档解压到 destPath, 返回解压后的归档的大小。
+// 解压缩在这里进行, 这样复制的数据量是 tar 读取的数据量。
+func extractArchive(ctx context.Context, r io.Reader, destPath string) (int64, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	data := &countingReader{r: zr}
+	cmd := utilexec.New().CommandContext(ctx, "tar", "xf", "-", "-C", destPath)
+	cmd.SetStdin(data)
+	out, err := cmd.CombinedOutput()
+	// tar 只看到输入中断, 读取归档的错误更能说明原因
+	if data.err != nil {
+		return data.bytes, data.err
+	}
+	if err != nil {
+		return data.bytes, fmt.Errorf("%w: %s", err, out)
+	}
+	return data.bytes, nil
+}
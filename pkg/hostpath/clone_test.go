@@ -0,0 +1,193 @@
+package hostpath
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloneFile(t *testing.T) {
+	for _, method := range []copyMethod{copyReflink, copyFileRange, copyStream} {
+		t.Run(method.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, "src")
+			data := bytes.Repeat([]byte("hostpath"), 100000)
+			require.NoError(t, os.WriteFile(src, data, 0600))
+
+			// 新文件
+			dst := filepath.Join(dir, "new")
+			result, err := cloneFile(context.Background(), method, src, dst)
+			require.NoError(t, err)
+			if !result.shared {
+				require.Equal(t, int64(len(data)), result.bytes, "copied bytes")
+			}
+			content, err := os.ReadFile(dst)
+			require.NoError(t, err)
+			require.Equal(t, data, content)
+
+			// 已经存在的更大的块文件保持原来的大小
+			block := filepath.Join(dir, "block")
+			f, err := os.Create(block)
+			require.NoError(t, err)
+			require.NoError(t, f.Truncate(2*int64(len(data))))
+			require.NoError(t, f.Close())
+			_, err = cloneFile(context.Background(), method, src, block)
+			require.NoError(t, err)
+			content, err = os.ReadFile(block)
+			require.NoError(t, err)
+			require.Len(t, content, 2*len(data))
+			require.Equal(t, data, content[:len(data)])
+
+			// 取消的复制不再写入数据, reflink 是一次完成的
+			if method != copyReflink {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				_, err = cloneFile(ctx, method, src, filepath.Join(dir, "canceled"))
+				require.ErrorIs(t, err, context.Canceled)
+			}
+		})
+	}
+}
+
+func TestCopyRangeShortSource(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	require.NoError(t, os.WriteFile(src, bytes.Repeat([]byte("hostpath"), 512), 0600))
+	in, err := os.Open(src)
+	require.NoError(t, err)
+	defer in.Close()
+	out, err := os.Create(filepath.Join(dir, "dst"))
+	require.NoError(t, err)
+	defer out.Close()
+
+	// 源文件比要复制的范围短, 例如在复制期间被截断
+	require.ErrorIs(t, copyRange(in, out, 0, 8192), io.ErrUnexpectedEOF)
+	require.NoError(t, copyRange(in, out, 0, 4096))
+}
+
+func TestCloneTree(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "a", "b"), 0750))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "a", "b", "file"), []byte("data"), 0640))
+	require.NoError(t, os.Symlink("b/file", filepath.Join(src, "a", "link")))
+	require.NoError(t, os.Chtimes(filepath.Join(src, "a"), mtime, mtime))
+
+	_, err := cloneTree(context.Background(), copyFileRange, src, dst)
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(filepath.Join(dst, "a", "link"))
+	require.NoError(t, err)
+	require.Equal(t, "data", string(content))
+	info, err := os.Stat(filepath.Join(dst, "a", "b", "file"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	info, err = os.Stat(filepath.Join(dst, "a"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0750), info.Mode().Perm())
+	require.True(t, mtime.Equal(info.ModTime()), "directory mtime preserved")
+}
+
+// TestReflinkXFS 在回环设备上的 XFS 文件系统中测试通过 reflink 克隆卷。
+// 需要 root 权限和 mkfs.xfs。
+func TestReflinkXFS(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	if _, err := exec.LookPath("mkfs.xfs"); err != nil {
+		t.Skip("requires mkfs.xfs")
+	}
+
+	tmp := t.TempDir()
+	image := filepath.Join(tmp, "xfs.img")
+	stateDir := filepath.Join(tmp, "state")
+	require.NoError(t, os.Mkdir(stateDir, 0750))
+	require.NoError(t, os.WriteFile(image, nil, 0600))
+	require.NoError(t, os.Truncate(image, 512*mib))
+	out, err := exec.Command("mkfs.xfs", "-q", "-m", "reflink=1", image).CombinedOutput()
+	require.NoError(t, err, string(out))
+	out, err = exec.Command("mount", "-o", "loop", image, stateDir).CombinedOutput()
+	require.NoError(t, err, string(out))
+	t.Cleanup(func() {
+		if out, err := exec.Command("umount", stateDir).CombinedOutput(); err != nil {
+			t.Errorf("umount %s: %v: %s", stateDir, err, out)
+		}
+	})
+
+	require.Equal(t, copyReflink, detectCopyMethod(stateDir))
+
+	hp := newTestDriver(t, func(cfg *Config) {
+		cfg.StateDir = stateDir
+	})
+
+	mount := []*csi.VolumeCapability{mountCapability()}
+	src, err := hp.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "src",
+		VolumeCapabilities: mount,
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: mib},
+	})
+	require.NoError(t, err)
+	srcID := src.GetVolume().GetVolumeId()
+	require.NoError(t, os.WriteFile(filepath.Join(hp.getVolumePath(srcID), "data"), bytes.Repeat([]byte{1}, int(mib)), 0644))
+
+	clone, err := hp.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "clone",
+		VolumeCapabilities: mount,
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: mib},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: srcID}},
+		},
+	})
+	require.NoError(t, err)
+	vol, err := hp.state.GetVolumeByID(clone.GetVolume().GetVolumeId())
+	require.NoError(t, err)
+	require.True(t, vol.SharesExtents, "clone shares extents with its source")
+
+	content, err := os.ReadFile(filepath.Join(vol.VolPath, "data"))
+	require.NoError(t, err)
+	require.Equal(t, bytes.Repeat([]byte{1}, int(mib)), content)
+}
+
+func TestCloneSparseFile(t *testing.T) {
+	for _, method := range []copyMethod{copyFileRange, copyStream} {
+		t.Run(method.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, "src")
+			f, err := os.Create(src)
+			require.NoError(t, err)
+			_, err = f.WriteAt([]byte("begin"), 0)
+			require.NoError(t, err)
+			_, err = f.WriteAt([]byte("middle"), 32*mib)
+			require.NoError(t, err)
+			require.NoError(t, f.Truncate(64*mib))
+			require.NoError(t, f.Close())
+
+			dst := filepath.Join(dir, "dst")
+			result, err := cloneFile(context.Background(), method, src, dst)
+			require.NoError(t, err)
+			require.Less(t, result.bytes, 4*mib, "holes are not counted as copied data")
+
+			info, err := os.Stat(dst)
+			require.NoError(t, err)
+			require.Equal(t, 64*mib, info.Size(), "trailing hole preserved")
+			allocated, err := allocatedBytes(dst)
+			require.NoError(t, err)
+			require.Less(t, allocated, 4*mib, "holes are not filled")
+
+			content, err := os.ReadFile(dst)
+			require.NoError(t, err)
+			require.Equal(t, "begin", string(content[:5]))
+			require.Equal(t, "middle", string(content[32*mib:32*mib+6]))
+		})
+	}
+}
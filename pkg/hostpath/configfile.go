@@ -0,0 +1,389 @@
+package hostpath
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"syscall"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// 配置文件的版本和类型
+	ConfigAPIVersion = "hostpath.csi.k8s.io/v1alpha1"
+	ConfigKind       = "HostPathDriverConfig"
+
+	// 默认检查配置文件是否变化的间隔
+	defaultConfigReloadInterval = 10 * time.Second
+)
+
+// ConfigFile 是 YAML 或 JSON 格式的配置文件, 包含 Config 中除了
+// TracerProvider 和 KubeClient 之外的所有字段。大小可以写成 "10Gi",
+// 时间可以写成 "30s"。未设置的字段与 Config 中的零值含义相同。
+//
+//	apiVersion: hostpath.csi.k8s.io/v1alpha1
+//	kind: HostPathDriverConfig
+//	driverName: hostpath.csi.k8s.io
+//	endpoint: unix:///csi/csi.sock
+//	nodeID: node-1
+//	stateDir: /csi-data-dir
+//	capacity:
+//	  fast:
+//	    size: 100Gi
+//	    overcommitRatio: 2
+//	acceptedMutableParameterNames: [iops]
+type ConfigFile struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	DriverName                    string                      `json:"driverName,omitempty"`
+	EndPoint                      string                      `json:"endpoint,omitempty"`
+	NodeID                        string                      `json:"nodeID,omitempty"`
+	VendorVersion                 string                      `json:"vendorVersion,omitempty"`
+	StateDir                      string                      `json:"stateDir,omitempty"`
+	MaxVolumesPerNode             int64                       `json:"maxVolumesPerNode,omitempty"`
+	MaxVolumeSize                 resource.Quantity           `json:"maxVolumeSize,omitempty"`
+	AttachLimit                   int64                       `json:"attachLimit,omitempty"`
+	Capacity                      map[string]KindCapacityFile `json:"capacity,omitempty"`
+	Ephemeral                     bool                        `json:"ephemeral,omitempty"`
+	EnableAttach                  bool                        `json:"enableAttach,omitempty"`
+	EnableTopology                bool                        `json:"enableTopology,omitempty"`
+	EnableVolumeExpansion         bool                        `json:"enableVolumeExpansion,omitempty"`
+	EnableControllerModifyVolume  bool                        `json:"enableControllerModifyVolume,omitempty"`
+	AcceptedMutableParameterNames []string                    `json:"acceptedMutableParameterNames,omitempty"`
+	DisableControllerExpansion    bool                        `json:"disableControllerExpansion,omitempty"`
+	DisableNodeExpansion          bool                        `json:"disableNodeExpansion,omitempty"`
+	MaxVolumeExpansionSizeNode    resource.Quantity           `json:"maxVolumeExpansionSizeNode,omitempty"`
+	CheckVolumeLifecycle          bool                        `json:"checkVolumeLifecycle,omitempty"`
+	SnapshotScheduleInterval      metav1.Duration             `json:"snapshotScheduleInterval,omitempty"`
+	SnapshotWorkers               int                         `json:"snapshotWorkers,omitempty"`
+	CapacityAccounting            string                      `json:"capacityAccounting,omitempty"`
+	CapacityHighWatermark         float64                     `json:"capacityHighWatermark,omitempty"`
+	MountVolumeQuota              string                      `json:"mountVolumeQuota,omitempty"`
+	BlockBackedMountVolumes       bool                        `json:"blockBackedMountVolumes,omitempty"`
+	TopologySegments              map[string]string           `json:"topologySegments,omitempty"`
+	TopologyLabelsFile            string                      `json:"topologyLabelsFile,omitempty"`
+	TopologyLabelKeys             []string                    `json:"topologyLabelKeys,omitempty"`
+	NodeAgents                    []string                    `json:"nodeAgents,omitempty"`
+	ReplicationPeers              map[string]string           `json:"replicationPeers,omitempty"`
+	ReplicationInterval           metav1.Duration             `json:"replicationInterval,omitempty"`
+	ReplicationAddress            string                      `json:"replicationAddress,omitempty"`
+	MetricsAddress                string                      `json:"metricsAddress,omitempty"`
+	MetricsPath                   string                      `json:"metricsPath,omitempty"`
+	TracingEndpoint               string                      `json:"tracingEndpoint,omitempty"`
+	HealthCheckTTL                metav1.Duration             `json:"healthCheckTTL,omitempty"`
+	HealthMinFreeBytes            resource.Quantity           `json:"healthMinFreeBytes,omitempty"`
+	StateLockTimeout              metav1.Duration             `json:"stateLockTimeout,omitempty"`
+	LeaderElection                string                      `json:"leaderElection,omitempty"`
+	LeaderElectionLeaseFile       string                      `json:"leaderElectionLeaseFile,omitempty"`
+	LeaderElectionNamespace       string                      `json:"leaderElectionNamespace,omitempty"`
+	LeaderElectionLeaseName       string                      `json:"leaderElectionLeaseName,omitempty"`
+	LeaderElectionIdentity        string                      `json:"leaderElectionIdentity,omitempty"`
+	LeaseDuration                 metav1.Duration             `json:"leaseDuration,omitempty"`
+	RenewDeadline                 metav1.Duration             `json:"renewDeadline,omitempty"`
+	RetryPeriod                   metav1.Duration             `json:"retryPeriod,omitempty"`
+	ConfigReloadInterval          metav1.Duration             `json:"configReloadInterval,omitempty"`
+	VolumeDeletionPolicy          string                      `json:"volumeDeletionPolicy,omitempty"`
+	SnapshotDeletionPolicy        string                      `json:"snapshotDeletionPolicy,omitempty"`
+	TrashRetention                metav1.Duration             `json:"trashRetention,omitempty"`
+	SnapshotKeyFile               string                      `json:"snapshotKeyFile,omitempty"`
+}
+
+// KindCapacityFile 是配置文件中一种存储类型的容量
+type KindCapacityFile struct {
+	Size            resource.Quantity `json:"size"`
+	OvercommitRatio float64           `json:"overcommitRatio,omitempty"`
+}
+
+// reloadableConfigFields 是不需要重启驱动就可以修改的字段
+var reloadableConfigFields = map[string]bool{
+	"MaxVolumesPerNode":             true,
+	"MaxVolumeSize":                 true,
+	"AttachLimit":                   true,
+	"Capacity":                      true,
+	"AcceptedMutableParameterNames": true,
+	"MaxVolumeExpansionSizeNode":    true,
+	"CapacityHighWatermark":         true,
+	"TrashRetention":                true,
+}
+
+// LoadConfigFile 读取并检查配置文件。未知的字段和无效的值都是错误,
+// 错误信息中包含出错的字段
+func LoadConfigFile(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	cfg, err := parseConfigFile(data)
+	if err != nil {
+		return Config{}, fmt.Errorf("%s: %w", path, err)
+	}
+	cfg.ConfigFile = path
+	return cfg, nil
+}
+
+// parseConfigFile 把 YAML 或 JSON 格式的配置转换成 Config
+func parseConfigFile(data []byte) (Config, error) {
+	var file ConfigFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return Config{}, err
+	}
+	if err := file.validate().ToAggregate(); err != nil {
+		return Config{}, err
+	}
+
+	cfg := Config{
+		DriverName:                    file.DriverName,
+		EndPoint:                      file.EndPoint,
+		NodeID:                        file.NodeID,
+		VendorVersion:                 file.VendorVersion,
+		StateDir:                      file.StateDir,
+		MaxVolumesPerNode:             file.MaxVolumesPerNode,
+		MaxVolumeSize:                 file.MaxVolumeSize.Value(),
+		AttachLimit:                   file.AttachLimit,
+		Ephemeral:                     file.Ephemeral,
+		EnableAttach:                  file.EnableAttach,
+		EnableTopology:                file.EnableTopology,
+		EnableVolumeExpansion:         file.EnableVolumeExpansion,
+		EnableControllerModifyVolume:  file.EnableControllerModifyVolume,
+		AcceptedMutableParameterNames: file.AcceptedMutableParameterNames,
+		DisableControllerExpansion:    file.DisableControllerExpansion,
+		DisableNodeExpansion:          file.DisableNodeExpansion,
+		MaxVolumeExpansionSizeNode:    file.MaxVolumeExpansionSizeNode.Value(),
+		CheckVolumeLifecycle:          file.CheckVolumeLifecycle,
+		SnapshotScheduleInterval:      file.SnapshotScheduleInterval.Duration,
+		SnapshotWorkers:               file.SnapshotWorkers,
+		CapacityAccounting:            file.CapacityAccounting,
+		CapacityHighWatermark:         file.CapacityHighWatermark,
+		MountVolumeQuota:              file.MountVolumeQuota,
+		BlockBackedMountVolumes:       file.BlockBackedMountVolumes,
+		TopologySegments:              file.TopologySegments,
+		TopologyLabelsFile:            file.TopologyLabelsFile,
+		TopologyLabelKeys:             file.TopologyLabelKeys,
+		NodeAgents:                    file.NodeAgents,
+		ReplicationPeers:              file.ReplicationPeers,
+		ReplicationInterval:           file.ReplicationInterval.Duration,
+		ReplicationAddress:            file.ReplicationAddress,
+		MetricsAddress:                file.MetricsAddress,
+		MetricsPath:                   file.MetricsPath,
+		TracingEndpoint:               file.TracingEndpoint,
+		HealthCheckTTL:                file.HealthCheckTTL.Duration,
+		HealthMinFreeBytes:            file.HealthMinFreeBytes.Value(),
+		StateLockTimeout:              file.StateLockTimeout.Duration,
+		LeaderElection:                file.LeaderElection,
+		LeaderElectionLeaseFile:       file.LeaderElectionLeaseFile,
+		LeaderElectionNamespace:       file.LeaderElectionNamespace,
+		LeaderElectionLeaseName:       file.LeaderElectionLeaseName,
+		LeaderElectionIdentity:        file.LeaderElectionIdentity,
+		LeaseDuration:                 file.LeaseDuration.Duration,
+		RenewDeadline:                 file.RenewDeadline.Duration,
+		RetryPeriod:                   file.RetryPeriod.Duration,
+		ConfigReloadInterval:          file.ConfigReloadInterval.Duration,
+		VolumeDeletionPolicy:          file.VolumeDeletionPolicy,
+		SnapshotDeletionPolicy:        file.SnapshotDeletionPolicy,
+		TrashRetention:                file.TrashRetention.Duration,
+		SnapshotKeyFile:               file.SnapshotKeyFile,
+	}
+	if len(file.Capacity) > 0 {
+		cfg.Capacity = Capacity{}
+		for kind, capacity := range file.Capacity {
+			cfg.Capacity[kind] = KindCapacity{Size: capacity.Size, OvercommitRatio: capacity.OvercommitRatio}
+		}
+	}
+	return cfg, nil
+}
+
+// validate 检查配置文件中的值, 错误中的路径与文件中的字段名称相同
+func (f *ConfigFile) validate() field.ErrorList {
+	var errs field.ErrorList
+	if f.APIVersion != ConfigAPIVersion {
+		errs = append(errs, field.NotSupported(field.NewPath("apiVersion"), f.APIVersion, []string{ConfigAPIVersion}))
+	}
+	if f.Kind != ConfigKind {
+		errs = append(errs, field.NotSupported(field.NewPath("kind"), f.Kind, []string{ConfigKind}))
+	}
+
+	for key, value := range map[string]int64{
+		"maxVolumesPerNode":          f.MaxVolumesPerNode,
+		"maxVolumeSize":              f.MaxVolumeSize.Value(),
+		"attachLimit":                f.AttachLimit,
+		"maxVolumeExpansionSizeNode": f.MaxVolumeExpansionSizeNode.Value(),
+		"snapshotWorkers":            int64(f.SnapshotWorkers),
+		"healthMinFreeBytes":         f.HealthMinFreeBytes.Value(),
+	} {
+		if value < 0 {
+			errs = append(errs, field.Invalid(field.NewPath(key), value, "must not be negative"))
+		}
+	}
+	for key, value := range map[string]metav1.Duration{
+		"snapshotScheduleInterval": f.SnapshotScheduleInterval,
+		"replicationInterval":      f.ReplicationInterval,
+		"healthCheckTTL":           f.HealthCheckTTL,
+		"stateLockTimeout":         f.StateLockTimeout,
+		"leaseDuration":            f.LeaseDuration,
+		"renewDeadline":            f.RenewDeadline,
+		"retryPeriod":              f.RetryPeriod,
+		"configReloadInterval":     f.ConfigReloadInterval,
+		"trashRetention":           f.TrashRetention,
+	} {
+		if value.Duration < 0 {
+			errs = append(errs, field.Invalid(field.NewPath(key), value.Duration.String(), "must not be negative"))
+		}
+	}
+
+	for kind, capacity := range f.Capacity {
+		path := field.NewPath("capacity").Key(kind)
+		if capacity.Size.Sign() <= 0 {
+			errs = append(errs, field.Invalid(path.Child("size"), capacity.Size.String(), "must be positive"))
+		}
+		if capacity.OvercommitRatio != 0 && capacity.OvercommitRatio < 1 {
+			errs = append(errs, field.Invalid(path.Child("overcommitRatio"), capacity.OvercommitRatio, "must be at least 1.0"))
+		}
+	}
+	if f.CapacityHighWatermark < 0 || f.CapacityHighWatermark > 1 {
+		errs = append(errs, field.Invalid(field.NewPath("capacityHighWatermark"), f.CapacityHighWatermark, "must be between 0 and 1"))
+	}
+	for i, name := range f.AcceptedMutableParameterNames {
+		if name == "" {
+			errs = append(errs, field.Required(field.NewPath("acceptedMutableParameterNames").Index(i), ""))
+		}
+	}
+
+	if f.CapacityAccounting != "" && f.CapacityAccounting != AccountingNominal && f.CapacityAccounting != AccountingAllocated {
+		errs = append(errs, field.NotSupported(field.NewPath("capacityAccounting"), f.CapacityAccounting, []string{AccountingNominal, AccountingAllocated}))
+	}
+	switch f.MountVolumeQuota {
+	case "", QuotaNone, QuotaProject, QuotaLoop:
+	default:
+		errs = append(errs, field.NotSupported(field.NewPath("mountVolumeQuota"), f.MountVolumeQuota, []string{QuotaNone, QuotaProject, QuotaLoop}))
+	}
+	switch f.LeaderElection {
+	case "", LeaderElectionFile, LeaderElectionKubernetes:
+	default:
+		errs = append(errs, field.NotSupported(field.NewPath("leaderElection"), f.LeaderElection, []string{LeaderElectionFile, LeaderElectionKubernetes}))
+	}
+
+	for key, value := range map[string]string{
+		"volumeDeletionPolicy":   f.VolumeDeletionPolicy,
+		"snapshotDeletionPolicy": f.SnapshotDeletionPolicy,
+	} {
+		if validateDeletionPolicy(value) != nil {
+			errs = append(errs, field.NotSupported(field.NewPath(key), value, []string{DeletionPolicyAllow, DeletionPolicyBlock, DeletionPolicyDefer}))
+		}
+	}
+
+	for key, value := range f.TopologySegments {
+		path := field.NewPath("topologySegments").Key(key)
+		for _, msg := range validation.IsQualifiedName(key) {
+			errs = append(errs, field.Invalid(path, key, msg))
+		}
+		for _, msg := range validation.IsValidLabelValue(value) {
+			errs = append(errs, field.Invalid(path, value, msg))
+		}
+	}
+	for nodeID, address := range f.ReplicationPeers {
+		if nodeID == "" || address == "" {
+			errs = append(errs, field.Invalid(field.NewPath("replicationPeers").Key(nodeID), address, "node id and address must not be empty"))
+		}
+	}
+
+	// map 的遍历顺序是随机的, 排序后错误信息保持稳定
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Field < errs[j].Field
+	})
+	return errs
+}
+
+// ReloadConfig 应用新配置中可以安全修改的字段: 容量, 各种限制, 可修改参数的列表和回收站的保留时间。
+// 其它字段的修改需要重启驱动, 只会记录日志
+func (hp *hostpath) ReloadConfig(cfg Config) {
+	hp.mutex.Lock()
+	defer hp.mutex.Unlock()
+
+	current := reflect.ValueOf(&hp.config).Elem()
+	updated := reflect.ValueOf(cfg)
+	fileType := reflect.TypeOf(ConfigFile{})
+	var changed, ignored []string
+	for i := 0; i < current.NumField(); i++ {
+		name := current.Type().Field(i).Name
+		fileField, ok := fileType.FieldByName(name)
+		if !ok {
+			// TracerProvider, KubeClient 和 ConfigFile 不在配置文件中
+			continue
+		}
+		if reflect.DeepEqual(current.Field(i).Interface(), updated.Field(i).Interface()) {
+			continue
+		}
+		key, _, _ := bytes.Cut([]byte(fileField.Tag.Get("json")), []byte(","))
+		if !reloadableConfigFields[name] {
+			ignored = append(ignored, string(key))
+			continue
+		}
+		current.Field(i).Set(updated.Field(i))
+		changed = append(changed, string(key))
+	}
+	if len(changed) > 0 {
+		klog.Infof("Reloaded configuration: %v", changed)
+	}
+	if len(ignored) > 0 {
+		klog.Warningf("Changes of %v take effect after restarting the driver", ignored)
+	}
+}
+
+// reloadConfigFile 重新读取配置文件。无效的配置不会被应用
+func (hp *hostpath) reloadConfigFile() error {
+	cfg, err := LoadConfigFile(hp.config.ConfigFile)
+	if err != nil {
+		return err
+	}
+	hp.ReloadConfig(cfg)
+	return nil
+}
+
+// WatchConfigFile 在收到 SIGHUP 或者配置文件的内容变化时重新加载配置, 直到 stopCh 被关闭
+func (hp *hostpath) WatchConfigFile(stopCh <-chan struct{}) {
+	if hp.config.ConfigFile == "" {
+		return
+	}
+	interval := hp.config.ConfigReloadInterval
+	if interval <= 0 {
+		interval = defaultConfigReloadInterval
+	}
+	last, _ := os.ReadFile(hp.config.ConfigFile)
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(sighup)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-sighup:
+				klog.Infof("Received SIGHUP, reloading %s", hp.config.ConfigFile)
+			case <-ticker.C:
+				data, err := os.ReadFile(hp.config.ConfigFile)
+				if err != nil || bytes.Equal(data, last) {
+					continue
+				}
+				last = data
+				klog.Infof("%s changed, reloading", hp.config.ConfigFile)
+			}
+			if err := hp.reloadConfigFile(); err != nil {
+				klog.Errorf("failed to reload configuration: %v", err)
+			}
+		}
+	}()
+}
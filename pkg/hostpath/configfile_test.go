@@ -0,0 +1,140 @@
+package hostpath
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestParseConfigFile(t *testing.T) {
+	cfg, err := parseConfigFile([]byte(`
+apiVersion: hostpath.csi.k8s.io/v1alpha1
+kind: HostPathDriverConfig
+driverName: hostpath.csi.k8s.io
+endpoint: unix:///csi.sock
+nodeID: node
+maxVolumeSize: 1Ti
+capacity:
+  fast:
+    size: 100Gi
+    overcommitRatio: 2
+  slow:
+    size: 1Ti
+acceptedMutableParameterNames: [iops, throughput]
+topologySegments:
+  topology.kubernetes.io/zone: zone-a
+snapshotScheduleInterval: 5m
+`))
+	require.NoError(t, err)
+	require.Equal(t, "unix:///csi.sock", cfg.EndPoint)
+	require.Equal(t, tib, cfg.MaxVolumeSize)
+	require.Equal(t, 200*gib, cfg.Capacity["fast"].Nominal())
+	require.Equal(t, tib, cfg.Capacity["slow"].Nominal())
+	require.Equal(t, StringArray{"iops", "throughput"}, cfg.AcceptedMutableParameterNames)
+	require.Equal(t, Segments{"topology.kubernetes.io/zone": "zone-a"}, cfg.TopologySegments)
+	require.Equal(t, 5*time.Minute, cfg.SnapshotScheduleInterval)
+
+	cfg, err = parseConfigFile([]byte(`{"apiVersion": "hostpath.csi.k8s.io/v1alpha1", "kind": "HostPathDriverConfig", "attachLimit": 3}`))
+	require.NoError(t, err, "JSON")
+	require.Equal(t, int64(3), cfg.AttachLimit)
+
+	// 错误信息中包含出错的字段
+	for name, tc := range map[string]struct {
+		config string
+		err    string
+	}{
+		"version": {
+			config: "apiVersion: v2\nkind: HostPathDriverConfig",
+			err:    `apiVersion: Unsupported value: "v2"`,
+		},
+		"unknown key": {
+			config: "apiVersion: hostpath.csi.k8s.io/v1alpha1\nkind: HostPathDriverConfig\nmaxVolumeSise: 1Ti",
+			err:    `unknown field "maxVolumeSise"`,
+		},
+		"capacity": {
+			config: "apiVersion: hostpath.csi.k8s.io/v1alpha1\nkind: HostPathDriverConfig\ncapacity:\n  fast:\n    size: 1Gi\n    overcommitRatio: 0.5",
+			err:    "capacity[fast].overcommitRatio: Invalid value: 0.5: must be at least 1.0",
+		},
+		"watermark": {
+			config: "apiVersion: hostpath.csi.k8s.io/v1alpha1\nkind: HostPathDriverConfig\ncapacityHighWatermark: 2",
+			err:    "capacityHighWatermark: Invalid value: 2: must be between 0 and 1",
+		},
+		"quota": {
+			config: "apiVersion: hostpath.csi.k8s.io/v1alpha1\nkind: HostPathDriverConfig\nmountVolumeQuota: xfs",
+			err:    `mountVolumeQuota: Unsupported value: "xfs"`,
+		},
+		"duration": {
+			config: "apiVersion: hostpath.csi.k8s.io/v1alpha1\nkind: HostPathDriverConfig\nleaseDuration: -1s",
+			err:    `leaseDuration: Invalid value: "-1s": must not be negative`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseConfigFile([]byte(tc.config))
+			require.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	stateDir := t.TempDir()
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(capacity, stateDir string) {
+		require.NoError(t, os.WriteFile(configFile, []byte(`
+apiVersion: hostpath.csi.k8s.io/v1alpha1
+kind: HostPathDriverConfig
+driverName: hostpath.csi.k8s.io
+endpoint: unix:///csi.sock
+nodeID: node
+stateDir: `+stateDir+`
+maxVolumeSize: 1Ti
+configReloadInterval: 10ms
+capacity:
+  fast:
+    size: `+capacity+`
+`), 0644))
+	}
+	writeConfig("1Gi", stateDir)
+	cfg, err := LoadConfigFile(configFile)
+	require.NoError(t, err)
+	require.Equal(t, configFile, cfg.ConfigFile)
+	hp, err := NewHostPathDriver(cfg)
+	require.NoError(t, err)
+	defer hp.Close()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	hp.WatchConfigFile(stopCh)
+
+	capacity := func() int64 {
+		resp, err := hp.GetCapacity(context.Background(), &csi.GetCapacityRequest{
+			Parameters: map[string]string{storageKind: "fast"},
+		})
+		require.NoError(t, err)
+		return resp.AvailableCapacity
+	}
+	require.Equal(t, gib, capacity())
+
+	// 文件变化后应用新的容量, StateDir 的修改需要重启
+	writeConfig("2Gi", t.TempDir())
+	require.Eventually(t, func() bool { return capacity() == 2*gib }, 10*time.Second, 10*time.Millisecond)
+	require.Equal(t, stateDir, hp.config.StateDir)
+
+	// 无效的配置被忽略
+	require.NoError(t, os.WriteFile(configFile, []byte("apiVersion: v2"), 0644))
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 2*gib, capacity())
+
+	// SIGHUP 重新加载配置, 即使检查文件变化的间隔还没有到
+	writeConfig("3Gi", stateDir)
+	hp.mutex.Lock()
+	hp.config.Capacity = Capacity{"fast": {Size: resource.MustParse("1Gi")}}
+	hp.mutex.Unlock()
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	require.Eventually(t, func() bool { return capacity() == 3*gib }, 10*time.Second, 10*time.Millisecond)
+}
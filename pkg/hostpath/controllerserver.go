@@ -2,24 +2,33 @@ package hostpath
 
 import (
 	"context"
+	"fmt"
 	"github.com/bearcat-panda/csi-demo/pkg/state"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/pborman/uuid"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/klog/v2"
+	"maps"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
 )
 
 func (hp *hostpath) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (resp *csi.CreateVolumeResponse, finalerr error) {
+	logger := klog.FromContext(ctx)
 	if err := hp.validateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
-		klog.V(3).Infof("invalid create volume req: %v", req)
+		logger.V(3).Info("Invalid create volume request", "err", err)
 		return nil, err
 	}
 
 	if len(req.GetMutableParameters()) > 0 {
 		if err := hp.validateControllerServiceRequest(csi.ControllerServiceCapability_RPC_MODIFY_VOLUME); err != nil {
-			klog.V(3).Infof("invalid create volume req: %v", req)
+			logger.V(3).Info("Invalid create volume request", "err", err)
 			return nil, err
 		}
 		// Check if the mutable parameters are in the accepted list
@@ -27,6 +36,12 @@ func (hp *hostpath) CreateVolume(ctx context.Context, req *csi.CreateVolumeReque
 			return nil, err
 		}
 	}
+	// VolumeAttributesClass 中的参数覆盖 StorageClass 中的参数
+	params := maps.Clone(req.GetParameters())
+	if params == nil {
+		params = map[string]string{}
+	}
+	maps.Copy(params, req.GetMutableParameters())
 
 	// Check arguments
 	if len(req.GetName()) == 0 {
@@ -37,138 +52,817 @@ func (hp *hostpath) CreateVolume(ctx context.Context, req *csi.CreateVolumeReque
 		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities missing in request")
 	}
 
-	// Keep a record of the requested access types.
-	var accessTypeMount, accessTypeBlock bool
-
-	for _, cap := range caps {
-		if cap.GetBlock() != nil {
-			accessTypeBlock = true
-		}
-		if cap.GetMount() != nil {
-			accessTypeMount = true
-		}
+	// 分布式控制器把请求转发给选择的节点, 由节点检查其余的参数
+	if hp.distributed() {
+		return hp.createRemoteVolume(ctx, req)
 	}
 
-	// 真正的csi驱动程序还需要检查其他字段
-	if accessTypeBlock && accessTypeMount {
-		return nil, status.Error(codes.InvalidArgument, "cannot have both block and mount access type")
+	// 检查访问类型, 访问模式, fsType 和挂载选项
+	if err := hp.validateVolumeCapabilities(caps, nil); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
 	var requestedAccessType state.AccessType
 
-	if accessTypeBlock {
+	if caps[0].GetBlock() != nil {
 		requestedAccessType = state.BlockAccess
 	} else {
-		// Default to mount.
 		requestedAccessType = state.MountAccess
 	}
 
+	// 拒绝未知的参数, 例如 StorageClass 中拼写错误的参数名称
+	if err := volumeParameters.validate(hp, params, false); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// 定时快照的保留策略需要调度
+	schedule := params[snapshotSchedule]
+	retention := params[snapshotRetain]
+	if schedule == "" && retention != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "%s requires %s", snapshotRetain, snapshotSchedule)
+	}
+
+	// 卷的数据异步复制到对等节点
+	replica := params[replicaNode]
+	thin := volumeParameters.get(params, provisioning) == provisioningThin
+	// 目录没有预先分配的空间, 只有块文件可以选择分配方式
+	if thin && requestedAccessType == state.MountAccess && !hp.config.BlockBackedMountVolumes {
+		return nil, status.Errorf(codes.InvalidArgument, "%s=%s is only supported for block volumes and block-backed mount volumes", provisioning, provisioningThin)
+	}
+
+	// 加密的块卷在创建时格式化, 需要 secrets 中的密码
+	encrypt, _ := strconv.ParseBool(volumeParameters.get(params, encrypted))
+	var passphrase []byte
+	if encrypt {
+		if requestedAccessType != state.BlockAccess {
+			return nil, status.Errorf(codes.InvalidArgument, "%s is only supported for block volumes", encrypted)
+		}
+		// 从数据源创建的卷沿用数据源的 LUKS 头, 不需要密码
+		if req.GetVolumeContentSource() == nil {
+			var err error
+			if passphrase, err = passphraseFrom(req.GetSecrets()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// 推导解密快照的密钥需要很长时间, 与 CreateSnapshot 一样在加锁之前完成
+	var restoreKey *snapshotKey
+	if source := req.GetVolumeContentSource().GetSnapshot(); source != nil {
+		unlock := hp.lockState(ctx)
+		snapshot, err := hp.state.GetSnapshotByID(source.GetSnapshotId())
+		unlock()
+		// 快照不存在时由 loadFromSnapshot 返回错误
+		if err == nil {
+			if restoreKey, err = hp.decryptionKeyFor(snapshot, req.GetSecrets()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	// 在操作全局status是.需要先加锁
-	hp.mutex.Lock()
-	defer hp.mutex.Unlock()
+	unlock := hp.lockState(ctx)
+	defer unlock()
 
 	capacity := int64(req.GetCapacityRange().GetRequiredBytes())
-	topologies := []*csi.Topology{}
-	if hp.config.EnableTopology {
-		topologies = append(topologies, &csi.Topology{Segments: map[string]string{TopologyKeyNode: hp.config.NodeID}})
-	}
 
-	// 这里根据volume name判断是否已经存在了，存在了就返回就行了
+	// 这里根据volume name判断是否已经存在了. 重复的请求必须与已经存在的卷一致, 返回保存的卷
 	if exVol, err := hp.state.GetVolumeByName(req.GetName()); err == nil {
-		// volume已经存在.但是大小不符合
-		if exVol.VolSize < capacity {
-			return nil, status.Errorf(codes.AlreadyExists, "Volume with the same name: %s but with different size already exist", req.GetName())
-		}
-		// 判断数据的恢复方式
-		if req.GetVolumeContentSource() != nil{
-			volumeSource := req.VolumeContentSource
-			switch volumeSource.Type.(type) {
-			// 校验: 从快照中恢复
-			case *csi.VolumeContentSource_Snapshot:
-				if volumeSource.GetSnapshot() != nil && exVol.ParentSnapID != "" && exVol.ParentSnapID != volumeSource.GetSnapshot().GetSnapshotId() {
-					return nil, status.Error(codes.AlreadyExists, "existing volume source snapshot id not matching")
-				}
-			// 校验: clone过程
-			case *csi.VolumeContentSource_Volume:
-				if volumeSource.GetVolume() != nil && exVol.ParentVolID != volumeSource.GetVolume().GetVolumeId() {
-					return nil, status.Error(codes.AlreadyExists, "existing volume source volume id not matching")
-				}
-			default:
-				return nil, status.Errorf(codes.InvalidArgument, "%v not a proper volume source", volumeSource)
-			}
+		if err := checkExistingVolume(exVol, req, requestedAccessType); err != nil {
+			return nil, err
 		}
+		return &csi.CreateVolumeResponse{Volume: convertVolume(exVol)}, nil
+	}
 
-		return &csi.CreateVolumeResponse{
-			Volume: &csi.Volume{
-				VolumeId: exVol.VolID,
-				CapacityBytes: int64(exVol.VolSize),
-				VolumeContext: req.GetParameters(),
-				ContentSource: req.GetVolumeContentSource(),
-				AccessibleTopology: topologies,
-			},
-		}, nil
+	// 节点必须满足请求的拓扑要求
+	topologies, err := hp.accessibleTopology(req.GetAccessibilityRequirements())
+	if err != nil {
+		return nil, err
+	}
+
+	// 加密卷的克隆和恢复的卷复制了 LUKS 头, 同样是加密的。没有设置 encrypted 参数时沿用数据源的加密
+	if source := req.GetVolumeContentSource(); source != nil {
+		sourceEncrypted, err := hp.sourceEncrypted(source)
+		if err != nil {
+			return nil, err
+		}
+		_, explicit := params[encrypted]
+		switch {
+		case encrypt && !sourceEncrypted:
+			return nil, status.Errorf(codes.InvalidArgument, "the content source of encrypted volume %s is not encrypted", req.GetName())
+		case !encrypt && sourceEncrypted && explicit:
+			return nil, status.Errorf(codes.InvalidArgument, "the content source of volume %s is encrypted, %s=false is not possible", req.GetName(), encrypted)
+		}
+		encrypt = sourceEncrypted
+	}
+	// 块文件按 MiB 分配, 加密卷的数据区不能为空
+	if encrypt && capacity < mib {
+		return nil, status.Errorf(codes.OutOfRange, "encrypted volumes need a capacity of at least %d bytes", mib)
 	}
 
 	// 创建volume
 	volumeID := uuid.NewUUID().String()
-	kind := req.GetParameters()[storageKind]
+	kind := params[storageKind]
 	// 创建hostpath的volume
-	vol, err := hp.createVolume(volumeID, req.GetName(), capacity, requestedAccessType, false, kind)
+	vol, err := hp.createVolume(ctx, volumeID, req.GetName(), capacity, requestedAccessType, false, kind, thin, encrypt)
 	if err != nil {
 		return nil, err
 	}
-	klog.V(4).Infof("created volume %s at path %s", vol.VolID, vol.VolPath)
+	logger.V(4).Info("Created volume", "volumeID", vol.VolID, "path", vol.VolPath)
+
+	// 保存请求的参数, 能力和拓扑, 用于检查重复的请求
+	vol.Parameters = req.GetParameters()
+	vol.Capabilities = convertCapabilities(caps)
+	for _, topology := range topologies {
+		vol.AccessibleTopology = append(vol.AccessibleTopology, topology.GetSegments())
+	}
+	vol.SnapshotSchedule = schedule
+	vol.SnapshotRetention = retention
+	if replica != "" {
+		vol.Replication = state.Replication{Role: state.ReplicationSource, Peer: replica}
+	}
+	if err := hp.state.UpdateVolume(*vol); err != nil {
+		return nil, err
+	}
 
 	//新卷的数据是否 允许来自备份数据
 	if req.GetVolumeContentSource() != nil {
-		// 获取卷的规范路径
-		path := hp.getVolumePath(volumeID)
 		volumeSource := req.VolumeContentSource
+		var copied copyResult
+		var operation string
+		start := time.Now()
 		switch volumeSource.Type.(type) {
 		case *csi.VolumeContentSource_Snapshot:
 			if snapshot := volumeSource.GetSnapshot(); snapshot != nil {
-				err = hp.loadFromSnapshot(capacity, snapshot.GetSnapshotId(), path, requestedAccessType)
-				vol.ParentVolID = snapshot.GetSnapshotId()
+				operation = copyRestore
+				copied, err = hp.loadFromSnapshot(ctx, capacity, snapshot.GetSnapshotId(), vol, restoreKey)
+				vol.ParentSnapID = snapshot.GetSnapshotId()
 			}
 		case *csi.VolumeContentSource_Volume:
 			if srcVolume := volumeSource.GetVolume(); srcVolume != nil {
-				err = hp.loadFromVolume(capacity, srcVolume.GetVolumeId(), path, requestedAccessType)
+				operation = copyClone
+				copied, err = hp.loadFromVolume(ctx, capacity, srcVolume.GetVolumeId(), vol)
 				vol.ParentVolID = srcVolume.GetVolumeId()
 			}
 		default:
 			err = status.Errorf(codes.InvalidArgument, "%v not a proper volume source", volumeSource)
 		}
+		// 复制的文件系统决定了新卷的 fsType, 请求的能力必须与它一致
+		if err == nil {
+			if capErr := hp.validateVolumeCapabilities(caps, vol); capErr != nil {
+				err = status.Error(codes.InvalidArgument, capErr.Error())
+			}
+		}
 		if err != nil {
-			klog.V(4).Infof("VolumeSource error: %v", err)
+			logger.V(4).Info("Failed to populate volume", "volumeID", volumeID, "err", err)
+			if delErr := hp.deleteVolume(volumeID); delErr != nil {
+				logger.V(2).Info("Deleting hostpath volume failed", "volumeID", volumeID, "err", delErr)
+			}
+			return nil, err
+		}
+		hp.metrics.observeCopy(operation, copied.bytes, time.Since(start))
+		// 记录volume是否与数据源共享数据块
+		vol.SharesExtents = copied.shared
+		if err := hp.state.UpdateVolume(*vol); err != nil {
+			return nil, err
+		}
+		logger.V(4).Info("Populated volume", "volumeID", vol.VolID, "sharesExtents", copied.shared, "copiedBytes", copied.bytes)
+	}
+
+	if encrypt {
+		if err := hp.setupEncryption(ctx, vol, passphrase, req.GetVolumeContentSource() != nil); err != nil {
 			if delErr := hp.deleteVolume(volumeID); delErr != nil {
-				klog.V(2).Infof("deleting hostpath volume %v failed: %v", volumeID, delErr)
+				logger.V(2).Info("Deleting hostpath volume failed", "volumeID", volumeID, "err", delErr)
 			}
 			return nil, err
 		}
-		klog.V(4).Infof("successfully populate volume %s", vol.VolID)
+		logger.V(4).Info("Set up encryption", "volumeID", vol.VolID)
+	}
+
+	return &csi.CreateVolumeResponse{Volume: convertVolume(*vol)}, nil
+}
+
+// checkExistingVolume 检查同名的 CreateVolume 请求与已经存在的卷是否一致, 不一致时返回 AlreadyExists
+func checkExistingVolume(exVol state.Volume, req *csi.CreateVolumeRequest, accessType state.AccessType) error {
+	name := req.GetName()
+	// volume已经存在.但是大小不符合
+	capacityRange := req.GetCapacityRange()
+	if exVol.VolSize < capacityRange.GetRequiredBytes() ||
+		(capacityRange.GetLimitBytes() > 0 && exVol.VolSize > capacityRange.GetLimitBytes()) {
+		return status.Errorf(codes.AlreadyExists, "Volume with the same name: %s but with different size already exist", name)
+	}
+
+	// 判断数据的恢复方式
+	volumeSource := req.GetVolumeContentSource()
+	switch volumeSource.GetType().(type) {
+	case nil:
+		if exVol.ParentSnapID != "" || exVol.ParentVolID != "" {
+			return status.Errorf(codes.AlreadyExists, "Volume with the same name: %s but with a content source already exist", name)
+		}
+	// 校验: 从快照中恢复
+	case *csi.VolumeContentSource_Snapshot:
+		if exVol.ParentSnapID != volumeSource.GetSnapshot().GetSnapshotId() {
+			return status.Error(codes.AlreadyExists, "existing volume source snapshot id not matching")
+		}
+	// 校验: clone过程
+	case *csi.VolumeContentSource_Volume:
+		if exVol.ParentVolID != volumeSource.GetVolume().GetVolumeId() {
+			return status.Error(codes.AlreadyExists, "existing volume source volume id not matching")
+		}
+	default:
+		return status.Errorf(codes.InvalidArgument, "%v not a proper volume source", volumeSource)
+	}
+
+	// 访问类型总是被保存, 旧版本创建的卷也可以比较
+	if exVol.VolAccessType != accessType {
+		return status.Errorf(codes.AlreadyExists, "Volume with the same name: %s but with different access type already exist", name)
+	}
+
+	// 旧版本创建的卷没有保存参数和能力
+	if exVol.Capabilities == nil {
+		return nil
+	}
+	if !maps.Equal(exVol.Parameters, req.GetParameters()) {
+		return status.Errorf(codes.AlreadyExists, "Volume with the same name: %s but with different parameters already exist", name)
+	}
+	if !equalCapabilities(exVol.Capabilities, convertCapabilities(req.GetVolumeCapabilities())) {
+		return status.Errorf(codes.AlreadyExists, "Volume with the same name: %s but with different capabilities already exist", name)
+	}
+	// 卷必须可以从请求要求的拓扑中的一个访问
+	if requisite := req.GetAccessibilityRequirements().GetRequisite(); len(requisite) > 0 {
+		for _, segments := range exVol.AccessibleTopology {
+			if !slices.ContainsFunc(requisite, func(topology *csi.Topology) bool {
+				return topologyMatches(topology, segments)
+			}) {
+				return status.Errorf(codes.AlreadyExists, "Volume with the same name: %s but with different accessibility requirements already exist", name)
+			}
+		}
+	}
+	return nil
+}
+
+// convertVolume 根据保存的状态返回卷的信息
+func convertVolume(vol state.Volume) *csi.Volume {
+	var source *csi.VolumeContentSource
+	switch {
+	case vol.ParentSnapID != "":
+		source = &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: vol.ParentSnapID},
+			},
+		}
+	case vol.ParentVolID != "":
+		source = &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: vol.ParentVolID},
+			},
+		}
+	}
+
+	topologies := []*csi.Topology{}
+	for _, segments := range vol.AccessibleTopology {
+		topologies = append(topologies, &csi.Topology{Segments: segments})
+	}
+
+	return &csi.Volume{
+		VolumeId:           vol.VolID,
+		CapacityBytes:      vol.VolSize,
+		VolumeContext:      vol.Parameters,
+		ContentSource:      source,
+		AccessibleTopology: topologies,
+	}
+}
+
+
+func (hp *hostpath) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+
+	if err := hp.validateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
+		klog.FromContext(ctx).V(3).Info("Invalid delete volume request", "err", err)
+		return nil, err
+	}
+
+	if hp.distributed() {
+		return hp.deleteRemoteVolume(ctx, req)
+	}
+
+	// 在操作全局status是.需要先加锁
+	unlock := hp.lockState(ctx)
+	vol, err := hp.deleteLocalVolume(ctx, req.GetVolumeId())
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// 副本随源卷一起删除, 调用对等节点时不持有 hp.mutex. 对等节点不可用时副本会被保留
+	if vol != nil && vol.Replication.Role == state.ReplicationSource {
+		if err := hp.deleteReplica(ctx, *vol); err != nil {
+			klog.FromContext(ctx).Error(err, "Failed to delete replica, keeping it", "volumeID", vol.VolID, "replicaNode", vol.Replication.Peer)
+		}
+	}
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+// deleteLocalVolume 删除卷或者推迟到它的快照和克隆都被删除之后, 返回被删除的卷。
+// 卷不存在时返回 nil。调用者必须持有 hp.mutex。
+func (hp *hostpath) deleteLocalVolume(ctx context.Context, volId string) (*state.Volume, error) {
+	vol, err := hp.state.GetVolumeByID(volId)
+	if err != nil || vol.DeletionDeferred {
+		// 卷不存在时可能已经被删除了
+		return nil, nil
+	}
+
+	if vol.Attached || !vol.Published.Empty() || !vol.Staged.Empty() {
+		msg := fmt.Sprintf("Volume '%s' is still used (attached: %v, staged: %v, published: %v) by '%s' node",
+			vol.VolID, vol.Attached, vol.Staged, vol.Published, hp.config.NodeID)
+		if hp.config.CheckVolumeLifecycle {
+			return nil, status.Error(codes.Internal, msg)
+		}
+		klog.FromContext(ctx).Error(nil, msg)
+	}
+
+	// 卷仍有快照时按照删除策略处理
+	deferred, err := checkDeletionPolicy(hp.config.VolumeDeletionPolicy, "volume", volId, hp.volumeDependents(volId))
+	if err != nil {
+		return nil, err
+	}
+
+	if deferred {
+		if err := hp.deferVolumeDeletion(ctx, vol); err != nil {
+			return nil, err
+		}
+		return &vol, nil
+	}
+	if err := hp.deleteVolume(volId); err != nil {
+		return nil, fmt.Errorf("failed to delete volume %v: %w", volId, err)
+	}
+	klog.FromContext(ctx).V(4).Info("Deleted volume", "volumeID", volId)
+	return &vol, nil
+}
+
+// CreateSnapshot 立即返回未就绪(ReadyToUse=false)的快照, 数据在后台保存。
+// 对同一个快照的重复调用返回当前的状态。
+func (hp *hostpath) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	if err := hp.validateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		klog.FromContext(ctx).V(3).Info("Invalid create snapshot request", "err", err)
+		return nil, err
+	}
+
+	if len(req.GetName()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
+	}
+	// Check arguments
+	if len(req.GetSourceVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "SourceVolumeId missing in request")
+	}
+
+	if hp.distributed() {
+		return hp.createRemoteSnapshot(ctx, req)
+	}
+
+	if err := snapshotParameters.validate(hp, req.GetParameters(), false); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	key, err := hp.snapshotKeyFor(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+
+	// 在操作全局status是.需要先加锁
+	unlock := hp.lockState(ctx)
+	defer unlock()
+
+	// 这里根据snapshot name判断是否已经存在了，存在了就返回当前的状态
+	if exSnap, err := hp.state.GetSnapshotByName(req.GetName()); err == nil {
+		if exSnap.VolID != req.GetSourceVolumeId() {
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot with the same name: %s but with different SourceVolumeId already exist", req.GetName())
+		}
+		if err := hp.snapshotJobError(exSnap.Id); err != nil {
+			return nil, err
+		}
+		if !exSnap.ReadyToUse {
+			klog.FromContext(ctx).V(4).Info("Snapshot is still being created", "snapshotID", exSnap.Id, "bytesWritten", snapshotProgress(exSnap))
+		}
+		return &csi.CreateSnapshotResponse{Snapshot: convertSnapshot(exSnap)}, nil
+	}
+
+	hostPathVolume, err := hp.visibleVolume(req.GetSourceVolumeId())
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotID := uuid.NewUUID().String()
+	snapshot, err := hp.createSnapshot(snapshotID, req.GetName(), hostPathVolume, false, key)
+	if err != nil {
+		return nil, err
+	}
+	klog.FromContext(ctx).V(4).Info("Started snapshot", "snapshotID", snapshotID, "volumeID", hostPathVolume.VolID)
+
+	return &csi.CreateSnapshotResponse{Snapshot: convertSnapshot(*snapshot)}, nil
+}
+
+func (hp *hostpath) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	// Check arguments
+	if len(req.GetSnapshotId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot ID missing in request")
+	}
+
+	if err := hp.validateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		klog.FromContext(ctx).V(3).Info("Invalid delete snapshot request", "err", err)
+		return nil, err
 	}
+	snapshotID := req.GetSnapshotId()
 
-	return &csi.CreateVolumeResponse{
-		Volume: &csi.Volume{
-			VolumeId: volumeID,
-			CapacityBytes: req.GetCapacityRange().GetRequiredBytes(),
-			VolumeContext: req.GetParameters(),
-			ContentSource:  req.GetVolumeContentSource(),
-			AccessibleTopology: topologies,
+	if hp.distributed() {
+		return hp.deleteRemoteSnapshot(ctx, req)
+	}
+
+	// 在操作全局status是.需要先加锁
+	unlock := hp.lockState(ctx)
+	defer unlock()
+
+	snapshot, err := hp.state.GetSnapshotByID(snapshotID)
+	if err != nil {
+		// 如果找不到快照.直接返回ok
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+	// 属于组快照的快照不允许单独删除
+	if snapshot.GroupSnapshotID != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Snapshot with ID %s is part of groupsnapshot %s", snapshotID, snapshot.GroupSnapshotID)
+	}
+
+	// 正在创建的快照会被取消. 仍有从快照恢复的卷时按照删除策略处理
+	if err := hp.removeSnapshot(ctx, snapshot); err != nil {
+		return nil, err
+	}
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+func (hp *hostpath) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID cannot be empty")
+	}
+	if len(req.VolumeCapabilities) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume capabilities cannot be empty")
+	}
+
+	// 分布式控制器由卷所在节点的代理检查能力
+	if hp.distributed() {
+		return hp.validateRemoteVolumeCapabilities(ctx, req)
+	}
+
+	// 在操作全局status是.需要先加锁
+	unlock := hp.lockState(ctx)
+	defer unlock()
+
+	vol, err := hp.state.GetVolumeByID(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+
+	// 不支持的能力不是错误, 在 Message 中说明原因
+	if err := hp.validateVolumeCapabilities(req.GetVolumeCapabilities(), &vol); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+	}
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: req.GetVolumeCapabilities(),
+			Parameters:         req.GetParameters(),
 		},
 	}, nil
 }
 
+func (hp *hostpath) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	if err := hp.validateControllerServiceRequest(csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME); err != nil {
+		return nil, err
+	}
+
+	if len(req.VolumeId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID cannot be empty")
+	}
+	if len(req.NodeId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Node ID cannot be empty")
+	}
+	if req.VolumeCapability == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities cannot be empty")
+	}
+
+	// 分布式控制器由卷所在节点的代理 attach
+	if hp.distributed() {
+		return hp.publishRemoteVolume(ctx, req)
+	}
+
+	if req.NodeId != hp.config.NodeID {
+		return nil, status.Errorf(codes.NotFound, "Not matching Node ID %s to hostpath Node ID %s", req.NodeId, hp.config.NodeID)
+	}
+
+	// 在操作全局status是.需要先加锁
+	unlock := hp.lockState(ctx)
+	defer unlock()
+
+	vol, err := hp.state.GetVolumeByID(req.VolumeId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	if err := hp.validateVolumeCapabilities([]*csi.VolumeCapability{req.GetVolumeCapability()}, &vol); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// 卷已经 attach 时检查 readonly 是否一致
+	if vol.Attached {
+		if req.GetReadonly() != vol.ReadOnlyAttach {
+			return nil, status.Error(codes.AlreadyExists, "Volume published but has incompatible readonly flag")
+		}
+
+		return &csi.ControllerPublishVolumeResponse{
+			PublishContext: map[string]string{},
+		}, nil
+	}
+
+	// 检查节点上可 attach 的卷的数量
+	if hp.config.AttachLimit > 0 && hp.getAttachCount() >= hp.config.AttachLimit {
+		return nil, status.Errorf(codes.ResourceExhausted, "Cannot attach any more volumes to this node ('%s')", hp.config.NodeID)
+	}
+
+	vol.Attached = true
+	vol.ReadOnlyAttach = req.GetReadonly()
+	if err := hp.state.UpdateVolume(vol); err != nil {
+		return nil, err
+	}
+
+	return &csi.ControllerPublishVolumeResponse{
+		PublishContext: map[string]string{},
+	}, nil
+}
+
+func (hp *hostpath) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	if err := hp.validateControllerServiceRequest(csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME); err != nil {
+		return nil, err
+	}
+
+	if len(req.VolumeId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID cannot be empty")
+	}
+
+	if hp.distributed() {
+		return hp.unpublishRemoteVolume(ctx, req)
+	}
+
+	// 按照规范, 没有指定节点不是错误
+	if req.NodeId != "" && req.NodeId != hp.config.NodeID {
+		return nil, status.Errorf(codes.NotFound, "Node ID %s does not match to expected Node ID %s", req.NodeId, hp.config.NodeID)
+	}
+
+	// 在操作全局status是.需要先加锁
+	unlock := hp.lockState(ctx)
+	defer unlock()
+
+	vol, err := hp.state.GetVolumeByID(req.VolumeId)
+	if err != nil {
+		// 不存在的卷也没有被 attach
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+
+	// 卷仍然在节点上 stage 或 publish 时不能 detach
+	if !vol.Published.Empty() || !vol.Staged.Empty() {
+		msg := fmt.Sprintf("Volume '%s' is still used (staged: %v, published: %v) by '%s' node",
+			vol.VolID, vol.Staged, vol.Published, hp.config.NodeID)
+		if hp.config.CheckVolumeLifecycle {
+			return nil, status.Error(codes.Internal, msg)
+		}
+		klog.FromContext(ctx).Error(nil, msg)
+	}
+
+	vol.Attached = false
+	if err := hp.state.UpdateVolume(vol); err != nil {
+		return nil, err
+	}
+
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+func (hp *hostpath) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	if err := hp.validateControllerServiceRequest(csi.ControllerServiceCapability_RPC_GET_CAPACITY); err != nil {
+		klog.FromContext(ctx).V(3).Info("Invalid get capacity request", "err", err)
+		return nil, err
+	}
+
+	if hp.distributed() {
+		return hp.getRemoteCapacity(ctx, req)
+	}
+
+	// 在操作全局status是.需要先加锁
+	unlock := hp.lockState(ctx)
+	defer unlock()
+
+	// 容量属于这个节点, 节点不属于请求的拓扑时容量为零
+	if topology := req.GetAccessibleTopology(); topology != nil && !topologyMatches(topology, hp.topology) {
+		return &csi.GetCapacityResponse{
+			AvailableCapacity: 0,
+			MaximumVolumeSize: wrapperspb.Int64(0),
+		}, nil
+	}
+
+	// 卷的能力与容量无关, 只根据 "kind" 参数区分.
+	// 没有配置容量时, 只有最大卷大小的限制
+	available := hp.config.MaxVolumeSize
+	if hp.config.Capacity.Enabled() {
+		// 没有指定 "kind" 时容量为零
+		kind := req.GetParameters()[storageKind]
+		capacity := hp.config.Capacity[kind]
+		allocated := hp.sumVolumeSizes(kind)
+		available = capacity.Nominal() - allocated
+		// 实际分配的空间超过高水位时不再报告剩余容量
+		if available < 0 || hp.aboveHighWatermark(kind) {
+			available = 0
+		}
+	}
+	maxVolumeSize := hp.config.MaxVolumeSize
+	if maxVolumeSize > available {
+		maxVolumeSize = available
+	}
+
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: available,
+		MaximumVolumeSize: wrapperspb.Int64(maxVolumeSize),
+	}, nil
+}
+
+func (hp *hostpath) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	if err := hp.validateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS); err != nil {
+		klog.FromContext(ctx).V(3).Info("Invalid list snapshot request", "err", err)
+		return nil, err
+	}
+
+	// 在操作全局status是.需要先加锁
+	unlock := hp.lockState(ctx)
+	defer unlock()
+
+	// 按快照id查找, 找不到时返回空列表
+	if len(req.GetSnapshotId()) != 0 {
+		snapshot, err := hp.visibleSnapshot(req.GetSnapshotId())
+		if err != nil {
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		return &csi.ListSnapshotsResponse{
+			Entries: []*csi.ListSnapshotsResponse_Entry{{Snapshot: convertSnapshot(snapshot)}},
+		}, nil
+	}
+
+	// 按源卷id过滤, 没有设置时返回所有快照. 定时快照也包含在内
+	var snapshots []*csi.Snapshot
+	hpSnapshots := hp.state.GetSnapshots()
+	sort.Slice(hpSnapshots, func(i, j int) bool {
+		return hpSnapshots[i].Id < hpSnapshots[j].Id
+	})
+	for _, snapshot := range hpSnapshots {
+		if len(req.GetSourceVolumeId()) != 0 && snapshot.VolID != req.GetSourceVolumeId() {
+			continue
+		}
+		// 推迟删除的快照对 CO 不可见
+		if snapshot.DeletionDeferred {
+			continue
+		}
+		snapshots = append(snapshots, convertSnapshot(snapshot))
+	}
 
+	var (
+		ulenSnapshots = int32(len(snapshots))
+		maxEntries    = req.GetMaxEntries()
+		startingToken int32
+	)
 
+	if v := req.GetStartingToken(); v != "" {
+		i, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, status.Errorf(codes.Aborted, "startingToken=%s !< int32=%d", v, math.MaxUint32)
+		}
+		startingToken = int32(i)
+	}
+
+	if startingToken > ulenSnapshots {
+		return nil, status.Errorf(codes.Aborted, "startingToken=%d > len(snapshots)=%d", startingToken, ulenSnapshots)
+	}
+
+	// 如果 maxEntries 为 0 或大于剩余的数量, 则返回剩余的全部快照
+	rem := ulenSnapshots - startingToken
+	if maxEntries == 0 || maxEntries > rem {
+		maxEntries = rem
+	}
+
+	entries := make([]*csi.ListSnapshotsResponse_Entry, 0, maxEntries)
+	j := startingToken
+	for ; j < startingToken+maxEntries; j++ {
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{Snapshot: snapshots[j]})
+	}
+
+	var nextToken string
+	if j < ulenSnapshots {
+		nextToken = fmt.Sprintf("%d", j)
+	}
+
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+// ControllerModifyVolume 应用 VolumeAttributesClass 中可以修改的参数, 例如定时快照
+func (hp *hostpath) ControllerModifyVolume(ctx context.Context, req *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
+	if err := hp.validateControllerServiceRequest(csi.ControllerServiceCapability_RPC_MODIFY_VOLUME); err != nil {
+		klog.FromContext(ctx).V(3).Info("Invalid modify volume request", "err", err)
+		return nil, err
+	}
+
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetMutableParameters()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Mutable parameters missing in request")
+	}
+	if err := hp.validateVolumeMutableParameters(req.GetMutableParameters()); err != nil {
+		return nil, err
+	}
+
+	if hp.distributed() {
+		return hp.modifyRemoteVolume(ctx, req)
+	}
+
+	// 在操作全局status是.需要先加锁
+	unlock := hp.lockState(ctx)
+	defer unlock()
+
+	vol, err := hp.visibleVolume(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	params := req.GetMutableParameters()
+	if schedule, ok := params[snapshotSchedule]; ok {
+		vol.SnapshotSchedule = schedule
+	}
+	if retention, ok := params[snapshotRetain]; ok {
+		vol.SnapshotRetention = retention
+	}
+	if vol.SnapshotSchedule == "" && vol.SnapshotRetention != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "%s requires %s", snapshotRetain, snapshotSchedule)
+	}
+	if err := hp.state.UpdateVolume(vol); err != nil {
+		return nil, err
+	}
+	klog.FromContext(ctx).V(4).Info("Modified volume", "volumeID", vol.VolID, "parameters", params)
+	return &csi.ControllerModifyVolumeResponse{}, nil
+}
+
+// getAttachCount 返回已经 attach 到节点上的卷的数量
+func (hp *hostpath) getAttachCount() int64 {
+	count := int64(0)
+	for _, vol := range hp.state.GetVolumes() {
+		if vol.Attached {
+			count++
+		}
+	}
+	return count
+}
+
+func convertSnapshot(snapshot state.Snapshot) *csi.Snapshot {
+	// 正在创建的快照的大小是已经写入的字节数, 重复的 CreateSnapshot 和 ListSnapshots 通过它报告进度.
+	// 分布式模式下控制器上的快照记录没有本地文件
+	size := snapshot.SizeBytes
+	if !snapshot.ReadyToUse && snapshot.Path != "" {
+		size = snapshotProgress(snapshot)
+	}
+	return &csi.Snapshot{
+		SnapshotId:      snapshot.Id,
+		SourceVolumeId:  snapshot.VolID,
+		CreationTime:    snapshot.CreationTime,
+		SizeBytes:       size,
+		ReadyToUse:      snapshot.ReadyToUse,
+		GroupSnapshotId: snapshot.GroupSnapshotID,
+	}
+}
 
 // validateVolumeMutableParameters is a helper function to check if the mutable parameters are in the accepted list
 func (hp *hostpath) validateVolumeMutableParameters(params map[string]string) error {
-	if len(hp.config.AcceptedMutableParameterNames) == 0 {
-		return nil
+	// 只有注册为可以修改的参数才能出现在 VolumeAttributesClass 中
+	if err := volumeParameters.validate(hp, params, true); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
 	}
 
+	// 列表可以被 ReloadConfig 修改
+	hp.mutex.Lock()
 	accepts := sets.New(hp.config.AcceptedMutableParameterNames...)
+	hp.mutex.Unlock()
+	if accepts.Len() == 0 {
+		return nil
+	}
+
 	unsupported := []string{}
 	for k := range params {
 		if !accepts.Has(k) {
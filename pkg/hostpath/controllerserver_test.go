@@ -0,0 +1,152 @@
+package hostpath
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCreateVolumeIdempotency(t *testing.T) {
+	hp := newTestDriver(t, func(cfg *Config) {
+		cfg.EnableTopology = true
+	})
+	ctx := context.Background()
+
+	request := func() *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name:               "vol",
+			VolumeCapabilities: []*csi.VolumeCapability{mountCapability("noatime")},
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: mib},
+			Parameters:         map[string]string{provisioning: provisioningThick},
+		}
+	}
+	resp, err := hp.CreateVolume(ctx, request())
+	require.NoError(t, err)
+	volume := resp.GetVolume()
+	require.Equal(t, map[string]string{provisioning: provisioningThick}, volume.GetVolumeContext())
+
+	// 相同的请求返回保存的卷
+	retry := request()
+	retry.CapacityRange = &csi.CapacityRange{RequiredBytes: kib}
+	retry.AccessibilityRequirements = &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{{Segments: map[string]string{TopologyKeyNode: "node"}}},
+	}
+	resp, err = hp.CreateVolume(ctx, retry)
+	require.NoError(t, err)
+	require.Equal(t, volume.String(), resp.GetVolume().String())
+
+	testcases := map[string]func(req *csi.CreateVolumeRequest){
+		"larger size": func(req *csi.CreateVolumeRequest) {
+			req.CapacityRange = &csi.CapacityRange{RequiredBytes: 2 * mib}
+		},
+		"smaller limit": func(req *csi.CreateVolumeRequest) {
+			req.CapacityRange = &csi.CapacityRange{LimitBytes: kib}
+		},
+		"different parameters": func(req *csi.CreateVolumeRequest) {
+			req.Parameters = nil
+		},
+		"different access type": func(req *csi.CreateVolumeRequest) {
+			req.VolumeCapabilities = []*csi.VolumeCapability{blockCapability()}
+		},
+		"different access mode": func(req *csi.CreateVolumeRequest) {
+			req.VolumeCapabilities[0].AccessMode.Mode = csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY
+		},
+		"different mount flags": func(req *csi.CreateVolumeRequest) {
+			req.VolumeCapabilities = []*csi.VolumeCapability{mountCapability()}
+		},
+		"different topology": func(req *csi.CreateVolumeRequest) {
+			req.AccessibilityRequirements = &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{{Segments: map[string]string{TopologyKeyNode: "other-node"}}},
+			}
+		},
+		"different content source": func(req *csi.CreateVolumeRequest) {
+			req.VolumeContentSource = &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "other-volume"}},
+			}
+		},
+	}
+	for name, modify := range testcases {
+		t.Run(name, func(t *testing.T) {
+			req := request()
+			modify(req)
+			_, err := hp.CreateVolume(ctx, req)
+			require.Equal(t, codes.AlreadyExists, status.Code(err), "retry with %s: %v", name, err)
+		})
+	}
+	require.Len(t, hp.state.GetVolumes(), 1)
+
+	// 旧版本创建的卷没有保存参数和能力, 访问类型仍然必须相同
+	vol, err := hp.state.GetVolumeByID(volume.GetVolumeId())
+	require.NoError(t, err)
+	vol.Parameters, vol.Capabilities = nil, nil
+	require.NoError(t, hp.state.UpdateVolume(vol))
+	_, err = hp.CreateVolume(ctx, request())
+	require.NoError(t, err)
+	legacy := request()
+	legacy.VolumeCapabilities = []*csi.VolumeCapability{blockCapability()}
+	_, err = hp.CreateVolume(ctx, legacy)
+	require.Equal(t, codes.AlreadyExists, status.Code(err), "retry of a legacy volume with a different access type: %v", err)
+}
+
+func TestCopyFsTypeFromSource(t *testing.T) {
+	hp := newTestDriver(t, func(cfg *Config) {
+		cfg.BlockBackedMountVolumes = true
+	})
+	ctx := context.Background()
+
+	resp, err := hp.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "source",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: mib},
+	})
+	require.NoError(t, err)
+	volID := resp.GetVolume().GetVolumeId()
+	// 第一次 NodeStage 把卷格式化为 xfs
+	vol, err := hp.state.GetVolumeByID(volID)
+	require.NoError(t, err)
+	vol.FsType = "xfs"
+	require.NoError(t, hp.state.UpdateVolume(vol))
+
+	snap, err := hp.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snap", SourceVolumeId: volID})
+	require.NoError(t, err)
+	hp.snapshotWG.Wait()
+
+	withFsType := func(fsType string) *csi.VolumeCapability {
+		cap := mountCapability()
+		cap.GetMount().FsType = fsType
+		return cap
+	}
+	sources := map[string]*csi.VolumeContentSource{
+		"clone":   {Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: volID}}},
+		"restore": {Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snap.GetSnapshot().GetSnapshotId()}}},
+	}
+	for name, source := range sources {
+		t.Run(name, func(t *testing.T) {
+			resp, err := hp.CreateVolume(ctx, &csi.CreateVolumeRequest{
+				Name:                name,
+				VolumeCapabilities:  []*csi.VolumeCapability{mountCapability()},
+				CapacityRange:       &csi.CapacityRange{RequiredBytes: mib},
+				VolumeContentSource: source,
+			})
+			require.NoError(t, err)
+			vol, err := hp.state.GetVolumeByID(resp.GetVolume().GetVolumeId())
+			require.NoError(t, err)
+			require.Equal(t, "xfs", vol.FsType, "fsType of the copied filesystem")
+
+			// 复制的文件系统不能以其他 fsType 使用
+			_, err = hp.CreateVolume(ctx, &csi.CreateVolumeRequest{
+				Name:                name + "-ext4",
+				VolumeCapabilities:  []*csi.VolumeCapability{withFsType("ext4")},
+				CapacityRange:       &csi.CapacityRange{RequiredBytes: mib},
+				VolumeContentSource: source,
+			})
+			require.Equal(t, codes.InvalidArgument, status.Code(err), "different fsType: %v", err)
+			_, err = hp.state.GetVolumeByName(name + "-ext4")
+			require.Error(t, err, "failed volume is removed")
+		})
+	}
+}
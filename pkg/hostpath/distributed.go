@@ -0,0 +1,522 @@
+package hostpath
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bearcat-panda/csi-demo/pkg/agent"
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"k8s.io/klog/v2"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 每次调用节点代理都有超时时间, 无法访问的节点代理不会一直阻塞请求
+const (
+	// 查询节点信息和容量的超时时间
+	nodeAgentQueryTimeout = 10 * time.Second
+	// 节点代理创建, 删除卷和快照的超时时间. 从数据源创建卷时需要复制数据
+	nodeAgentTimeout = 2 * time.Minute
+)
+
+// nodeAgent 是分布式控制器与一个节点代理之间的连接
+type nodeAgent struct {
+	address string
+	client  agent.NodeAgentClient
+}
+
+func newNodeAgent(address string) (*nodeAgent, error) {
+	conn, err := grpc.NewClient(address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(injectTraceContext),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node agent %s: %v", address, err)
+	}
+	return &nodeAgent{address: address, client: agent.NewNodeAgentClient(conn)}, nil
+}
+
+// agentNode 是节点代理报告的节点信息
+type agentNode struct {
+	agent    *nodeAgent
+	nodeID   string
+	topology map[string]string
+}
+
+// distributed 判断驱动是否作为分布式控制器运行
+func (hp *hostpath) distributed() bool {
+	return len(hp.nodeAgents) > 0
+}
+
+// NewNodeAgentServer 返回提供节点代理 API 的 gRPC 服务器. 只有节点本地模式的驱动可以作为节点代理
+func (hp *hostpath) NewNodeAgentServer(opts ...grpc.ServerOption) (*grpc.Server, error) {
+	if hp.distributed() {
+		return nil, errors.New("a distributed controller cannot serve as node agent")
+	}
+	s := grpc.NewServer(opts...)
+	agent.RegisterNodeAgentServer(s, hp)
+	return s, nil
+}
+
+// nameLocks 串行执行对同一个名称的请求, 不同名称的请求可以同时调用节点代理
+type nameLocks struct {
+	mutex sync.Mutex
+	locks map[string]*nameLock
+}
+
+type nameLock struct {
+	sync.Mutex
+	// 持有或者等待这个锁的请求数量, 为 0 时从 locks 中删除
+	refs int
+}
+
+func newNameLocks() *nameLocks {
+	return &nameLocks{locks: map[string]*nameLock{}}
+}
+
+// lock 锁定名称, 返回释放锁的函数
+func (l *nameLocks) lock(name string) (unlock func()) {
+	l.mutex.Lock()
+	lock, ok := l.locks[name]
+	if !ok {
+		lock = &nameLock{}
+		l.locks[name] = lock
+	}
+	lock.refs++
+	l.mutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		if lock.refs--; lock.refs == 0 {
+			delete(l.locks, name)
+		}
+	}
+}
+
+// discoverNodes 查询所有节点代理的节点信息, 无法访问的节点代理会被跳过
+func (hp *hostpath) discoverNodes(ctx context.Context) []agentNode {
+	var nodes []agentNode
+	for _, a := range hp.nodeAgents {
+		callCtx, cancel := context.WithTimeout(ctx, nodeAgentQueryTimeout)
+		info, err := a.client.NodeGetInfo(callCtx, &csi.NodeGetInfoRequest{})
+		cancel()
+		if err != nil {
+			klog.FromContext(ctx).Error(err, "Skipping node agent", "address", a.address)
+			continue
+		}
+		topology := info.GetAccessibleTopology().GetSegments()
+		if topology == nil {
+			topology = map[string]string{TopologyKeyNode: info.GetNodeId()}
+		}
+		hp.agentMutex.Lock()
+		hp.agentNodes[info.GetNodeId()] = a
+		hp.agentMutex.Unlock()
+		nodes = append(nodes, agentNode{agent: a, nodeID: info.GetNodeId(), topology: topology})
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].nodeID < nodes[j].nodeID
+	})
+	return nodes
+}
+
+// agentForNode 返回节点的代理
+func (hp *hostpath) agentForNode(ctx context.Context, nodeID string) (*nodeAgent, error) {
+	lookup := func() (*nodeAgent, bool) {
+		hp.agentMutex.Lock()
+		defer hp.agentMutex.Unlock()
+		a, ok := hp.agentNodes[nodeID]
+		return a, ok
+	}
+	if a, ok := lookup(); ok {
+		return a, nil
+	}
+	hp.discoverNodes(ctx)
+	if a, ok := lookup(); ok {
+		return a, nil
+	}
+	return nil, status.Errorf(codes.Unavailable, "no node agent for node %s", nodeID)
+}
+
+// remoteVolume 返回控制器记录的卷. 只在读取状态时持有 hp.mutex
+func (hp *hostpath) remoteVolume(ctx context.Context, volID string) (state.Volume, error) {
+	unlock := hp.lockState(ctx)
+	defer unlock()
+	return hp.state.GetVolumeByID(volID)
+}
+
+// remoteSnapshot 返回控制器记录的快照. 只在读取状态时持有 hp.mutex
+func (hp *hostpath) remoteSnapshot(ctx context.Context, snapshotID string) (state.Snapshot, error) {
+	unlock := hp.lockState(ctx)
+	defer unlock()
+	return hp.state.GetSnapshotByID(snapshotID)
+}
+
+// sourceNode 返回卷的数据源所在的节点, 没有数据源时返回空字符串
+func (hp *hostpath) sourceNode(ctx context.Context, req *csi.CreateVolumeRequest) (string, error) {
+	switch source := req.GetVolumeContentSource(); source.GetType().(type) {
+	case *csi.VolumeContentSource_Snapshot:
+		snapshot, err := hp.remoteSnapshot(ctx, source.GetSnapshot().GetSnapshotId())
+		if err != nil {
+			return "", err
+		}
+		return snapshot.NodeID, nil
+	case *csi.VolumeContentSource_Volume:
+		vol, err := hp.remoteVolume(ctx, source.GetVolume().GetVolumeId())
+		if err != nil {
+			return "", err
+		}
+		return vol.NodeID, nil
+	}
+	return "", nil
+}
+
+// pickNode 选择创建卷的节点. 节点必须满足 requisite 拓扑并且有足够的容量,
+// 从快照或卷创建时必须是数据源所在的节点。优先选择 preferred 中靠前的拓扑中的节点,
+// 否则选择剩余容量最多的节点。
+func (hp *hostpath) pickNode(ctx context.Context, req *csi.CreateVolumeRequest) (agentNode, error) {
+	logger := klog.FromContext(ctx)
+	sourceNode, err := hp.sourceNode(ctx, req)
+	if err != nil {
+		return agentNode{}, err
+	}
+
+	type candidate struct {
+		agentNode
+		available int64
+	}
+	var candidates []candidate
+	required := req.GetCapacityRange().GetRequiredBytes()
+	requisite := req.GetAccessibilityRequirements().GetRequisite()
+	for _, node := range hp.discoverNodes(ctx) {
+		if sourceNode != "" && node.nodeID != sourceNode {
+			continue
+		}
+		if len(requisite) > 0 && !matchesAnyTopology(requisite, node.topology) {
+			continue
+		}
+		capacity, err := hp.nodeCapacity(ctx, node, req.GetVolumeCapabilities(), req.GetParameters())
+		if err != nil {
+			logger.Error(err, "Skipping node, failed to get capacity", "node", node.nodeID)
+			continue
+		}
+		if capacity.GetAvailableCapacity() < required ||
+			(capacity.GetMaximumVolumeSize() != nil && capacity.GetMaximumVolumeSize().GetValue() < required) {
+			logger.V(4).Info("Skipping node with insufficient capacity", "node", node.nodeID, "availableBytes", capacity.GetAvailableCapacity())
+			continue
+		}
+		candidates = append(candidates, candidate{agentNode: node, available: capacity.GetAvailableCapacity()})
+	}
+	if len(candidates) == 0 {
+		if sourceNode != "" {
+			return agentNode{}, status.Errorf(codes.ResourceExhausted, "node %s of the volume content source does not satisfy the topology requirements or has not enough capacity", sourceNode)
+		}
+		return agentNode{}, status.Errorf(codes.ResourceExhausted, "no node with %d bytes of capacity satisfies the topology requirements", required)
+	}
+
+	for _, topology := range req.GetAccessibilityRequirements().GetPreferred() {
+		for _, c := range candidates {
+			if topologyMatches(topology, c.topology) {
+				return c.agentNode, nil
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].available > candidates[j].available
+	})
+	return candidates[0].agentNode, nil
+}
+
+// nodeCapacity 返回节点的剩余容量
+func (hp *hostpath) nodeCapacity(ctx context.Context, node agentNode, caps []*csi.VolumeCapability, params map[string]string) (*csi.GetCapacityResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, nodeAgentQueryTimeout)
+	defer cancel()
+	return node.agent.client.GetCapacity(ctx, &csi.GetCapacityRequest{
+		VolumeCapabilities: caps,
+		Parameters:         params,
+		AccessibleTopology: &csi.Topology{Segments: node.topology},
+	})
+}
+
+// createRemoteVolume 在选择的节点上创建卷, 并记录卷所在的节点和请求的参数和能力。
+// 重复的请求转发给原来的节点, 由节点检查请求是否与已经存在的卷一致。
+// 同名的请求串行执行, 调用节点代理时不持有 hp.mutex。
+func (hp *hostpath) createRemoteVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	logger := klog.FromContext(ctx)
+	unlockName := hp.remoteNames.lock(volumeLockName(req.GetName()))
+	defer unlockName()
+
+	unlock := hp.lockState(ctx)
+	exVol, err := hp.state.GetVolumeByName(req.GetName())
+	unlock()
+	if err == nil {
+		a, err := hp.agentForNode(ctx, exVol.NodeID)
+		if err != nil {
+			return nil, err
+		}
+		callCtx, cancel := context.WithTimeout(ctx, nodeAgentTimeout)
+		defer cancel()
+		return a.client.CreateVolume(callCtx, req)
+	}
+
+	node, err := hp.pickNode(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	logger.V(4).Info("Creating volume on node", "name", req.GetName(), "node", node.nodeID)
+	callCtx, cancel := context.WithTimeout(ctx, nodeAgentTimeout)
+	defer cancel()
+	resp, err := node.agent.client.CreateVolume(callCtx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// 记录卷的访问类型, 能力和参数. attach 和能力检查仍然由节点代理完成
+	accessType := state.MountAccess
+	if req.GetVolumeCapabilities()[0].GetBlock() != nil {
+		accessType = state.BlockAccess
+	}
+	vol := state.Volume{
+		VolID:         resp.GetVolume().GetVolumeId(),
+		VolName:       req.GetName(),
+		VolSize:       resp.GetVolume().GetCapacityBytes(),
+		VolAccessType: accessType,
+		NodeID:        node.nodeID,
+		Remote:        true,
+		Parameters:    req.GetParameters(),
+		Capabilities:  convertCapabilities(req.GetVolumeCapabilities()),
+		ParentSnapID:  req.GetVolumeContentSource().GetSnapshot().GetSnapshotId(),
+		ParentVolID:   req.GetVolumeContentSource().GetVolume().GetVolumeId(),
+	}
+	for _, topology := range resp.GetVolume().GetAccessibleTopology() {
+		vol.AccessibleTopology = append(vol.AccessibleTopology, topology.GetSegments())
+	}
+	unlock = hp.lockState(ctx)
+	defer unlock()
+	if err := hp.state.UpdateVolume(vol); err != nil {
+		return nil, err
+	}
+	logger.V(4).Info("Created volume on node", "volumeID", vol.VolID, "node", vol.NodeID)
+	return resp, nil
+}
+
+// volumeLockName 和 snapshotLockName 返回串行执行请求使用的名称, 卷和快照可以同名
+func volumeLockName(name string) string {
+	return "volume/" + name
+}
+
+func snapshotLockName(name string) string {
+	return "snapshot/" + name
+}
+
+// deleteRemoteVolume 在卷所在的节点上删除卷
+func (hp *hostpath) deleteRemoteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	vol, err := hp.remoteVolume(ctx, req.GetVolumeId())
+	if err != nil {
+		// 卷不存在时可能已经被删除了
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+	unlockName := hp.remoteNames.lock(volumeLockName(vol.VolName))
+	defer unlockName()
+	// 等待同名的请求期间卷可能已经被删除了
+	if vol, err = hp.remoteVolume(ctx, req.GetVolumeId()); err != nil {
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	a, err := hp.agentForNode(ctx, vol.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	callCtx, cancel := context.WithTimeout(ctx, nodeAgentTimeout)
+	defer cancel()
+	if _, err := a.client.DeleteVolume(callCtx, req); err != nil {
+		return nil, err
+	}
+
+	unlock := hp.lockState(ctx)
+	defer unlock()
+	if err := hp.state.DeleteVolume(vol.VolID); err != nil {
+		return nil, err
+	}
+	klog.FromContext(ctx).V(4).Info("Deleted volume on node", "volumeID", vol.VolID, "node", vol.NodeID)
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+// modifyRemoteVolume 在卷所在的节点上修改卷
+func (hp *hostpath) modifyRemoteVolume(ctx context.Context, req *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
+	vol, err := hp.remoteVolume(ctx, req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	a, err := hp.agentForNode(ctx, vol.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	callCtx, cancel := context.WithTimeout(ctx, nodeAgentTimeout)
+	defer cancel()
+	return a.client.ControllerModifyVolume(callCtx, req)
+}
+
+// publishRemoteVolume 由卷所在节点的代理 attach 卷, 卷只能 attach 到这个节点
+func (hp *hostpath) publishRemoteVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	vol, err := hp.remoteVolume(ctx, req.GetVolumeId())
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if req.GetNodeId() != vol.NodeID {
+		return nil, status.Errorf(codes.NotFound, "volume %s is stored on node %s and cannot be published on node %s", vol.VolID, vol.NodeID, req.GetNodeId())
+	}
+	a, err := hp.agentForNode(ctx, vol.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	callCtx, cancel := context.WithTimeout(ctx, nodeAgentTimeout)
+	defer cancel()
+	return a.client.ControllerPublishVolume(callCtx, req)
+}
+
+// unpublishRemoteVolume 由卷所在节点的代理 detach 卷
+func (hp *hostpath) unpublishRemoteVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	vol, err := hp.remoteVolume(ctx, req.GetVolumeId())
+	if err != nil {
+		// 不存在的卷也没有被 attach
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	if req.GetNodeId() != "" && req.GetNodeId() != vol.NodeID {
+		return nil, status.Errorf(codes.NotFound, "volume %s is stored on node %s, not on node %s", vol.VolID, vol.NodeID, req.GetNodeId())
+	}
+	a, err := hp.agentForNode(ctx, vol.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	callCtx, cancel := context.WithTimeout(ctx, nodeAgentTimeout)
+	defer cancel()
+	return a.client.ControllerUnpublishVolume(callCtx, req)
+}
+
+// validateRemoteVolumeCapabilities 由卷所在节点的代理检查能力, 节点上的卷记录了文件系统等信息
+func (hp *hostpath) validateRemoteVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	vol, err := hp.remoteVolume(ctx, req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	a, err := hp.agentForNode(ctx, vol.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	callCtx, cancel := context.WithTimeout(ctx, nodeAgentQueryTimeout)
+	defer cancel()
+	return a.client.ValidateVolumeCapabilities(callCtx, req)
+}
+
+// createRemoteSnapshot 在源卷所在的节点上创建快照, 并记录快照所在的节点
+func (hp *hostpath) createRemoteSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	unlockName := hp.remoteNames.lock(snapshotLockName(req.GetName()))
+	defer unlockName()
+
+	unlock := hp.lockState(ctx)
+	nodeID := ""
+	if exSnap, err := hp.state.GetSnapshotByName(req.GetName()); err == nil {
+		nodeID = exSnap.NodeID
+	} else {
+		vol, err := hp.state.GetVolumeByID(req.GetSourceVolumeId())
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		nodeID = vol.NodeID
+	}
+	unlock()
+
+	a, err := hp.agentForNode(ctx, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	callCtx, cancel := context.WithTimeout(ctx, nodeAgentTimeout)
+	defer cancel()
+	resp, err := a.client.CreateSnapshot(callCtx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := resp.GetSnapshot()
+	unlock = hp.lockState(ctx)
+	defer unlock()
+	if err := hp.state.UpdateSnapshot(state.Snapshot{
+		Name:         req.GetName(),
+		Id:           snapshot.GetSnapshotId(),
+		VolID:        snapshot.GetSourceVolumeId(),
+		CreationTime: snapshot.GetCreationTime(),
+		SizeBytes:    snapshot.GetSizeBytes(),
+		ReadyToUse:   snapshot.GetReadyToUse(),
+		NodeID:       nodeID,
+		Remote:       true,
+	}); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// deleteRemoteSnapshot 在快照所在的节点上删除快照
+func (hp *hostpath) deleteRemoteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	snapshot, err := hp.remoteSnapshot(ctx, req.GetSnapshotId())
+	if err != nil {
+		// 如果找不到快照.直接返回ok
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+	unlockName := hp.remoteNames.lock(snapshotLockName(snapshot.Name))
+	defer unlockName()
+	if snapshot, err = hp.remoteSnapshot(ctx, req.GetSnapshotId()); err != nil {
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	a, err := hp.agentForNode(ctx, snapshot.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	callCtx, cancel := context.WithTimeout(ctx, nodeAgentTimeout)
+	defer cancel()
+	if _, err := a.client.DeleteSnapshot(callCtx, req); err != nil {
+		return nil, err
+	}
+
+	unlock := hp.lockState(ctx)
+	defer unlock()
+	if err := hp.state.DeleteSnapshot(snapshot.Id); err != nil {
+		return nil, err
+	}
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+// getRemoteCapacity 返回属于请求的拓扑的所有节点的剩余容量之和, 以及其中最大的卷大小
+func (hp *hostpath) getRemoteCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	var available, maxVolumeSize int64
+	for _, node := range hp.discoverNodes(ctx) {
+		if topology := req.GetAccessibleTopology(); topology != nil && !topologyMatches(topology, node.topology) {
+			continue
+		}
+		capacity, err := hp.nodeCapacity(ctx, node, req.GetVolumeCapabilities(), req.GetParameters())
+		if err != nil {
+			klog.FromContext(ctx).Error(err, "Skipping node, failed to get capacity", "node", node.nodeID)
+			continue
+		}
+		available += capacity.GetAvailableCapacity()
+		if size := capacity.GetMaximumVolumeSize().GetValue(); size > maxVolumeSize {
+			maxVolumeSize = size
+		}
+	}
+
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: available,
+		MaximumVolumeSize: wrapperspb.Int64(maxVolumeSize),
+	}, nil
+}
@@ -0,0 +1,272 @@
+package hostpath
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bearcat-panda/csi-demo/pkg/agent"
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// startNodeAgent 启动一个节点本地模式的驱动, 并在随机端口上提供节点代理 API
+func startNodeAgent(t *testing.T, nodeID, zone string, size string) (*hostpath, string) {
+	hp := newTestDriver(t, func(cfg *Config) {
+		cfg.NodeID = nodeID
+		cfg.EnableTopology = true
+		cfg.EnableAttach = true
+		cfg.TopologySegments = Segments{zoneKey: zone}
+		cfg.Capacity = Capacity{"default": {Size: resource.MustParse(size)}}
+	})
+	t.Cleanup(hp.snapshotWG.Wait)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s, err := hp.NewNodeAgentServer()
+	require.NoError(t, err)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	return hp, lis.Addr().String()
+}
+
+func TestDistributedController(t *testing.T) {
+	node1, addr1 := startNodeAgent(t, "node-1", "zone-a", "10Mi")
+	node2, addr2 := startNodeAgent(t, "node-2", "zone-a", "20Mi")
+	node3, addr3 := startNodeAgent(t, "node-3", "zone-b", "10Mi")
+	nodes := map[string]*hostpath{"node-1": node1, "node-2": node2, "node-3": node3}
+
+	controller := newTestDriver(t, func(cfg *Config) {
+		cfg.NodeID = "controller"
+		cfg.EnableTopology = true
+		cfg.EnableAttach = true
+		cfg.NodeAgents = StringArray{addr1, addr2, addr3}
+	})
+	_, err := controller.NewNodeAgentServer()
+	require.Error(t, err, "controller cannot be a node agent")
+	ctx := context.Background()
+
+	zone := func(name string) *csi.Topology {
+		return &csi.Topology{Segments: map[string]string{zoneKey: name}}
+	}
+	create := func(name string, size int64, requirement *csi.TopologyRequirement, source *csi.VolumeContentSource) (*csi.Volume, error) {
+		resp, err := controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:                      name,
+			VolumeCapabilities:        []*csi.VolumeCapability{mountCapability()},
+			CapacityRange:             &csi.CapacityRange{RequiredBytes: size},
+			Parameters:                map[string]string{storageKind: "default"},
+			AccessibilityRequirements: requirement,
+			VolumeContentSource:       source,
+		})
+		return resp.GetVolume(), err
+	}
+	// requireNode 检查卷只存在于指定的节点上
+	requireNode := func(vol *csi.Volume, nodeID string) {
+		t.Helper()
+		require.Equal(t, nodeID, vol.GetAccessibleTopology()[0].GetSegments()[TopologyKeyNode])
+		for id, node := range nodes {
+			_, err := node.state.GetVolumeByID(vol.GetVolumeId())
+			if id == nodeID {
+				require.NoError(t, err, "volume on %s", id)
+			} else {
+				require.Error(t, err, "volume not on %s", id)
+			}
+		}
+		record, err := controller.state.GetVolumeByID(vol.GetVolumeId())
+		require.NoError(t, err)
+		require.Equal(t, nodeID, record.NodeID)
+		require.True(t, record.Remote)
+	}
+
+	// requisite 拓扑
+	vol1, err := create("vol-1", mib, &csi.TopologyRequirement{Requisite: []*csi.Topology{zone("zone-b")}}, nil)
+	require.NoError(t, err)
+	requireNode(vol1, "node-3")
+
+	// 剩余容量最多的节点
+	vol2, err := create("vol-2", mib, nil, nil)
+	require.NoError(t, err)
+	requireNode(vol2, "node-2")
+
+	// 重复的请求返回同一个卷
+	retry, err := create("vol-2", mib, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, vol2.GetVolumeId(), retry.GetVolumeId())
+	_, err = create("vol-2", 2*mib, nil, nil)
+	require.Equal(t, codes.AlreadyExists, status.Code(err), "retry with different size: %v", err)
+
+	// 控制器记录请求的能力和参数, 但是这些卷不占用控制器本地的容量
+	record, err := controller.state.GetVolumeByID(vol2.GetVolumeId())
+	require.NoError(t, err)
+	require.Equal(t, state.MountAccess, record.VolAccessType)
+	require.Equal(t, map[string]string{storageKind: "default"}, record.Parameters)
+	require.Len(t, record.Capabilities, 1)
+	require.Zero(t, controller.sumVolumeSizes(""))
+
+	// attach 和能力检查由卷所在节点的代理完成
+	_, err = controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: vol2.GetVolumeId(), NodeId: "node-1", VolumeCapability: mountCapability()})
+	require.Equal(t, codes.NotFound, status.Code(err), "publish on other node: %v", err)
+	_, err = controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: vol2.GetVolumeId(), NodeId: "node-2", VolumeCapability: mountCapability()})
+	require.NoError(t, err)
+	attached, err := node2.state.GetVolumeByID(vol2.GetVolumeId())
+	require.NoError(t, err)
+	require.True(t, attached.Attached)
+	validated, err := controller.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{VolumeId: vol2.GetVolumeId(), VolumeCapabilities: []*csi.VolumeCapability{blockCapability()}})
+	require.NoError(t, err)
+	require.Nil(t, validated.GetConfirmed(), "mount volume with block access type")
+	validated, err = controller.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{VolumeId: vol2.GetVolumeId(), VolumeCapabilities: []*csi.VolumeCapability{mountCapability()}})
+	require.NoError(t, err)
+	require.NotNil(t, validated.GetConfirmed())
+	_, err = controller.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: vol2.GetVolumeId(), NodeId: "node-2"})
+	require.NoError(t, err)
+	attached, err = node2.state.GetVolumeByID(vol2.GetVolumeId())
+	require.NoError(t, err)
+	require.False(t, attached.Attached)
+
+	// preferred 拓扑中容量足够的第一个节点
+	vol3, err := create("vol-3", 5*mib, &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{zone("zone-a"), zone("zone-b")},
+		Preferred: []*csi.Topology{zone("zone-b"), zone("zone-a")},
+	}, nil)
+	require.NoError(t, err)
+	requireNode(vol3, "node-3")
+	vol4, err := create("vol-4", 5*mib, &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{zone("zone-a"), zone("zone-b")},
+		Preferred: []*csi.Topology{zone("zone-b"), zone("zone-a")},
+	}, nil)
+	require.NoError(t, err)
+	requireNode(vol4, "node-1")
+
+	// 没有容量足够的节点
+	_, err = create("too-large", 30*mib, nil, nil)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err), "create too large volume: %v", err)
+
+	capacity, err := controller.GetCapacity(ctx, &csi.GetCapacityRequest{
+		Parameters:         map[string]string{storageKind: "default"},
+		AccessibleTopology: zone("zone-a"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, 10*mib-5*mib+20*mib-mib, capacity.GetAvailableCapacity())
+
+	// 快照保存在源卷所在的节点上, 从快照创建的卷也必须在这个节点上
+	snapResp, err := controller.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snap", SourceVolumeId: vol1.GetVolumeId()})
+	require.NoError(t, err)
+	snapshotID := snapResp.GetSnapshot().GetSnapshotId()
+	node3.snapshotWG.Wait()
+	_, err = node3.state.GetSnapshotByID(snapshotID)
+	require.NoError(t, err)
+
+	source := &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshotID}},
+	}
+	_, err = create("restore-zone-a", mib, &csi.TopologyRequirement{Requisite: []*csi.Topology{zone("zone-a")}}, source)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err), "restore in other zone: %v", err)
+	restored, err := create("restore", mib, nil, source)
+	require.NoError(t, err)
+	requireNode(restored, "node-3")
+
+	_, err = controller.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: snapshotID})
+	require.NoError(t, err)
+	_, err = node3.state.GetSnapshotByID(snapshotID)
+	require.Error(t, err)
+
+	for _, vol := range []*csi.Volume{vol1, vol2, vol3, vol4, restored} {
+		_, err := controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: vol.GetVolumeId()})
+		require.NoError(t, err)
+	}
+	for id, node := range nodes {
+		require.Empty(t, node.state.GetVolumes(), "volumes on %s", id)
+	}
+	require.Empty(t, controller.state.GetVolumes())
+}
+
+// blockingAgent 的 CreateVolume 一直阻塞到 context 被取消
+type blockingAgent struct {
+	agent.NodeAgentServer
+	started chan struct{}
+}
+
+func (a *blockingAgent) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	close(a.started)
+	<-ctx.Done()
+	return nil, status.FromContextError(ctx.Err()).Err()
+}
+
+func TestDistributedControllerSlowAgent(t *testing.T) {
+	node := newTestDriver(t, func(cfg *Config) {
+		cfg.NodeID = "slow"
+	})
+	slow := &blockingAgent{NodeAgentServer: node, started: make(chan struct{})}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := grpc.NewServer()
+	agent.RegisterNodeAgentServer(s, slow)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	controller := newTestDriver(t, func(cfg *Config) {
+		cfg.NodeID = "controller"
+		cfg.NodeAgents = StringArray{lis.Addr().String()}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	created := make(chan error)
+	go func() {
+		_, err := controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               "vol",
+			VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: mib},
+		})
+		created <- err
+	}()
+	<-slow.started
+
+	// 等待节点代理时不持有 hp.mutex, 其他请求不会被阻塞
+	_, err = controller.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{})
+	require.NoError(t, err)
+	_, err = controller.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "other"})
+	require.NoError(t, err)
+
+	cancel()
+	require.Equal(t, codes.Canceled, status.Code(<-created))
+}
+
+// TestPublishedVolumeCapacity 测试发布在本节点上的卷仍然占用本地的容量。需要 root 权限。
+func TestPublishedVolumeCapacity(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	hp := newTestDriver(t, func(cfg *Config) {
+		cfg.Capacity = Capacity{"default": {Size: resource.MustParse("10Mi")}}
+	})
+	ctx := context.Background()
+
+	resp, err := hp.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "vol",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 4 * mib},
+	})
+	require.NoError(t, err)
+	volID := resp.GetVolume().GetVolumeId()
+	target := filepath.Join(t.TempDir(), "target")
+	_, err = hp.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{VolumeId: volID, TargetPath: target, VolumeCapability: mountCapability()})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, err := hp.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: volID, TargetPath: target})
+		require.NoError(t, err)
+	})
+
+	vol, err := hp.state.GetVolumeByID(volID)
+	require.NoError(t, err)
+	require.False(t, vol.Remote)
+	available, err := hp.GetCapacity(ctx, &csi.GetCapacityRequest{Parameters: map[string]string{storageKind: "default"}})
+	require.NoError(t, err)
+	require.Equal(t, 6*mib, available.GetAvailableCapacity())
+}
@@ -0,0 +1,462 @@
+package hostpath
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+	"golang.org/x/crypto/pbkdf2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	utilexec "k8s.io/utils/exec"
+)
+
+const (
+	// CreateSnapshot 和 CreateVolume 的 secrets 中快照密钥的名称. 设置了密钥时快照被加密,
+	// 从快照恢复卷时需要同样的密钥。密钥id是可选的, 默认由密钥和随机的盐推导
+	snapshotEncryptionKeySecret   = "encryptionKey"
+	snapshotEncryptionKeyIDSecret = "encryptionKeyID"
+	// 密钥的最小长度
+	minSnapshotKeyLength = 16
+
+	// 密钥可能是一个密码, 所以用加盐的 PBKDF2-HMAC-SHA256 推导 AES 密钥
+	snapshotKeyIterations = 600000
+	snapshotKeySaltSize   = 16
+	// 推导出的密钥id的前缀, 之后是盐和只有知道密钥才能算出的校验值
+	derivedKeyIDPrefix = "pbkdf2:"
+
+	// 加密的快照文件以 magic, 块大小, 推导密钥的盐和 nonce 前缀开头, 之后是一个个独立加密的块。
+	// 每个块的 nonce 由前缀, 块的序号和是否是最后一块组成, 块的顺序被调换或者文件被截短都会被发现
+	encryptionMagic      = "HPSENC02"
+	encryptionChunkSize  = 64 << 10
+	noncePrefixSize      = 7
+	encryptionSaltStart  = len(encryptionMagic) + 4
+	encryptionNonceStart = encryptionSaltStart + snapshotKeySaltSize
+	encryptionHeaderLen  = encryptionNonceStart + noncePrefixSize
+	maxEncryptionChunk   = 16 << 20
+)
+
+// errSnapshotDecrypt 表示快照的某一块不能被解密
+var errSnapshotDecrypt = errors.New("cannot decrypt snapshot, the key is wrong or the snapshot file is corrupted")
+
+// snapshotKey 是加密快照的密钥. 每个快照文件记录推导 AES-256-GCM 密钥时使用的盐
+type snapshotKey struct {
+	id string
+	// 用户指定了 id
+	namedID bool
+	secret  []byte
+	// 加密新快照时使用的盐和由它推导的密钥
+	salt []byte
+	aead cipher.AEAD
+
+	mutex sync.Mutex
+	// 按盐缓存推导出的密钥, 解密用其他盐加密的快照时使用
+	derived map[string]*derivedKey
+}
+
+// derivedKey 是用一个盐由 secret 推导出的密钥
+type derivedKey struct {
+	aead cipher.AEAD
+	// 密钥id的校验值
+	check []byte
+}
+
+// newSnapshotKey 由 secret 和随机的盐推导密钥. id 为空时由盐和推导出的密钥生成,
+// 这样用错密钥时可以在解密之前发现, id 本身不会泄露密钥
+func newSnapshotKey(secret []byte, id string) (*snapshotKey, error) {
+	if len(secret) < minSnapshotKeyLength {
+		return nil, fmt.Errorf("snapshot encryption key must have at least %d bytes", minSnapshotKeyLength)
+	}
+	salt := make([]byte, snapshotKeySaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key := &snapshotKey{
+		id:      id,
+		namedID: id != "",
+		secret:  append([]byte{}, secret...),
+		salt:    salt,
+		derived: map[string]*derivedKey{},
+	}
+	derived, err := key.derive(salt)
+	if err != nil {
+		return nil, err
+	}
+	key.aead = derived.aead
+	if !key.namedID {
+		key.id = derivedKeyIDPrefix + hex.EncodeToString(salt) + ":" + hex.EncodeToString(derived.check)
+	}
+	return key, nil
+}
+
+// derive 用 salt 由密钥推导 AES-256-GCM 密钥和密钥id的校验值, 结果被缓存
+func (k *snapshotKey) derive(salt []byte) (*derivedKey, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if derived, ok := k.derived[string(salt)]; ok {
+		return derived, nil
+	}
+	master := pbkdf2.Key(k.secret, salt, snapshotKeyIterations, sha256.Size, sha256.New)
+	block, err := aes.NewCipher(expandKey(master, "hostpath snapshot encryption key"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	derived := &derivedKey{aead: aead, check: expandKey(master, "hostpath snapshot key id")[:8]}
+	k.derived[string(salt)] = derived
+	return derived, nil
+}
+
+// matches 返回快照的密钥id是否属于这个密钥. 推导出的id通过重新计算校验值检查
+func (k *snapshotKey) matches(id string) (bool, error) {
+	if k.namedID || !strings.HasPrefix(id, derivedKeyIDPrefix) {
+		return id == k.id, nil
+	}
+	salt, check, ok := strings.Cut(strings.TrimPrefix(id, derivedKeyIDPrefix), ":")
+	if !ok {
+		return false, nil
+	}
+	saltBytes, err := hex.DecodeString(salt)
+	if err != nil || len(saltBytes) != snapshotKeySaltSize {
+		return false, nil
+	}
+	checkBytes, err := hex.DecodeString(check)
+	if err != nil {
+		return false, nil
+	}
+	derived, err := k.derive(saltBytes)
+	if err != nil {
+		return false, err
+	}
+	return hmac.Equal(derived.check, checkBytes), nil
+}
+
+// expandKey 由推导出的密钥为不同的用途生成独立的子密钥
+func expandKey(master []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// loadSnapshotKeyFile 读取本地的快照密钥文件, 文件末尾的换行被忽略。path 为空时返回 nil
+func loadSnapshotKeyFile(path string) (*snapshotKey, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot key file: %w", err)
+	}
+	key, err := newSnapshotKey(bytes.TrimRight(data, "\r\n"), "")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+// snapshotKeyFor 返回 secrets 中的快照密钥, 没有时返回 SnapshotKeyFile 中的密钥。都没有时返回 nil
+func (hp *hostpath) snapshotKeyFor(secrets map[string]string) (*snapshotKey, error) {
+	secret, ok := secrets[snapshotEncryptionKeySecret]
+	if !ok {
+		return hp.snapshotKey, nil
+	}
+	key, err := newSnapshotKey([]byte(secret), secrets[snapshotEncryptionKeyIDSecret])
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid secret %s: %v", snapshotEncryptionKeySecret, err)
+	}
+	return key, nil
+}
+
+// decryptionKeyFor 返回解密快照需要的密钥, 快照没有加密时返回 nil。
+// 密钥不存在或者与加密快照时使用的密钥不同时返回错误
+func (hp *hostpath) decryptionKeyFor(snapshot state.Snapshot, secrets map[string]string) (*snapshotKey, error) {
+	if snapshot.EncryptionKeyID == "" {
+		return nil, nil
+	}
+	key, err := hp.snapshotKeyFor(secrets)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "snapshot %s is encrypted with key %s, the %s secret is required to restore it",
+			snapshot.Id, snapshot.EncryptionKeyID, snapshotEncryptionKeySecret)
+	}
+	matches, err := key.matches(snapshot.EncryptionKeyID)
+	if err != nil {
+		return nil, err
+	}
+	if !matches {
+		return nil, status.Errorf(codes.InvalidArgument, "snapshot %s is encrypted with key %s, but the %s secret is a different key",
+			snapshot.Id, snapshot.EncryptionKeyID, snapshotEncryptionKeySecret)
+	}
+	return key, nil
+}
+
+// encryptWriter 把写入的数据分块加密后写入 w. Close 写入最后一块, 但不关闭 w
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+	count  uint32
+	buf    []byte
+	out    []byte
+}
+
+func newEncryptWriter(w io.Writer, key *snapshotKey) (*encryptWriter, error) {
+	header := make([]byte, encryptionHeaderLen)
+	copy(header, encryptionMagic)
+	binary.BigEndian.PutUint32(header[len(encryptionMagic):], encryptionChunkSize)
+	copy(header[encryptionSaltStart:], key.salt)
+	if _, err := rand.Read(header[encryptionNonceStart:]); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		w:      w,
+		aead:   key.aead,
+		header: header,
+		nonce:  make([]byte, key.aead.NonceSize()),
+		buf:    make([]byte, 0, encryptionChunkSize),
+	}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// 缓冲区满了并且还有数据时, 缓冲区中的块不是最后一块
+		if len(e.buf) == cap(e.buf) {
+			if err := e.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) Close() error {
+	return e.flush(true)
+}
+
+func (e *encryptWriter) flush(final bool) error {
+	chunkNonce(e.nonce, e.header, e.count, final)
+	e.out = e.aead.Seal(e.out[:0], e.nonce, e.buf, e.header)
+	if _, err := e.w.Write(e.out); err != nil {
+		return err
+	}
+	e.buf = e.buf[:0]
+	e.count++
+	if e.count == 0 {
+		return errors.New("snapshot is too large to be encrypted")
+	}
+	return nil
+}
+
+// chunkNonce 生成第 count 块的 nonce
+func chunkNonce(nonce, header []byte, count uint32, final bool) {
+	copy(nonce, header[encryptionNonceStart:])
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], count)
+	nonce[len(nonce)-1] = 0
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+}
+
+// decryptReader 读取并验证 encryptWriter 写入的数据
+type decryptReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+	count  uint32
+	in     []byte
+	buf    []byte
+	done   bool
+	err    error
+}
+
+func newDecryptReader(r io.Reader, key *snapshotKey) (*decryptReader, error) {
+	header := make([]byte, encryptionHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, errors.New("snapshot file is not encrypted or corrupted")
+	}
+	chunkSize := binary.BigEndian.Uint32(header[len(encryptionMagic):])
+	if chunkSize == 0 || chunkSize > maxEncryptionChunk {
+		return nil, fmt.Errorf("invalid chunk size %d in encrypted snapshot", chunkSize)
+	}
+	derived, err := key.derive(header[encryptionSaltStart:encryptionNonceStart])
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		r:      bufio.NewReader(r),
+		aead:   derived.aead,
+		header: header,
+		nonce:  make([]byte, derived.aead.NonceSize()),
+		in:     make([]byte, int(chunkSize)+derived.aead.Overhead()),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+		d.err = d.readChunk()
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *decryptReader) readChunk() error {
+	n, err := io.ReadFull(d.r, d.in)
+	final := false
+	switch {
+	case err == io.ErrUnexpectedEOF:
+		final = true
+	case err == io.EOF:
+		// 缺少最后一块
+		return errSnapshotDecrypt
+	case err != nil:
+		return err
+	default:
+		// 大小正好是一整块时, 只有读到文件末尾才知道是不是最后一块
+		if _, err := d.r.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+	chunkNonce(d.nonce, d.header, d.count, final)
+	plain, err := d.aead.Open(d.in[:0], d.nonce, d.in[:n], d.header)
+	if err != nil {
+		return errSnapshotDecrypt
+	}
+	d.buf = plain
+	d.count++
+	d.done = final
+	return nil
+}
+
+// encryptFile 把从 r 读取的数据加密写入 dst
+func encryptFile(key *snapshotKey, r io.Reader, dst string) (finalerr error) {
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := out.Close(); err != nil && finalerr == nil {
+			finalerr = err
+		}
+	}()
+	w, err := newEncryptWriter(out, key)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// archiveEncrypted 把卷的数据加密保存到快照文件中: 块卷是原始镜像, mount 卷是 tar.gz
+func archiveEncrypted(ctx context.Context, key *snapshotKey, vol state.Volume, file string) error {
+	if isFileBacked(vol) {
+		in, err := os.Open(vol.VolPath)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		return encryptFile(key, in, file)
+	}
+
+	pr, pw := io.Pipe()
+	var stderr bytes.Buffer
+	cmd := utilexec.New().CommandContext(ctx, "tar", "--sparse", "-czf", "-", "-C", vol.VolPath, ".")
+	cmd.SetStdout(pw)
+	cmd.SetStderr(&stderr)
+	klog.V(4).Infof("Command Start: tar of %s, encrypted with key %s", vol.VolPath, key.id)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	waitErr := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		pw.CloseWithError(err)
+		waitErr <- err
+	}()
+	err := encryptFile(key, pr, file)
+	// 加密失败时 tar 因为管道被关闭而退出
+	pr.CloseWithError(err)
+	if tarErr := <-waitErr; tarErr != nil && err == nil {
+		err = tarErr
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, stderr.String())
+	}
+	return nil
+}
+
+// restoreEncrypted 解密快照并写入新卷, 返回写入的数据量. 块快照写入 destPath 时不截短文件, 块文件保持申请的大小
+func restoreEncrypted(ctx context.Context, key *snapshotKey, snapshot state.Snapshot, destPath string, raw bool) (int64, error) {
+	in, err := os.Open(snapshot.Path)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	r, err := newDecryptReader(in, key)
+	if err != nil {
+		return 0, err
+	}
+
+	if raw {
+		out, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE, 0600)
+		if err != nil {
+			return 0, err
+		}
+		defer out.Close()
+		n, err := io.Copy(out, r)
+		if err != nil {
+			return n, err
+		}
+		return n, out.Close()
+	}
+
+	n, err := extractArchive(ctx, r, destPath)
+	// 解压缩只看到输入中断, 解密的错误更能说明原因
+	if r.err != nil {
+		return n, r.err
+	}
+	return n, err
+}
@@ -0,0 +1,185 @@
+package hostpath
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestEncryptionStream(t *testing.T) {
+	key, err := newSnapshotKey([]byte("0123456789abcdef"), "")
+	require.NoError(t, err)
+	otherKey, err := newSnapshotKey([]byte("fedcba9876543210"), key.id)
+	require.NoError(t, err)
+
+	encrypt := func(t *testing.T, data []byte) []byte {
+		var buf bytes.Buffer
+		w, err := newEncryptWriter(&buf, key)
+		require.NoError(t, err)
+		_, err = w.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		return buf.Bytes()
+	}
+	decrypt := func(data []byte, key *snapshotKey) ([]byte, error) {
+		r, err := newDecryptReader(bytes.NewReader(data), key)
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(r)
+	}
+
+	for _, size := range []int{0, 1, encryptionChunkSize, encryptionChunkSize + 1, 3 * encryptionChunkSize} {
+		data := make([]byte, size)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+		encrypted := encrypt(t, data)
+		decrypted, err := decrypt(encrypted, key)
+		require.NoError(t, err, size)
+		require.Equal(t, data, append([]byte{}, decrypted...), size)
+	}
+
+	data := bytes.Repeat([]byte("secret"), encryptionChunkSize)
+	encrypted := encrypt(t, data)
+	require.NotContains(t, string(encrypted), "secret")
+	_, err = decrypt(encrypted, otherKey)
+	require.ErrorIs(t, err, errSnapshotDecrypt, "wrong key")
+
+	// 截短到整块的边界, 缺少最后一块
+	chunk := encryptionChunkSize + key.aead.Overhead()
+	_, err = decrypt(encrypted[:encryptionHeaderLen+2*chunk], key)
+	require.ErrorIs(t, err, errSnapshotDecrypt, "truncated")
+
+	tampered := append([]byte{}, encrypted...)
+	tampered[encryptionHeaderLen+chunk+10] ^= 1
+	_, err = decrypt(tampered, key)
+	require.ErrorIs(t, err, errSnapshotDecrypt, "tampered")
+
+	_, err = decrypt(data, key)
+	require.ErrorContains(t, err, "not encrypted")
+
+	// 密钥文件末尾的换行不属于密钥
+	keyFile := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(keyFile, []byte("0123456789abcdef\n"), 0600))
+	fileKey, err := loadSnapshotKeyFile(keyFile)
+	require.NoError(t, err)
+	matches, err := fileKey.matches(key.id)
+	require.NoError(t, err)
+	require.True(t, matches, "same key with a different salt")
+	decrypted, err := decrypt(encrypted, fileKey)
+	require.NoError(t, err)
+	require.Equal(t, data, decrypted)
+}
+
+func TestSnapshotKeyID(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	key, err := newSnapshotKey(secret, "")
+	require.NoError(t, err)
+	again, err := newSnapshotKey(secret, "")
+	require.NoError(t, err)
+	other, err := newSnapshotKey([]byte("fedcba9876543210"), "")
+	require.NoError(t, err)
+
+	// 推导出的id是加盐的, 相同的密钥也不会得到相同的id
+	require.Regexp(t, `^pbkdf2:[0-9a-f]{32}:[0-9a-f]{16}$`, key.id)
+	require.NotEqual(t, key.id, again.id)
+	for id, expected := range map[string]bool{
+		again.id:               true,
+		other.id:               false,
+		"pbkdf2:invalid":       false,
+		"my-key":               false,
+		key.id[:len(key.id)-1]: false,
+	} {
+		matches, err := key.matches(id)
+		require.NoError(t, err)
+		require.Equal(t, expected, matches, id)
+	}
+
+	named, err := newSnapshotKey(secret, "my-key")
+	require.NoError(t, err)
+	require.Equal(t, "my-key", named.id)
+	matches, err := named.matches(key.id)
+	require.NoError(t, err)
+	require.False(t, matches, "named key only matches its name")
+}
+
+func TestSnapshotEncryption(t *testing.T) {
+	hp := newTestDriver(t, nil)
+	ctx := context.Background()
+	secrets := map[string]string{snapshotEncryptionKeySecret: "correct horse battery staple"}
+
+	for _, capability := range []*csi.VolumeCapability{mountCapability(), blockCapability()} {
+		mode := "mount"
+		if capability.GetBlock() != nil {
+			mode = "block"
+		}
+		t.Run(mode, func(t *testing.T) {
+			src, err := hp.CreateVolume(ctx, &csi.CreateVolumeRequest{
+				Name:               "src-" + mode,
+				VolumeCapabilities: []*csi.VolumeCapability{capability},
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: mib},
+			})
+			require.NoError(t, err)
+			srcPath := hp.getVolumePath(src.GetVolume().GetVolumeId())
+			if mode == "mount" {
+				srcPath = filepath.Join(srcPath, "data")
+			}
+			require.NoError(t, os.WriteFile(srcPath, []byte("plain text"), 0644))
+
+			resp, err := hp.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+				Name:           "snap-" + mode,
+				SourceVolumeId: src.GetVolume().GetVolumeId(),
+				Secrets:        secrets,
+			})
+			require.NoError(t, err)
+			hp.snapshotWG.Wait()
+			snapshot, err := hp.state.GetSnapshotByID(resp.GetSnapshot().GetSnapshotId())
+			require.NoError(t, err)
+			require.True(t, snapshot.ReadyToUse)
+			require.Regexp(t, `^pbkdf2:[0-9a-f]{32}:[0-9a-f]{16}$`, snapshot.EncryptionKeyID)
+			data, err := os.ReadFile(snapshot.Path)
+			require.NoError(t, err)
+			require.True(t, bytes.HasPrefix(data, []byte(encryptionMagic)))
+
+			restore := func(name string, secrets map[string]string) (string, error) {
+				resp, err := hp.CreateVolume(ctx, &csi.CreateVolumeRequest{
+					Name:               name,
+					VolumeCapabilities: []*csi.VolumeCapability{capability},
+					CapacityRange:      &csi.CapacityRange{RequiredBytes: mib},
+					Secrets:            secrets,
+					VolumeContentSource: &csi.VolumeContentSource{
+						Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshot.Id}},
+					},
+				})
+				return hp.getVolumePath(resp.GetVolume().GetVolumeId()), err
+			}
+			_, err = restore("missing-"+mode, nil)
+			require.Equal(t, codes.InvalidArgument, status.Code(err))
+			require.ErrorContains(t, err, "the encryptionKey secret is required")
+			_, err = restore("wrong-"+mode, map[string]string{snapshotEncryptionKeySecret: "Tr0ub4dor&3 is not it"})
+			require.Equal(t, codes.InvalidArgument, status.Code(err))
+			require.ErrorContains(t, err, "is encrypted with key "+snapshot.EncryptionKeyID)
+
+			path, err := restore("restored-"+mode, secrets)
+			require.NoError(t, err)
+			if mode == "mount" {
+				path = filepath.Join(path, "data")
+			}
+			data, err = os.ReadFile(path)
+			require.NoError(t, err)
+			require.True(t, bytes.HasPrefix(data, []byte("plain text")))
+			if mode == "block" {
+				require.Len(t, data, int(mib), "block file keeps its size")
+			}
+		})
+	}
+}
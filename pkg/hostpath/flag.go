@@ -20,9 +20,11 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 // Capacity simulates linear storage of certain types ("fast",
@@ -30,37 +32,76 @@ import (
 // all currently existing volumes of the same kind is summed up.
 //
 // Available capacity is configurable with a command line flag
-// -capacity <type>=<size> where <type> is a string and <size>
-// is a quantity (1T, 1Gi). More than one of those
+// -capacity <type>=<size>[:<overcommit ratio>] where <type> is a
+// string, <size> is a quantity (1T, 1Gi) and the optional ratio is a
+// floating point number >= 1.0 (2.0 allows volumes with a total size
+// of twice the real capacity). More than one of those
 // flags can be used.
 //
 // The underlying map will be initialized if needed by Set,
 // which makes it possible to define and use a Capacity instance
 // without explicit initialization (`var capacity Capacity` or as
 // member in a struct).
-type Capacity map[string]resource.Quantity
+type Capacity map[string]KindCapacity
+
+// KindCapacity is the capacity of one storage kind.
+type KindCapacity struct {
+	// Size is the real amount of storage.
+	Size resource.Quantity
+	// OvercommitRatio is the factor by which the total size of
+	// all volumes may exceed Size. Zero is the same as 1.0, i.e.
+	// no overcommitment.
+	OvercommitRatio float64
+}
+
+// Nominal returns the total size that may be given out to volumes,
+// i.e. Size multiplied with the overcommit ratio.
+func (k KindCapacity) Nominal() int64 {
+	if k.OvercommitRatio <= 1 {
+		return k.Size.Value()
+	}
+	return int64(float64(k.Size.Value()) * k.OvercommitRatio)
+}
+
+func (k KindCapacity) String() string {
+	if k.OvercommitRatio <= 1 {
+		return k.Size.String()
+	}
+	return fmt.Sprintf("%s:%g", k.Size.String(), k.OvercommitRatio)
+}
 
 // Set is an implementation of flag.Value.Set.
 func (c *Capacity) Set(arg string) error {
 	parts := strings.SplitN(arg, "=", 2)
 	if len(parts) != 2 {
-		return errors.New("must be of format <type>=<size>")
+		return errors.New("must be of format <type>=<size>[:<overcommit ratio>]")
 	}
-	quantity, err := resource.ParseQuantity(parts[1])
+	size, ratio, hasRatio := strings.Cut(parts[1], ":")
+	quantity, err := resource.ParseQuantity(size)
 	if err != nil {
 		return err
 	}
+	capacity := KindCapacity{Size: quantity}
+	if hasRatio {
+		capacity.OvercommitRatio, err = strconv.ParseFloat(ratio, 64)
+		if err != nil {
+			return fmt.Errorf("invalid overcommit ratio %q: %v", ratio, err)
+		}
+		if capacity.OvercommitRatio < 1 {
+			return fmt.Errorf("invalid overcommit ratio %q: must be at least 1.0", ratio)
+		}
+	}
 
 	// We overwrite any previous value.
 	if *c == nil {
 		*c = Capacity{}
 	}
-	(*c)[parts[0]] = quantity
+	(*c)[parts[0]] = capacity
 	return nil
 }
 
 func (c *Capacity) String() string {
-	return fmt.Sprintf("%v", map[string]resource.Quantity(*c))
+	return fmt.Sprintf("%v", map[string]KindCapacity(*c))
 }
 
 var _ flag.Value = &Capacity{}
@@ -89,3 +130,66 @@ func (s *StringArray) String() string {
 }
 
 var _ flag.Value = &StringArray{}
+
+// Segments is a flag.Value implementation for topology segments
+// which are specified as comma-separated list of <key>=<value>
+// pairs on the command line. More than one of those flags can be
+// used. Keys and values must be valid Kubernetes label keys and
+// values.
+type Segments map[string]string
+
+// Set is an implementation of flag.Value.Set.
+func (s *Segments) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		key, val, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return fmt.Errorf("%q must be of format <key>=<value>", part)
+		}
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("invalid topology key %q: %s", key, strings.Join(errs, ", "))
+		}
+		if errs := validation.IsValidLabelValue(val); len(errs) > 0 {
+			return fmt.Errorf("invalid value %q for topology key %q: %s", val, key, strings.Join(errs, ", "))
+		}
+		if *s == nil {
+			*s = Segments{}
+		}
+		(*s)[key] = val
+	}
+	return nil
+}
+
+// String is an implementation of flag.Value.String.
+func (s *Segments) String() string {
+	return fmt.Sprintf("%v", map[string]string(*s))
+}
+
+var _ flag.Value = &Segments{}
+
+// Peers is a flag.Value implementation for the addresses of peer
+// drivers which are specified as comma-separated list of
+// <node id>=<address> pairs on the command line. More than one
+// of those flags can be used.
+type Peers map[string]string
+
+// Set is an implementation of flag.Value.Set.
+func (p *Peers) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		nodeID, address, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || nodeID == "" || address == "" {
+			return fmt.Errorf("%q must be of format <node id>=<address>", part)
+		}
+		if *p == nil {
+			*p = Peers{}
+		}
+		(*p)[nodeID] = address
+	}
+	return nil
+}
+
+// String is an implementation of flag.Value.String.
+func (p *Peers) String() string {
+	return fmt.Sprintf("%v", map[string]string(*p))
+}
+
+var _ flag.Value = &Peers{}
@@ -0,0 +1,53 @@
+package hostpath
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCapacity(t *testing.T) {
+	var c Capacity
+	require.False(t, c.Enabled())
+
+	require.NoError(t, c.Set("fast=100Gi:2.0"))
+	require.NoError(t, c.Set("slow=1Ti"))
+	require.True(t, c.Enabled())
+	require.Equal(t, 200*gib, c["fast"].Nominal())
+	require.Equal(t, tib, c["slow"].Nominal())
+	require.Equal(t, "100Gi:2", c["fast"].String())
+
+	for _, arg := range []string{"fast", "fast=x", "fast=1Gi:", "fast=1Gi:x", "fast=1Gi:0.5"} {
+		require.Error(t, c.Set(arg), arg)
+	}
+}
+
+func TestSegments(t *testing.T) {
+	var s Segments
+	require.NoError(t, s.Set("topology.kubernetes.io/zone=zone-a, example.com/rack=r1"))
+	require.NoError(t, s.Set("example.com/disk=ssd"))
+	require.Equal(t, Segments{
+		"topology.kubernetes.io/zone": "zone-a",
+		"example.com/rack":            "r1",
+		"example.com/disk":            "ssd",
+	}, s)
+
+	for _, arg := range []string{"zone", "=a", "zone=a b", "a/b/c=d"} {
+		require.Error(t, s.Set(arg), arg)
+	}
+}
+
+func TestPeers(t *testing.T) {
+	var p Peers
+	require.NoError(t, p.Set("node-1=10.0.0.1:9000, node-2=dns:///replica.example.com:9000"))
+	require.NoError(t, p.Set("node-3=unix:///run/replica.sock"))
+	require.Equal(t, Peers{
+		"node-1": "10.0.0.1:9000",
+		"node-2": "dns:///replica.example.com:9000",
+		"node-3": "unix:///run/replica.sock",
+	}, p)
+
+	for _, arg := range []string{"node", "=addr", "node="} {
+		require.Error(t, p.Set(arg), arg)
+	}
+}
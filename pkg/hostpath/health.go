@@ -0,0 +1,255 @@
+package hostpath
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 默认缓存健康检查结果的时间
+	defaultHealthCheckTTL = 10 * time.Second
+	// StateDir 所在的文件系统默认至少需要的可用空间
+	defaultHealthMinFreeBytes = 100 * mib
+	// 健康检查的 HTTP 路径
+	healthzPath = "/healthz"
+)
+
+// healthCheck 检查驱动依赖的一项资源, 返回 nil 表示正常
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// healthResult 是一次健康检查的结果
+type healthResult struct {
+	name string
+	err  error
+}
+
+// health 保存注册的健康检查和最近一次检查的结果
+type health struct {
+	ttl time.Duration
+
+	mutex     sync.Mutex
+	checks    []healthCheck
+	results   []healthResult
+	checkedAt time.Time
+	// 启动时的状态恢复完成之前驱动没有就绪
+	ready bool
+}
+
+// registerHealthCheck 注册一个在 Probe 和 /healthz 中执行的健康检查
+func (hp *hostpath) registerHealthCheck(name string, check func(ctx context.Context) error) {
+	hp.health.mutex.Lock()
+	defer hp.health.mutex.Unlock()
+	hp.health.checks = append(hp.health.checks, healthCheck{name: name, check: check})
+	hp.health.checkedAt = time.Time{}
+}
+
+// registerDefaultHealthChecks 注册驱动内置的健康检查
+func (hp *hostpath) registerDefaultHealthChecks() {
+	hp.registerHealthCheck("stateDir", hp.checkStateDirWritable)
+	hp.registerHealthCheck("state", hp.checkStateRoundTrip)
+	hp.registerHealthCheck("diskSpace", hp.checkFreeSpace)
+	hp.registerHealthCheck("tools", hp.checkTools)
+}
+
+// setReady 设置启动时的状态恢复是否已经完成
+func (hp *hostpath) setReady(ready bool) {
+	hp.health.mutex.Lock()
+	defer hp.health.mutex.Unlock()
+	hp.health.ready = ready
+}
+
+// checkHealth 返回驱动是否就绪, 以及所有健康检查的结果。结果在 TTL 内被缓存
+func (hp *hostpath) checkHealth(ctx context.Context) (bool, []healthResult) {
+	hp.health.mutex.Lock()
+	defer hp.health.mutex.Unlock()
+	if !hp.health.ready {
+		return false, nil
+	}
+	if !hp.health.checkedAt.IsZero() && time.Since(hp.health.checkedAt) < hp.health.ttl {
+		return true, hp.health.results
+	}
+	results := make([]healthResult, 0, len(hp.health.checks))
+	for _, c := range hp.health.checks {
+		results = append(results, healthResult{name: c.name, err: c.check(ctx)})
+	}
+	hp.health.results = results
+	hp.health.checkedAt = time.Now()
+	return true, results
+}
+
+// healthError 把失败的健康检查合并为一个错误, 全部正常时返回 nil
+func healthError(results []healthResult) error {
+	var failed []string
+	for _, r := range results {
+		if r.err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", r.name, r.err))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(failed, "; "))
+}
+
+// checkStateDirWritable 检查 StateDir 是否可以写入
+func (hp *hostpath) checkStateDirWritable(ctx context.Context) error {
+	f, err := os.CreateTemp(hp.config.StateDir, ".healthz-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("ok"); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// checkStateRoundTrip 在 StateDir 中保存并重新读取一个临时的状态文件, 并检查驱动的状态文件是否可以读取。
+// 状态文件总是被整体替换, 所以读取时不需要持有 hp.mutex
+func (hp *hostpath) checkStateRoundTrip(ctx context.Context) error {
+	path := filepath.Join(hp.config.StateDir, ".healthz-state.json")
+	defer os.Remove(path)
+	s, err := state.New(path)
+	if err != nil {
+		return err
+	}
+	probe := state.Volume{VolID: "healthz", VolName: "healthz", VolSize: time.Now().UnixNano()}
+	if err := s.UpdateVolume(probe); err != nil {
+		return err
+	}
+	if s, err = state.New(path); err != nil {
+		return err
+	}
+	vol, err := s.GetVolumeByID(probe.VolID)
+	if err != nil {
+		return err
+	}
+	if vol.VolSize != probe.VolSize {
+		return fmt.Errorf("read back volume size %d, expected %d", vol.VolSize, probe.VolSize)
+	}
+	_, err = state.New(hp.statePath())
+	return err
+}
+
+// checkFreeSpace 检查 StateDir 所在的文件系统的可用空间是否高于阈值
+func (hp *hostpath) checkFreeSpace(ctx context.Context) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(hp.config.StateDir, &st); err != nil {
+		return err
+	}
+	free := int64(st.Bavail) * st.Bsize
+	if free < hp.minFreeBytes() {
+		return fmt.Errorf("%s available, need at least %s",
+			resource.NewQuantity(free, resource.BinarySI).String(), resource.NewQuantity(hp.minFreeBytes(), resource.BinarySI).String())
+	}
+	return nil
+}
+
+func (hp *hostpath) minFreeBytes() int64 {
+	if hp.config.HealthMinFreeBytes > 0 {
+		return hp.config.HealthMinFreeBytes
+	}
+	return defaultHealthMinFreeBytes
+}
+
+// checkTools 检查按配置和已有的卷需要的命令和设备是否存在
+func (hp *hostpath) checkTools(ctx context.Context) error {
+	// 快照
+	binaries := []string{"tar"}
+	if hp.config.BlockBackedMountVolumes || hp.config.MountVolumeQuota == QuotaLoop {
+		binaries = append(binaries, "mkfs."+loopImageFsType, "blkid")
+	}
+	loop, encrypted, err := hp.loopFeaturesInUse()
+	if err != nil {
+		return err
+	}
+	if loop {
+		binaries = append(binaries, "fallocate", "losetup")
+	}
+	if encrypted {
+		binaries = append(binaries, "cryptsetup")
+	}
+	var missing []string
+	for _, binary := range binaries {
+		if _, err := exec.LookPath(binary); err != nil {
+			missing = append(missing, binary)
+		}
+	}
+	// 块文件需要 loop 设备
+	if loop {
+		if _, err := os.Stat("/dev/loop-control"); err != nil {
+			missing = append(missing, "/dev/loop-control")
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("missing %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// loopFeaturesInUse 返回按配置或者已有的本地卷是否需要 loop 设备, 以及是否有加密的卷。
+// 卷从状态文件中读取, 这样检查不会等待持有 hp.mutex 的长时间操作
+func (hp *hostpath) loopFeaturesInUse() (loop, encrypted bool, err error) {
+	loop = hp.config.BlockBackedMountVolumes || hp.config.MountVolumeQuota == QuotaLoop
+	s, err := state.New(hp.statePath())
+	if err != nil {
+		return false, false, err
+	}
+	for _, vol := range s.GetVolumes() {
+		if vol.Remote {
+			continue
+		}
+		loop = loop || isFileBacked(vol) || vol.Encrypted
+		encrypted = encrypted || vol.Encrypted
+	}
+	return loop, encrypted, nil
+}
+
+// HealthzHandler 返回执行健康检查的 HTTP handler. 驱动没有就绪或者有检查失败时返回 503
+func (hp *hostpath) HealthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ready, results := hp.checkHealth(r.Context())
+		var body strings.Builder
+		healthy := ready
+		if !ready {
+			body.WriteString("[-]ready failed: startup reconciliation in progress\n")
+		}
+		for _, result := range results {
+			if result.err != nil {
+				healthy = false
+				fmt.Fprintf(&body, "[-]%s failed: %v\n", result.name, result.err)
+			} else {
+				fmt.Fprintf(&body, "[+]%s ok\n", result.name)
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			body.WriteString("healthz check failed\n")
+		} else {
+			body.WriteString("healthz check passed\n")
+		}
+		w.Write([]byte(body.String()))
+	})
+}
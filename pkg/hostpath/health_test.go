@@ -0,0 +1,105 @@
+package hostpath
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestProbe(t *testing.T) {
+	hp := newTestDriver(t, func(cfg *Config) {
+		cfg.HealthCheckTTL = time.Hour
+		cfg.HealthMinFreeBytes = 1
+	})
+	ctx := context.Background()
+
+	server := httptest.NewServer(hp.HealthzHandler())
+	defer server.Close()
+	healthz := func() (int, string) {
+		resp, err := server.Client().Get(server.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	// 启动时的状态恢复完成之前没有就绪
+	resp, err := hp.Probe(ctx, &csi.ProbeRequest{})
+	require.NoError(t, err)
+	require.False(t, resp.GetReady().GetValue())
+	code, body := healthz()
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Contains(t, body, "reconciliation in progress")
+
+	require.NoError(t, hp.reconcile())
+	resp, err = hp.Probe(ctx, &csi.ProbeRequest{})
+	require.NoError(t, err, "default health checks")
+	require.True(t, resp.GetReady().GetValue())
+	code, body = healthz()
+	require.Equal(t, http.StatusOK, code)
+	for _, name := range []string{"stateDir", "state", "diskSpace", "tools"} {
+		require.Contains(t, body, "[+]"+name+" ok")
+	}
+
+	// 注册的检查失败时 Probe 返回错误, 结果在 TTL 内被缓存
+	calls := 0
+	hp.registerHealthCheck("broken", func(ctx context.Context) error {
+		calls++
+		return errors.New("disk on fire")
+	})
+	_, err = hp.Probe(ctx, &csi.ProbeRequest{})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.Contains(t, err.Error(), "broken: disk on fire")
+	code, body = healthz()
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Contains(t, body, "[-]broken failed: disk on fire")
+	require.Equal(t, 1, calls)
+
+	hp.health.checkedAt = time.Now().Add(-2 * time.Hour)
+	_, err = hp.Probe(ctx, &csi.ProbeRequest{})
+	require.Error(t, err)
+	require.Equal(t, 2, calls)
+}
+
+func TestFreeSpaceCheck(t *testing.T) {
+	hp := newTestDriver(t, func(cfg *Config) {
+		cfg.HealthMinFreeBytes = 1 << 62
+	})
+	err := hp.checkFreeSpace(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "need at least")
+}
+
+func TestToolsCheck(t *testing.T) {
+	hp := newTestDriver(t, nil)
+	bin := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "tar"), []byte("#!/bin/sh\n"), 0755))
+	t.Setenv("PATH", bin)
+
+	// 没有块卷时不需要 loop 设备
+	require.NoError(t, hp.checkTools(context.Background()))
+
+	require.NoError(t, hp.state.UpdateVolume(state.Volume{VolID: "block", VolName: "block", VolAccessType: state.BlockAccess}))
+	err := hp.checkTools(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "losetup")
+	require.NotContains(t, err.Error(), "cryptsetup")
+
+	require.NoError(t, hp.state.UpdateVolume(state.Volume{VolID: "block", VolName: "block", VolAccessType: state.BlockAccess, Encrypted: true}))
+	err = hp.checkTools(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cryptsetup")
+}
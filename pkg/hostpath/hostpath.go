@@ -1,12 +1,21 @@
 package hostpath
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/bearcat-panda/csi-demo/pkg/replication"
 	"github.com/bearcat-panda/csi-demo/pkg/state"
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"io"
+	"k8s.io/client-go/kubernetes"
+	"io/fs"
 	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/klog/v2"
 	"k8s.io/kubernetes/pkg/volume/util/volumepathhandler"
@@ -14,6 +23,8 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"syscall"
+	"time"
 )
 
 const (
@@ -27,6 +38,25 @@ const (
 	// storageKind is the special parameter which requests
 	// storage of a certain kind (only affects capacity checks).
 	storageKind = "kind"
+
+	// snapshotSchedule 参数让驱动按固定间隔自动为卷创建快照,
+	// 例如 "@hourly" 或 "@every 30m"。
+	snapshotSchedule = "snapshotSchedule"
+	// snapshotRetain 参数定义定时快照的保留策略, 例如 "24h:24,7d:7"。
+	snapshotRetain = "snapshotRetain"
+
+	// provisioning 参数选择块卷和由块文件支持的 mount 卷的分配方式:
+	// thin 创建稀疏文件, thick(默认)预先分配所有的空间。目录卷不支持 thin
+	provisioning      = "provisioning"
+	provisioningThin  = "thin"
+	provisioningThick = "thick"
+)
+
+const (
+	// 按卷申请的大小计算已经使用的容量(默认)
+	AccountingNominal = "nominal"
+	// 按卷实际分配的数据块计算已经使用的容量
+	AccountingAllocated = "allocated"
 )
 
 var (
@@ -36,6 +66,8 @@ var (
 const (
 	// Extension with which snapshot files will be saved.
 	snapshotExt = ".snap"
+	// StateDir 中保存状态的文件
+	stateFile = "state.json"
 )
 
 
@@ -45,10 +77,52 @@ type hostpath struct {
 	csi.UnimplementedNodeServer
 	csi.UnimplementedGroupControllerServer
 	config Config
+	// 只由持有状态文件的实例运行的后台任务
+	background backgroundTasks
 
 	//访问state.必须要使用互斥锁
 	mutex sync.Mutex
 	state state.State
+
+	// 正在后台创建的快照, 以快照id为键. 访问时同样需要持有 mutex
+	snapshotJobs map[string]*snapshotJob
+	// 限制同时运行的快照任务数量
+	snapshotWorkers chan struct{}
+	// 等待所有快照任务结束, 主要用于测试
+	snapshotWG sync.WaitGroup
+	// StateDir 所在的文件系统支持的最快的复制方式
+	copyMethod copyMethod
+	// 实际分配的空间超过高水位的存储类型. 访问时需要持有 mutex
+	capacityAlarms map[string]bool
+	// 每个卷实际分配的空间, 由 StartUsageRefresher 在后台更新
+	usage *allocatedUsage
+	// 节点的所有拓扑段
+	topology map[string]string
+	// 分布式控制器模式下的节点代理, 以及节点id与代理的对应关系. 访问 agentNodes 时需要持有 agentMutex
+	nodeAgents []*nodeAgent
+	agentNodes map[string]*nodeAgent
+	agentMutex sync.Mutex
+	// 分布式控制器模式下串行执行对同一个卷或快照名称的请求, 调用节点代理时不持有 mutex
+	remoteNames *nameLocks
+	// 对等节点的复制服务, 以节点id为键
+	replicationPeers map[string]replication.ReplicationClient
+	// 串行执行复制, 同一个卷不会同时被传输两次
+	replicationMutex sync.Mutex
+	// 导出的 Prometheus 指标
+	metrics *metrics
+	// 创建 span 的 tracer, 以及由驱动创建、停止时需要关闭的 TracerProvider
+	tracer         trace.Tracer
+	tracerProvider *sdktrace.TracerProvider
+	// 健康检查
+	health *health
+	// 选主的状态
+	election leaderElection
+	// 持有 mutex 的请求的 context, 状态写入的 span 属于它的 trace. 访问时需要持有 mutex
+	lockCtx context.Context
+	// SnapshotKeyFile 中的快照密钥, 没有配置时为 nil
+	snapshotKey *snapshotKey
+	// 格式化和打开加密的块卷
+	crypt cryptSetup
 }
 
 type Config struct {
@@ -89,11 +163,246 @@ type Config struct {
 	MaxVolumeExpansionSizeNode    int64
 	// 可用于将卷生命周期的某些冲突转换为警告，而不是使不正确的 gRPC 调用失败
 	CheckVolumeLifecycle          bool
+	// 快照调度器检查到期定时快照的间隔。零表示使用默认值(1分钟)
+	SnapshotScheduleInterval time.Duration
+	// 同时在后台创建快照的最大数量。零表示使用默认值
+	SnapshotWorkers int
+	// 计算已使用容量的方式: nominal(默认) 或 allocated
+	CapacityAccounting string
+	// 实际分配的空间达到 Capacity 中 Size 的这个比例(0-1)时拒绝创建新卷。零表示不检查
+	CapacityHighWatermark float64
+	// 限制 mount 卷大小的方式: none(默认), project 或 loop
+	MountVolumeQuota string
+	// mount 卷由关联到 loop 设备的块文件支持, 在第一次 NodeStage 时按 fsType 格式化
+	BlockBackedMountVolumes bool
+	// 除了节点之外的拓扑段, 例如 zone, rack 或磁盘类型
+	TopologySegments Segments
+	// downward API 格式的节点标签文件
+	TopologyLabelsFile string
+	// 节点标签文件中作为拓扑段的标签
+	TopologyLabelKeys StringArray
+	// 节点代理的地址. 设置时驱动作为分布式控制器, 在节点代理上创建卷和快照
+	NodeAgents StringArray
+	// 复制卷的对等节点的复制服务地址, 以节点id为键
+	ReplicationPeers Peers
+	// 复制卷数据的间隔。零表示使用默认值(1分钟)
+	ReplicationInterval time.Duration
+	// 接收其它节点的卷副本的复制服务地址, 例如 ":9090"。空表示不接收副本
+	ReplicationAddress string
+	// 导出 Prometheus 指标和 /healthz 的 HTTP 地址, 例如 ":8080"。空表示不导出
+	MetricsAddress string
+	// 导出 Prometheus 指标的 HTTP 路径。空表示使用默认值(/metrics)
+	MetricsPath string
+	// 接收 trace 的 OTLP gRPC 地址, 例如 "otel-collector:4317"。空表示使用全局的 TracerProvider
+	TracingEndpoint string
+	// 创建 span 的 TracerProvider, 主要用于测试。设置时忽略 TracingEndpoint
+	TracerProvider trace.TracerProvider
+	// 缓存健康检查结果的时间。零表示使用默认值(10秒)
+	HealthCheckTTL time.Duration
+	// StateDir 所在的文件系统至少需要的可用空间。零表示使用默认值(100Mi)
+	HealthMinFreeBytes int64
+	// 等待其它进程释放状态文件的锁的时间, 例如滚动更新时的旧实例。零表示立即失败
+	StateLockTimeout time.Duration
+	// 选主方式, "file" 或 "kubernetes"。设置时多个实例可以使用同一个 StateDir, 只有 leader 提供 controller 服务
+	LeaderElection string
+	// "file" 方式使用的租约文件, 必须位于所有实例共享的文件系统上。空表示使用 StateDir 中的文件
+	LeaderElectionLeaseFile string
+	// "kubernetes" 方式使用的 Lease 的名称空间和名称。空表示使用 Pod 的名称空间和驱动名称
+	LeaderElectionNamespace string
+	LeaderElectionLeaseName string
+	// 当前实例在选主中的标识。空表示使用主机名
+	LeaderElectionIdentity string
+	// 租约时长, 续约期限和重试间隔。零表示使用默认值(15秒, 10秒, 2秒)
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+	// "kubernetes" 方式使用的客户端, 主要用于测试。空表示使用 Pod 的 service account
+	KubeClient kubernetes.Interface
+	// 加载配置的文件, 由 LoadConfigFile 设置。设置时 Run 在收到 SIGHUP 或文件变化后重新加载其中可以安全修改的字段
+	ConfigFile string
+	// 检查配置文件是否变化的间隔。零表示使用默认值(10秒)
+	ConfigReloadInterval time.Duration
+	// 删除仍有快照的卷, 以及仍有从它恢复的卷的快照时的策略: allow(默认), block 或 defer
+	VolumeDeletionPolicy   string
+	SnapshotDeletionPolicy string
+	// 删除的卷和快照在回收站中保留的时间, 在此期间可以用 hostpathctl undelete 恢复。
+	// 零表示立即删除。过期的条目由 StartTrashPurger 删除, 在此之前回收站中的卷仍然计入已使用的容量
+	TrashRetention time.Duration
+	// 加密快照的本地密钥文件, 主要用于测试。CreateSnapshot 的 secrets 中没有密钥时使用,
+	// 定时快照也用它加密。空表示这些快照不加密
+	SnapshotKeyFile string
+}
+
+func NewHostPathDriver(cfg Config) (_ *hostpath, finalerr error) {
+	if cfg.DriverName == "" {
+		return nil, errors.New("no driver name provided")
+	}
+
+	if cfg.NodeID == "" {
+		return nil, errors.New("no node id provided")
+	}
+
+	if cfg.EndPoint == "" {
+		return nil, errors.New("no driver endpoint provided")
+	}
+
+	if cfg.VendorVersion != "" {
+		vendorVersion = cfg.VendorVersion
+	}
+
+	switch cfg.CapacityAccounting {
+	case "", AccountingNominal, AccountingAllocated:
+	default:
+		return nil, fmt.Errorf("invalid capacity accounting %q, must be %q or %q", cfg.CapacityAccounting, AccountingNominal, AccountingAllocated)
+	}
+
+	switch cfg.MountVolumeQuota {
+	case "", QuotaNone, QuotaProject, QuotaLoop:
+	default:
+		return nil, fmt.Errorf("invalid mount volume quota %q, must be %q, %q or %q", cfg.MountVolumeQuota, QuotaNone, QuotaProject, QuotaLoop)
+	}
+
+	if cfg.BlockBackedMountVolumes && cfg.MountVolumeQuota != "" && cfg.MountVolumeQuota != QuotaNone {
+		return nil, errors.New("mount volume quota cannot be used with block-backed mount volumes, their size is always enforced")
+	}
+
+	if err := validateDeletionPolicy(cfg.VolumeDeletionPolicy); err != nil {
+		return nil, fmt.Errorf("volume %v", err)
+	}
+	if err := validateDeletionPolicy(cfg.SnapshotDeletionPolicy); err != nil {
+		return nil, fmt.Errorf("snapshot %v", err)
+	}
+
+	if cfg.TrashRetention < 0 {
+		return nil, fmt.Errorf("invalid trash retention %v, must not be negative", cfg.TrashRetention)
+	}
+
+	if cfg.CapacityHighWatermark < 0 || cfg.CapacityHighWatermark > 1 {
+		return nil, fmt.Errorf("invalid capacity high watermark %g, must be between 0 and 1", cfg.CapacityHighWatermark)
+	}
+
+	topology, err := loadTopologySegments(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotKey, err := loadSnapshotKeyFile(cfg.SnapshotKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(cfg.StateDir, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create dataRoot: %v", err)
+	}
+
+	klog.Infof("Driver: %v ", cfg.DriverName)
+	klog.Infof("Version: %s", cfg.VendorVersion)
+
+	switch cfg.LeaderElection {
+	case "", LeaderElectionFile, LeaderElectionKubernetes:
+	default:
+		return nil, fmt.Errorf("invalid leader election %q, must be %q or %q", cfg.LeaderElection, LeaderElectionFile, LeaderElectionKubernetes)
+	}
+
+	// 锁住状态文件, 防止两个驱动同时修改它, 例如滚动更新时。
+	// 选主时只有 leader 读取状态文件, 在此之前使用不保存的空状态
+	var s state.State
+	if cfg.LeaderElection == "" {
+		s, err = state.New(filepath.Join(cfg.StateDir, stateFile), state.WithLock(cfg.StateLockTimeout))
+	} else {
+		s, err = state.New("")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state: %w", err)
+	}
+	defer func() {
+		if finalerr != nil {
+			s.Close()
+		}
+	}()
+	workers := cfg.SnapshotWorkers
+	if workers <= 0 {
+		workers = defaultSnapshotWorkers
+	}
+	hp := &hostpath{
+		config:          cfg,
+		state:           s,
+		snapshotJobs:    map[string]*snapshotJob{},
+		snapshotWorkers: make(chan struct{}, workers),
+		copyMethod:      detectCopyMethod(cfg.StateDir),
+		capacityAlarms:  map[string]bool{},
+		usage:           newAllocatedUsage(),
+		topology:        topology,
+		agentNodes:      map[string]*nodeAgent{},
+		remoteNames:     newNameLocks(),
+		snapshotKey:     snapshotKey,
+		crypt:           luksCryptSetup{exec: utilexec.New()},
+	}
+	switch {
+	case cfg.TracerProvider != nil:
+		hp.tracer = cfg.TracerProvider.Tracer(tracerName)
+	case cfg.TracingEndpoint != "":
+		if hp.tracerProvider, err = newOTLPTracerProvider(cfg.TracingEndpoint, cfg.DriverName); err != nil {
+			return nil, err
+		}
+		hp.tracer = hp.tracerProvider.Tracer(tracerName)
+	default:
+		hp.tracer = otel.GetTracerProvider().Tracer(tracerName)
+	}
+	hp.metrics = newMetrics(hp)
+	hp.state = hp.metrics.instrumentState(s, hp.tracer, hp.stateContext)
+	for _, address := range cfg.NodeAgents {
+		agent, err := newNodeAgent(address)
+		if err != nil {
+			return nil, err
+		}
+		hp.nodeAgents = append(hp.nodeAgents, agent)
+	}
+	if hp.replicationPeers, err = newReplicationPeers(cfg.ReplicationPeers); err != nil {
+		return nil, err
+	}
+	ttl := cfg.HealthCheckTTL
+	if ttl <= 0 {
+		ttl = defaultHealthCheckTTL
+	}
+	hp.health = &health{ttl: ttl}
+	hp.registerDefaultHealthChecks()
+	klog.Infof("Copy method for clones and snapshots: %s", hp.copyMethod)
+	return hp, nil
+}
+
+// reconcile 恢复上一次运行留下的状态: 重新挂载 loop 卷, 继续创建没有完成的快照。
+// 完成之前 Probe 返回 Ready=false
+func (hp *hostpath) reconcile() error {
+	hp.setReady(false)
+	hp.mutex.Lock()
+	err := hp.mountLoopVolumes()
+	hp.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := hp.resumeSnapshots(); err != nil {
+		return err
+	}
+	hp.setReady(true)
+	return nil
 }
 
 
 // createVolume 分配容量，为 hostpath 卷创建目录，并将卷添加到列表中
-func (hp *hostpath) createVolume(volID, name string, cap int64, volAccessType state.AccessType, ephemeral bool, kind string) (*state.Volume, error) {
+// thin 为 true 时块卷使用稀疏文件, 不预先分配空间
+// encrypted 的块卷的块文件多出 LUKS2 头的大小, 头也计入已使用的容量
+func (hp *hostpath) createVolume(ctx context.Context, volID, name string, cap int64, volAccessType state.AccessType, ephemeral bool, kind string, thin, encrypted bool) (_ *state.Volume, finalerr error) {
+	_, span := hp.tracer.Start(ctx, "hostpath.createVolume", trace.WithAttributes(
+		attribute.String("hostpath.volume.id", volID),
+		attribute.Int64("hostpath.volume.size_bytes", cap),
+		attribute.String("hostpath.volume.access_type", accessTypeName(volAccessType)),
+		attribute.Bool("hostpath.volume.thin", thin),
+		attribute.Bool("hostpath.volume.encrypted", encrypted),
+	))
+	defer func() { endSpan(span, finalerr) }()
+	size := fileSize(state.Volume{VolSize: cap, Encrypted: encrypted})
+
 	// 检查最大可用容量
 	if cap > hp.config.MaxVolumeSize {
 		return nil, status.Errorf(codes.OutOfRange, "Requested capacity %d exceeds maximum allowed %d", cap, hp.config.MaxVolumeSize)
@@ -104,8 +413,8 @@ func (hp *hostpath) createVolume(volID, name string, cap int64, volAccessType st
 		if kind == "" {
 			// 选择具有足够剩余容量的种类。
 			for k, c := range hp.config.Capacity {
-				// 判断已经使用的容量和要申请的容量. 是否超出总容量
-				if hp.sumVolumeSizes(k) + cap <= c.Value() {
+				// 判断已经使用的容量和要申请的容量. 是否超出总容量, 以及实际分配是否超过了高水位
+				if hp.sumVolumeSizes(k) + size <= c.Nominal() && !hp.aboveHighWatermark(k) {
 					kind = k
 					break
 				}
@@ -118,47 +427,33 @@ func (hp *hostpath) createVolume(volID, name string, cap int64, volAccessType st
 		}
 		used := hp.sumVolumeSizes(kind)
 		available := hp.config.Capacity[kind]
-		if used + cap > available.Value() {
+		if used + size > available.Nominal() {
 			return nil, status.Errorf(codes.ResourceExhausted, "requested capacity %d exceeds remaining capacity for %q, %s out of %s already used",
-				cap, kind, resource.NewQuantity(used, resource.BinarySI).String(), available.String())
+				cap, kind, resource.NewQuantity(used, resource.BinarySI).String(), resource.NewQuantity(available.Nominal(), resource.BinarySI).String())
+		}
+		// 即使申请的容量还有剩余, 实际分配的空间超过高水位时也不再创建新卷
+		if hp.aboveHighWatermark(kind) {
+			return nil, status.Errorf(codes.ResourceExhausted, "allocated storage for %q exceeds %g%% of %s",
+				kind, hp.config.CapacityHighWatermark*100, available.Size.String())
 		}
 	} else if kind != "" {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("capacity tracking disabled, specifying kind %q is invalid", kind))
 	}
 
+	span.SetAttributes(attribute.String("hostpath.volume.kind", kind))
 	path := hp.getVolumePath(volID)
+	// mount 卷也可以使用与块卷相同的块文件, 文件系统在 NodeStage 时创建
+	blockBacked := volAccessType == state.MountAccess && hp.config.BlockBackedMountVolumes
 
-	switch volAccessType {
-	case state.MountAccess:
-		err := os.MkdirAll(path, 0777)
-		if err != nil {
+	switch {
+	case volAccessType == state.BlockAccess || blockBacked:
+		if err := createBlockFile(path, size, thin); err != nil {
 			return nil, err
 		}
-	case state.BlockAccess:
-		executor := utilexec.New()
-		size := fmt.Sprintf("%dM", cap/mib)
-		// 创建块文件。
-		_, err := os.Stat(path)
-		if err != nil {
-			if os.IsNotExist(err) {
-				out, err := executor.Command("fallocate", "-l", size, path).CombinedOutput()
-				if err != nil {
-					return nil, fmt.Errorf("failed to create block device: %v, %v", err, string(out))
-				}
-			} else {
-				return nil, fmt.Errorf("failed to stat block device: %v, %v", path, err)
-			}
-		}
-
-		// 将块文件与 loop 设备关联。
-		volPathHandler := volumepathhandler.VolumePathHandler{}
-		_, err = volPathHandler.AttachFileDevice(path)
+	case volAccessType == state.MountAccess:
+		err := os.MkdirAll(path, 0777)
 		if err != nil {
-			// 删除块文件，因为它将不再使用。
-			if errDelete := os.Remove(path); errDelete != nil {
-				klog.Errorf("failed to cleanup block file %s: %v", path, errDelete)
-			}
-			return nil, fmt.Errorf("failed to attach device %v: %v", path, err)
+			return nil, err
 		}
 	default:
 		return nil, fmt.Errorf("unsupported access type %v", volAccessType)
@@ -173,6 +468,19 @@ func (hp *hostpath) createVolume(volID, name string, cap int64, volAccessType st
 		VolAccessType: volAccessType,
 		Ephemeral: ephemeral,
 		Kind: kind,
+		ThinProvisioned: thin,
+		BlockBacked: blockBacked,
+		Encrypted: encrypted,
+	}
+
+	// 按配置限制 mount 卷可以使用的空间. 块文件的大小本身就是限制
+	if volAccessType == state.MountAccess && !blockBacked {
+		if err := hp.setupQuota(&volume); err != nil {
+			if errDelete := os.RemoveAll(path); errDelete != nil {
+				klog.Errorf("failed to cleanup volume directory %s: %v", path, errDelete)
+			}
+			return nil, err
+		}
 	}
 
 	klog.V(4).Infof("adding hostpath volume: %s = %+v", volID, volume)
@@ -183,119 +491,345 @@ func (hp *hostpath) createVolume(volID, name string, cap int64, volAccessType st
 }
 
 
-// 获取当前类型volume已经被使用的容量
+// createBlockFile 创建块文件并将它与 loop 设备关联
+func createBlockFile(path string, cap int64, thin bool) error {
+	executor := utilexec.New()
+	size := fmt.Sprintf("%dM", cap/mib)
+	// 创建块文件。
+	_, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if thin {
+				// 稀疏文件, 只有写入数据时才分配数据块
+				if err := createSparseFile(path, cap/mib*mib); err != nil {
+					return fmt.Errorf("failed to create block device: %v", err)
+				}
+			} else {
+				out, err := executor.Command("fallocate", "-l", size, path).CombinedOutput()
+				if err != nil {
+					return fmt.Errorf("failed to create block device: %v, %v", err, string(out))
+				}
+			}
+		} else {
+			return fmt.Errorf("failed to stat block device: %v, %v", path, err)
+		}
+	}
+
+	// 将块文件与 loop 设备关联。
+	volPathHandler := volumepathhandler.VolumePathHandler{}
+	_, err = volPathHandler.AttachFileDevice(path)
+	if err != nil {
+		// 删除块文件，因为它将不再使用。
+		if errDelete := os.Remove(path); errDelete != nil {
+			klog.Errorf("failed to cleanup block file %s: %v", path, errDelete)
+		}
+		return fmt.Errorf("failed to attach device %v: %v", path, err)
+	}
+	return nil
+}
+
+// isFileBacked 判断卷的数据是否保存在一个块文件中, 即块卷和由块文件支持的 mount 卷
+func isFileBacked(vol state.Volume) bool {
+	return vol.VolAccessType == state.BlockAccess || vol.BlockBacked
+}
+
+// 获取当前类型volume已经被使用的容量.
+// 按 CapacityAccounting 的配置计算卷申请的大小或者实际分配的数据块
 func (hp *hostpath) sumVolumeSizes(kind string) (sum int64) {
-	for _, volume := range hp.state.GetVolumes() {
-		if volume.Kind == kind {
-			sum += volume.VolSize
+	// 回收站中的卷在被删除之前仍然占用容量
+	for _, volume := range append(hp.state.GetVolumes(), hp.trashedVolumes()...) {
+		// 分布式控制器记录的卷在节点代理上, 不占用本地的容量
+		if volume.Kind != kind || volume.Remote {
+			continue
+		}
+		if hp.config.CapacityAccounting != AccountingAllocated {
+			sum += fileSize(volume)
+			continue
 		}
+		sum += hp.usage.get(volume)
 	}
 	return
 }
 
+// 获取当前类型volume实际分配的数据块大小. 使用缓存的值, 不遍历卷的文件
+func (hp *hostpath) sumAllocatedSizes(kind string) (sum int64) {
+	for _, volume := range append(hp.state.GetVolumes(), hp.trashedVolumes()...) {
+		if volume.Kind == kind && !volume.Remote {
+			sum += hp.usage.get(volume)
+		}
+	}
+	return
+}
+
+// aboveHighWatermark 检查当前类型volume实际分配的空间是否达到了 CapacityHighWatermark.
+// 超过或者回落到高水位以下时会记录告警日志
+func (hp *hostpath) aboveHighWatermark(kind string) bool {
+	if hp.config.CapacityHighWatermark <= 0 {
+		return false
+	}
+	capacity, ok := hp.config.Capacity[kind]
+	if !ok {
+		return false
+	}
+
+	allocated := hp.sumAllocatedSizes(kind)
+	limit := int64(float64(capacity.Size.Value()) * hp.config.CapacityHighWatermark)
+	above := allocated >= limit
+	if above != hp.capacityAlarms[kind] {
+		if above {
+			klog.Warningf("ALARM: allocated storage %s for %q reached high watermark %g%% of %s",
+				resource.NewQuantity(allocated, resource.BinarySI).String(), kind, hp.config.CapacityHighWatermark*100, capacity.Size.String())
+		} else {
+			klog.Infof("allocated storage %s for %q is below high watermark again", resource.NewQuantity(allocated, resource.BinarySI).String(), kind)
+		}
+		hp.capacityAlarms[kind] = above
+	}
+	return above
+}
+
+// volumeAllocatedBytes 返回volume实际分配的数据块大小, 无法确定时返回申请的大小
+func volumeAllocatedBytes(volume state.Volume) int64 {
+	allocated, err := allocatedBytes(volume.VolPath)
+	if err != nil {
+		klog.Warningf("failed to determine allocated size of volume %s, using nominal size: %v", volume.VolID, err)
+		return volume.VolSize
+	}
+	return allocated
+}
+
+// allocatedBytes 返回文件或目录中的所有文件实际分配的数据块大小, 与 du 的结果相同
+func allocatedBytes(path string) (int64, error) {
+	var sum int64
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			// st_blocks 的单位总是 512 字节
+			sum += st.Blocks * 512
+		}
+		return nil
+	})
+	return sum, err
+}
+
+// createSparseFile 创建一个指定大小但不分配数据块的文件
+func createSparseFile(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
 // getVolumePath 返回 hostpath 卷的规范路径
 func (hp *hostpath) getVolumePath(volID string) string {
 	return filepath.Join(hp.config.StateDir, volID)
 }
 
+// statePath 返回状态文件的路径
+func (hp *hostpath) statePath() string {
+	return filepath.Join(hp.config.StateDir, stateFile)
+}
+
+// Close 释放状态文件的锁, 并发送还没有导出的 span. 之后不能再使用驱动
+func (hp *hostpath) Close() error {
+	if hp.tracerProvider != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := hp.tracerProvider.Shutdown(ctx); err != nil {
+			klog.Errorf("failed to shut down tracing: %v", err)
+		}
+	}
+	hp.mutex.Lock()
+	defer hp.mutex.Unlock()
+	return hp.state.Close()
+}
+
 // getSnapshotPath 返回快照存储位置的完整路径
 func (hp *hostpath) getSnapshotPath(snapshotID string) string {
 	return filepath.Join(hp.config.StateDir, fmt.Sprintf("%s%s", snapshotID, snapshotExt))
 }
 
-// 使用来自快照的数据填充volume
-func (hp *hostpath) loadFromSnapshot(size int64, snapshotId, destPath string, mode state.AccessType) error {
-	snapshot, err := hp.state.GetSnapshotByID(snapshotId)
+// deleteSnapshot 删除快照文件, 并将快照从列表中移除
+func (hp *hostpath) deleteSnapshot(snapshotID string) error {
+	klog.V(4).Infof("starting to delete hostpath snapshot: %s", snapshotID)
+
+	snapshot, err := hp.state.GetSnapshotByID(snapshotID)
 	if err != nil {
+		// 如果找不到快照.直接返回ok
+		return nil
+	}
+
+	// 取消仍在进行中的快照任务, 任务结束时会清理写入的文件
+	if job, ok := hp.snapshotJobs[snapshotID]; ok {
+		job.cancel()
+		delete(hp.snapshotJobs, snapshotID)
+	}
+
+	if hp.trashEnabled() && snapshot.ReadyToUse {
+		if err := hp.trashSnapshot(snapshot); err != nil {
+			return err
+		}
+	} else if err := os.RemoveAll(snapshot.Path); err != nil && !os.IsNotExist(err) {
 		return err
 	}
 
+	if err := hp.state.DeleteSnapshot(snapshotID); err != nil {
+		return err
+	}
+	klog.V(4).Infof("deleted hostpath snapshot: %s = %+v", snapshotID, snapshot)
+	// 源卷可能只是在等待它的最后一个快照被删除
+	return hp.deleteDeferredVolume(snapshot.VolID)
+}
+
+// 使用来自快照的数据填充volume. 返回volume是否与快照共享数据块和复制的数据量
+// 加密的快照用 key 解密, key 由 decryptionKeyFor 在加锁之前推导. 文件系统镜像的 fsType 记录在 vol 中
+func (hp *hostpath) loadFromSnapshot(ctx context.Context, size int64, snapshotId string, vol *state.Volume, key *snapshotKey) (_ copyResult, finalerr error) {
+	ctx, span := hp.tracer.Start(ctx, "hostpath.loadFromSnapshot", trace.WithAttributes(
+		attribute.String("hostpath.snapshot.id", snapshotId),
+		attribute.String("hostpath.copy.method", hp.copyMethod.String()),
+	))
+	defer func() { endSpan(span, finalerr) }()
+
+	snapshot, err := hp.visibleSnapshot(snapshotId)
+	if err != nil {
+		return copyResult{}, err
+	}
+
 	if !snapshot.ReadyToUse {
-		return fmt.Errorf("snapshot %v is not yet ready to use", snapshotId)
+		return copyResult{}, fmt.Errorf("snapshot %v is not yet ready to use", snapshotId)
 	}
 
 	if snapshot.SizeBytes > size {
-		return status.Errorf(codes.InvalidArgument, "snapshot %v size %v is greater than requested volume size %v", snapshotId, snapshot.SizeBytes, size)
+		return copyResult{}, status.Errorf(codes.InvalidArgument, "snapshot %v size %v is greater than requested volume size %v", snapshotId, snapshot.SizeBytes, size)
 	}
 	snapshotPath := snapshot.Path
+	destPath, mode := vol.VolPath, vol.VolAccessType
+	span.SetAttributes(attribute.Int64("hostpath.copy.bytes", snapshot.SizeBytes))
 
-	var cmd []string
-	switch mode {
-	case state.MountAccess:
-		// 解压缩一个 .tar.gz 格式的快照文件，将内容提取到指定的目标路径 destPath
-		cmd = []string{"tar", "zxvf", snapshotPath, "-C", destPath}
-	case state.BlockAccess:
-		// 使用 dd 命令将快照文件的内容直接复制到目标路径，适合处理原始磁盘镜像或文件
-		cmd = []string{"dd", "if=" + snapshotPath, "of=" + destPath}
-	default:
-		return status.Errorf(codes.InvalidArgument, "unknown accessType: %d", mode)
+	// 由块文件支持的 mount 卷的快照是文件系统镜像, 只能用于创建同样由块文件支持的卷
+	if mode == state.MountAccess && snapshot.BlockBacked != hp.config.BlockBackedMountVolumes {
+		return copyResult{}, status.Errorf(codes.InvalidArgument, "snapshot %v and the new volume must both be block-backed or both be directories", snapshotId)
+	}
+	// 新卷使用快照中已经存在的文件系统, NodeStage 时不能重新格式化或者修改根目录的权限
+	vol.FsType = snapshot.FsType
+	// 加密卷的快照包含 LUKS 头, 恢复的卷同样是加密的
+	vol.Encrypted = snapshot.Encrypted
+
+	if snapshot.EncryptionKeyID != "" && key == nil {
+		// 推导密钥时快照还不存在
+		return copyResult{}, status.Errorf(codes.Aborted, "snapshot %v changed while its key was derived", snapshotId)
+	}
+	if key != nil {
+		// 解密后的数据不能与快照共享数据块
+		span.SetAttributes(attribute.String("hostpath.snapshot.key_id", key.id))
+		copied, err := restoreEncrypted(ctx, key, snapshot, destPath, mode == state.BlockAccess || snapshot.BlockBacked)
+		if err != nil {
+			return copyResult{}, fmt.Errorf("failed pre-poplulate data from snapshot %v: %w", snapshotId, err)
+		}
+		return copyResult{bytes: copied}, nil
 	}
 
-	executor := utilexec.New()
-	klog.V(4).Infof("Command Start: %v", cmd)
-	out, err := executor.Command(cmd[0], cmd[1:]...).CombinedOutput()
-	klog.V(4).Infof("Command Finish: %v", string(out))
-	if err != nil {
-		return fmt.Errorf("failed pre-poplulate data from snapshot %v: %w: %s", snapshotId, err, out)
+	switch {
+	case mode == state.BlockAccess || snapshot.BlockBacked:
+		// 块快照是原始的磁盘镜像, 文件系统支持时通过 reflink 共享数据块
+		result, err := cloneFile(ctx, hp.copyMethod, snapshotPath, destPath)
+		if err != nil {
+			return copyResult{}, fmt.Errorf("failed pre-poplulate data from snapshot %v: %w", snapshotId, err)
+		}
+		return result, nil
+	case mode == state.MountAccess:
+		// 解压缩一个 .tar.gz 格式的快照文件，将内容提取到指定的目标路径 destPath
+		in, err := os.Open(snapshotPath)
+		if err != nil {
+			return copyResult{}, fmt.Errorf("failed pre-poplulate data from snapshot %v: %w", snapshotId, err)
+		}
+		defer in.Close()
+		copied, err := extractArchive(ctx, in, destPath)
+		if err != nil {
+			return copyResult{}, fmt.Errorf("failed pre-poplulate data from snapshot %v: %w", snapshotId, err)
+		}
+		return copyResult{bytes: copied}, nil
+	default:
+		return copyResult{}, status.Errorf(codes.InvalidArgument, "unknown accessType: %d", mode)
 	}
-	return nil
 }
 
-// 使用本地数据填充volume
-func (hp *hostpath) loadFromVolume(size int64, srcVolumeId, destPath string, mode state.AccessType) error {
-	hostPathVolume, err := hp.state.GetVolumeByID(srcVolumeId)
+// 使用本地数据填充volume. 返回volume是否与源volume共享数据块和复制的数据量. 源volume的 fsType 记录在 vol 中
+func (hp *hostpath) loadFromVolume(ctx context.Context, size int64, srcVolumeId string, vol *state.Volume) (_ copyResult, finalerr error) {
+	ctx, span := hp.tracer.Start(ctx, "hostpath.loadFromVolume", trace.WithAttributes(
+		attribute.String("hostpath.source_volume.id", srcVolumeId),
+		attribute.String("hostpath.copy.method", hp.copyMethod.String()),
+	))
+	defer func() { endSpan(span, finalerr) }()
+
+	hostPathVolume, err := hp.visibleVolume(srcVolumeId)
 	if err != nil {
-		return err
+		return copyResult{}, err
 	}
+	destPath, mode := vol.VolPath, vol.VolAccessType
+	span.SetAttributes(attribute.Int64("hostpath.copy.bytes", hostPathVolume.VolSize))
 	if hostPathVolume.VolSize > size {
-		return status.Errorf(codes.InvalidArgument, "volume %v size %v is greater than requested volume size %v", srcVolumeId, hostPathVolume.VolSize, size)
+		return copyResult{}, status.Errorf(codes.InvalidArgument, "volume %v size %v is greater than requested volume size %v", srcVolumeId, hostPathVolume.VolSize, size)
 	}
 	if mode != hostPathVolume.VolAccessType {
-		return status.Errorf(codes.InvalidArgument, "volume %v mode is not compatible with requested mode", srcVolumeId)
+		return copyResult{}, status.Errorf(codes.InvalidArgument, "volume %v mode is not compatible with requested mode", srcVolumeId)
 	}
-
-	switch mode {
-	case state.MountAccess:
-		return loadFromFileSystemVolume(hostPathVolume, destPath)
-	case state.BlockAccess:
-		return loadFromBlockVolume(hostPathVolume, destPath)
+	if mode == state.MountAccess && hostPathVolume.BlockBacked != hp.config.BlockBackedMountVolumes {
+		return copyResult{}, status.Errorf(codes.InvalidArgument, "volume %v and the new volume must both be block-backed or both be directories", srcVolumeId)
+	}
+	vol.FsType = hostPathVolume.FsType
+	vol.Encrypted = hostPathVolume.Encrypted
+
+	switch {
+	case isFileBacked(hostPathVolume):
+		return loadFromBlockVolume(ctx, hp.copyMethod, hostPathVolume, destPath)
+	case mode == state.MountAccess:
+		return loadFromFileSystemVolume(ctx, hp.copyMethod, hostPathVolume, destPath)
 	default:
-		return status.Errorf(codes.InvalidArgument, "unknow accessType: %d", mode)
+		return copyResult{}, status.Errorf(codes.InvalidArgument, "unknow accessType: %d", mode)
 	}
 }
 
 // 从系统文件加载数据.填充到volume
-func loadFromFileSystemVolume(hosPathVolume state.Volume, destPath string) error {
+func loadFromFileSystemVolume(ctx context.Context, method copyMethod, hosPathVolume state.Volume, destPath string) (copyResult, error) {
 	srcPath := hosPathVolume.VolPath
 	// 判断目录是否为空
 	isEmpty, err := hostPathIsEmpty(srcPath)
 	if err != nil {
-		return fmt.Errorf("failed verification check of source hostpath volume %v: %w", hosPathVolume.VolID, err)
+		return copyResult{}, fmt.Errorf("failed verification check of source hostpath volume %v: %w", hosPathVolume.VolID, err)
 	}
 
-	// 如果源 hostpath 卷为空，则它是一个 noop，我们只需继续操作，否则 cp 调用将失败，并显示 a file stat 错误 DNE
-	if !isEmpty{
-		args :=[]string{"-a", srcPath + "/.", destPath + "/"}
-		executor := utilexec.New()
-		out, err := executor.Command("cp", args...).CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("failed pre-populate data from volume %v: %s: %w", hosPathVolume.VolID, out, err)
-		}
+	// 如果源 hostpath 卷为空，则它是一个 noop，我们只需继续操作
+	if isEmpty {
+		return copyResult{}, nil
 	}
 
-	return nil
+	// 文件系统支持 reflink 或 copy_file_range 时在内核中复制, 否则在用户态流式复制
+	result, err := cloneTree(ctx, method, srcPath, destPath)
+	if err != nil {
+		return copyResult{}, fmt.Errorf("failed pre-populate data from volume %v: %w", hosPathVolume.VolID, err)
+	}
+	return result, nil
 }
 
 // 从块文件加载数据.填充到volume
-func loadFromBlockVolume(hostPathVolume state.Volume, destPath string) error {
-	srcPath := hostPathVolume.VolPath
-	args := []string{"if=" + srcPath, "of=" + destPath}
-	executor := utilexec.New()
-	out, err := executor.Command("dd", args...).CombinedOutput()
+func loadFromBlockVolume(ctx context.Context, method copyMethod, hostPathVolume state.Volume, destPath string) (copyResult, error) {
+	result, err := cloneFile(ctx, method, hostPathVolume.VolPath, destPath)
 	if err != nil {
-		return fmt.Errorf("failed pre-populate data from volume %v: %w: %s", hostPathVolume.VolID, err, out)
+		return copyResult{}, fmt.Errorf("failed pre-populate data from volume %v: %w", hostPathVolume.VolID, err)
 	}
-	return nil
+	return result, nil
 }
 
 // hostPathIsEmpty 是一个简单的检查，用于确定指定的 hostpath 目录是否为空。
@@ -323,7 +857,14 @@ func (hp *hostpath) deleteVolume(volID string) error {
 		return nil
 	}
 
-	if vol.VolAccessType == state.BlockAccess {
+	// 解密后的设备使用 loop 设备, 必须先关闭
+	if vol.Encrypted {
+		if err := hp.closeEncryptedVolume(context.Background(), vol); err != nil {
+			return err
+		}
+	}
+
+	if isFileBacked(vol) {
 		volPathHandler := volumepathhandler.VolumePathHandler{}
 		path := hp.getVolumePath(volID)
 		klog.V(4).Infof("deleteing loop device for file %s if it exists", path)
@@ -332,15 +873,31 @@ func (hp *hostpath) deleteVolume(volID string) error {
 		}
 	}
 
-	path := hp.getVolumePath(volID)
-	if err := os.RemoveAll(path); err != nil && !os.IsNotExist(err) {
-		return err
+	// 临时卷不会被 CO 恢复, 总是立即删除
+	if hp.trashEnabled() && !vol.Ephemeral {
+		if err := hp.trashVolume(vol); err != nil {
+			return err
+		}
+	} else {
+		if err := hp.teardownQuota(vol); err != nil {
+			return err
+		}
+
+		path := hp.getVolumePath(volID)
+		if err := os.RemoveAll(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
 	}
 
 	if err := hp.state.DeleteVolume(volID); err != nil {
 		return err
 	}
+	hp.usage.forget(volID)
 	klog.V(4).Infof("deleted hostpath volume: %s = %+v", volID, vol)
+	// 恢复卷的快照可能只是在等待这个卷被删除
+	if vol.ParentSnapID != "" {
+		return hp.deleteDeferredSnapshot(vol.ParentSnapID)
+	}
 	return nil
 }
 
@@ -0,0 +1,164 @@
+package hostpath
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// testConfig 返回测试使用的驱动配置, 状态保存在临时目录中
+func testConfig(t *testing.T) Config {
+	return Config{
+		DriverName:    "hostpath.csi.k8s.io",
+		EndPoint:      "unix:///csi.sock",
+		NodeID:        "node",
+		VendorVersion: "test",
+		StateDir:      t.TempDir(),
+		MaxVolumeSize: tib,
+	}
+}
+
+// newTestDriver 用 testConfig 创建驱动, configure 不为 nil 时先用它修改配置
+func newTestDriver(t *testing.T, configure func(cfg *Config)) *hostpath {
+	t.Helper()
+	cfg := testConfig(t)
+	if configure != nil {
+		configure(&cfg)
+	}
+	hp, err := NewHostPathDriver(cfg)
+	require.NoError(t, err)
+	return hp
+}
+
+func TestThinProvisioning(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("block volumes require root for loop devices")
+	}
+
+	hp := newTestDriver(t, func(cfg *Config) {
+		cfg.Capacity = Capacity{"fast": {Size: resource.MustParse("1Gi")}}
+		cfg.CapacityAccounting = AccountingAllocated
+	})
+
+	block := []*csi.VolumeCapability{blockCapability()}
+	for _, p := range []string{provisioningThin, provisioningThick} {
+		resp, err := hp.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:               p,
+			VolumeCapabilities: block,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: 64 * mib},
+			Parameters:         map[string]string{storageKind: "fast", provisioning: p},
+		})
+		require.NoError(t, err, p)
+		volID := resp.GetVolume().GetVolumeId()
+		t.Cleanup(func() {
+			require.NoError(t, hp.deleteVolume(volID))
+		})
+
+		vol, err := hp.state.GetVolumeByID(volID)
+		require.NoError(t, err)
+		require.Equal(t, p == provisioningThin, vol.ThinProvisioned)
+		allocated, err := allocatedBytes(vol.VolPath)
+		require.NoError(t, err)
+		if p == provisioningThin {
+			require.Less(t, allocated, mib, "thin volume is sparse")
+		} else {
+			require.GreaterOrEqual(t, allocated, 64*mib, "thick volume is preallocated")
+		}
+	}
+
+	// 只有预先分配的卷占用容量
+	capacity, err := hp.GetCapacity(context.Background(), &csi.GetCapacityRequest{Parameters: map[string]string{storageKind: "fast"}})
+	require.NoError(t, err)
+	require.Greater(t, capacity.GetAvailableCapacity(), gib-65*mib)
+	require.LessOrEqual(t, capacity.GetAvailableCapacity(), gib-64*mib)
+
+	hp.config.CapacityAccounting = AccountingNominal
+	capacity, err = hp.GetCapacity(context.Background(), &csi.GetCapacityRequest{Parameters: map[string]string{storageKind: "fast"}})
+	require.NoError(t, err)
+	require.Equal(t, gib-128*mib, capacity.GetAvailableCapacity())
+
+	_, err = hp.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "invalid",
+		VolumeCapabilities: block,
+		Parameters:         map[string]string{provisioning: "lazy"},
+	})
+	require.Error(t, err)
+	_, err = hp.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "directory",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		Parameters:         map[string]string{provisioning: provisioningThin},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err), "thin directory volume: %v", err)
+}
+
+func TestOvercommitAndHighWatermark(t *testing.T) {
+	var capacity Capacity
+	require.NoError(t, capacity.Set("fast=10Mi:4"))
+	hp := newTestDriver(t, func(cfg *Config) {
+		cfg.Capacity = capacity
+		cfg.CapacityHighWatermark = 0.5
+	})
+
+	mount := []*csi.VolumeCapability{mountCapability()}
+	createVolume := func(name string, size int64) (*csi.CreateVolumeResponse, error) {
+		return hp.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:               name,
+			VolumeCapabilities: mount,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: size},
+			Parameters:         map[string]string{storageKind: "fast"},
+		})
+	}
+
+	// 申请的容量可以超过实际的容量, 最多是它的 4 倍
+	resp, err := createVolume("a", 30*mib)
+	require.NoError(t, err)
+	_, err = createVolume("b", 20*mib)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err), "nominal budget exceeded")
+	_, err = createVolume("b", 10*mib)
+	require.NoError(t, err)
+
+	// 实际写入的数据超过高水位后, 即使还有申请的容量也不再创建新卷
+	require.NoError(t, hp.deleteVolume(hp.state.GetVolumes()[1].VolID))
+	data := make([]byte, 6*mib)
+	data[0] = 1
+	require.NoError(t, os.WriteFile(filepath.Join(hp.getVolumePath(resp.GetVolume().GetVolumeId()), "data"), data, 0600))
+	hp.refreshUsage()
+	_, err = createVolume("c", mib)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err), "high watermark exceeded")
+	require.Contains(t, err.Error(), "exceeds 50% of 10Mi")
+	available, err := hp.GetCapacity(context.Background(), &csi.GetCapacityRequest{Parameters: map[string]string{storageKind: "fast"}})
+	require.NoError(t, err)
+	require.Zero(t, available.GetAvailableCapacity())
+}
+
+func TestStateDirLock(t *testing.T) {
+	cfg := testConfig(t)
+	hp, err := NewHostPathDriver(cfg)
+	require.NoError(t, err)
+
+	// 第二个驱动立即失败, 错误中包含持有锁的进程
+	_, err = NewHostPathDriver(cfg)
+	require.ErrorIs(t, err, state.ErrLocked)
+	require.ErrorContains(t, err, fmt.Sprintf("held by process %d", os.Getpid()))
+
+	// 滚动更新时新的驱动等待旧的驱动退出
+	cfg.StateLockTimeout = 10 * time.Second
+	first := hp
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		first.Close()
+	}()
+	hp, err = NewHostPathDriver(cfg)
+	require.NoError(t, err)
+	require.NoError(t, hp.Close())
+}
@@ -5,11 +5,12 @@ import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 	"k8s.io/klog/v2"
 )
 // 返回插件信息
 func (hp *hostpath) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error)  {
-	klog.V(5).Infof("Using default GetPluginInfo")
+	klog.FromContext(ctx).V(5).Info("Using default GetPluginInfo")
 
 	if hp.config.DriverName == "" {
 		return nil, status.Error(codes.Unavailable, "Driver name not configured")
@@ -25,13 +26,18 @@ func (hp *hostpath) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoReq
 	}, nil
 }
 
+// 执行健康检查. 启动时的状态恢复完成之前返回 Ready=false, 有检查失败时返回 FailedPrecondition
 func (hp *hostpath) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
-	return &csi.ProbeResponse{}, nil
+	ready, results := hp.checkHealth(ctx)
+	if err := healthError(results); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "health check failed: %v", err)
+	}
+	return &csi.ProbeResponse{Ready: wrapperspb.Bool(ready)}, nil
 }
 
 // 返回当前插件支持的能力
 func (hp *hostpath) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
-	klog.V(5).Infof("Using default capabilities")
+	klog.FromContext(ctx).V(5).Info("Using default capabilities")
 	caps := []*csi.PluginCapability{
 		{
 			Type: &csi.PluginCapability_Service_{
@@ -0,0 +1,75 @@
+package hostpath
+
+import (
+	"context"
+	"fmt"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	"github.com/pborman/uuid"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"runtime/debug"
+	"time"
+)
+
+// requestIDKey 是携带请求id的 gRPC metadata. 客户端没有提供时由驱动生成
+const requestIDKey = "x-request-id"
+
+// unaryInterceptors 返回 CSI 服务的拦截器: span 在最外层, 日志可以记录 trace id;
+// 日志和指标都能看到由 panic 转换而来的错误
+func (hp *hostpath) unaryInterceptors() []grpc.UnaryServerInterceptor {
+	return []grpc.UnaryServerInterceptor{
+		hp.traceGRPC,
+		logGRPC,
+		hp.metrics.unaryInterceptor,
+		hp.checkLeader,
+		recoverPanic,
+	}
+}
+
+// logGRPC 为每个请求创建带有方法和请求id的 logger 并放入 context, 然后记录去掉了 secrets 的请求,
+// 以及调用的时间和状态码。
+func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	requestID := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get(requestIDKey)) > 0 {
+		requestID = md.Get(requestIDKey)[0]
+	} else {
+		requestID = uuid.NewUUID().String()
+	}
+	// 把请求id返回给客户端, 以便关联双方的日志
+	if err := grpc.SetHeader(ctx, metadata.Pairs(requestIDKey, requestID)); err != nil {
+		klog.V(5).Infof("failed to set request id header: %v", err)
+	}
+
+	logger := klog.FromContext(ctx).WithValues("method", info.FullMethod, "requestID", requestID)
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		logger = logger.WithValues("traceID", spanContext.TraceID().String())
+	}
+	ctx = klog.NewContext(ctx, logger)
+	logger.V(5).Info("GRPC request", "request", protosanitizer.StripSecrets(req))
+
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	duration := time.Since(start)
+	if err != nil {
+		logger.V(2).Info("GRPC call failed", "duration", duration, "code", status.Code(err).String(), "err", err)
+	} else {
+		logger.V(3).Info("GRPC call succeeded", "duration", duration, "code", codes.OK.String())
+		logger.V(5).Info("GRPC response", "response", protosanitizer.StripSecrets(resp))
+	}
+	return resp, err
+}
+
+// recoverPanic 把处理请求时的 panic 转换为 codes.Internal, 驱动继续提供服务
+func recoverPanic(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			klog.FromContext(ctx).Error(fmt.Errorf("%v", r), "GRPC call panicked", "stack", string(debug.Stack()))
+			resp, err = nil, status.Errorf(codes.Internal, "panic in %s: %v", info.FullMethod, r)
+		}
+	}()
+	return handler(ctx, req)
+}
@@ -0,0 +1,92 @@
+package hostpath
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/go-logr/logr/funcr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// contextWithLogs 返回一个 context, 其中的 logger 把所有日志行保存在 logs 中
+func contextWithLogs(logs *[]string) context.Context {
+	logger := funcr.New(func(prefix, args string) {
+		*logs = append(*logs, args)
+	}, funcr.Options{Verbosity: 5})
+	return klog.NewContext(context.Background(), logger)
+}
+
+func TestLogGRPC(t *testing.T) {
+	var logs []string
+	ctx := metadata.NewIncomingContext(contextWithLogs(&logs), metadata.Pairs(requestIDKey, "request-1"))
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeStageVolume"}
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId: "vol",
+		Secrets:  map[string]string{"passphrase": "top-secret"},
+	}
+
+	_, err := logGRPC(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		// 处理请求的方法使用带有请求id的 logger
+		klog.FromContext(ctx).Info("handling request")
+		return nil, status.Error(codes.NotFound, "volume not found")
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	all := strings.Join(logs, "\n")
+	require.NotContains(t, all, "top-secret")
+	require.Contains(t, all, "***stripped***")
+	for _, line := range logs {
+		require.Contains(t, line, `"method"="/csi.v1.Node/NodeStageVolume"`)
+		require.Contains(t, line, `"requestID"="request-1"`)
+	}
+	require.Contains(t, all, `"msg"="handling request"`)
+	require.Contains(t, all, `"code"="NotFound"`)
+	require.Contains(t, all, `"duration"=`)
+}
+
+func TestRecoverPanic(t *testing.T) {
+	var logs []string
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}
+	_, err := recoverPanic(contextWithLogs(&logs), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		var vol *csi.Volume
+		return vol.VolumeId, nil
+	})
+	require.Equal(t, codes.Internal, status.Code(err), "panic: %v", err)
+	require.Contains(t, status.Convert(err).Message(), "nil pointer dereference")
+	require.Len(t, logs, 1)
+	require.Contains(t, logs[0], "GRPC call panicked")
+}
+
+func TestGRPCServerInterceptors(t *testing.T) {
+	hp := newTestDriver(t, nil)
+
+	endpoint := "unix://" + filepath.Join(t.TempDir(), "csi.sock")
+	s := NewNonBlockingGRPCServer()
+	require.NoError(t, s.Start(endpoint, hp, hp, hp, hp, grpc.ChainUnaryInterceptor(hp.unaryInterceptors()...)))
+	defer s.ForceStop()
+
+	conn, err := grpc.NewClient(endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// 驱动生成请求id并返回给客户端
+	var header metadata.MD
+	_, err = csi.NewIdentityClient(conn).GetPluginInfo(context.Background(), &csi.GetPluginInfoRequest{}, grpc.Header(&header))
+	require.NoError(t, err)
+	require.Len(t, header.Get(requestIDKey), 1)
+	require.NotEmpty(t, header.Get(requestIDKey)[0])
+
+	_, err = csi.NewControllerClient(conn).DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.Equal(t, 1.0, testutil.ToFloat64(hp.metrics.rpcErrors.WithLabelValues("/csi.v1.Controller/DeleteVolume", "InvalidArgument")))
+}
@@ -0,0 +1,366 @@
+package hostpath
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// 选主方式
+	LeaderElectionFile       = "file"
+	LeaderElectionKubernetes = "kubernetes"
+
+	// 默认的租约文件, 位于 StateDir 中
+	defaultLeaseFile = ".leader-election.json"
+	// 默认的租约时长, 续约期限和重试间隔, 与 Kubernetes 的控制器相同
+	defaultLeaseDuration = 15 * time.Second
+	defaultRenewDeadline = 10 * time.Second
+	defaultRetryPeriod   = 2 * time.Second
+	// Pod 所在的名称空间
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// leaderElection 记录选主的状态
+type leaderElection struct {
+	// 当前实例是否是 leader, 以及最近一次观察到的 leader
+	leading atomic.Bool
+	leader  atomic.Value
+	// 串行执行成为 leader 和失去 leader 时的处理
+	mutex sync.Mutex
+	// 等待选主结束, 此时已经释放了租约和状态文件
+	wg sync.WaitGroup
+}
+
+// leaderElectionEnabled 判断是否只有 leader 提供 controller 服务
+func (hp *hostpath) leaderElectionEnabled() bool {
+	return hp.config.LeaderElection != ""
+}
+
+// isLeader 判断当前实例是否可以提供 controller 服务
+func (hp *hostpath) isLeader() bool {
+	return !hp.leaderElectionEnabled() || hp.election.leading.Load()
+}
+
+func durationOrDefault(d, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return def
+}
+
+// leaderIdentity 返回当前实例在选主中的标识, 默认是主机名, 即 Pod 的名称
+func (hp *hostpath) leaderIdentity() (string, error) {
+	if hp.config.LeaderElectionIdentity != "" {
+		return hp.config.LeaderElectionIdentity, nil
+	}
+	return os.Hostname()
+}
+
+// newLeaseLock 按配置创建租约
+func (hp *hostpath) newLeaseLock() (resourcelock.Interface, error) {
+	identity, err := hp.leaderIdentity()
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine leader election identity: %v", err)
+	}
+	switch hp.config.LeaderElection {
+	case LeaderElectionFile:
+		path := hp.config.LeaderElectionLeaseFile
+		if path == "" {
+			path = filepath.Join(hp.config.StateDir, defaultLeaseFile)
+		}
+		return &fileLeaseLock{path: path, identity: identity}, nil
+	case LeaderElectionKubernetes:
+		client := hp.config.KubeClient
+		if client == nil {
+			config, err := rest.InClusterConfig()
+			if err != nil {
+				return nil, fmt.Errorf("failed to create Kubernetes client config: %v", err)
+			}
+			if client, err = kubernetes.NewForConfig(config); err != nil {
+				return nil, fmt.Errorf("failed to create Kubernetes client: %v", err)
+			}
+		}
+		namespace := hp.config.LeaderElectionNamespace
+		if namespace == "" {
+			namespace = "default"
+			if data, err := os.ReadFile(serviceAccountNamespaceFile); err == nil {
+				namespace = strings.TrimSpace(string(data))
+			}
+		}
+		name := hp.config.LeaderElectionLeaseName
+		if name == "" {
+			// Lease 的名称不能包含驱动名称中的点
+			name = strings.ReplaceAll(hp.config.DriverName, ".", "-")
+		}
+		return &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Client:     client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid leader election %q, must be %q or %q", hp.config.LeaderElection, LeaderElectionFile, LeaderElectionKubernetes)
+	}
+}
+
+// StartLeaderElection 参与选主直到 stopCh 被关闭。只有 leader 读取状态文件并提供 controller 服务,
+// 失去租约后重新参与选主。
+func (hp *hostpath) StartLeaderElection(stopCh <-chan struct{}) error {
+	lock, err := hp.newLeaseLock()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+	hp.election.wg.Add(1)
+	go func() {
+		defer hp.election.wg.Done()
+		for ctx.Err() == nil {
+			if err := hp.runLeaderElection(ctx, lock); err != nil {
+				klog.Errorf("leader election failed: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(durationOrDefault(hp.config.RetryPeriod, defaultRetryPeriod)):
+			}
+		}
+	}()
+	return nil
+}
+
+// runLeaderElection 等待成为 leader, 在失去租约或者 ctx 结束时返回
+func (hp *hostpath) runLeaderElection(ctx context.Context, lock resourcelock.Interface) error {
+	// 无法接管状态时放弃租约
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   durationOrDefault(hp.config.LeaseDuration, defaultLeaseDuration),
+		RenewDeadline:   durationOrDefault(hp.config.RenewDeadline, defaultRenewDeadline),
+		RetryPeriod:     durationOrDefault(hp.config.RetryPeriod, defaultRetryPeriod),
+		ReleaseOnCancel: true,
+		Name:            hp.config.DriverName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				if err := hp.startLeading(ctx); err != nil {
+					klog.Errorf("failed to take over as leader, giving up the lease: %v", err)
+					cancel()
+				}
+			},
+			OnStoppedLeading: hp.stopLeading,
+			OnNewLeader: func(identity string) {
+				klog.Infof("new leader elected: %s", identity)
+				hp.election.leader.Store(identity)
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	elector.Run(ctx)
+	return nil
+}
+
+// startLeading 在成为 leader 时读取状态文件, 之前的 leader 可能修改了它
+func (hp *hostpath) startLeading(ctx context.Context) error {
+	hp.election.mutex.Lock()
+	defer hp.election.mutex.Unlock()
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	// 之前的 leader 在续约失败时释放状态文件, 最多等待一个租约时长
+	s, err := state.New(hp.statePath(), state.WithLock(durationOrDefault(hp.config.LeaseDuration, defaultLeaseDuration)))
+	if err != nil {
+		return err
+	}
+	hp.mutex.Lock()
+	old := hp.state
+	hp.state = hp.metrics.instrumentState(s, hp.tracer, hp.stateContext)
+	hp.mutex.Unlock()
+	old.Close()
+
+	if err := hp.reconcile(); err != nil {
+		hp.releaseState()
+		return err
+	}
+	hp.election.leading.Store(true)
+	hp.startBackgroundTasks()
+	klog.Info("started leading, serving controller requests")
+	return nil
+}
+
+// stopLeading 在失去 leader 时停止提供 controller 服务并释放状态文件。
+// 后台任务和快照任务结束之后才释放, 新的 leader 不会看到它们的写入
+func (hp *hostpath) stopLeading() {
+	hp.election.mutex.Lock()
+	defer hp.election.mutex.Unlock()
+	if !hp.election.leading.Swap(false) {
+		return
+	}
+	klog.Info("stopped leading, no longer serving controller requests")
+	hp.stopBackgroundTasks()
+	hp.cancelSnapshotJobs()
+	hp.releaseState()
+}
+
+// cancelSnapshotJobs 取消所有正在运行的快照任务并等待它们结束。
+// 未完成的快照留在状态文件中, 由新的 leader 在 resumeSnapshots 中重新创建
+func (hp *hostpath) cancelSnapshotJobs() {
+	hp.mutex.Lock()
+	for _, job := range hp.snapshotJobs {
+		job.cancel()
+	}
+	hp.mutex.Unlock()
+	hp.snapshotWG.Wait()
+
+	// 任务的结果属于新的 leader 的状态, 不能再用于之后的请求
+	hp.mutex.Lock()
+	hp.snapshotJobs = map[string]*snapshotJob{}
+	hp.mutex.Unlock()
+}
+
+// releaseState 用不保存的空状态替换状态文件, 还在运行的后台任务不会再修改状态文件
+func (hp *hostpath) releaseState() {
+	empty, _ := state.New("")
+	hp.mutex.Lock()
+	old := hp.state
+	hp.state = hp.metrics.instrumentState(empty, hp.tracer, hp.stateContext)
+	hp.mutex.Unlock()
+	if err := old.Close(); err != nil {
+		klog.Errorf("failed to release state: %v", err)
+	}
+}
+
+// checkLeader 拒绝 follower 收到的 controller 请求
+func (hp *hostpath) checkLeader(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !hp.isLeader() && (strings.HasPrefix(info.FullMethod, "/csi.v1.Controller/") || strings.HasPrefix(info.FullMethod, "/csi.v1.GroupController/")) {
+		leader, _ := hp.election.leader.Load().(string)
+		return nil, status.Errorf(codes.Unavailable, "not the leader, the current leader is %q", leader)
+	}
+	return handler(ctx, req)
+}
+
+// fileLeaseLock 把租约保存在共享文件系统上的文件中。更新时检查文件在上一次读取之后没有被修改,
+// 与 Kubernetes 对象的 resourceVersion 作用相同
+type fileLeaseLock struct {
+	path     string
+	identity string
+
+	mutex sync.Mutex
+	// 上一次读取的内容
+	observed []byte
+}
+
+var _ resourcelock.Interface = &fileLeaseLock{}
+
+func (l *fileLeaseLock) Get(ctx context.Context) (*resourcelock.LeaderElectionRecord, []byte, error) {
+	data, err := os.ReadFile(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, apierrors.NewNotFound(schema.GroupResource{Resource: "lease file"}, l.path)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var record resourcelock.LeaderElectionRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode lease file %s: %v", l.path, err)
+	}
+	l.mutex.Lock()
+	l.observed = data
+	l.mutex.Unlock()
+	return &record, data, nil
+}
+
+func (l *fileLeaseLock) Create(ctx context.Context, record resourcelock.LeaderElectionRecord) error {
+	return l.write(record, func(current []byte, exists bool) error {
+		if exists {
+			return apierrors.NewAlreadyExists(schema.GroupResource{Resource: "lease file"}, l.path)
+		}
+		return nil
+	})
+}
+
+func (l *fileLeaseLock) Update(ctx context.Context, record resourcelock.LeaderElectionRecord) error {
+	l.mutex.Lock()
+	observed := l.observed
+	l.mutex.Unlock()
+	return l.write(record, func(current []byte, exists bool) error {
+		if !exists || !bytes.Equal(current, observed) {
+			return apierrors.NewConflict(schema.GroupResource{Resource: "lease file"}, l.path, errors.New("the lease was modified"))
+		}
+		return nil
+	})
+}
+
+// write 在持有文件锁时检查当前的内容并替换租约文件
+func (l *fileLeaseLock) write(record resourcelock.LeaderElectionRecord, check func(current []byte, exists bool) error) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	lockFile, err := os.OpenFile(l.path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer lockFile.Close()
+	if err := unix.Flock(int(lockFile.Fd()), unix.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock %s: %v", lockFile.Name(), err)
+	}
+
+	current, err := os.ReadFile(l.path)
+	exists := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := check(current, exists); err != nil {
+		return err
+	}
+	// 其它实例不会读到写了一半的文件
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	l.observed = data
+	l.mutex.Unlock()
+	return nil
+}
+
+func (l *fileLeaseLock) RecordEvent(string) {}
+
+func (l *fileLeaseLock) Identity() string {
+	return l.identity
+}
+
+func (l *fileLeaseLock) Describe() string {
+	return l.path
+}
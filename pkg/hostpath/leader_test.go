@@ -0,0 +1,114 @@
+package hostpath
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLeaderElection(t *testing.T) {
+	for name, configure := range map[string]func(cfg *Config){
+		"file": func(cfg *Config) {
+			cfg.LeaderElection = LeaderElectionFile
+		},
+		"kubernetes": func() func(cfg *Config) {
+			client := fake.NewSimpleClientset()
+			return func(cfg *Config) {
+				cfg.LeaderElection = LeaderElectionKubernetes
+				cfg.LeaderElectionNamespace = "default"
+				cfg.KubeClient = client
+			}
+		}(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			testLeaderElection(t, configure)
+		})
+	}
+}
+
+func testLeaderElection(t *testing.T, configure func(cfg *Config)) {
+	stateDir := t.TempDir()
+	newDriver := func(identity string) *hostpath {
+		return newTestDriver(t, func(cfg *Config) {
+			cfg.StateDir = stateDir
+			cfg.LeaderElectionIdentity = identity
+			cfg.LeaseDuration = time.Second
+			cfg.RenewDeadline = 500 * time.Millisecond
+			cfg.RetryPeriod = 100 * time.Millisecond
+			configure(cfg)
+		})
+	}
+	// 通过选主的拦截器调用 RPC
+	call := func(hp *hostpath, method string) error {
+		_, err := hp.checkLeader(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: method}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		})
+		return err
+	}
+	const createVolume = "/csi.v1.Controller/CreateVolume"
+
+	first := newDriver("first")
+	stopFirst := make(chan struct{})
+	require.NoError(t, first.StartLeaderElection(stopFirst))
+	require.Eventually(t, first.isLeader, 10*time.Second, 10*time.Millisecond, "first instance becomes leader")
+	_, err := first.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "vol",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+	})
+	require.NoError(t, err)
+
+	second := newDriver("second")
+	stopSecond := make(chan struct{})
+	require.NoError(t, second.StartLeaderElection(stopSecond))
+	defer func() {
+		close(stopSecond)
+		second.election.wg.Wait()
+	}()
+	// follower 只拒绝 controller 请求
+	require.Eventually(t, func() bool {
+		err := call(second, createVolume)
+		return status.Code(err) == codes.Unavailable && status.Convert(err).Message() == `not the leader, the current leader is "first"`
+	}, 10*time.Second, 10*time.Millisecond, "follower knows the leader")
+	require.NoError(t, call(second, "/csi.v1.Node/NodeGetInfo"))
+	require.NoError(t, call(first, createVolume))
+
+	// 所有快照任务都在等待空闲的 worker
+	for i := 0; i < cap(first.snapshotWorkers); i++ {
+		first.snapshotWorkers <- struct{}{}
+	}
+	vol, err := first.state.GetVolumeByName("vol")
+	require.NoError(t, err)
+	snap, err := first.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snap", SourceVolumeId: vol.VolID})
+	require.NoError(t, err)
+	require.False(t, snap.GetSnapshot().GetReadyToUse())
+
+	// leader 停止后, follower 接管并读取 leader 写入的状态
+	close(stopFirst)
+	first.election.wg.Wait()
+	require.False(t, first.isLeader())
+	// 失去 leader 之前取消了快照任务
+	first.mutex.Lock()
+	require.Empty(t, first.snapshotJobs, "snapshot jobs of the previous leader")
+	first.mutex.Unlock()
+	require.Eventually(t, second.isLeader, 10*time.Second, 10*time.Millisecond, "second instance takes over")
+	require.NoError(t, call(second, createVolume))
+	second.mutex.Lock()
+	_, err = second.state.GetVolumeByName("vol")
+	second.mutex.Unlock()
+	require.NoError(t, err, "volume created by the previous leader")
+
+	// 新的 leader 继续创建未完成的快照
+	second.snapshotWG.Wait()
+	second.mutex.Lock()
+	snapshot, err := second.state.GetSnapshotByID(snap.GetSnapshot().GetSnapshotId())
+	second.mutex.Unlock()
+	require.NoError(t, err)
+	require.True(t, snapshot.ReadyToUse, "snapshot resumed by the new leader")
+}
@@ -0,0 +1,138 @@
+package hostpath
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// 删除仍有依赖的卷或快照时的策略. 卷的依赖是它的快照,
+	// 快照的依赖是从它恢复的卷
+	// 立即删除(默认), 依赖不受影响
+	DeletionPolicyAllow = "allow"
+	// 拒绝删除, 返回 FailedPrecondition
+	DeletionPolicyBlock = "block"
+	// 立即返回成功, 保留数据直到最后一个依赖被删除
+	DeletionPolicyDefer = "defer"
+)
+
+// validateDeletionPolicy 检查删除策略的值
+func validateDeletionPolicy(policy string) error {
+	switch policy {
+	case "", DeletionPolicyAllow, DeletionPolicyBlock, DeletionPolicyDefer:
+		return nil
+	default:
+		return fmt.Errorf("invalid deletion policy %q, must be %q, %q or %q", policy, DeletionPolicyAllow, DeletionPolicyBlock, DeletionPolicyDefer)
+	}
+}
+
+// checkDeletionPolicy 根据删除策略决定是否推迟删除有依赖的卷或快照
+func checkDeletionPolicy(policy, what, id string, dependents []string) (deferred bool, err error) {
+	if len(dependents) == 0 {
+		return false, nil
+	}
+	switch policy {
+	case DeletionPolicyBlock:
+		return false, status.Errorf(codes.FailedPrecondition, "%s %s still has dependents %v", what, id, dependents)
+	case DeletionPolicyDefer:
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// volumeDependents 返回卷的快照的id
+func (hp *hostpath) volumeDependents(volID string) []string {
+	var ids []string
+	for _, snapshot := range state.SnapshotsOf(hp.state, volID) {
+		ids = append(ids, snapshot.Id)
+	}
+	return ids
+}
+
+// snapshotDependents 返回从快照恢复的卷的id
+func (hp *hostpath) snapshotDependents(snapshotID string) []string {
+	var ids []string
+	for _, vol := range state.RestoredFrom(hp.state, snapshotID) {
+		ids = append(ids, vol.VolID)
+	}
+	return ids
+}
+
+// removeSnapshot 按照 SnapshotDeletionPolicy 删除快照. 推迟删除的快照对
+// CO 不再可见, 在最后一个从它恢复的卷被删除时才真正删除
+func (hp *hostpath) removeSnapshot(ctx context.Context, snapshot state.Snapshot) error {
+	if snapshot.DeletionDeferred {
+		return nil
+	}
+	deferred, err := checkDeletionPolicy(hp.config.SnapshotDeletionPolicy, "snapshot", snapshot.Id, hp.snapshotDependents(snapshot.Id))
+	if err != nil {
+		return err
+	}
+	if !deferred {
+		return hp.deleteSnapshot(snapshot.Id)
+	}
+	snapshot.DeletionDeferred = true
+	if err := hp.state.UpdateSnapshot(snapshot); err != nil {
+		return err
+	}
+	klog.FromContext(ctx).V(4).Info("Deferred deletion of snapshot until its restored volumes are deleted", "snapshotID", snapshot.Id)
+	return nil
+}
+
+// deferVolumeDeletion 把卷标记为已删除. 它的数据保留到最后一个快照被删除
+func (hp *hostpath) deferVolumeDeletion(ctx context.Context, vol state.Volume) error {
+	vol.DeletionDeferred = true
+	// 已删除的卷不再创建定时快照, 也不再复制
+	vol.SnapshotSchedule = ""
+	vol.SnapshotRetention = ""
+	vol.Replication = state.Replication{}
+	if err := hp.state.UpdateVolume(vol); err != nil {
+		return err
+	}
+	klog.FromContext(ctx).V(4).Info("Deferred deletion of volume until its snapshots are deleted", "volumeID", vol.VolID)
+	return nil
+}
+
+// deleteDeferredSnapshot 在从快照恢复的最后一个卷被删除后删除推迟删除的快照
+func (hp *hostpath) deleteDeferredSnapshot(snapshotID string) error {
+	snapshot, err := hp.state.GetSnapshotByID(snapshotID)
+	if err != nil || !snapshot.DeletionDeferred || len(hp.snapshotDependents(snapshotID)) > 0 {
+		return nil
+	}
+	klog.V(4).Infof("deleting snapshot %s, its last restored volume is gone", snapshotID)
+	return hp.deleteSnapshot(snapshotID)
+}
+
+// deleteDeferredVolume 在卷的最后一个快照被删除后删除推迟删除的卷
+func (hp *hostpath) deleteDeferredVolume(volID string) error {
+	vol, err := hp.state.GetVolumeByID(volID)
+	if err != nil || !vol.DeletionDeferred || len(hp.volumeDependents(volID)) > 0 {
+		return nil
+	}
+	klog.V(4).Infof("deleting volume %s, its last snapshot is gone", volID)
+	return hp.deleteVolume(volID)
+}
+
+// visibleVolume 返回 CO 可以使用的卷, 推迟删除的卷被当作不存在
+func (hp *hostpath) visibleVolume(volID string) (state.Volume, error) {
+	vol, err := hp.state.GetVolumeByID(volID)
+	if err == nil && vol.DeletionDeferred {
+		return state.Volume{}, status.Errorf(codes.NotFound, "volume id %s was deleted", volID)
+	}
+	return vol, err
+}
+
+// visibleSnapshot 返回 CO 可以使用的快照, 推迟删除的快照被当作不存在
+func (hp *hostpath) visibleSnapshot(snapshotID string) (state.Snapshot, error) {
+	snapshot, err := hp.state.GetSnapshotByID(snapshotID)
+	if err == nil && snapshot.DeletionDeferred {
+		return state.Snapshot{}, status.Errorf(codes.NotFound, "snapshot id %s was deleted", snapshotID)
+	}
+	return snapshot, err
+}
@@ -0,0 +1,111 @@
+package hostpath
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDeletionPolicy(t *testing.T) {
+	ctx := context.Background()
+	// setup 创建卷 src, 它的快照和从快照恢复的卷 restored
+	setup := func(t *testing.T, policy string) (hp *hostpath, srcID, snapshotID, restoredID string) {
+		hp = newTestDriver(t, func(cfg *Config) {
+			cfg.VolumeDeletionPolicy = policy
+			cfg.SnapshotDeletionPolicy = policy
+		})
+		src, err := hp.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               "src",
+			VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		})
+		require.NoError(t, err)
+		snapshot, err := hp.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+			Name:           "snap",
+			SourceVolumeId: src.GetVolume().GetVolumeId(),
+		})
+		require.NoError(t, err)
+		hp.snapshotWG.Wait()
+		restored, err := hp.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               "restored",
+			VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshot.GetSnapshot().GetSnapshotId()}},
+			},
+		})
+		require.NoError(t, err)
+		return hp, src.GetVolume().GetVolumeId(), snapshot.GetSnapshot().GetSnapshotId(), restored.GetVolume().GetVolumeId()
+	}
+	deleteVolume := func(hp *hostpath, volID string) error {
+		_, err := hp.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volID})
+		return err
+	}
+	deleteSnapshot := func(hp *hostpath, snapshotID string) error {
+		_, err := hp.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: snapshotID})
+		return err
+	}
+
+	t.Run("allow", func(t *testing.T) {
+		hp, srcID, snapshotID, restoredID := setup(t, DeletionPolicyAllow)
+		vol, err := hp.state.GetVolumeByID(restoredID)
+		require.NoError(t, err)
+		require.Equal(t, snapshotID, vol.ParentSnapID, "parent snapshot is recorded")
+		require.Empty(t, vol.ParentVolID)
+
+		require.NoError(t, deleteVolume(hp, srcID))
+		require.NoError(t, deleteSnapshot(hp, snapshotID))
+		_, err = hp.state.GetSnapshotByID(snapshotID)
+		require.Error(t, err)
+	})
+
+	t.Run("block", func(t *testing.T) {
+		hp, srcID, snapshotID, restoredID := setup(t, DeletionPolicyBlock)
+		err := deleteVolume(hp, srcID)
+		require.Equal(t, codes.FailedPrecondition, status.Code(err))
+		require.ErrorContains(t, err, snapshotID)
+		err = deleteSnapshot(hp, snapshotID)
+		require.Equal(t, codes.FailedPrecondition, status.Code(err))
+		require.ErrorContains(t, err, restoredID)
+
+		// 依赖被删除后可以删除
+		require.NoError(t, deleteVolume(hp, restoredID))
+		require.NoError(t, deleteSnapshot(hp, snapshotID))
+		require.NoError(t, deleteVolume(hp, srcID))
+		require.Empty(t, hp.state.GetVolumes())
+	})
+
+	t.Run("defer", func(t *testing.T) {
+		hp, srcID, snapshotID, restoredID := setup(t, DeletionPolicyDefer)
+		src, err := hp.state.GetVolumeByID(srcID)
+		require.NoError(t, err)
+
+		// 删除立即成功, 数据保留到依赖被删除
+		require.NoError(t, deleteVolume(hp, srcID))
+		require.NoError(t, deleteVolume(hp, srcID), "repeated delete")
+		require.NoError(t, deleteSnapshot(hp, snapshotID))
+		require.DirExists(t, src.VolPath)
+		list, err := hp.ListSnapshots(ctx, &csi.ListSnapshotsRequest{})
+		require.NoError(t, err)
+		require.Empty(t, list.GetEntries(), "deferred snapshot is hidden")
+		_, err = hp.state.GetVolumeByName("src")
+		require.Error(t, err, "name of deferred volume can be reused")
+		_, err = hp.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snap-2", SourceVolumeId: srcID})
+		require.Equal(t, codes.NotFound, status.Code(err))
+
+		// 删除最后一个恢复的卷时依次删除快照和源卷
+		require.NoError(t, deleteVolume(hp, restoredID))
+		require.Empty(t, hp.state.GetVolumes())
+		require.Empty(t, hp.state.GetSnapshots())
+		_, err = os.Stat(src.VolPath)
+		require.True(t, os.IsNotExist(err), "source volume data removed")
+	})
+
+	cfg := testConfig(t)
+	cfg.VolumeDeletionPolicy = "later"
+	_, err := NewHostPathDriver(cfg)
+	require.ErrorContains(t, err, `invalid deletion policy "later"`)
+}
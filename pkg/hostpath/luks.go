@@ -0,0 +1,222 @@
+package hostpath
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"k8s.io/kubernetes/pkg/volume/util/volumepathhandler"
+	utilexec "k8s.io/utils/exec"
+)
+
+const (
+	// encrypted 参数为 true 时块卷的块文件在创建时用 LUKS2 格式化,
+	// NodeStage 时打开解密后的设备, NodeUnstage 时关闭
+	encrypted = "encrypted"
+	// CreateVolume 和 NodeStageVolume 的 secrets 中 LUKS 密码的名称
+	encryptionPassphraseSecret = "encryptionPassphrase"
+
+	// LUKS2 头的大小, 也是数据区在块文件中的偏移。加密卷的块文件比卷的大小多出这么多,
+	// 这样数据区正好是申请的容量
+	luksHeaderSize = 16 * mib
+
+	// 解密后的设备在 /dev/mapper 中的名称的前缀
+	cryptDevicePrefix = "hostpath-"
+	cryptDeviceDir    = "/dev/mapper"
+)
+
+// errWrongPassphrase 表示密码不能打开 LUKS 设备
+var errWrongPassphrase = errors.New("no key slot of the LUKS device matches the passphrase")
+
+// cryptSetup 格式化和打开 LUKS2 加密的设备. 测试中使用不需要 root 权限的实现
+type cryptSetup interface {
+	// format 把 device 格式化为 LUKS2, 原来的数据会丢失
+	format(ctx context.Context, device string, passphrase []byte) error
+	// isLuks 判断 device 是否有 LUKS 头
+	isLuks(ctx context.Context, device string) (bool, error)
+	// open 用密码打开 device, 返回解密后的设备的路径。已经打开时直接返回路径
+	open(ctx context.Context, device, name string, passphrase []byte) (string, error)
+	// close 关闭解密后的设备, 没有打开时什么也不做
+	close(ctx context.Context, name string) error
+	// devicePath 返回解密后的设备的路径
+	devicePath(name string) string
+}
+
+// cryptDeviceName 返回卷解密后的设备的名称
+func cryptDeviceName(volID string) string {
+	return cryptDevicePrefix + volID
+}
+
+// luksCryptSetup 使用 cryptsetup 命令, 密码通过标准输入传递
+type luksCryptSetup struct {
+	exec utilexec.Interface
+}
+
+func (c luksCryptSetup) run(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	cmd := c.exec.CommandContext(ctx, "cryptsetup", args...)
+	if stdin != nil {
+		cmd.SetStdin(bytes.NewReader(stdin))
+	}
+	klog.V(4).Infof("Command Start: cryptsetup %v", args)
+	out, err := cmd.CombinedOutput()
+	klog.V(4).Infof("Command Finish: %v", string(out))
+	return out, err
+}
+
+// exitStatus 返回命令的退出码, 命令没有运行时返回 -1
+func exitStatus(err error) int {
+	var exitErr utilexec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus()
+	}
+	return -1
+}
+
+func (c luksCryptSetup) format(ctx context.Context, device string, passphrase []byte) error {
+	offset := strconv.FormatInt(luksHeaderSize/512, 10)
+	if out, err := c.run(ctx, passphrase, "luksFormat", "--type", "luks2", "--offset", offset, "--batch-mode", "--key-file=-", device); err != nil {
+		return fmt.Errorf("cryptsetup luksFormat %s: %w: %s", device, err, out)
+	}
+	return nil
+}
+
+func (c luksCryptSetup) isLuks(ctx context.Context, device string) (bool, error) {
+	out, err := c.run(ctx, nil, "isLuks", device)
+	switch {
+	case err == nil:
+		return true, nil
+	case exitStatus(err) == 1:
+		return false, nil
+	default:
+		return false, fmt.Errorf("cryptsetup isLuks %s: %w: %s", device, err, out)
+	}
+}
+
+func (c luksCryptSetup) active(ctx context.Context, name string) bool {
+	// 设备不存在时 cryptsetup status 的退出码是 4
+	_, err := c.run(ctx, nil, "status", name)
+	return err == nil
+}
+
+func (c luksCryptSetup) devicePath(name string) string {
+	return filepath.Join(cryptDeviceDir, name)
+}
+
+func (c luksCryptSetup) open(ctx context.Context, device, name string, passphrase []byte) (string, error) {
+	path := c.devicePath(name)
+	if c.active(ctx, name) {
+		return path, nil
+	}
+	out, err := c.run(ctx, passphrase, "open", "--type", "luks2", "--key-file=-", device, name)
+	switch {
+	case err == nil:
+		return path, nil
+	case exitStatus(err) == 2:
+		return "", errWrongPassphrase
+	default:
+		return "", fmt.Errorf("cryptsetup open %s: %w: %s", device, err, out)
+	}
+}
+
+func (c luksCryptSetup) close(ctx context.Context, name string) error {
+	if !c.active(ctx, name) {
+		return nil
+	}
+	if out, err := c.run(ctx, nil, "close", name); err != nil {
+		return fmt.Errorf("cryptsetup close %s: %w: %s", name, err, out)
+	}
+	return nil
+}
+
+// passphraseFrom 返回 secrets 中的 LUKS 密码
+func passphraseFrom(secrets map[string]string) ([]byte, error) {
+	passphrase, ok := secrets[encryptionPassphraseSecret]
+	if !ok || passphrase == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "encrypted volumes require the %s secret", encryptionPassphraseSecret)
+	}
+	return []byte(passphrase), nil
+}
+
+// fileSize 返回卷的数据占用的空间, 加密卷还包括 LUKS2 头
+func fileSize(vol state.Volume) int64 {
+	if vol.Encrypted {
+		return vol.VolSize + luksHeaderSize
+	}
+	return vol.VolSize
+}
+
+// sourceEncrypted 返回新卷的数据源是否是加密卷或者加密卷的快照, 没有数据源时返回 false
+func (hp *hostpath) sourceEncrypted(source *csi.VolumeContentSource) (bool, error) {
+	switch {
+	case source.GetVolume() != nil:
+		vol, err := hp.visibleVolume(source.GetVolume().GetVolumeId())
+		if err != nil {
+			return false, err
+		}
+		return vol.Encrypted, nil
+	case source.GetSnapshot() != nil:
+		snapshot, err := hp.visibleSnapshot(source.GetSnapshot().GetSnapshotId())
+		if err != nil {
+			return false, err
+		}
+		return snapshot.Encrypted, nil
+	}
+	return false, nil
+}
+
+// setupEncryption 用 LUKS2 格式化新的加密卷。从数据源创建的卷复制了数据源的 LUKS 头,
+// 不能再格式化, 打开它需要数据源的密码
+func (hp *hostpath) setupEncryption(ctx context.Context, vol *state.Volume, passphrase []byte, hasSource bool) error {
+	if hasSource {
+		luks, err := hp.crypt.isLuks(ctx, vol.VolPath)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if !luks {
+			return status.Errorf(codes.InvalidArgument, "the content source of encrypted volume %s is not encrypted", vol.VolID)
+		}
+	} else if err := hp.crypt.format(ctx, vol.VolPath, passphrase); err != nil {
+		return status.Errorf(codes.Internal, "failed to format encrypted volume %s: %v", vol.VolID, err)
+	}
+	vol.Encrypted = true
+	return hp.state.UpdateVolume(*vol)
+}
+
+// openEncryptedVolume 用 NodeStage 的 secrets 中的密码打开加密卷, 返回解密后的设备的路径
+func (hp *hostpath) openEncryptedVolume(ctx context.Context, vol state.Volume, secrets map[string]string) (string, error) {
+	passphrase, err := passphraseFrom(secrets)
+	if err != nil {
+		return "", err
+	}
+	// 驱动重启或节点重启后 loop 设备可能已经不存在了, 已经关联时返回原来的设备
+	volPathHandler := volumepathhandler.VolumePathHandler{}
+	device, err := volPathHandler.AttachFileDevice(vol.VolPath)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "failed to attach device %v: %v", vol.VolPath, err)
+	}
+	path, err := hp.crypt.open(ctx, device, cryptDeviceName(vol.VolID), passphrase)
+	if errors.Is(err, errWrongPassphrase) {
+		return "", status.Errorf(codes.InvalidArgument, "cannot open encrypted volume %s: %v", vol.VolID, err)
+	}
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "cannot open encrypted volume %s: %v", vol.VolID, err)
+	}
+	klog.FromContext(ctx).V(4).Info("Opened encrypted volume", "volumeID", vol.VolID, "device", path)
+	return path, nil
+}
+
+// closeEncryptedVolume 关闭加密卷解密后的设备
+func (hp *hostpath) closeEncryptedVolume(ctx context.Context, vol state.Volume) error {
+	if err := hp.crypt.close(ctx, cryptDeviceName(vol.VolID)); err != nil {
+		return status.Errorf(codes.Internal, "failed to close encrypted volume %s: %v", vol.VolID, err)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package hostpath
+
+import (
+	"context"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeCryptSetup 模拟 cryptsetup: 格式化时在块文件开头写入密码的摘要,
+// 打开的设备是 deviceDir 中的普通文件
+type fakeCryptSetup struct {
+	stateDir  string
+	deviceDir string
+	opened    map[string]bool
+}
+
+const fakeLuksMagic = "FAKELUKS"
+
+func fakeLuksHeader(passphrase []byte) []byte {
+	sum := sha256.Sum256(passphrase)
+	return append([]byte(fakeLuksMagic), sum[:]...)
+}
+
+func (f *fakeCryptSetup) format(ctx context.Context, device string, passphrase []byte) error {
+	file, err := os.OpenFile(device, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteAt(fakeLuksHeader(passphrase), 0)
+	return err
+}
+
+func (f *fakeCryptSetup) readHeader(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	header := make([]byte, len(fakeLuksHeader(nil)))
+	_, err = file.ReadAt(header, 0)
+	return header, err
+}
+
+func (f *fakeCryptSetup) isLuks(ctx context.Context, device string) (bool, error) {
+	header, err := f.readHeader(device)
+	if err != nil {
+		return false, err
+	}
+	return strings.HasPrefix(string(header), fakeLuksMagic), nil
+}
+
+func (f *fakeCryptSetup) open(ctx context.Context, device, name string, passphrase []byte) (string, error) {
+	path := f.devicePath(name)
+	if f.opened[name] {
+		return path, nil
+	}
+	// device 是 loop 设备, 头从它的块文件中读取
+	header, err := f.readHeader(filepath.Join(f.stateDir, strings.TrimPrefix(name, cryptDevicePrefix)))
+	if err != nil {
+		return "", err
+	}
+	if string(header) != string(fakeLuksHeader(passphrase)) {
+		return "", errWrongPassphrase
+	}
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		return "", err
+	}
+	f.opened[name] = true
+	return path, nil
+}
+
+func (f *fakeCryptSetup) close(ctx context.Context, name string) error {
+	delete(f.opened, name)
+	if err := os.Remove(f.devicePath(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (f *fakeCryptSetup) devicePath(name string) string {
+	return filepath.Join(f.deviceDir, name)
+}
+
+// TestEncryptedVolume 测试加密块卷的创建, stage 和 publish。loop 设备需要 root 权限
+func TestEncryptedVolume(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	tmp := t.TempDir()
+	stateDir := filepath.Join(tmp, "state")
+	hp := newTestDriver(t, func(cfg *Config) {
+		cfg.StateDir = stateDir
+	})
+	crypt := &fakeCryptSetup{stateDir: stateDir, deviceDir: t.TempDir(), opened: map[string]bool{}}
+	hp.crypt = crypt
+	ctx := context.Background()
+	secrets := map[string]string{encryptionPassphraseSecret: "passphrase"}
+
+	createVolume := func(name string, capability *csi.VolumeCapability, params, secrets map[string]string, source *csi.VolumeContentSource) (string, error) {
+		resp, err := hp.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:                name,
+			VolumeCapabilities:  []*csi.VolumeCapability{capability},
+			CapacityRange:       &csi.CapacityRange{RequiredBytes: mib},
+			Parameters:          params,
+			Secrets:             secrets,
+			VolumeContentSource: source,
+		})
+		volID := resp.GetVolume().GetVolumeId()
+		if err == nil {
+			t.Cleanup(func() {
+				require.NoError(t, hp.deleteVolume(volID))
+			})
+		}
+		return volID, err
+	}
+	encryptedParams := map[string]string{encrypted: "true"}
+
+	_, err := createVolume("no-secret", blockCapability(), encryptedParams, nil, nil)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.ErrorContains(t, err, "require the encryptionPassphrase secret")
+	_, err = createVolume("mount", mountCapability(), encryptedParams, secrets, nil)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.ErrorContains(t, err, "only supported for block volumes")
+	_, err = createVolume("invalid", blockCapability(), map[string]string{encrypted: "yes"}, secrets, nil)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	volID, err := createVolume("vol", blockCapability(), encryptedParams, secrets, nil)
+	require.NoError(t, err)
+	vol, err := hp.state.GetVolumeByID(volID)
+	require.NoError(t, err)
+	require.True(t, vol.Encrypted)
+	luks, err := crypt.isLuks(ctx, vol.VolPath)
+	require.NoError(t, err)
+	require.True(t, luks, "formatted at provisioning time")
+	// LUKS2 头不占用申请的容量
+	info, err := os.Stat(vol.VolPath)
+	require.NoError(t, err)
+	require.Equal(t, mib+luksHeaderSize, info.Size())
+
+	_, err = hp.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "small",
+		VolumeCapabilities: []*csi.VolumeCapability{blockCapability()},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: kib},
+		Parameters:         encryptedParams,
+		Secrets:            secrets,
+	})
+	require.Equal(t, codes.OutOfRange, status.Code(err), "too small: %v", err)
+
+	staging := filepath.Join(tmp, "staging")
+	target := filepath.Join(tmp, "target")
+	stage := func(secrets map[string]string) error {
+		_, err := hp.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{VolumeId: volID, StagingTargetPath: staging, VolumeCapability: blockCapability(), Secrets: secrets})
+		return err
+	}
+	publish := &csi.NodePublishVolumeRequest{VolumeId: volID, StagingTargetPath: staging, TargetPath: target, VolumeCapability: blockCapability()}
+
+	_, err = hp.NodePublishVolume(ctx, publish)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err), "publish before stage: %v", err)
+	err = stage(nil)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	err = stage(map[string]string{encryptionPassphraseSecret: "wrong"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.ErrorIs(t, err, status.Error(codes.InvalidArgument, "cannot open encrypted volume "+volID+": "+errWrongPassphrase.Error()))
+	require.NoError(t, stage(secrets))
+	require.True(t, crypt.opened[cryptDeviceName(volID)])
+
+	// 目标路径上挂载的是解密后的设备
+	_, err = hp.NodePublishVolume(ctx, publish)
+	require.NoError(t, err)
+	_, err = hp.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: volID, TargetPath: target})
+	require.NoError(t, err)
+	_, err = hp.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: volID, StagingTargetPath: staging})
+	require.NoError(t, err)
+	require.False(t, crypt.opened[cryptDeviceName(volID)], "closed at unstage")
+
+	// 克隆沿用源卷的 LUKS 头, 没有加密的数据源不能创建加密卷
+	cloneOf := func(volID string) *csi.VolumeContentSource {
+		return &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: volID}}}
+	}
+	_, err = createVolume("clone", blockCapability(), encryptedParams, secrets, cloneOf(volID))
+	require.NoError(t, err)
+	plainID, err := createVolume("plain", blockCapability(), nil, nil, nil)
+	require.NoError(t, err)
+	_, err = createVolume("plain-clone", blockCapability(), encryptedParams, secrets, cloneOf(plainID))
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.ErrorContains(t, err, "is not encrypted")
+
+	// 没有设置 encrypted 参数的克隆和恢复的卷沿用数据源的加密
+	snap, err := hp.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snap", SourceVolumeId: volID})
+	require.NoError(t, err)
+	hp.snapshotWG.Wait()
+	snapshot, err := hp.state.GetSnapshotByID(snap.GetSnapshot().GetSnapshotId())
+	require.NoError(t, err)
+	require.True(t, snapshot.Encrypted, "snapshot of an encrypted volume")
+	restoreOf := &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshot.Id}}}
+	for name, source := range map[string]*csi.VolumeContentSource{"inherited-clone": cloneOf(volID), "inherited-restore": restoreOf} {
+		id, err := createVolume(name, blockCapability(), nil, nil, source)
+		require.NoError(t, err, name)
+		vol, err := hp.state.GetVolumeByID(id)
+		require.NoError(t, err)
+		require.True(t, vol.Encrypted, name)
+
+		_, err = createVolume(name+"-plain", blockCapability(), map[string]string{encrypted: "false"}, nil, source)
+		require.Equal(t, codes.InvalidArgument, status.Code(err), "%s with encrypted=false: %v", name, err)
+	}
+}
@@ -0,0 +1,234 @@
+package hostpath
+
+import (
+	"context"
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"time"
+)
+
+const (
+	metricsNamespace = "hostpath"
+	// 默认的指标路径
+	defaultMetricsPath = "/metrics"
+
+	// 复制数据的操作
+	copyClone   = "clone"
+	copyRestore = "restore"
+)
+
+// metrics 是驱动导出的 Prometheus 指标. 每个驱动使用自己的 registry
+type metrics struct {
+	registry *prometheus.Registry
+
+	rpcDuration        *prometheus.HistogramVec
+	rpcErrors          *prometheus.CounterVec
+	copyBytes          *prometheus.CounterVec
+	copyDuration       *prometheus.HistogramVec
+	stateWriteDuration *prometheus.HistogramVec
+}
+
+func newMetrics(hp *hostpath) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		rpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "rpc_duration_seconds",
+			Help:      "Latency of gRPC calls.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"method"}),
+		rpcErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rpc_errors_total",
+			Help:      "Number of failed gRPC calls by status code.",
+		}, []string{"method", "code"}),
+		copyBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "copy_bytes_total",
+			Help:      "Amount of data copied into new volumes from volumes (clone) or snapshots (restore).",
+		}, []string{"operation"}),
+		copyDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "copy_duration_seconds",
+			Help:      "Time spent copying data into new volumes from volumes (clone) or snapshots (restore).",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+		}, []string{"operation"}),
+		stateWriteDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "state_write_duration_seconds",
+			Help:      "Latency of writing the state file.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}, []string{"operation"}),
+	}
+	m.registry.MustRegister(
+		m.rpcDuration,
+		m.rpcErrors,
+		m.copyBytes,
+		m.copyDuration,
+		m.stateWriteDuration,
+		&stateCollector{hp: hp},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// MetricsHandler 返回导出驱动的指标的 HTTP handler
+func (hp *hostpath) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(hp.metrics.registry, promhttp.HandlerOpts{})
+}
+
+func (hp *hostpath) metricsPath() string {
+	if hp.config.MetricsPath == "" {
+		return defaultMetricsPath
+	}
+	return hp.config.MetricsPath
+}
+
+// unaryInterceptor 记录每个 gRPC 调用的时间和失败的状态码
+func (m *metrics) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	m.rpcDuration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+	if code := status.Code(err); code != codes.OK {
+		m.rpcErrors.WithLabelValues(info.FullMethod, code.String()).Inc()
+	}
+	return resp, err
+}
+
+// observeCopy 记录填充新卷的数据量和时间. 数据量由复制数据的代码统计, 记录时不需要遍历新卷
+func (m *metrics) observeCopy(operation string, bytes int64, duration time.Duration) {
+	m.copyBytes.WithLabelValues(operation).Add(float64(bytes))
+	m.copyDuration.WithLabelValues(operation).Observe(duration.Seconds())
+}
+
+// instrumentState 返回记录每次写入状态文件的时间的 state.State, 写入的 span 属于 ctx 返回的 context 的 trace
+func (m *metrics) instrumentState(s state.State, tracer trace.Tracer, ctx func() context.Context) state.State {
+	return &timedState{State: s, duration: m.stateWriteDuration, tracer: tracer, ctx: ctx}
+}
+
+// timedState 记录修改状态的时间, 每次修改都会写入状态文件
+type timedState struct {
+	state.State
+	duration *prometheus.HistogramVec
+	tracer   trace.Tracer
+	ctx      func() context.Context
+}
+
+// write 执行一次修改, 记录它的时间和 span
+func (s *timedState) write(operation string, id attribute.KeyValue, write func() error) error {
+	start := time.Now()
+	_, span := s.tracer.Start(s.ctx(), "state."+operation, trace.WithAttributes(id))
+	err := write()
+	endSpan(span, err)
+	s.duration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	return err
+}
+
+func (s *timedState) UpdateVolume(volume state.Volume) error {
+	return s.write("UpdateVolume", attribute.String("hostpath.volume.id", volume.VolID), func() error {
+		return s.State.UpdateVolume(volume)
+	})
+}
+
+func (s *timedState) DeleteVolume(volID string) error {
+	return s.write("DeleteVolume", attribute.String("hostpath.volume.id", volID), func() error {
+		return s.State.DeleteVolume(volID)
+	})
+}
+
+func (s *timedState) UpdateSnapshot(snapshot state.Snapshot) error {
+	return s.write("UpdateSnapshot", attribute.String("hostpath.snapshot.id", snapshot.Id), func() error {
+		return s.State.UpdateSnapshot(snapshot)
+	})
+}
+
+func (s *timedState) DeleteSnapshot(snapshotID string) error {
+	return s.write("DeleteSnapshot", attribute.String("hostpath.snapshot.id", snapshotID), func() error {
+		return s.State.DeleteSnapshot(snapshotID)
+	})
+}
+
+func (s *timedState) UpdateGroupSnapshot(snapshot state.GroupSnapshot) error {
+	return s.write("UpdateGroupSnapshot", attribute.String("hostpath.group_snapshot.id", snapshot.Id), func() error {
+		return s.State.UpdateGroupSnapshot(snapshot)
+	})
+}
+
+func (s *timedState) DeleteGroupSnapshot(groupSnapshotID string) error {
+	return s.write("DeleteGroupSnapshot", attribute.String("hostpath.group_snapshot.id", groupSnapshotID), func() error {
+		return s.State.DeleteGroupSnapshot(groupSnapshotID)
+	})
+}
+
+var (
+	volumesDesc = prometheus.NewDesc(metricsNamespace+"_volumes",
+		"Number of volumes by storage kind and access type.", []string{"kind", "access_type"}, nil)
+	snapshotsDesc = prometheus.NewDesc(metricsNamespace+"_snapshots",
+		"Number of snapshots by storage kind and access type of the source volume. Both are unknown if the source volume was deleted.", []string{"kind", "access_type"}, nil)
+	capacityUsedDesc = prometheus.NewDesc(metricsNamespace+"_capacity_used_bytes",
+		"Used capacity by storage kind, according to the capacity accounting.", []string{"kind"}, nil)
+	capacityTotalDesc = prometheus.NewDesc(metricsNamespace+"_capacity_total_bytes",
+		"Total capacity by storage kind.", []string{"kind"}, nil)
+)
+
+// stateCollector 在每次采集时根据状态计算卷和快照的数量以及已经使用的容量
+type stateCollector struct {
+	hp *hostpath
+}
+
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- volumesDesc
+	ch <- snapshotsDesc
+	ch <- capacityUsedDesc
+	ch <- capacityTotalDesc
+}
+
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	hp := c.hp
+	hp.mutex.Lock()
+	defer hp.mutex.Unlock()
+
+	type key struct{ kind, accessType string }
+	volumes := map[key]int{}
+	volumeKeys := map[string]key{}
+	for _, vol := range hp.state.GetVolumes() {
+		k := key{vol.Kind, accessTypeName(vol.VolAccessType)}
+		volumes[k]++
+		volumeKeys[vol.VolID] = k
+	}
+	snapshots := map[key]int{}
+	for _, snapshot := range hp.state.GetSnapshots() {
+		k, ok := volumeKeys[snapshot.VolID]
+		if !ok {
+			k = key{"unknown", "unknown"}
+		}
+		snapshots[k]++
+	}
+	for k, n := range volumes {
+		ch <- prometheus.MustNewConstMetric(volumesDesc, prometheus.GaugeValue, float64(n), k.kind, k.accessType)
+	}
+	for k, n := range snapshots {
+		ch <- prometheus.MustNewConstMetric(snapshotsDesc, prometheus.GaugeValue, float64(n), k.kind, k.accessType)
+	}
+
+	for kind, capacity := range hp.config.Capacity {
+		ch <- prometheus.MustNewConstMetric(capacityUsedDesc, prometheus.GaugeValue, float64(hp.sumVolumeSizes(kind)), kind)
+		ch <- prometheus.MustNewConstMetric(capacityTotalDesc, prometheus.GaugeValue, float64(capacity.Nominal()), kind)
+	}
+}
+
+func accessTypeName(accessType state.AccessType) string {
+	if accessType == state.BlockAccess {
+		return "block"
+	}
+	return "mount"
+}
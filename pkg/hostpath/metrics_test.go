@@ -0,0 +1,106 @@
+package hostpath
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestMetrics(t *testing.T) {
+	hp := newTestDriver(t, func(cfg *Config) {
+		cfg.Capacity = Capacity{"fast": {Size: resource.MustParse("100Mi")}}
+	})
+	ctx := context.Background()
+
+	// 通过拦截器调用 RPC
+	call := func(method string, req interface{}, handler grpc.UnaryHandler) error {
+		_, err := hp.metrics.unaryInterceptor(ctx, req, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		return err
+	}
+	const createVolume = "/csi.v1.Controller/CreateVolume"
+	createVolumeHandler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return hp.CreateVolume(ctx, req.(*csi.CreateVolumeRequest))
+	}
+	request := func(name string, capability *csi.VolumeCapability, size int64) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name:               name,
+			VolumeCapabilities: []*csi.VolumeCapability{capability},
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: size},
+			Parameters:         map[string]string{storageKind: "fast"},
+		}
+	}
+
+	require.NoError(t, call(createVolume, request("block", blockCapability(), 10*mib), createVolumeHandler))
+	require.NoError(t, call(createVolume, request("mount", mountCapability(), 20*mib), createVolumeHandler))
+	err := call(createVolume, request("too-large", mountCapability(), 100*mib), createVolumeHandler)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err), "create too large volume: %v", err)
+	err = call(createVolume, &csi.CreateVolumeRequest{}, createVolumeHandler)
+	require.Equal(t, codes.InvalidArgument, status.Code(err), "create without name: %v", err)
+
+	require.Equal(t, 1, testutil.CollectAndCount(hp.metrics.rpcDuration))
+	require.Equal(t, 1.0, testutil.ToFloat64(hp.metrics.rpcErrors.WithLabelValues(createVolume, "ResourceExhausted")))
+	require.Equal(t, 1.0, testutil.ToFloat64(hp.metrics.rpcErrors.WithLabelValues(createVolume, "InvalidArgument")))
+	require.Equal(t, 2, testutil.CollectAndCount(hp.metrics.rpcErrors))
+
+	// 克隆的数据量
+	vol, err := hp.state.GetVolumeByName("mount")
+	require.NoError(t, err)
+	data := make([]byte, mib)
+	require.NoError(t, os.WriteFile(filepath.Join(vol.VolPath, "data"), data, 0644))
+	clone := request("clone", mountCapability(), 20*mib)
+	clone.VolumeContentSource = &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: vol.VolID}},
+	}
+	_, err = hp.CreateVolume(ctx, clone)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, testutil.ToFloat64(hp.metrics.copyBytes.WithLabelValues(copyClone)), float64(mib))
+	require.Equal(t, 1, testutil.CollectAndCount(hp.metrics.copyDuration))
+
+	_, err = hp.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snap", SourceVolumeId: vol.VolID})
+	require.NoError(t, err)
+	hp.snapshotWG.Wait()
+	require.Greater(t, testutil.CollectAndCount(hp.metrics.stateWriteDuration), 1)
+
+	// 卷, 快照和容量在采集时根据状态计算
+	expected := `
+# HELP hostpath_capacity_total_bytes Total capacity by storage kind.
+# TYPE hostpath_capacity_total_bytes gauge
+hostpath_capacity_total_bytes{kind="fast"} 1.048576e+08
+# HELP hostpath_capacity_used_bytes Used capacity by storage kind, according to the capacity accounting.
+# TYPE hostpath_capacity_used_bytes gauge
+hostpath_capacity_used_bytes{kind="fast"} 5.24288e+07
+# HELP hostpath_snapshots Number of snapshots by storage kind and access type of the source volume. Both are unknown if the source volume was deleted.
+# TYPE hostpath_snapshots gauge
+hostpath_snapshots{access_type="mount",kind="fast"} 1
+# HELP hostpath_volumes Number of volumes by storage kind and access type.
+# TYPE hostpath_volumes gauge
+hostpath_volumes{access_type="block",kind="fast"} 1
+hostpath_volumes{access_type="mount",kind="fast"} 2
+`
+	require.NoError(t, testutil.GatherAndCompare(hp.metrics.registry, strings.NewReader(expected),
+		"hostpath_capacity_total_bytes", "hostpath_capacity_used_bytes", "hostpath_snapshots", "hostpath_volumes"))
+
+	// HTTP endpoint
+	server := httptest.NewServer(hp.MetricsHandler())
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), `hostpath_rpc_errors_total{code="ResourceExhausted",method="/csi.v1.Controller/CreateVolume"} 1`)
+	require.Contains(t, string(body), `hostpath_state_write_duration_seconds_count{operation="UpdateVolume"}`)
+	require.Contains(t, string(body), "go_goroutines")
+}
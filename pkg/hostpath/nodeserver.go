@@ -1,8 +1,485 @@
 package hostpath
 
+import (
+	"context"
+	"fmt"
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"k8s.io/kubernetes/pkg/volume/util/volumepathhandler"
+	"k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
+	"maps"
+	"os"
+	"path/filepath"
+)
 
 const (
 	TopologyKeyNode = "topology.hostpath.csi/node"
 
 	failedPreconditionAccessModeConflict = "volume uses SINGLE_NODE_SINGLE_WRITER access mode and is already mounted at a different target path"
-)
\ No newline at end of file
+
+	// 由块文件支持的 mount 卷没有指定 fsType 时使用的文件系统
+	defaultFsType = "ext4"
+)
+
+// 由块文件支持的 mount 卷可以使用的文件系统
+var supportedFsTypes = map[string]bool{
+	"ext3": true,
+	"ext4": true,
+	"xfs":  true,
+}
+
+// NodeStageVolume 记录卷的 staging 路径. 由块文件支持的 mount 卷在这里关联 loop 设备,
+// 第一次 stage 时按 fsType 格式化, 之后每次 stage 前检查并修复文件系统, 然后挂载到 staging 路径。
+// 加密的块卷用 secrets 中的密码打开。
+func (hp *hostpath) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	stagingTargetPath := req.GetStagingTargetPath()
+	if stagingTargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume Capability missing in request")
+	}
+
+	// 在操作全局status是.需要先加锁
+	unlock := hp.lockState(ctx)
+	defer unlock()
+
+	vol, err := hp.state.GetVolumeByID(req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := hp.validateVolumeCapabilities([]*csi.VolumeCapability{req.GetVolumeCapability()}, &vol); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if hp.config.EnableAttach && !vol.Attached {
+		return nil, status.Errorf(codes.FailedPrecondition, "ControllerPublishVolume must be called on volume '%s' before staging on node", vol.VolID)
+	}
+
+	// 挂载文件系统会写入副本, 例如回放日志
+	if vol.Replication.Role == state.ReplicationReplica && vol.BlockBacked {
+		return nil, errReplica(vol.VolID)
+	}
+
+	if vol.Staged.Has(stagingTargetPath) {
+		klog.FromContext(ctx).V(4).Info("Volume is already staged, nothing to do", "volumeID", req.VolumeId, "stagingTargetPath", stagingTargetPath)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	if !vol.Staged.Empty() {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %q is already staged at %v", req.VolumeId, vol.Staged)
+	}
+
+	if vol.BlockBacked {
+		fsType, err := hp.stageBlockBackedVolume(ctx, vol, stagingTargetPath, req.GetVolumeCapability())
+		if err != nil {
+			return nil, err
+		}
+		vol.FsType = fsType
+	}
+
+	if vol.Encrypted {
+		if _, err := hp.openEncryptedVolume(ctx, vol, req.GetSecrets()); err != nil {
+			return nil, err
+		}
+	}
+
+	vol.Staged.Add(stagingTargetPath)
+	if err := hp.state.UpdateVolume(vol); err != nil {
+		return nil, err
+	}
+
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// stageBlockBackedVolume 格式化(只在第一次)并挂载由块文件支持的 mount 卷, 返回使用的文件系统
+func (hp *hostpath) stageBlockBackedVolume(ctx context.Context, vol state.Volume, stagingTargetPath string, capability *csi.VolumeCapability) (string, error) {
+	// 能力已经由 validateVolumeCapabilities 检查过了
+	mnt := capability.GetMount()
+	fsType := mnt.GetFsType()
+	if fsType == "" {
+		fsType = vol.FsType
+	}
+	if fsType == "" {
+		fsType = defaultFsType
+	}
+
+	// 驱动重启或节点重启后 loop 设备可能已经不存在了, 已经关联时返回原来的设备
+	volPathHandler := volumepathhandler.VolumePathHandler{}
+	device, err := volPathHandler.AttachFileDevice(vol.VolPath)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "failed to attach device %v: %v", vol.VolPath, err)
+	}
+
+	if err := os.MkdirAll(stagingTargetPath, 0750); err != nil {
+		return "", status.Errorf(codes.Internal, "failed to create staging target path %s: %v", stagingTargetPath, err)
+	}
+	mounter := &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: utilexec.New()}
+	notMnt, err := mounter.IsLikelyNotMountPoint(stagingTargetPath)
+	if err != nil {
+		return "", status.Error(codes.Internal, err.Error())
+	}
+	if !notMnt {
+		// 上一次 NodeStage 挂载成功之后没有来得及更新状态
+		klog.FromContext(ctx).V(4).Info("Volume is already mounted", "volumeID", vol.VolID, "stagingTargetPath", stagingTargetPath)
+		return fsType, nil
+	}
+
+	// 没有文件系统时格式化, 否则先运行 fsck
+	options := mnt.GetMountFlags()
+	klog.FromContext(ctx).V(4).Info("Staging volume", "volumeID", vol.VolID, "device", device, "fsType", fsType, "stagingTargetPath", stagingTargetPath, "mountFlags", options)
+	if err := mounter.FormatAndMount(device, stagingTargetPath, fsType, options); err != nil {
+		return "", status.Errorf(codes.Internal, "failed to format and mount device %s at %s: %v", device, stagingTargetPath, err)
+	}
+	// 与普通的 mount 卷一样, 新文件系统的根目录所有人都可以写入
+	if vol.FsType == "" {
+		if err := os.Chmod(stagingTargetPath, 0777); err != nil {
+			return "", status.Error(codes.Internal, err.Error())
+		}
+	}
+	return fsType, nil
+}
+
+func (hp *hostpath) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	stagingTargetPath := req.GetStagingTargetPath()
+	if stagingTargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
+	}
+
+	// 在操作全局status是.需要先加锁
+	unlock := hp.lockState(ctx)
+	defer unlock()
+
+	vol, err := hp.state.GetVolumeByID(req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !vol.Staged.Has(stagingTargetPath) {
+		klog.FromContext(ctx).V(4).Info("Volume is not staged, nothing to do", "volumeID", req.VolumeId, "stagingTargetPath", stagingTargetPath)
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
+
+	if !vol.Published.Empty() {
+		return nil, status.Errorf(codes.Internal, "volume %q is still published at %q on node %q", vol.VolID, vol.Published, hp.config.NodeID)
+	}
+
+	// loop 设备保持关联, 直到卷被删除
+	if vol.BlockBacked {
+		if err := mount.CleanupMountPoint(stagingTargetPath, mount.New(""), false); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to unmount staging target path %s: %v", stagingTargetPath, err)
+		}
+	}
+	if vol.Encrypted {
+		if err := hp.closeEncryptedVolume(ctx, vol); err != nil {
+			return nil, err
+		}
+	}
+
+	vol.Staged.Remove(stagingTargetPath)
+	if err := hp.state.UpdateVolume(vol); err != nil {
+		return nil, err
+	}
+
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+// NodePublishVolume 将卷 bind mount 到目标路径. 块卷挂载 loop 设备, 由块文件支持的 mount 卷
+// 挂载 staging 路径上的文件系统, 其它 mount 卷挂载卷的目录。
+func (hp *hostpath) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	// Check arguments
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	targetPath := req.GetTargetPath()
+	if len(targetPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
+	}
+
+	// 在操作全局status是.需要先加锁
+	unlock := hp.lockState(ctx)
+	defer unlock()
+
+	vol, err := hp.state.GetVolumeByID(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := hp.validateVolumeCapabilities([]*csi.VolumeCapability{req.GetVolumeCapability()}, &vol); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// 副本在提升之前只能以只读方式发布
+	if vol.Replication.Role == state.ReplicationReplica && !req.GetReadonly() {
+		return nil, errReplica(vol.VolID)
+	}
+
+	if vol.Published.Has(targetPath) {
+		klog.FromContext(ctx).V(4).Info("Volume is already published, nothing to do", "volumeID", req.VolumeId, "targetPath", targetPath)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	if !vol.Published.Empty() && req.GetVolumeCapability().GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER {
+		return nil, status.Error(codes.FailedPrecondition, failedPreconditionAccessModeConflict)
+	}
+
+	options := []string{"bind"}
+	if req.GetReadonly() {
+		options = append(options, "ro")
+	}
+	mounter := mount.New("")
+
+	var source string
+	switch {
+	case req.GetVolumeCapability().GetBlock() != nil && vol.Encrypted:
+		// 解密后的设备在 NodeStage 时打开
+		stagingTargetPath := req.GetStagingTargetPath()
+		if stagingTargetPath == "" || !vol.Staged.Has(stagingTargetPath) {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %q must be staged before it can be published", vol.VolID)
+		}
+		source = hp.crypt.devicePath(cryptDeviceName(vol.VolID))
+
+		if err := makeFile(targetPath); err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to create target path %s: %v", targetPath, err))
+		}
+	case req.GetVolumeCapability().GetBlock() != nil:
+		volPathHandler := volumepathhandler.VolumePathHandler{}
+		source, err = volPathHandler.GetLoopDevice(vol.VolPath)
+		if err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to get the loop device: %v", err))
+		}
+
+		// 目标路径是一个文件
+		if err := makeFile(targetPath); err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to create target path %s: %v", targetPath, err))
+		}
+	case req.GetVolumeCapability().GetMount() != nil:
+		source = vol.VolPath
+		if vol.BlockBacked {
+			// 文件系统在 NodeStage 时挂载到了 staging 路径
+			stagingTargetPath := req.GetStagingTargetPath()
+			if stagingTargetPath == "" || !vol.Staged.Has(stagingTargetPath) {
+				return nil, status.Errorf(codes.FailedPrecondition, "volume %q must be staged before it can be published", vol.VolID)
+			}
+			source = stagingTargetPath
+		}
+		options = append(options, req.GetVolumeCapability().GetMount().GetMountFlags()...)
+
+		if err := os.MkdirAll(targetPath, 0750); err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to create target path %s: %v", targetPath, err))
+		}
+	}
+
+	notMnt, err := mount.IsNotMountPoint(mounter, targetPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if notMnt {
+		klog.FromContext(ctx).V(4).Info("Bind mounting volume", "source", source, "targetPath", targetPath, "options", options)
+		if err := mounter.Mount(source, targetPath, "", options); err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to mount %s at %s: %v", source, targetPath, err))
+		}
+	}
+
+	vol.Published.Add(targetPath)
+	if err := hp.state.UpdateVolume(vol); err != nil {
+		return nil, err
+	}
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+func (hp *hostpath) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	targetPath := req.GetTargetPath()
+	if len(targetPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
+	}
+
+	// 在操作全局status是.需要先加锁
+	unlock := hp.lockState(ctx)
+	defer unlock()
+
+	vol, err := hp.state.GetVolumeByID(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+
+	if !vol.Published.Has(targetPath) {
+		klog.FromContext(ctx).V(4).Info("Volume is not published, nothing to do", "volumeID", req.VolumeId, "targetPath", targetPath)
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
+
+	// 只有目标路径确实是挂载点时才卸载
+	if notMnt, err := mount.IsNotMountPoint(mount.New(""), targetPath); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	} else if !notMnt {
+		if err := mount.New("").Unmount(targetPath); err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to unmount %s: %v", targetPath, err))
+		}
+	}
+	// 删除挂载点. 路径不存在时不会返回错误, 重复调用是幂等的
+	if err := os.RemoveAll(targetPath); err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to remove %s: %v", targetPath, err))
+	}
+	klog.FromContext(ctx).V(4).Info("Volume has been unpublished", "volumeID", req.VolumeId, "targetPath", targetPath)
+
+	vol.Published.Remove(targetPath)
+	if err := hp.state.UpdateVolume(vol); err != nil {
+		return nil, err
+	}
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// makeFile 创建块卷的目标路径, 文件已经存在时不会返回错误
+func makeFile(pathname string) error {
+	if err := os.MkdirAll(filepath.Dir(pathname), 0750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(pathname, os.O_CREATE, os.FileMode(0644))
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+	if f != nil {
+		f.Close()
+	}
+	return nil
+}
+
+// NodeGetInfo 返回节点的id, 可以发布的卷的数量和节点的所有拓扑段
+func (hp *hostpath) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	// 限制可以被 ReloadConfig 修改
+	hp.mutex.Lock()
+	defer hp.mutex.Unlock()
+	resp := &csi.NodeGetInfoResponse{
+		NodeId:            hp.config.NodeID,
+		MaxVolumesPerNode: hp.config.MaxVolumesPerNode,
+	}
+
+	if hp.config.EnableTopology {
+		resp.AccessibleTopology = &csi.Topology{
+			Segments: maps.Clone(hp.topology),
+		}
+	}
+
+	if hp.config.AttachLimit > 0 {
+		resp.MaxVolumesPerNode = hp.config.AttachLimit
+	}
+
+	return resp, nil
+}
+
+func (hp *hostpath) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	caps := []*csi.NodeServiceCapability{
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+				},
+			},
+		},
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+				},
+			},
+		},
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+				},
+			},
+		},
+	}
+
+	return &csi.NodeGetCapabilitiesResponse{Capabilities: caps}, nil
+}
+
+// NodeGetVolumeStats 返回卷的使用情况. 设置了配额的 mount 卷报告配额的上限,
+// 由块文件支持的 mount 卷报告文件系统的使用情况, 其它卷报告申请的大小和实际分配的数据块。
+func (hp *hostpath) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
+	}
+	if len(req.GetVolumePath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume Path not provided")
+	}
+
+	// 在操作全局status是.需要先加锁
+	unlock := hp.lockState(ctx)
+	defer unlock()
+
+	volume, err := hp.state.GetVolumeByID(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(req.GetVolumePath()); err != nil {
+		return nil, status.Errorf(codes.NotFound, "Could not get file information from %s: %+v", req.GetVolumePath(), err)
+	}
+
+	total := volume.VolSize
+	var used int64
+	if volume.BlockBacked {
+		total, used, err = filesystemUsage(req.GetVolumePath())
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get filesystem usage of %s: %v", req.GetVolumePath(), err)
+		}
+	} else if quota := hp.quotaFor(volume.Quota); quota != nil {
+		total, used, err = quota.usage(volume)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get %s quota of volume %s: %v", volume.Quota, volume.VolID, err)
+		}
+	} else {
+		used = volumeAllocatedBytes(volume)
+	}
+	available := total - used
+	if available < 0 {
+		available = 0
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Available: available,
+				Total:     total,
+				Used:      used,
+				Unit:      csi.VolumeUsage_BYTES,
+			},
+		},
+	}, nil
+}
+
+// filesystemUsage 返回 path 所在的文件系统的大小和已经使用的字节数
+func filesystemUsage(path string) (int64, int64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	total := int64(st.Blocks) * st.Bsize
+	used := int64(st.Blocks-st.Bfree) * st.Bsize
+	return total, used, nil
+}
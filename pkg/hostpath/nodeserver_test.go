@@ -0,0 +1,112 @@
+package hostpath
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/moby/sys/mountinfo"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/volume/util/volumepathhandler"
+)
+
+// TestBlockBackedMountVolume 测试由块文件支持的 mount 卷的格式化, 重新 stage 和 publish。需要 root 权限。
+func TestBlockBackedMountVolume(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	tmp := t.TempDir()
+	hp := newTestDriver(t, func(cfg *Config) {
+		cfg.StateDir = filepath.Join(tmp, "state")
+		cfg.BlockBackedMountVolumes = true
+	})
+	ctx := context.Background()
+
+	resp, err := hp.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "vol",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 32 * mib},
+	})
+	require.NoError(t, err)
+	volID := resp.GetVolume().GetVolumeId()
+	t.Cleanup(func() {
+		require.NoError(t, hp.deleteVolume(volID))
+		device, _ := volumepathhandler.VolumePathHandler{}.GetLoopDevice(hp.getVolumePath(volID))
+		require.Empty(t, device, "loop device detached")
+	})
+
+	capability := func(fsType string, flags ...string) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsType, MountFlags: flags}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}
+	}
+	staging := filepath.Join(tmp, "staging")
+	target := filepath.Join(tmp, "target")
+
+	// 没有 stage 时不能 publish
+	_, err = hp.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{VolumeId: volID, StagingTargetPath: staging, TargetPath: target, VolumeCapability: capability("")})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err), "publish before stage: %v", err)
+
+	// 第一次 stage 时格式化
+	_, err = hp.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{VolumeId: volID, StagingTargetPath: staging, VolumeCapability: capability("ext4", "noatime")})
+	require.NoError(t, err)
+	requireMount(t, staging, "ext4", "noatime")
+	require.NoError(t, os.WriteFile(filepath.Join(staging, "data"), []byte("hello"), 0644))
+
+	_, err = hp.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{VolumeId: volID, StagingTargetPath: staging, TargetPath: target, VolumeCapability: capability("ext4")})
+	require.NoError(t, err)
+	content, err := os.ReadFile(filepath.Join(target, "data"))
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(content))
+	// NodeID 只记录分布式控制器的卷所在的节点, publish 不修改它
+	vol, err := hp.state.GetVolumeByID(volID)
+	require.NoError(t, err)
+	require.Empty(t, vol.NodeID)
+
+	stats, err := hp.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: volID, VolumePath: target})
+	require.NoError(t, err)
+	require.LessOrEqual(t, stats.GetUsage()[0].GetTotal(), 32*mib)
+	require.Greater(t, stats.GetUsage()[0].GetTotal(), 16*mib)
+
+	_, err = hp.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: volID, TargetPath: target})
+	require.NoError(t, err)
+	require.NoDirExists(t, target)
+	_, err = hp.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: volID, StagingTargetPath: staging})
+	require.NoError(t, err)
+	requireNotMounted(t, staging)
+
+	// 文件系统不同时不能 stage
+	_, err = hp.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{VolumeId: volID, StagingTargetPath: staging, VolumeCapability: capability("xfs")})
+	require.Equal(t, codes.InvalidArgument, status.Code(err), "stage with different fsType: %v", err)
+
+	// 再次 stage 时保留数据, 没有指定 fsType 时使用卷原来的文件系统
+	_, err = hp.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{VolumeId: volID, StagingTargetPath: staging, VolumeCapability: capability("")})
+	require.NoError(t, err)
+	requireMount(t, staging, "ext4")
+	content, err = os.ReadFile(filepath.Join(staging, "data"))
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(content))
+	_, err = hp.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: volID, StagingTargetPath: staging})
+	require.NoError(t, err)
+}
+
+func requireMount(t *testing.T, path, fsType string, options ...string) {
+	mounts, err := mountinfo.GetMounts(mountinfo.SingleEntryFilter(path))
+	require.NoError(t, err)
+	require.Len(t, mounts, 1, "%s is mounted", path)
+	require.Equal(t, fsType, mounts[0].FSType)
+	for _, option := range options {
+		require.Contains(t, mounts[0].Options, option)
+	}
+}
+
+func requireNotMounted(t *testing.T, path string) {
+	mounts, err := mountinfo.GetMounts(mountinfo.SingleEntryFilter(path))
+	require.NoError(t, err)
+	require.Empty(t, mounts, "%s is not mounted", path)
+}
@@ -0,0 +1,208 @@
+package hostpath
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// ParameterType 是参数值的类型
+type ParameterType string
+
+const (
+	ParameterString ParameterType = "string"
+	ParameterBool   ParameterType = "bool"
+	// 只能是 AllowedValues 中的一个值
+	ParameterEnum ParameterType = "enum"
+)
+
+// reservedParameterPrefix 是 external-provisioner 和 external-snapshotter
+// 添加的参数的前缀, 例如 csi.storage.k8s.io/pvc/name。这些参数总是被接受
+const reservedParameterPrefix = "csi.storage.k8s.io/"
+
+// Parameter 描述驱动支持的一个 StorageClass, VolumeAttributesClass 或 VolumeSnapshotClass 参数
+type Parameter struct {
+	Name          string        `json:"name"`
+	Type          ParameterType `json:"type"`
+	Default       string        `json:"default,omitempty"`
+	AllowedValues []string      `json:"allowedValues,omitempty"`
+	// 可以通过 VolumeAttributesClass 和 ControllerModifyVolume 修改
+	Mutable     bool   `json:"mutable"`
+	Description string `json:"description"`
+
+	// validate 检查类型之外的格式, 只对非空的值调用
+	validate func(hp *hostpath, value string) error
+}
+
+// parameterSet 是一类请求支持的参数
+type parameterSet []Parameter
+
+// volumeParameters 是 CreateVolume 和 ControllerModifyVolume 支持的参数
+var volumeParameters = parameterSet{
+	{
+		Name:        storageKind,
+		Type:        ParameterString,
+		Description: "Storage kind of the volume, selects the capacity which the volume is counted against.",
+	},
+	{
+		Name:          provisioning,
+		Type:          ParameterEnum,
+		Default:       provisioningThick,
+		AllowedValues: []string{provisioningThin, provisioningThick},
+		Description:   "Allocation of block volumes and block-backed mount volumes: thin creates sparse files, thick allocates all space up front. Directory volumes reject thin.",
+	},
+	{
+		Name:        snapshotSchedule,
+		Type:        ParameterString,
+		Mutable:     true,
+		Description: "Interval of automatic snapshots: @hourly, @daily, @weekly or @every <duration>.",
+		validate: func(hp *hostpath, value string) error {
+			_, err := parseSnapshotSchedule(value)
+			return err
+		},
+	},
+	{
+		Name:        snapshotRetain,
+		Type:        ParameterString,
+		Mutable:     true,
+		Description: "Retention of automatic snapshots as comma-separated <window>:<count>, for example 24h:24,7d:7. Requires snapshotSchedule.",
+		validate: func(hp *hostpath, value string) error {
+			_, err := parseSnapshotRetention(value)
+			return err
+		},
+	},
+	{
+		Name:        replicaNode,
+		Type:        ParameterString,
+		Description: "Node ID of a replication peer to which the volume data is replicated asynchronously.",
+		validate: func(hp *hostpath, value string) error {
+			return hp.validateReplicaNode(value)
+		},
+	},
+	{
+		Name:        encrypted,
+		Type:        ParameterBool,
+		Default:     "false",
+		Description: "Encrypt block volumes with LUKS2. The passphrase is read from the encryptionPassphrase secret of the provisioner and node stage secrets.",
+	},
+}
+
+// snapshotParameters 是 CreateSnapshot 支持的参数
+var snapshotParameters = parameterSet{}
+
+// VolumeParameters 返回 StorageClass 和 VolumeAttributesClass 中支持的参数
+func VolumeParameters() []Parameter {
+	return slices.Clone(volumeParameters)
+}
+
+// SnapshotParameters 返回 VolumeSnapshotClass 中支持的参数
+func SnapshotParameters() []Parameter {
+	return slices.Clone(snapshotParameters)
+}
+
+func (s parameterSet) lookup(name string) (Parameter, bool) {
+	for _, p := range s {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Parameter{}, false
+}
+
+// get 返回参数的值, 没有设置时返回默认值
+func (s parameterSet) get(params map[string]string, name string) string {
+	if value, ok := params[name]; ok && value != "" {
+		return value
+	}
+	p, _ := s.lookup(name)
+	return p.Default
+}
+
+// validate 检查所有的参数都是已知的并且值有效。mutable 为 true 时
+// 参数还必须是可以修改的
+func (s parameterSet) validate(hp *hostpath, params map[string]string, mutable bool) error {
+	var unknown, immutable []string
+	for name := range params {
+		if strings.HasPrefix(name, reservedParameterPrefix) {
+			continue
+		}
+		p, ok := s.lookup(name)
+		switch {
+		case !ok:
+			unknown = append(unknown, name)
+		case mutable && !p.Mutable:
+			immutable = append(immutable, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown parameters %q", unknown)
+	}
+	if len(immutable) > 0 {
+		sort.Strings(immutable)
+		return fmt.Errorf("parameters %q cannot be modified", immutable)
+	}
+
+	// 按注册的顺序检查, 错误信息保持稳定
+	for _, p := range s {
+		value, ok := params[p.Name]
+		if !ok || value == "" {
+			continue
+		}
+		if err := p.check(hp, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p Parameter) check(hp *hostpath, value string) error {
+	switch p.Type {
+	case ParameterBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("invalid %s %q, must be true or false", p.Name, value)
+		}
+	case ParameterEnum:
+		if !slices.Contains(p.AllowedValues, value) {
+			return fmt.Errorf("invalid %s %q, must be one of %q", p.Name, value, p.AllowedValues)
+		}
+	}
+	if p.validate != nil {
+		return p.validate(hp, value)
+	}
+	return nil
+}
+
+// WriteParameterDocs 以表格或者 JSON 格式输出支持的参数
+func WriteParameterDocs(w io.Writer, jsonFormat bool) error {
+	classes := []struct {
+		Class      string      `json:"class"`
+		Parameters []Parameter `json:"parameters"`
+	}{
+		{"StorageClass", volumeParameters},
+		{"VolumeSnapshotClass", snapshotParameters},
+	}
+	if jsonFormat {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(classes)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLASS\tNAME\tTYPE\tDEFAULT\tMUTABLE\tDESCRIPTION")
+	for _, class := range classes {
+		for _, p := range class.Parameters {
+			typ := string(p.Type)
+			if len(p.AllowedValues) > 0 {
+				typ = strings.Join(p.AllowedValues, "|")
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%t\t%s\n", class.Class, p.Name, typ, p.Default, p.Mutable, p.Description)
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,81 @@
+package hostpath
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParameters(t *testing.T) {
+	hp := newTestDriver(t, func(cfg *Config) {
+		cfg.EnableControllerModifyVolume = true
+		cfg.AcceptedMutableParameterNames = StringArray{snapshotSchedule}
+	})
+	ctx := context.Background()
+
+	createVolume := func(name string, params, mutableParams map[string]string) (*csi.CreateVolumeResponse, error) {
+		return hp.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               name,
+			VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+			Parameters:         params,
+			MutableParameters:  mutableParams,
+		})
+	}
+	for name, tc := range map[string]struct {
+		params, mutableParams map[string]string
+		err                   string
+	}{
+		"unknown":        {params: map[string]string{"knid": "fast"}, err: `unknown parameters ["knid"]`},
+		"enum":           {params: map[string]string{provisioning: "lazy"}, err: `invalid provisioning "lazy", must be one of ["thin" "thick"]`},
+		"schedule":       {params: map[string]string{snapshotSchedule: "hourly"}, err: `invalid snapshotSchedule "hourly"`},
+		"retention":      {params: map[string]string{snapshotRetain: "1h:1"}, err: "snapshotRetain requires snapshotSchedule"},
+		"replica":        {params: map[string]string{replicaNode: "node-2"}, err: `replicaNode "node-2" is not a known replication peer`},
+		"immutable":      {mutableParams: map[string]string{storageKind: "fast"}, err: `parameters ["kind"] cannot be modified`},
+		"not accepted":   {mutableParams: map[string]string{snapshotRetain: "1h:1"}, err: "invalid parameters: [snapshotRetain]"},
+		"mutable schema": {mutableParams: map[string]string{snapshotSchedule: "@every 1s"}, err: "interval must be at least"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := createVolume(name, tc.params, tc.mutableParams)
+			require.Equal(t, codes.InvalidArgument, status.Code(err), err)
+			require.ErrorContains(t, err, tc.err)
+		})
+	}
+
+	// 由 external-provisioner 添加的参数总是被接受, VolumeAttributesClass 覆盖 StorageClass
+	resp, err := createVolume("vol", map[string]string{
+		"csi.storage.k8s.io/pvc/name": "pvc",
+		snapshotSchedule:              "@daily",
+	}, map[string]string{snapshotSchedule: "@hourly"})
+	require.NoError(t, err)
+	volumeID := resp.GetVolume().GetVolumeId()
+	vol, err := hp.state.GetVolumeByID(volumeID)
+	require.NoError(t, err)
+	require.Equal(t, "@hourly", vol.SnapshotSchedule)
+
+	_, err = hp.ControllerModifyVolume(ctx, &csi.ControllerModifyVolumeRequest{
+		VolumeId:          volumeID,
+		MutableParameters: map[string]string{snapshotSchedule: "@weekly"},
+	})
+	require.NoError(t, err)
+	vol, err = hp.state.GetVolumeByID(volumeID)
+	require.NoError(t, err)
+	require.Equal(t, "@weekly", vol.SnapshotSchedule)
+
+	_, err = hp.ControllerModifyVolume(ctx, &csi.ControllerModifyVolumeRequest{
+		VolumeId:          volumeID,
+		MutableParameters: map[string]string{provisioning: provisioningThin},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = hp.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+		Name:           "snap",
+		SourceVolumeId: volumeID,
+		Parameters:     map[string]string{"compression": "zstd"},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.ErrorContains(t, err, `unknown parameters ["compression"]`)
+}
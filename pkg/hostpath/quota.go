@@ -0,0 +1,300 @@
+package hostpath
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+	"github.com/moby/sys/mountinfo"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+	"k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
+	"os"
+	"path/filepath"
+	"unsafe"
+)
+
+const (
+	// mount 卷不限制大小(默认)
+	QuotaNone = "none"
+	// 使用 XFS/ext4 的 project quota 限制卷目录的大小
+	QuotaProject = "project"
+	// 每个 mount 卷是一个格式化后通过 loop 设备挂载的镜像文件
+	QuotaLoop = "loop"
+
+	// 分配给卷的第一个 project id. kubelet 给 emptyDir 使用的 id 从 1048577 开始,
+	// 这里选择一个不同的范围以免冲突
+	firstProjectID uint32 = 1 << 24
+
+	// loop 镜像文件的扩展名和文件系统类型
+	loopImageExt    = ".img"
+	loopImageFsType = "ext4"
+)
+
+// volumeQuota 限制 mount 卷可以使用的空间
+type volumeQuota interface {
+	// setup 在卷的目录创建后设置配额
+	setup(vol *state.Volume) error
+	// teardown 在删除卷的目录之前移除配额
+	teardown(vol state.Volume) error
+	// usage 返回配额的上限和已经使用的字节数
+	usage(vol state.Volume) (limit, used int64, err error)
+}
+
+// quotaFor 返回卷使用的配额实现, 没有配额时返回 nil
+func (hp *hostpath) quotaFor(mode string) volumeQuota {
+	switch mode {
+	case QuotaProject:
+		return projectQuota{}
+	case QuotaLoop:
+		return loopQuota{imagePath: hp.getLoopImagePath}
+	default:
+		return nil
+	}
+}
+
+// setupQuota 按照 MountVolumeQuota 的配置为新的 mount 卷设置配额
+func (hp *hostpath) setupQuota(vol *state.Volume) error {
+	quota := hp.quotaFor(hp.config.MountVolumeQuota)
+	if quota == nil {
+		return nil
+	}
+	vol.Quota = hp.config.MountVolumeQuota
+	if vol.Quota == QuotaProject {
+		vol.ProjectID = hp.nextProjectID()
+	}
+	if err := quota.setup(vol); err != nil {
+		return fmt.Errorf("failed to set up %s quota for volume %s: %w", vol.Quota, vol.VolID, err)
+	}
+	klog.V(4).Infof("set up %s quota of %d bytes for volume %s", vol.Quota, vol.VolSize, vol.VolID)
+	return nil
+}
+
+// teardownQuota 移除卷的配额
+func (hp *hostpath) teardownQuota(vol state.Volume) error {
+	quota := hp.quotaFor(vol.Quota)
+	if quota == nil {
+		return nil
+	}
+	if err := quota.teardown(vol); err != nil {
+		return fmt.Errorf("failed to remove %s quota of volume %s: %w", vol.Quota, vol.VolID, err)
+	}
+	return nil
+}
+
+// nextProjectID 返回还没有被任何卷使用的 project id. 回收站中的卷保留着它们的 project quota
+func (hp *hostpath) nextProjectID() uint32 {
+	id := firstProjectID
+	for _, vol := range append(hp.state.GetVolumes(), hp.trashedVolumes()...) {
+		if vol.ProjectID >= id {
+			id = vol.ProjectID + 1
+		}
+	}
+	return id
+}
+
+// getLoopImagePath 返回 loop 卷的镜像文件的路径
+func (hp *hostpath) getLoopImagePath(volID string) string {
+	return filepath.Join(hp.config.StateDir, volID+loopImageExt)
+}
+
+// mountLoopVolumes 在驱动重启后重新挂载 loop 卷, 例如节点重启之后
+func (hp *hostpath) mountLoopVolumes() error {
+	mounter := mount.New("")
+	for _, vol := range hp.state.GetVolumes() {
+		if vol.Quota != QuotaLoop {
+			continue
+		}
+		notMnt, err := mounter.IsLikelyNotMountPoint(vol.VolPath)
+		if err != nil {
+			return fmt.Errorf("failed to check mount point of volume %s: %w", vol.VolID, err)
+		}
+		if !notMnt {
+			continue
+		}
+		klog.Infof("mounting image of loop volume %s", vol.VolID)
+		if err := mounter.Mount(hp.getLoopImagePath(vol.VolID), vol.VolPath, loopImageFsType, []string{"loop"}); err != nil {
+			return fmt.Errorf("failed to mount image of volume %s: %w", vol.VolID, err)
+		}
+	}
+	return nil
+}
+
+// loopQuota 把卷的目录作为挂载点, 挂载一个大小等于卷容量的文件系统镜像
+type loopQuota struct {
+	imagePath func(volID string) string
+}
+
+func (q loopQuota) setup(vol *state.Volume) error {
+	image := q.imagePath(vol.VolID)
+	if err := createSparseFile(image, vol.VolSize); err != nil {
+		return err
+	}
+	mounter := &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: utilexec.New()}
+	if err := mounter.FormatAndMount(image, vol.VolPath, loopImageFsType, []string{"loop"}); err != nil {
+		os.Remove(image)
+		return err
+	}
+	// 与普通的 mount 卷一样, 所有人都可以写入
+	if err := os.Chmod(vol.VolPath, 0777); err != nil {
+		// 调用者只删除目录, 镜像必须在这里卸载和删除
+		if errTeardown := q.teardown(*vol); errTeardown != nil {
+			klog.Errorf("failed to cleanup image of volume %s: %v", vol.VolID, errTeardown)
+		}
+		return err
+	}
+	return nil
+}
+
+func (q loopQuota) teardown(vol state.Volume) error {
+	if err := mount.CleanupMountPoint(vol.VolPath, mount.New(""), false); err != nil {
+		return err
+	}
+	if err := os.Remove(q.imagePath(vol.VolID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (q loopQuota) usage(vol state.Volume) (int64, int64, error) {
+	return filesystemUsage(vol.VolPath)
+}
+
+// projectQuota 给卷的目录设置一个单独的 project id, 并限制这个 project 可以使用的空间。
+// 文件系统必须启用 project quota (XFS: prjquota 挂载选项, ext4: -O quota,project 和 prjquota 挂载选项)。
+type projectQuota struct{}
+
+func (projectQuota) setup(vol *state.Volume) error {
+	if err := setProjectID(vol.VolPath, vol.ProjectID); err != nil {
+		return err
+	}
+	return setProjectLimit(vol.VolPath, vol.ProjectID, uint64(vol.VolSize))
+}
+
+func (projectQuota) teardown(vol state.Volume) error {
+	// 上限为零表示没有限制
+	return setProjectLimit(vol.VolPath, vol.ProjectID, 0)
+}
+
+func (projectQuota) usage(vol state.Volume) (int64, int64, error) {
+	var dq dqblk
+	if err := quotactl(vol.VolPath, qGetQuota, vol.ProjectID, &dq); err != nil {
+		return 0, 0, err
+	}
+	return int64(dq.bHardLimit * quotaBlockSize), int64(dq.curSpace), nil
+}
+
+// 以下的常量和结构体来自 linux/fs.h 和 linux/quota.h, golang.org/x/sys/unix 中没有定义
+const (
+	fsIocFsGetXattr    = 0x801c581f
+	fsIocFsSetXattr    = 0x401c5820
+	fsXflagProjInherit = 0x00000200
+
+	qGetQuota      = 0x800007
+	qSetQuota      = 0x800008
+	prjQuota       = 2
+	qifBLimits     = 1
+	quotaBlockSize = 1024
+)
+
+type fsxattr struct {
+	xflags     uint32
+	extsize    uint32
+	nextents   uint32
+	projid     uint32
+	cowextsize uint32
+	pad        [8]byte
+}
+
+type dqblk struct {
+	bHardLimit uint64
+	bSoftLimit uint64
+	curSpace   uint64
+	iHardLimit uint64
+	iSoftLimit uint64
+	curInodes  uint64
+	bTime      uint64
+	iTime      uint64
+	valid      uint32
+}
+
+// setProjectID 设置目录的 project id, 目录中新建的文件和子目录会继承这个 id
+func setProjectID(path string, id uint32) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var attr fsxattr
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), fsIocFsGetXattr, uintptr(unsafe.Pointer(&attr))); errno != 0 {
+		return fmt.Errorf("get project id of %s: %w", path, errno)
+	}
+	attr.projid = id
+	attr.xflags |= fsXflagProjInherit
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), fsIocFsSetXattr, uintptr(unsafe.Pointer(&attr))); errno != 0 {
+		return fmt.Errorf("set project id of %s: %w", path, errno)
+	}
+	return nil
+}
+
+// setProjectLimit 设置 project 可以使用的字节数
+func setProjectLimit(path string, id uint32, bytes uint64) error {
+	blocks := (bytes + quotaBlockSize - 1) / quotaBlockSize
+	dq := dqblk{
+		bHardLimit: blocks,
+		bSoftLimit: blocks,
+		valid:      qifBLimits,
+	}
+	return quotactl(path, qSetQuota, id, &dq)
+}
+
+// quotactl 对 path 所在的文件系统调用 project quota 的 quotactl 命令.
+// 优先使用 quotactl_fd (Linux 5.14), 否则通过挂载信息查找文件系统的设备
+func quotactl(path string, cmd int, id uint32, dq *dqblk) error {
+	qcmd := uintptr(cmd<<8 | prjQuota)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, _, errno := unix.Syscall6(unix.SYS_QUOTACTL_FD, f.Fd(), qcmd, uintptr(id), uintptr(unsafe.Pointer(dq)), 0, 0)
+	if errno == 0 {
+		return nil
+	}
+	if !errors.Is(errno, unix.ENOSYS) {
+		return fmt.Errorf("quotactl on %s: %w", path, errno)
+	}
+
+	device, err := mountDevice(path)
+	if err != nil {
+		return err
+	}
+	dev, err := unix.BytePtrFromString(device)
+	if err != nil {
+		return err
+	}
+	if _, _, errno := unix.Syscall6(unix.SYS_QUOTACTL, qcmd, uintptr(unsafe.Pointer(dev)), uintptr(id), uintptr(unsafe.Pointer(dq)), 0, 0); errno != 0 {
+		return fmt.Errorf("quotactl on %s: %w", device, errno)
+	}
+	return nil
+}
+
+// mountDevice 返回 path 所在的文件系统的设备
+func mountDevice(path string) (string, error) {
+	mounts, err := mountinfo.GetMounts(mountinfo.ParentsFilter(path))
+	if err != nil {
+		return "", err
+	}
+	var device, mountpoint string
+	for _, m := range mounts {
+		if len(m.Mountpoint) > len(mountpoint) {
+			device, mountpoint = m.Source, m.Mountpoint
+		}
+	}
+	if device == "" {
+		return "", fmt.Errorf("no mount found for %s", path)
+	}
+	return device, nil
+}
@@ -0,0 +1,91 @@
+package hostpath
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+)
+
+// TestQuota 在测试中创建的回环文件系统上测试 mount 卷的两种配额。需要 root 权限。
+func TestQuota(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	for _, mode := range []string{QuotaProject, QuotaLoop} {
+		t.Run(mode, func(t *testing.T) {
+			stateDir := t.TempDir()
+			if mode == QuotaProject {
+				stateDir = mountProjectQuotaFilesystem(t)
+			}
+
+			hp := newTestDriver(t, func(cfg *Config) {
+				cfg.StateDir = stateDir
+				cfg.MountVolumeQuota = mode
+			})
+
+			resp, err := hp.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:               "vol",
+				VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: 16 * mib},
+			})
+			require.NoError(t, err)
+			volID := resp.GetVolume().GetVolumeId()
+			path := hp.getVolumePath(volID)
+
+			// 写入的数据不能超过卷的容量
+			require.NoError(t, os.WriteFile(filepath.Join(path, "small"), make([]byte, 4*mib), 0644))
+			require.Error(t, writeFileSync(filepath.Join(path, "large"), make([]byte, 32*mib)))
+
+			stats, err := hp.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: volID, VolumePath: path})
+			require.NoError(t, err)
+			usage := stats.GetUsage()[0]
+			require.LessOrEqual(t, usage.GetTotal(), 16*mib, "enforced limit")
+			require.Greater(t, usage.GetTotal(), 8*mib, "enforced limit")
+			require.GreaterOrEqual(t, usage.GetUsed(), 4*mib)
+
+			require.NoError(t, hp.deleteVolume(volID))
+			require.NoDirExists(t, path)
+			require.NoFileExists(t, hp.getLoopImagePath(volID))
+		})
+	}
+}
+
+// mountProjectQuotaFilesystem 创建一个启用了 project quota 的 ext4 文件系统并挂载到临时目录
+func mountProjectQuotaFilesystem(t *testing.T) string {
+	tmp := t.TempDir()
+	image := filepath.Join(tmp, "ext4.img")
+	dir := filepath.Join(tmp, "mnt")
+	require.NoError(t, os.Mkdir(dir, 0750))
+	require.NoError(t, createSparseFile(image, 128*mib))
+	out, err := exec.Command("mkfs.ext4", "-q", "-F", "-O", "quota,project", image).CombinedOutput()
+	if err != nil {
+		t.Skipf("mkfs.ext4 does not support project quotas: %v: %s", err, out)
+	}
+	out, err = exec.Command("mount", "-o", "loop,prjquota", image, dir).CombinedOutput()
+	if err != nil {
+		t.Skipf("kernel does not support ext4 project quotas: %v: %s", err, out)
+	}
+	t.Cleanup(func() {
+		if out, err := exec.Command("umount", dir).CombinedOutput(); err != nil {
+			t.Errorf("umount %s: %v: %s", dir, err, out)
+		}
+	})
+	return dir
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	return f.Sync()
+}
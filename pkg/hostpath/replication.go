@@ -0,0 +1,649 @@
+package hostpath
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"github.com/bearcat-panda/csi-demo/pkg/replication"
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"io"
+	"io/fs"
+	"k8s.io/klog/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// replicaNode 参数让驱动把卷的数据异步复制到 ReplicationPeers 中的这个节点
+	replicaNode = "replicaNode"
+
+	// 比较和传输数据的块大小
+	replicationBlockSize = 64 * kib
+	// 一次 Apply 调用最多发送的数据量, 远小于 gRPC 默认的 4MiB 消息限制
+	maxApplyBytes = mib
+	// 复制数据的默认间隔
+	defaultReplicationInterval = time.Minute
+)
+
+// newReplicationPeers 创建到所有对等节点的复制服务的连接
+func newReplicationPeers(peers Peers) (map[string]replication.ReplicationClient, error) {
+	clients := map[string]replication.ReplicationClient{}
+	for nodeID, address := range peers {
+		conn, err := grpc.NewClient(address,
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithUnaryInterceptor(injectTraceContext),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to replication peer %s at %s: %v", nodeID, address, err)
+		}
+		clients[nodeID] = replication.NewReplicationClient(conn)
+	}
+	return clients, nil
+}
+
+// validateReplicaNode 检查 replicaNode 参数指定的是一个已知的对等节点
+func (hp *hostpath) validateReplicaNode(nodeID string) error {
+	if nodeID == hp.config.NodeID {
+		return fmt.Errorf("%s %q must not be the node of the volume", replicaNode, nodeID)
+	}
+	if _, ok := hp.replicationPeers[nodeID]; !ok {
+		return fmt.Errorf("%s %q is not a known replication peer", replicaNode, nodeID)
+	}
+	return nil
+}
+
+// NewReplicationServer 返回接收其它驱动的卷副本的 gRPC 服务器
+func (hp *hostpath) NewReplicationServer(opts ...grpc.ServerOption) *grpc.Server {
+	s := grpc.NewServer(opts...)
+	replication.RegisterReplicationServer(s, &replicationServer{hp: hp, replicas: newNameLocks()})
+	return s
+}
+
+// StartReplication 周期性地把设置了 replicaNode 的卷的数据复制到对等节点, 直到 stopCh 被关闭。
+// 由 startBackgroundTasks 调用
+func (hp *hostpath) StartReplication(stopCh <-chan struct{}) {
+	interval := hp.config.ReplicationInterval
+	if interval <= 0 {
+		interval = defaultReplicationInterval
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+	hp.background.wg.Add(1)
+	go func() {
+		defer hp.background.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			hp.runReplication(ctx)
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// runReplication 依次复制所有源卷
+func (hp *hostpath) runReplication(ctx context.Context) {
+	hp.mutex.Lock()
+	var volIDs []string
+	for _, vol := range hp.state.GetVolumes() {
+		if vol.Replication.Role == state.ReplicationSource {
+			volIDs = append(volIDs, vol.VolID)
+		}
+	}
+	hp.mutex.Unlock()
+
+	for _, volID := range volIDs {
+		if err := hp.replicateVolume(ctx, volID); err != nil {
+			klog.Errorf("replication of volume %s failed: %v", volID, err)
+		}
+	}
+}
+
+// replicateVolume 把卷的数据复制到对等节点, 并在卷上记录复制的状态。
+// 传输期间不持有 hp.mutex, 因此副本是卷在传输期间的状态, 与 rsync 一样不保证一致性。
+func (hp *hostpath) replicateVolume(ctx context.Context, volID string) error {
+	hp.replicationMutex.Lock()
+	defer hp.replicationMutex.Unlock()
+
+	hp.mutex.Lock()
+	vol, err := hp.state.GetVolumeByID(volID)
+	hp.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if vol.Replication.Role != state.ReplicationSource {
+		return status.Errorf(codes.FailedPrecondition, "volume %s is not replicated to a peer", volID)
+	}
+	client, ok := hp.replicationPeers[vol.Replication.Peer]
+	if !ok {
+		return status.Errorf(codes.FailedPrecondition, "replica node %s of volume %s is not a known replication peer", vol.Replication.Peer, volID)
+	}
+
+	start := time.Now()
+	transferred, err := hp.transferVolume(ctx, client, vol, start)
+
+	unlock := hp.lockState(ctx)
+	defer unlock()
+	// 卷可能在传输期间被删除了
+	vol, errGet := hp.state.GetVolumeByID(volID)
+	if errGet != nil {
+		return err
+	}
+	r := &vol.Replication
+	if err != nil {
+		r.Error = err.Error()
+		if !r.SyncTime.IsZero() {
+			r.Lag = time.Since(r.SyncTime)
+		}
+	} else {
+		r.Error = ""
+		r.SyncTime = start
+		r.Lag = time.Since(start)
+		r.BytesTransferred = transferred
+		klog.V(4).Infof("replicated volume %s to node %s, %d bytes transferred", volID, r.Peer, transferred)
+	}
+	if errUpdate := hp.state.UpdateVolume(vol); errUpdate != nil && err == nil {
+		err = errUpdate
+	}
+	return err
+}
+
+// transferVolume 只发送与副本不同的数据块, 然后删除副本中多余的文件. 返回发送的数据量
+func (hp *hostpath) transferVolume(ctx context.Context, client replication.ReplicationClient, vol state.Volume, start time.Time) (int64, error) {
+	if _, err := client.Prepare(ctx, &replication.PrepareRequest{
+		VolumeID:     vol.VolID,
+		Name:         vol.VolName,
+		SourceNode:   hp.config.NodeID,
+		Size:         vol.VolSize,
+		AccessType:   vol.VolAccessType,
+		BlockBacked:  vol.BlockBacked,
+		Parameters:   vol.Parameters,
+		Capabilities: vol.Capabilities,
+	}); err != nil {
+		return 0, fmt.Errorf("failed to prepare replica: %w", err)
+	}
+	resp, err := client.Checksums(ctx, &replication.ChecksumsRequest{VolumeID: vol.VolID, BlockSize: replicationBlockSize})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get checksums of replica: %w", err)
+	}
+	remote := map[string]replication.FileChecksums{}
+	for _, file := range resp.Files {
+		remote[file.Path] = file
+	}
+
+	var transferred, batchBytes int64
+	var paths []string
+	batch := &replication.ApplyRequest{VolumeID: vol.VolID, BlockSize: replicationBlockSize}
+	flush := func() error {
+		if len(batch.Files) == 0 {
+			return nil
+		}
+		if _, err := client.Apply(ctx, batch); err != nil {
+			return fmt.Errorf("failed to apply changes to replica: %w", err)
+		}
+		transferred += batchBytes
+		batch.Files, batchBytes = nil, 0
+		return nil
+	}
+
+	err = walkVolume(vol.VolPath, func(file replication.File, path string) error {
+		paths = append(paths, file.Path)
+		existing, ok := remote[file.Path]
+		if file.Type != replication.Regular {
+			if !ok || existing.File != file {
+				batch.Files = append(batch.Files, replication.FileData{File: file})
+			}
+			return nil
+		}
+
+		// 只有元数据不同时也要发送文件, 以便副本修改大小和权限
+		data := replication.FileData{File: file}
+		err := readBlocks(path, replicationBlockSize, func(index int64, block []byte) error {
+			sum := sha256.Sum256(block)
+			if ok && index < int64(len(existing.Checksums)) && bytes.Equal(existing.Checksums[index], sum[:]) {
+				return nil
+			}
+			data.Blocks = append(data.Blocks, replication.Block{Index: index, Data: bytes.Clone(block)})
+			batchBytes += int64(len(block))
+			if batchBytes < maxApplyBytes {
+				return nil
+			}
+			batch.Files = append(batch.Files, data)
+			data.Blocks = nil
+			return flush()
+		})
+		if err != nil {
+			return err
+		}
+		if len(data.Blocks) > 0 || !ok || existing.File != file {
+			batch.Files = append(batch.Files, data)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := flush(); err != nil {
+		return 0, err
+	}
+
+	if _, err := client.Finish(ctx, &replication.FinishRequest{VolumeID: vol.VolID, Paths: paths, SyncTime: start}); err != nil {
+		return 0, fmt.Errorf("failed to finish replica: %w", err)
+	}
+	return transferred, nil
+}
+
+// deleteReplica 删除卷在对等节点上的副本. 先等待正在进行的传输结束, 否则传输会重新创建副本。
+// 调用者不能持有 hp.mutex。
+func (hp *hostpath) deleteReplica(ctx context.Context, vol state.Volume) error {
+	client, ok := hp.replicationPeers[vol.Replication.Peer]
+	if !ok {
+		return fmt.Errorf("replica node %s is not a known replication peer", vol.Replication.Peer)
+	}
+	hp.replicationMutex.Lock()
+	defer hp.replicationMutex.Unlock()
+	_, err := client.Delete(ctx, &replication.DeleteRequest{VolumeID: vol.VolID})
+	return err
+}
+
+// walkVolume 为卷中的每个目录, 普通文件和符号链接调用 fn, 目录在它包含的文件之前。
+// 块卷和由块文件支持的 mount 卷只有一个文件。其它类型的文件被忽略。
+func walkVolume(root string, fn func(file replication.File, path string) error) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		file := replication.File{Path: filepath.ToSlash(rel), Mode: uint32(info.Mode().Perm())}
+		switch {
+		case info.Mode().IsRegular():
+			file.Type = replication.Regular
+			file.Size = info.Size()
+		case info.IsDir():
+			file.Type = replication.Directory
+		case info.Mode()&fs.ModeSymlink != 0:
+			file.Type = replication.Symlink
+			if file.Target, err = os.Readlink(path); err != nil {
+				return err
+			}
+		default:
+			klog.V(4).Infof("not replicating %s with mode %v", path, info.Mode())
+			return nil
+		}
+		return fn(file, path)
+	})
+}
+
+// readBlocks 按块读取文件, 最后一块可能小于 blockSize
+func readBlocks(path string, blockSize int64, fn func(index int64, block []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, blockSize)
+	for index := int64(0); ; index++ {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			if err := fn(index, buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// replicationServer 在这个驱动上保存其它驱动的卷的副本
+type replicationServer struct {
+	hp *hostpath
+	// 以卷id为键串行执行对同一个副本的操作. 读写副本的数据时只持有副本的锁, 不持有 hp.mutex
+	replicas *nameLocks
+}
+
+var _ replication.ReplicationServer = &replicationServer{}
+
+// replica 返回副本卷. 调用者必须持有 hp.mutex。
+func (s *replicationServer) replica(volID string) (state.Volume, error) {
+	vol, err := s.hp.state.GetVolumeByID(volID)
+	if err != nil {
+		return state.Volume{}, err
+	}
+	switch vol.Replication.Role {
+	case state.ReplicationReplica:
+		return vol, nil
+	case state.ReplicationPromoted:
+		return state.Volume{}, status.Errorf(codes.FailedPrecondition, "replica %s was promoted and no longer accepts data", volID)
+	default:
+		return state.Volume{}, status.Errorf(codes.FailedPrecondition, "volume %s is not a replica", volID)
+	}
+}
+
+// lockReplica 锁定并返回副本卷, 只在读取状态时持有 hp.mutex
+func (s *replicationServer) lockReplica(ctx context.Context, volID string) (state.Volume, func(), error) {
+	unlockReplica := s.replicas.lock(volID)
+	unlock := s.hp.lockState(ctx)
+	vol, err := s.replica(volID)
+	unlock()
+	if err != nil {
+		unlockReplica()
+		return state.Volume{}, nil, err
+	}
+	return vol, unlockReplica, nil
+}
+
+// Prepare 创建副本卷, 副本已经存在时什么都不做
+func (s *replicationServer) Prepare(ctx context.Context, req *replication.PrepareRequest) (*replication.Empty, error) {
+	hp := s.hp
+	unlock := hp.lockState(ctx)
+	defer unlock()
+
+	if vol, err := hp.state.GetVolumeByID(req.VolumeID); err == nil {
+		if _, err := s.replica(vol.VolID); err != nil {
+			return nil, err
+		}
+		if vol.Replication.Peer != req.SourceNode {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s is a replica of node %s, not of %s", vol.VolID, vol.Replication.Peer, req.SourceNode)
+		}
+		return &replication.Empty{}, nil
+	}
+	if _, err := hp.state.GetVolumeByName(req.Name); err == nil {
+		return nil, status.Errorf(codes.AlreadyExists, "a volume with name %s already exists", req.Name)
+	}
+	if req.AccessType == state.MountAccess && req.BlockBacked != hp.config.BlockBackedMountVolumes {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s and its replica must both be block-backed or both be directories", req.VolumeID)
+	}
+
+	// 副本总是稀疏的, 只有收到的数据块才分配空间
+	vol, err := hp.createVolume(ctx, req.VolumeID, req.Name, req.Size, req.AccessType, false, "", true, false)
+	if err != nil {
+		return nil, err
+	}
+	topologies, err := hp.accessibleTopology(nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, topology := range topologies {
+		vol.AccessibleTopology = append(vol.AccessibleTopology, topology.GetSegments())
+	}
+	vol.Parameters = req.Parameters
+	vol.Capabilities = req.Capabilities
+	vol.Replication = state.Replication{Role: state.ReplicationReplica, Peer: req.SourceNode}
+	if err := hp.state.UpdateVolume(*vol); err != nil {
+		return nil, err
+	}
+	klog.V(4).Infof("created replica %s of volume on node %s", vol.VolID, req.SourceNode)
+	return &replication.Empty{}, nil
+}
+
+// Checksums 返回副本中所有普通文件的数据块的校验和
+func (s *replicationServer) Checksums(ctx context.Context, req *replication.ChecksumsRequest) (*replication.ChecksumsResponse, error) {
+	if req.BlockSize <= 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid block size %d", req.BlockSize)
+	}
+	vol, unlock, err := s.lockReplica(ctx, req.VolumeID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	resp := &replication.ChecksumsResponse{}
+	err = walkVolume(vol.VolPath, func(file replication.File, path string) error {
+		sums := replication.FileChecksums{File: file}
+		if file.Type == replication.Regular {
+			err := readBlocks(path, req.BlockSize, func(index int64, block []byte) error {
+				sum := sha256.Sum256(block)
+				sums.Checksums = append(sums.Checksums, sum[:])
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		resp.Files = append(resp.Files, sums)
+		return nil
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to compute checksums of replica %s: %v", vol.VolID, err)
+	}
+	return resp, nil
+}
+
+// Apply 在副本中创建或修改文件并写入收到的数据块
+func (s *replicationServer) Apply(ctx context.Context, req *replication.ApplyRequest) (*replication.Empty, error) {
+	if req.BlockSize <= 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid block size %d", req.BlockSize)
+	}
+	vol, unlock, err := s.lockReplica(ctx, req.VolumeID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	for _, data := range req.Files {
+		if err := applyFile(vol, data, req.BlockSize); err != nil {
+			return nil, err
+		}
+	}
+	return &replication.Empty{}, nil
+}
+
+// applyFile 把一个文件的改动写入副本
+func applyFile(vol state.Volume, data replication.FileData, blockSize int64) error {
+	path, err := replicaPath(vol, data.File)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	mode := fs.FileMode(data.Mode).Perm()
+
+	// 类型改变的文件先删除. 卷本身的类型不会改变
+	if info, err := os.Lstat(path); err == nil && data.Path != replication.RootPath {
+		isSymlink := info.Mode()&fs.ModeSymlink != 0
+		if (data.Type == replication.Directory) != info.IsDir() ||
+			(data.Type == replication.Symlink) != isSymlink ||
+			(data.Type == replication.Symlink && isSymlink) {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch data.Type {
+	case replication.Directory:
+		if err := os.Mkdir(path, mode); err != nil && !os.IsExist(err) {
+			return err
+		}
+		return os.Chmod(path, mode)
+	case replication.Symlink:
+		return os.Symlink(data.Target, path)
+	case replication.Regular:
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, mode)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if info.Size() != data.Size {
+			if err := f.Truncate(data.Size); err != nil {
+				return err
+			}
+		}
+		for _, block := range data.Blocks {
+			if _, err := f.WriteAt(block.Data, block.Index*blockSize); err != nil {
+				return err
+			}
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		return os.Chmod(path, mode)
+	default:
+		return status.Errorf(codes.InvalidArgument, "unsupported file type %q", data.Type)
+	}
+}
+
+// replicaPath 返回文件在副本中的路径. 路径不能离开卷, 也不能经过符号链接
+func replicaPath(vol state.Volume, file replication.File) (string, error) {
+	if file.Path == replication.RootPath {
+		if isFileBacked(vol) != (file.Type == replication.Regular) {
+			return "", fmt.Errorf("volume %s cannot be replaced by a %s", vol.VolID, file.Type)
+		}
+		return vol.VolPath, nil
+	}
+	rel := filepath.FromSlash(file.Path)
+	if isFileBacked(vol) || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("invalid path %q in volume %s", file.Path, vol.VolID)
+	}
+	path := vol.VolPath
+	parts := strings.Split(rel, string(filepath.Separator))
+	for _, part := range parts[:len(parts)-1] {
+		path = filepath.Join(path, part)
+		info, err := os.Lstat(path)
+		if err != nil {
+			return "", err
+		}
+		if !info.IsDir() {
+			return "", fmt.Errorf("parent %s of %q in volume %s is not a directory", path, file.Path, vol.VolID)
+		}
+	}
+	return filepath.Join(vol.VolPath, rel), nil
+}
+
+// Finish 删除副本中源卷已经没有的文件, 并记录复制的时间
+func (s *replicationServer) Finish(ctx context.Context, req *replication.FinishRequest) (*replication.Empty, error) {
+	hp := s.hp
+	vol, unlockReplica, err := s.lockReplica(ctx, req.VolumeID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlockReplica()
+
+	if !isFileBacked(vol) {
+		keep := map[string]bool{}
+		for _, path := range req.Paths {
+			keep[path] = true
+		}
+		var remove []string
+		err := filepath.WalkDir(vol.VolPath, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(vol.VolPath, path)
+			if err != nil {
+				return err
+			}
+			if keep[filepath.ToSlash(rel)] {
+				return nil
+			}
+			remove = append(remove, path)
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to clean up replica %s: %v", vol.VolID, err)
+		}
+		for _, path := range remove {
+			if err := os.RemoveAll(path); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to clean up replica %s: %v", vol.VolID, err)
+			}
+		}
+	}
+
+	unlock := hp.lockState(ctx)
+	defer unlock()
+	// 删除文件期间卷的其它字段可能被修改了
+	if vol, err = s.replica(req.VolumeID); err != nil {
+		return nil, err
+	}
+	vol.Replication.SyncTime = req.SyncTime
+	vol.Replication.Lag = time.Since(req.SyncTime)
+	vol.Replication.Error = ""
+	if err := hp.state.UpdateVolume(vol); err != nil {
+		return nil, err
+	}
+	return &replication.Empty{}, nil
+}
+
+// Promote 把副本变成可写的卷, 之后它不再接受源卷的数据. 等待正在写入副本的请求结束
+func (s *replicationServer) Promote(ctx context.Context, req *replication.PromoteRequest) (*replication.Empty, error) {
+	hp := s.hp
+	unlockReplica := s.replicas.lock(req.VolumeID)
+	defer unlockReplica()
+	unlock := hp.lockState(ctx)
+	defer unlock()
+
+	vol, err := hp.state.GetVolumeByID(req.VolumeID)
+	if err != nil {
+		return nil, err
+	}
+	switch vol.Replication.Role {
+	case state.ReplicationPromoted:
+		return &replication.Empty{}, nil
+	case state.ReplicationReplica:
+	default:
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is not a replica", vol.VolID)
+	}
+	vol.Replication.Role = state.ReplicationPromoted
+	if err := hp.state.UpdateVolume(vol); err != nil {
+		return nil, err
+	}
+	klog.Infof("promoted replica %s of volume on node %s, data is from %v", vol.VolID, vol.Replication.Peer, vol.Replication.SyncTime)
+	return &replication.Empty{}, nil
+}
+
+// Delete 删除副本. 提升后的副本是一个独立的卷, 不会被删除
+func (s *replicationServer) Delete(ctx context.Context, req *replication.DeleteRequest) (*replication.Empty, error) {
+	hp := s.hp
+	unlockReplica := s.replicas.lock(req.VolumeID)
+	defer unlockReplica()
+	unlock := hp.lockState(ctx)
+	defer unlock()
+
+	vol, err := s.replica(req.VolumeID)
+	if status.Code(err) == codes.NotFound {
+		return &replication.Empty{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := hp.deleteVolume(vol.VolID); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete replica %s: %v", vol.VolID, err)
+	}
+	return &replication.Empty{}, nil
+}
+
+// errReplica 是副本不能被写入时返回的错误
+func errReplica(volID string) error {
+	return status.Errorf(codes.FailedPrecondition, "volume %s is a replica, it must be promoted before it can be written", volID)
+}
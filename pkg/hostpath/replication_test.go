@@ -0,0 +1,216 @@
+package hostpath
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bearcat-panda/csi-demo/pkg/replication"
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// startReplicationPeers 启动源驱动和提供复制服务的对等驱动, 返回源驱动, 对等驱动和对等驱动的客户端
+func startReplicationPeers(t *testing.T) (*hostpath, *hostpath, replication.ReplicationClient) {
+	peer := newTestDriver(t, func(cfg *Config) {
+		cfg.NodeID = "node-2"
+	})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := peer.NewReplicationServer()
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	source := newTestDriver(t, func(cfg *Config) {
+		cfg.NodeID = "node-1"
+		cfg.ReplicationPeers = Peers{"node-2": lis.Addr().String()}
+	})
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return source, peer, replication.NewReplicationClient(conn)
+}
+
+// requireSameTree 检查两个目录中的文件, 权限和内容相同
+func requireSameTree(t *testing.T, expected, actual string) {
+	t.Helper()
+	var files []string
+	err := filepath.WalkDir(expected, func(path string, d os.DirEntry, err error) error {
+		require.NoError(t, err)
+		rel, _ := filepath.Rel(expected, path)
+		files = append(files, rel)
+		info, err := os.Lstat(path)
+		require.NoError(t, err)
+		other, err := os.Lstat(filepath.Join(actual, rel))
+		require.NoError(t, err, rel)
+		require.Equal(t, info.Mode(), other.Mode(), rel)
+		switch {
+		case info.Mode().IsRegular():
+			want, err := os.ReadFile(path)
+			require.NoError(t, err)
+			got, err := os.ReadFile(filepath.Join(actual, rel))
+			require.NoError(t, err)
+			require.Equal(t, want, got, rel)
+		case info.Mode()&os.ModeSymlink != 0:
+			want, _ := os.Readlink(path)
+			got, _ := os.Readlink(filepath.Join(actual, rel))
+			require.Equal(t, want, got, rel)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	var actualFiles []string
+	err = filepath.WalkDir(actual, func(path string, d os.DirEntry, err error) error {
+		rel, _ := filepath.Rel(actual, path)
+		actualFiles = append(actualFiles, rel)
+		return err
+	})
+	require.NoError(t, err)
+	require.ElementsMatch(t, files, actualFiles)
+}
+
+func TestReplication(t *testing.T) {
+	source, peer, client := startReplicationPeers(t)
+	ctx := context.Background()
+
+	create := func(name string, capability *csi.VolumeCapability, params map[string]string) (*csi.Volume, error) {
+		resp, err := source.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               name,
+			VolumeCapabilities: []*csi.VolumeCapability{capability},
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: 4 * mib},
+			Parameters:         params,
+		})
+		return resp.GetVolume(), err
+	}
+	replicationStatus := func(hp *hostpath, volID string) state.Replication {
+		vol, err := hp.state.GetVolumeByID(volID)
+		require.NoError(t, err)
+		return vol.Replication
+	}
+
+	for _, node := range []string{"node-1", "node-3"} {
+		_, err := create("invalid", mountCapability(), map[string]string{replicaNode: node})
+		require.Equal(t, codes.InvalidArgument, status.Code(err), "replica node %s: %v", node, err)
+	}
+
+	vol, err := create("vol", mountCapability(), map[string]string{replicaNode: "node-2"})
+	require.NoError(t, err)
+	volID := vol.GetVolumeId()
+	require.Equal(t, state.Replication{Role: state.ReplicationSource, Peer: "node-2"}, replicationStatus(source, volID))
+
+	srcPath := source.getVolumePath(volID)
+	large := make([]byte, 10*replicationBlockSize+100)
+	_, err = rand.Read(large)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(srcPath, "large"), large, 0640))
+	require.NoError(t, os.MkdirAll(filepath.Join(srcPath, "dir", "sub"), 0750))
+	require.NoError(t, os.WriteFile(filepath.Join(srcPath, "dir", "sub", "small"), []byte("hello"), 0600))
+	require.NoError(t, os.Symlink("dir/sub/small", filepath.Join(srcPath, "link")))
+
+	// 第一次复制创建副本并传输所有数据
+	require.NoError(t, source.replicateVolume(ctx, volID))
+	requireSameTree(t, srcPath, peer.getVolumePath(volID))
+	r := replicationStatus(source, volID)
+	require.Empty(t, r.Error)
+	require.False(t, r.SyncTime.IsZero())
+	require.Equal(t, int64(len(large)+len("hello")), r.BytesTransferred)
+	replica := replicationStatus(peer, volID)
+	require.Equal(t, state.ReplicationReplica, replica.Role)
+	require.Equal(t, "node-1", replica.Peer)
+	require.True(t, replica.SyncTime.Equal(r.SyncTime))
+
+	// 之后只传输改变的数据块, 并删除副本中多余的文件
+	large[5*replicationBlockSize] ^= 0xff
+	require.NoError(t, os.WriteFile(filepath.Join(srcPath, "large"), large, 0640))
+	require.NoError(t, os.RemoveAll(filepath.Join(srcPath, "dir", "sub")))
+	require.NoError(t, os.WriteFile(filepath.Join(srcPath, "dir", "sub"), []byte("now a file"), 0644))
+	require.NoError(t, os.Chmod(filepath.Join(srcPath, "dir"), 0700))
+	require.NoError(t, source.replicateVolume(ctx, volID))
+	requireSameTree(t, srcPath, peer.getVolumePath(volID))
+	require.Equal(t, replicationBlockSize+int64(len("now a file")), replicationStatus(source, volID).BytesTransferred)
+
+	require.NoError(t, source.replicateVolume(ctx, volID))
+	require.Zero(t, replicationStatus(source, volID).BytesTransferred)
+
+	// 副本在提升之前不能写入
+	target := filepath.Join(t.TempDir(), "target")
+	_, err = peer.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:         volID,
+		TargetPath:       target,
+		VolumeCapability: mountCapability(),
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err), "publish replica writable: %v", err)
+
+	_, err = client.Promote(ctx, &replication.PromoteRequest{VolumeID: volID})
+	require.NoError(t, err)
+	require.Equal(t, state.ReplicationPromoted, replicationStatus(peer, volID).Role)
+	_, err = client.Promote(ctx, &replication.PromoteRequest{VolumeID: volID})
+	require.NoError(t, err, "promote again")
+
+	// 提升后的副本不再接受源卷的数据, 错误记录在源卷上
+	require.NoError(t, os.WriteFile(filepath.Join(srcPath, "new"), []byte("new"), 0644))
+	err = source.replicateVolume(ctx, volID)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err), "replicate to promoted replica: %v", err)
+	require.Contains(t, replicationStatus(source, volID).Error, "promoted")
+	_, err = os.Stat(filepath.Join(peer.getVolumePath(volID), "new"))
+	require.True(t, os.IsNotExist(err), "new file must not be replicated")
+
+	// 删除源卷不会删除提升后的副本
+	_, err = source.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volID})
+	require.NoError(t, err)
+	_, err = peer.state.GetVolumeByID(volID)
+	require.NoError(t, err)
+}
+
+func TestReplicationBlockVolume(t *testing.T) {
+	source, peer, _ := startReplicationPeers(t)
+	ctx := context.Background()
+
+	resp, err := source.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "block",
+		VolumeCapabilities: []*csi.VolumeCapability{blockCapability()},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 4 * mib},
+		Parameters:         map[string]string{replicaNode: "node-2", provisioning: provisioningThin},
+	})
+	require.NoError(t, err)
+	volID := resp.GetVolume().GetVolumeId()
+	srcPath := source.getVolumePath(volID)
+
+	// 稀疏文件中的零与副本相同, 只传输写入的数据块
+	f, err := os.OpenFile(srcPath, os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("data"), 3*replicationBlockSize)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	require.NoError(t, source.replicateVolume(ctx, volID))
+	want, err := os.ReadFile(srcPath)
+	require.NoError(t, err)
+	got, err := os.ReadFile(peer.getVolumePath(volID))
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+	vol, err := source.state.GetVolumeByID(volID)
+	require.NoError(t, err)
+	require.Equal(t, replicationBlockSize, vol.Replication.BytesTransferred)
+
+	replica, err := peer.state.GetVolumeByID(volID)
+	require.NoError(t, err)
+	require.Equal(t, state.BlockAccess, replica.VolAccessType)
+
+	// 删除源卷时同时删除副本
+	_, err = source.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volID})
+	require.NoError(t, err)
+	_, err = peer.state.GetVolumeByID(volID)
+	require.Error(t, err)
+	_, err = os.Stat(peer.getVolumePath(volID))
+	require.True(t, os.IsNotExist(err), "replica file must be removed")
+}
@@ -0,0 +1,210 @@
+package hostpath
+
+import (
+	"errors"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"k8s.io/klog/v2"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// backgroundTasks 是只能由持有状态文件的实例运行的后台任务, 选主时只有 leader 运行它们
+type backgroundTasks struct {
+	stopCh chan struct{}
+	// 等待任务的 goroutine 结束
+	wg sync.WaitGroup
+}
+
+// startBackgroundTasks 在恢复状态之后启动后台任务
+func (hp *hostpath) startBackgroundTasks() {
+	hp.background.stopCh = make(chan struct{})
+	hp.StartSnapshotScheduler(hp.background.stopCh)
+	// TrashRetention 为零时也要清理之前留在回收站中的条目
+	hp.StartTrashPurger(hp.background.stopCh)
+	if len(hp.replicationPeers) > 0 {
+		hp.StartReplication(hp.background.stopCh)
+	}
+}
+
+// stopBackgroundTasks 停止后台任务并等待它们结束, 之后它们不会再修改状态
+func (hp *hostpath) stopBackgroundTasks() {
+	if hp.background.stopCh == nil {
+		return
+	}
+	close(hp.background.stopCh)
+	hp.background.stopCh = nil
+	hp.background.wg.Wait()
+}
+
+// nonBlockingGRPCServer 在后台提供 CSI 服务
+type nonBlockingGRPCServer struct {
+	wg      sync.WaitGroup
+	server  *grpc.Server
+	cleanup func()
+}
+
+func NewNonBlockingGRPCServer() *nonBlockingGRPCServer {
+	return &nonBlockingGRPCServer{}
+}
+
+// Start 监听 endpoint 并在后台提供 CSI 服务. 为 nil 的服务不会被注册
+func (s *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer, gcs csi.GroupControllerServer, opts ...grpc.ServerOption) error {
+	proto, addr, err := parseEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
+	if proto == "unix" {
+		// 删除上一次运行留下的 socket 文件
+		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %v", addr, err)
+		}
+	}
+	listener, err := net.Listen(proto, addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %v", err)
+	}
+	s.cleanup = func() {
+		if proto == "unix" {
+			os.Remove(addr)
+		}
+	}
+
+	s.server = grpc.NewServer(opts...)
+	if ids != nil {
+		csi.RegisterIdentityServer(s.server, ids)
+	}
+	if cs != nil {
+		csi.RegisterControllerServer(s.server, cs)
+	}
+	if ns != nil {
+		csi.RegisterNodeServer(s.server, ns)
+	}
+	if gcs != nil {
+		csi.RegisterGroupControllerServer(s.server, gcs)
+	}
+
+	klog.Infof("Listening for connections on address: %#v", listener.Addr())
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := s.server.Serve(listener); err != nil {
+			klog.Errorf("gRPC server stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Wait 等待服务器停止
+func (s *nonBlockingGRPCServer) Wait() {
+	s.wg.Wait()
+}
+
+// Stop 等待正在处理的请求完成后停止服务器
+func (s *nonBlockingGRPCServer) Stop() {
+	s.server.GracefulStop()
+	s.cleanup()
+}
+
+// ForceStop 立即停止服务器
+func (s *nonBlockingGRPCServer) ForceStop() {
+	s.server.Stop()
+	s.cleanup()
+}
+
+// parseEndpoint 把 unix:///csi/csi.sock 或 tcp://127.0.0.1:10000 格式的 endpoint 拆分为协议和地址
+func parseEndpoint(ep string) (string, string, error) {
+	if strings.HasPrefix(strings.ToLower(ep), "unix://") || strings.HasPrefix(strings.ToLower(ep), "tcp://") {
+		s := strings.SplitN(ep, "://", 2)
+		if s[1] != "" {
+			return strings.ToLower(s[0]), s[1], nil
+		}
+	}
+	return "", "", fmt.Errorf("invalid endpoint: %v", ep)
+}
+
+// Run 提供 CSI 服务, 配置了 MetricsAddress 时同时导出 Prometheus 指标和 /healthz,
+// 配置了 ReplicationAddress 时接收其它节点的卷副本, 直到 gRPC 服务器停止。
+// 服务开始后才恢复上一次运行的状态, 在此期间 Probe 返回 Ready=false。
+// 选主时参与选主, 成为 leader 后才恢复状态并启动后台任务
+func (hp *hostpath) Run() (finalerr error) {
+	defer func() {
+		if err := hp.Close(); err != nil && finalerr == nil {
+			finalerr = err
+		}
+	}()
+	s := NewNonBlockingGRPCServer()
+	if err := s.Start(hp.config.EndPoint, hp, hp, hp, hp,
+		grpc.ChainUnaryInterceptor(hp.unaryInterceptors()...),
+	); err != nil {
+		return err
+	}
+
+	if hp.config.MetricsAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle(hp.metricsPath(), hp.MetricsHandler())
+		mux.Handle(healthzPath, hp.HealthzHandler())
+		server := &http.Server{Addr: hp.config.MetricsAddress, Handler: mux}
+		go func() {
+			klog.Infof("Serving metrics on %s%s", hp.config.MetricsAddress, hp.metricsPath())
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				klog.Errorf("metrics server stopped: %v", err)
+			}
+		}()
+		defer server.Close()
+	}
+
+	// 不需要重启 gRPC 服务就可以修改容量和限制
+	stopReload := make(chan struct{})
+	hp.WatchConfigFile(stopReload)
+	defer close(stopReload)
+
+	// 容量检查使用后台计算的实际分配的空间
+	stopUsage := make(chan struct{})
+	hp.StartUsageRefresher(stopUsage)
+	defer close(stopUsage)
+
+	if hp.config.ReplicationAddress != "" {
+		listener, err := net.Listen("tcp", hp.config.ReplicationAddress)
+		if err != nil {
+			s.ForceStop()
+			return fmt.Errorf("failed to listen for replication: %v", err)
+		}
+		server := hp.NewReplicationServer(grpc.ChainUnaryInterceptor(hp.unaryInterceptors()...))
+		go func() {
+			klog.Infof("Serving replication on %s", listener.Addr())
+			if err := server.Serve(listener); err != nil {
+				klog.Errorf("replication server stopped: %v", err)
+			}
+		}()
+		defer server.Stop()
+	}
+
+	if hp.leaderElectionEnabled() {
+		// 成为 leader 时才恢复状态
+		hp.setReady(true)
+		stopCh := make(chan struct{})
+		if err := hp.StartLeaderElection(stopCh); err != nil {
+			s.ForceStop()
+			return err
+		}
+		defer func() {
+			close(stopCh)
+			hp.election.wg.Wait()
+		}()
+	} else {
+		if err := hp.reconcile(); err != nil {
+			s.ForceStop()
+			return fmt.Errorf("failed to reconcile state: %v", err)
+		}
+		hp.startBackgroundTasks()
+		defer hp.stopBackgroundTasks()
+	}
+
+	s.Wait()
+	return nil
+}
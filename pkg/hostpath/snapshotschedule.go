@@ -0,0 +1,231 @@
+package hostpath
+
+import (
+	"context"
+	"fmt"
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+	"github.com/pborman/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// 快照调度器默认的检查间隔
+	defaultSnapshotScheduleInterval = time.Minute
+	// 定时快照允许的最小间隔
+	minSnapshotScheduleInterval = time.Minute
+)
+
+// retentionRule 表示保留策略中的一项 <window>:<count>:
+// 在最近 window 时间内最多保留 count 个快照, 每个 window/count 的时间段保留最新的一个。
+type retentionRule struct {
+	window time.Duration
+	keep   int
+}
+
+// parseSnapshotSchedule 解析 snapshotSchedule 参数, 返回两次快照之间的间隔。
+// 支持 @hourly, @daily, @weekly 和 @every <duration>。
+func parseSnapshotSchedule(spec string) (time.Duration, error) {
+	switch spec {
+	case "@hourly":
+		return time.Hour, nil
+	case "@daily", "@midnight":
+		return 24 * time.Hour, nil
+	case "@weekly":
+		return 7 * 24 * time.Hour, nil
+	}
+
+	every, ok := strings.CutPrefix(spec, "@every ")
+	if !ok {
+		return 0, fmt.Errorf("invalid %s %q: must be one of @hourly, @daily, @weekly or @every <duration>", snapshotSchedule, spec)
+	}
+	interval, err := parseDuration(strings.TrimSpace(every))
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", snapshotSchedule, spec, err)
+	}
+	if interval < minSnapshotScheduleInterval {
+		return 0, fmt.Errorf("invalid %s %q: interval must be at least %v", snapshotSchedule, spec, minSnapshotScheduleInterval)
+	}
+	return interval, nil
+}
+
+// parseSnapshotRetention 解析 snapshotRetain 参数, 格式为逗号分隔的 <window>:<count>。
+// 空字符串表示没有保留策略。
+func parseSnapshotRetention(spec string) ([]retentionRule, error) {
+	if spec == "" {
+		return nil, nil
+	}
+
+	var rules []retentionRule
+	for _, part := range strings.Split(spec, ",") {
+		window, count, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid %s %q: %q must be of format <window>:<count>", snapshotRetain, spec, part)
+		}
+		d, err := parseDuration(window)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", snapshotRetain, spec, err)
+		}
+		keep, err := strconv.Atoi(count)
+		if err != nil || keep <= 0 {
+			return nil, fmt.Errorf("invalid %s %q: count %q must be a positive integer", snapshotRetain, spec, count)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid %s %q: window %q must be positive", snapshotRetain, spec, window)
+		}
+		rules = append(rules, retentionRule{window: d, keep: keep})
+	}
+	return rules, nil
+}
+
+// parseDuration 在 time.ParseDuration 的基础上支持天(d)和周(w)作为单位, 例如 "7d"。
+func parseDuration(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			v, err := strconv.Atoi(n)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			return time.Duration(v) * unit, nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+// expiredSnapshots 返回按照保留策略应该删除的快照。
+// 没有保留策略时保留所有快照, 最新的快照总是被保留。
+func expiredSnapshots(snapshots []state.Snapshot, rules []retentionRule, now time.Time) []state.Snapshot {
+	if len(rules) == 0 || len(snapshots) == 0 {
+		return nil
+	}
+
+	sorted := make([]state.Snapshot, len(snapshots))
+	copy(sorted, snapshots)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].CreationTime.AsTime().After(sorted[j].CreationTime.AsTime())
+	})
+
+	keep := map[string]bool{sorted[0].Id: true}
+	for _, rule := range rules {
+		bucket := rule.window / time.Duration(rule.keep)
+		seen := map[int64]bool{}
+		for _, snapshot := range sorted {
+			created := snapshot.CreationTime.AsTime()
+			if now.Sub(created) >= rule.window {
+				continue
+			}
+			// 时间段以 Unix 纪元为起点, 这样每次检查时分段的边界都不会移动。
+			b := created.UnixNano() / int64(bucket)
+			if !seen[b] {
+				seen[b] = true
+				keep[snapshot.Id] = true
+			}
+		}
+	}
+
+	var expired []state.Snapshot
+	for _, snapshot := range sorted {
+		if !keep[snapshot.Id] {
+			expired = append(expired, snapshot)
+		}
+	}
+	return expired
+}
+
+// StartSnapshotScheduler 周期性地为设置了 snapshotSchedule 的卷创建快照,
+// 并按保留策略清理旧的定时快照, 直到 stopCh 被关闭。
+// 下一次快照的时间由已有的定时快照推算, 所以驱动重启后调度会继续进行。
+// 由 startBackgroundTasks 启动, 选主时只有 leader 运行调度。
+func (hp *hostpath) StartSnapshotScheduler(stopCh <-chan struct{}) {
+	interval := hp.config.SnapshotScheduleInterval
+	if interval <= 0 {
+		interval = defaultSnapshotScheduleInterval
+	}
+
+	hp.background.wg.Add(1)
+	go func() {
+		defer hp.background.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			hp.runSnapshotSchedules(time.Now())
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// runSnapshotSchedules 为所有到期的卷创建快照并清理过期的快照
+func (hp *hostpath) runSnapshotSchedules(now time.Time) {
+	hp.mutex.Lock()
+	defer hp.mutex.Unlock()
+
+	for _, vol := range hp.state.GetVolumes() {
+		if vol.SnapshotSchedule == "" || vol.DeletionDeferred {
+			continue
+		}
+		if err := hp.runSnapshotSchedule(vol, now); err != nil {
+			klog.Errorf("scheduled snapshot of volume %s failed: %v", vol.VolID, err)
+		}
+	}
+}
+
+func (hp *hostpath) runSnapshotSchedule(vol state.Volume, now time.Time) error {
+	interval, err := parseSnapshotSchedule(vol.SnapshotSchedule)
+	if err != nil {
+		return err
+	}
+	rules, err := parseSnapshotRetention(vol.SnapshotRetention)
+	if err != nil {
+		return err
+	}
+
+	// 只有已经就绪的快照才参与保留策略, 正在创建的快照不会被删除
+	var ready []state.Snapshot
+	var last time.Time
+	for _, snapshot := range hp.state.GetSnapshots() {
+		if snapshot.VolID != vol.VolID || !snapshot.Scheduled {
+			continue
+		}
+		if err := hp.snapshotJobError(snapshot.Id); err != nil {
+			klog.Errorf("removed failed scheduled snapshot of volume %s: %v", vol.VolID, err)
+			continue
+		}
+		if created := snapshot.CreationTime.AsTime(); created.After(last) {
+			last = created
+		}
+		if snapshot.ReadyToUse {
+			ready = append(ready, snapshot)
+		}
+	}
+
+	if last.IsZero() || now.Sub(last) >= interval {
+		name := fmt.Sprintf("%s-%s", vol.VolName, now.UTC().Format("20060102150405"))
+		snapshot, err := hp.createSnapshot(uuid.NewUUID().String(), name, vol, true, hp.snapshotKey)
+		if err != nil {
+			return err
+		}
+		klog.V(4).Infof("started scheduled snapshot %s of volume %s", snapshot.Id, vol.VolID)
+	}
+
+	for _, snapshot := range expiredSnapshots(ready, rules, now) {
+		// 删除策略同样适用于过期的快照, 被阻止删除的快照在下一次检查时重试
+		if err := hp.removeSnapshot(context.Background(), snapshot); err != nil {
+			if status.Code(err) == codes.FailedPrecondition {
+				klog.V(4).Infof("keeping expired scheduled snapshot %s: %v", snapshot.Id, err)
+				continue
+			}
+			return err
+		}
+		klog.V(4).Infof("pruned scheduled snapshot %s of volume %s", snapshot.Id, vol.VolID)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package hostpath
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestParseSnapshotSchedule(t *testing.T) {
+	for spec, expected := range map[string]time.Duration{
+		"@hourly":      time.Hour,
+		"@daily":       24 * time.Hour,
+		"@weekly":      7 * 24 * time.Hour,
+		"@every 30m":   30 * time.Minute,
+		"@every 2d":    48 * time.Hour,
+		"@every 1h30m": 90 * time.Minute,
+	} {
+		interval, err := parseSnapshotSchedule(spec)
+		require.NoError(t, err, spec)
+		require.Equal(t, expected, interval, spec)
+	}
+
+	for _, spec := range []string{"", "hourly", "0 * * * *", "@every", "@every 10s", "@every xyz"} {
+		_, err := parseSnapshotSchedule(spec)
+		require.Error(t, err, spec)
+	}
+}
+
+func TestParseSnapshotRetention(t *testing.T) {
+	rules, err := parseSnapshotRetention("24h:24, 7d:7")
+	require.NoError(t, err)
+	require.Equal(t, []retentionRule{{window: 24 * time.Hour, keep: 24}, {window: 7 * 24 * time.Hour, keep: 7}}, rules)
+
+	rules, err = parseSnapshotRetention("")
+	require.NoError(t, err)
+	require.Empty(t, rules)
+
+	for _, spec := range []string{"24h", "24h:0", "24h:x", "0h:1", "1y:1"} {
+		_, err := parseSnapshotRetention(spec)
+		require.Error(t, err, spec)
+	}
+}
+
+func TestExpiredSnapshots(t *testing.T) {
+	now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	// 每小时一个快照, 一共 10 天
+	var snapshots []state.Snapshot
+	for i := 0; i < 240; i++ {
+		snapshots = append(snapshots, state.Snapshot{
+			Id:           fmt.Sprintf("snap-%03d", i),
+			CreationTime: timestamppb.New(now.Add(-time.Duration(i) * time.Hour)),
+		})
+	}
+
+	require.Empty(t, expiredSnapshots(snapshots, nil, now), "no retention policy")
+
+	rules, err := parseSnapshotRetention("24h:24,7d:7")
+	require.NoError(t, err)
+	expired := expiredSnapshots(snapshots, rules, now)
+	kept := len(snapshots) - len(expired)
+	// 最近 24 小时的 24 个快照, 加上更早 6 天每天一个
+	require.Equal(t, 24+6, kept)
+	for _, snapshot := range expired {
+		require.NotEqual(t, "snap-000", snapshot.Id, "newest snapshot must be kept")
+		if snapshot.CreationTime.AsTime().Before(now.Add(-7 * 24 * time.Hour)) {
+			continue
+		}
+		require.False(t, snapshot.CreationTime.AsTime().After(now.Add(-24*time.Hour)), "snapshot %s of last day expired", snapshot.Id)
+	}
+
+	// 保留策略窗口外的快照全部删除, 但最新的快照除外
+	old := []state.Snapshot{{Id: "old", CreationTime: timestamppb.New(now.Add(-48 * time.Hour))}}
+	require.Empty(t, expiredSnapshots(old, rules[:1], now))
+}
+
+func TestSnapshotScheduler(t *testing.T) {
+	cfg := testConfig(t)
+	hp, err := NewHostPathDriver(cfg)
+	require.NoError(t, err)
+
+	resp, err := hp.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "vol",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: mib},
+		Parameters:         map[string]string{snapshotSchedule: "@hourly", snapshotRetain: "1h:1"},
+	})
+	require.NoError(t, err)
+	volID := resp.GetVolume().GetVolumeId()
+
+	now := time.Now()
+	hp.runSnapshotSchedules(now)
+	hp.runSnapshotSchedules(now.Add(time.Minute))
+	hp.snapshotWG.Wait()
+	list, err := hp.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SourceVolumeId: volID})
+	require.NoError(t, err)
+	require.Len(t, list.GetEntries(), 1, "snapshot is only taken once per interval")
+	first := list.GetEntries()[0].GetSnapshot()
+	require.True(t, first.GetReadyToUse())
+
+	// 模拟两个小时以后重启驱动: 调度继续进行, 旧的快照按保留策略被删除
+	old, err := hp.state.GetSnapshotByID(first.GetSnapshotId())
+	require.NoError(t, err)
+	old.CreationTime = timestamppb.New(now.Add(-2 * time.Hour))
+	require.NoError(t, hp.state.UpdateSnapshot(old))
+	require.NoError(t, hp.Close())
+	hp, err = NewHostPathDriver(cfg)
+	require.NoError(t, err)
+	hp.runSnapshotSchedules(time.Now())
+	hp.snapshotWG.Wait()
+	hp.runSnapshotSchedules(time.Now())
+	list, err = hp.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SourceVolumeId: volID})
+	require.NoError(t, err)
+	require.Len(t, list.GetEntries(), 1)
+	require.NotEqual(t, first.GetSnapshotId(), list.GetEntries()[0].GetSnapshot().GetSnapshotId())
+	require.NoFileExists(t, hp.getSnapshotPath(first.GetSnapshotId()))
+
+	_, err = hp.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "invalid",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		Parameters:         map[string]string{snapshotSchedule: "every hour"},
+	})
+	require.Error(t, err)
+}
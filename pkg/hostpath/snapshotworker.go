@@ -0,0 +1,206 @@
+package hostpath
+
+import (
+	"context"
+	"fmt"
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"k8s.io/klog/v2"
+	utilexec "k8s.io/utils/exec"
+	"os"
+)
+
+const (
+	// 默认同时在后台创建快照的最大数量
+	defaultSnapshotWorkers = 4
+)
+
+// snapshotJob 记录一个正在后台创建的快照
+type snapshotJob struct {
+	cancel context.CancelFunc
+	// 任务失败时的错误, 下一次对同一个快照的 CreateSnapshot 调用会返回这个错误
+	err error
+}
+
+// createSnapshot 将快照以未就绪(ReadyToUse=false)的状态添加到列表中, 然后在后台保存卷的数据。
+// key 不为 nil 时快照被加密。调用者必须持有 hp.mutex。
+func (hp *hostpath) createSnapshot(snapshotID, name string, vol state.Volume, scheduled bool, key *snapshotKey) (*state.Snapshot, error) {
+	snapshot := state.Snapshot{
+		Name:         name,
+		Id:           snapshotID,
+		VolID:        vol.VolID,
+		Path:         hp.getSnapshotPath(snapshotID),
+		CreationTime: timestamppb.Now(),
+		SizeBytes:    vol.VolSize,
+		ReadyToUse:   false,
+		Scheduled:    scheduled,
+		BlockBacked:  vol.BlockBacked,
+		FsType:       vol.FsType,
+		Encrypted:    vol.Encrypted,
+	}
+	if key != nil {
+		snapshot.EncryptionKeyID = key.id
+	}
+
+	klog.V(4).Infof("adding hostpath snapshot: %s = %+v", snapshotID, snapshot)
+	if err := hp.state.UpdateSnapshot(snapshot); err != nil {
+		return nil, err
+	}
+	hp.startSnapshotJob(snapshot, vol, key)
+	return &snapshot, nil
+}
+
+// startSnapshotJob 在后台保存卷的数据. 同时运行的任务数量受 hp.snapshotWorkers 限制。
+// 调用者必须持有 hp.mutex。
+func (hp *hostpath) startSnapshotJob(snapshot state.Snapshot, vol state.Volume, key *snapshotKey) {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &snapshotJob{cancel: cancel}
+	hp.snapshotJobs[snapshot.Id] = job
+
+	hp.snapshotWG.Add(1)
+	go func() {
+		defer hp.snapshotWG.Done()
+		defer cancel()
+
+		var err error
+		select {
+		case hp.snapshotWorkers <- struct{}{}:
+			klog.V(4).Infof("starting to save volume %s into snapshot %s", vol.VolID, snapshot.Id)
+			err = archiveVolume(ctx, hp.copyMethod, vol, snapshot.Path, key)
+			<-hp.snapshotWorkers
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		hp.finishSnapshotJob(snapshot.Id, job, err)
+	}()
+}
+
+// finishSnapshotJob 在任务结束后更新快照的状态
+func (hp *hostpath) finishSnapshotJob(snapshotID string, job *snapshotJob, err error) {
+	hp.mutex.Lock()
+	defer hp.mutex.Unlock()
+
+	snapshot, getErr := hp.state.GetSnapshotByID(snapshotID)
+	if hp.snapshotJobs[snapshotID] != job || getErr != nil {
+		// 快照在任务运行期间被删除了
+		klog.V(4).Infof("snapshot %s was deleted while it was being created", snapshotID)
+		if errDelete := os.RemoveAll(hp.getSnapshotPath(snapshotID)); errDelete != nil {
+			klog.Errorf("failed to cleanup snapshot file of %s: %v", snapshotID, errDelete)
+		}
+		return
+	}
+
+	if err == nil {
+		snapshot.ReadyToUse = true
+		err = hp.state.UpdateSnapshot(snapshot)
+	}
+	if err != nil {
+		klog.Errorf("failed to create snapshot %s of volume %s: %v", snapshotID, snapshot.VolID, err)
+		job.err = err
+		return
+	}
+	delete(hp.snapshotJobs, snapshotID)
+	klog.V(4).Infof("snapshot %s of volume %s is ready to use", snapshotID, snapshot.VolID)
+}
+
+// snapshotJobError 返回快照任务失败的错误, 并移除失败的快照, 以便重试时重新创建。
+// 调用者必须持有 hp.mutex。
+func (hp *hostpath) snapshotJobError(snapshotID string) error {
+	job, ok := hp.snapshotJobs[snapshotID]
+	if !ok || job.err == nil {
+		return nil
+	}
+	if err := hp.deleteSnapshot(snapshotID); err != nil {
+		return err
+	}
+	return status.Errorf(codes.Internal, "failed to create snapshot %s: %v", snapshotID, job.err)
+}
+
+// snapshotProgress 返回已经写入快照文件的字节数
+func snapshotProgress(snapshot state.Snapshot) int64 {
+	info, err := os.Stat(snapshot.Path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// resumeSnapshots 在驱动重启后重新开始未完成的快照. 源卷已经不存在的快照会被移除。
+func (hp *hostpath) resumeSnapshots() error {
+	hp.mutex.Lock()
+	defer hp.mutex.Unlock()
+
+	for _, snapshot := range hp.state.GetSnapshots() {
+		if snapshot.ReadyToUse {
+			continue
+		}
+		if err := os.RemoveAll(snapshot.Path); err != nil {
+			return fmt.Errorf("failed to cleanup incomplete snapshot %s: %v", snapshot.Id, err)
+		}
+		vol, err := hp.state.GetVolumeByID(snapshot.VolID)
+		if err != nil {
+			klog.Infof("removing incomplete snapshot %s, source volume %s no longer exists", snapshot.Id, snapshot.VolID)
+			if err := hp.state.DeleteSnapshot(snapshot.Id); err != nil {
+				return err
+			}
+			continue
+		}
+		// secrets 中的密钥没有被保存, 这样的快照在 CO 重试 CreateSnapshot 时重新创建
+		key := hp.snapshotKey
+		if snapshot.EncryptionKeyID == "" {
+			key = nil
+		} else {
+			matches := false
+			if key != nil {
+				if matches, err = key.matches(snapshot.EncryptionKeyID); err != nil {
+					return err
+				}
+			}
+			if !matches {
+				klog.Infof("removing incomplete snapshot %s, its encryption key %s is not available", snapshot.Id, snapshot.EncryptionKeyID)
+				if err := hp.state.DeleteSnapshot(snapshot.Id); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		klog.Infof("resuming creation of snapshot %s of volume %s", snapshot.Id, snapshot.VolID)
+		hp.startSnapshotJob(snapshot, vol, key)
+	}
+	return nil
+}
+
+// archiveVolume 将卷的数据保存到快照文件中. 失败时删除不完整的快照文件。
+// 块卷和由块文件支持的 mount 卷的快照是原始的磁盘镜像, 文件系统支持时与卷共享数据块。
+// key 不为 nil 时快照被加密, 不再与卷共享数据块。
+func archiveVolume(ctx context.Context, method copyMethod, vol state.Volume, file string, key *snapshotKey) error {
+	var err error
+	switch {
+	case key != nil:
+		err = archiveEncrypted(ctx, key, vol, file)
+	case isFileBacked(vol):
+		_, err = cloneFile(ctx, method, vol.VolPath, file)
+	case vol.VolAccessType == state.MountAccess:
+		// --sparse 保留卷中稀疏文件的空洞
+		cmd := []string{"tar", "--sparse", "-czf", file, "-C", vol.VolPath, "."}
+		executor := utilexec.New()
+		klog.V(4).Infof("Command Start: %v", cmd)
+		out, cmdErr := executor.CommandContext(ctx, cmd[0], cmd[1:]...).CombinedOutput()
+		klog.V(4).Infof("Command Finish: %v", string(out))
+		if cmdErr != nil {
+			err = fmt.Errorf("%w: %s", cmdErr, out)
+		}
+	default:
+		return status.Errorf(codes.InvalidArgument, "unknown accessType: %d", vol.VolAccessType)
+	}
+
+	if err != nil {
+		if errDelete := os.Remove(file); errDelete != nil && !os.IsNotExist(errDelete) {
+			klog.Errorf("failed to cleanup snapshot file %s: %v", file, errDelete)
+		}
+		return fmt.Errorf("failed create snapshot of volume %v: %w", vol.VolID, err)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package hostpath
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestAsyncSnapshot(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.SnapshotWorkers = 1
+	hp, err := NewHostPathDriver(cfg)
+	require.NoError(t, err)
+
+	resp, err := hp.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "vol",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: mib},
+	})
+	require.NoError(t, err)
+	volID := resp.GetVolume().GetVolumeId()
+	require.NoError(t, os.WriteFile(filepath.Join(hp.getVolumePath(volID), "data"), []byte("hello"), 0644))
+
+	req := &csi.CreateSnapshotRequest{Name: "snap", SourceVolumeId: volID}
+	snap, err := hp.CreateSnapshot(context.Background(), req)
+	require.NoError(t, err)
+	require.False(t, snap.GetSnapshot().GetReadyToUse(), "snapshot is created in the background")
+
+	hp.snapshotWG.Wait()
+	again, err := hp.CreateSnapshot(context.Background(), req)
+	require.NoError(t, err)
+	require.Equal(t, snap.GetSnapshot().GetSnapshotId(), again.GetSnapshot().GetSnapshotId())
+	require.True(t, again.GetSnapshot().GetReadyToUse())
+	require.FileExists(t, hp.getSnapshotPath(snap.GetSnapshot().GetSnapshotId()))
+
+	_, err = hp.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snap", SourceVolumeId: "other"})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	// 驱动重启时未完成的快照重新开始, 源卷已经不存在的快照被移除
+	hp.mutex.Lock()
+	require.NoError(t, hp.state.UpdateSnapshot(state.Snapshot{Id: "incomplete", Name: "incomplete", VolID: volID, Path: hp.getSnapshotPath("incomplete"), CreationTime: timestamppb.Now()}))
+	require.NoError(t, hp.state.UpdateSnapshot(state.Snapshot{Id: "orphan", Name: "orphan", VolID: "gone", Path: hp.getSnapshotPath("orphan"), CreationTime: timestamppb.Now()}))
+	hp.mutex.Unlock()
+	require.NoError(t, os.WriteFile(hp.getSnapshotPath("incomplete"), []byte("partial"), 0644))
+	// 重复的请求返回已经写入的字节数
+	progress, err := hp.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "incomplete", SourceVolumeId: volID})
+	require.NoError(t, err)
+	require.False(t, progress.GetSnapshot().GetReadyToUse())
+	require.Equal(t, int64(len("partial")), progress.GetSnapshot().GetSizeBytes())
+
+	require.NoError(t, hp.Close())
+	hp, err = NewHostPathDriver(cfg)
+	require.NoError(t, err)
+	require.NoError(t, hp.reconcile())
+	hp.snapshotWG.Wait()
+	incomplete, err := hp.state.GetSnapshotByID("incomplete")
+	require.NoError(t, err)
+	require.True(t, incomplete.ReadyToUse)
+	_, err = hp.state.GetSnapshotByID("orphan")
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = hp.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: "incomplete"})
+	require.NoError(t, err)
+	require.NoFileExists(t, hp.getSnapshotPath("incomplete"))
+}
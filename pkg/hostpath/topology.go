@@ -0,0 +1,115 @@
+package hostpath
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"maps"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// loadTopologySegments 返回节点的所有拓扑段: 节点本身, TopologySegments 中的拓扑段,
+// 以及节点标签文件中 TopologyLabelKeys 指定的标签
+func loadTopologySegments(cfg Config) (map[string]string, error) {
+	segments := map[string]string{TopologyKeyNode: cfg.NodeID}
+	for key, value := range cfg.TopologySegments {
+		if key == TopologyKeyNode {
+			return nil, fmt.Errorf("topology key %s is always set to the node id", TopologyKeyNode)
+		}
+		segments[key] = value
+	}
+	if cfg.TopologyLabelsFile == "" {
+		return segments, nil
+	}
+
+	labels, err := readLabelsFile(cfg.TopologyLabelsFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range cfg.TopologyLabelKeys {
+		value, ok := labels[key]
+		if !ok {
+			return nil, fmt.Errorf("node label %s not found in %s", key, cfg.TopologyLabelsFile)
+		}
+		if existing, ok := segments[key]; ok && existing != value {
+			return nil, fmt.Errorf("node label %s=%s conflicts with topology segment %s=%s", key, value, key, existing)
+		}
+		segments[key] = value
+	}
+	return segments, nil
+}
+
+// readLabelsFile 读取 downward API 格式的标签文件, 每一行的格式为 key="value"
+func readLabelsFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read node labels: %v", err)
+	}
+	defer f.Close()
+
+	labels := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		key, quoted, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid line %q in %s", line, path)
+		}
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of label %s in %s: %v", key, path, err)
+		}
+		labels[key] = value
+	}
+	return labels, scanner.Err()
+}
+
+// topologyMatches 判断节点是否属于 topology, 即 topology 中的每个拓扑段都与节点的相同
+func topologyMatches(topology *csi.Topology, segments map[string]string) bool {
+	for key, value := range topology.GetSegments() {
+		if segments[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesAnyTopology 判断节点是否属于 topologies 中的一个拓扑
+func matchesAnyTopology(topologies []*csi.Topology, segments map[string]string) bool {
+	for _, topology := range topologies {
+		if topologyMatches(topology, segments) {
+			return true
+		}
+	}
+	return false
+}
+
+// accessibleTopology 根据请求的拓扑要求返回新卷可以访问的拓扑. 卷只能在这个节点上访问,
+// 因此节点必须属于 requisite 中的一个拓扑, preferred 只用于记录日志。
+func (hp *hostpath) accessibleTopology(requirement *csi.TopologyRequirement) ([]*csi.Topology, error) {
+	if !hp.config.EnableTopology {
+		return []*csi.Topology{}, nil
+	}
+
+	if requisite := requirement.GetRequisite(); len(requisite) > 0 {
+		if !matchesAnyTopology(requisite, hp.topology) {
+			return nil, status.Errorf(codes.ResourceExhausted, "node %s with topology %v is not in any of the requisite topologies", hp.config.NodeID, hp.topology)
+		}
+	}
+	for i, topology := range requirement.GetPreferred() {
+		if topologyMatches(topology, hp.topology) {
+			klog.V(4).Infof("node %s matches preferred topology #%d %v", hp.config.NodeID, i, topology.GetSegments())
+			break
+		}
+	}
+
+	return []*csi.Topology{{Segments: maps.Clone(hp.topology)}}, nil
+}
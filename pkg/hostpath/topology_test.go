@@ -0,0 +1,99 @@
+package hostpath
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	zoneKey = "topology.kubernetes.io/zone"
+	rackKey = "example.com/rack"
+)
+
+func TestTopology(t *testing.T) {
+	labels := filepath.Join(t.TempDir(), "labels")
+	require.NoError(t, os.WriteFile(labels, []byte(`example.com/rack="r1"
+kubernetes.io/hostname="node"
+`), 0644))
+
+	hp := newTestDriver(t, func(cfg *Config) {
+		cfg.EnableTopology = true
+		cfg.TopologySegments = Segments{zoneKey: "zone-a"}
+		cfg.TopologyLabelsFile = labels
+		cfg.TopologyLabelKeys = StringArray{rackKey}
+	})
+	ctx := context.Background()
+	segments := map[string]string{TopologyKeyNode: "node", zoneKey: "zone-a", rackKey: "r1"}
+
+	info, err := hp.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	require.NoError(t, err)
+	require.Equal(t, segments, info.GetAccessibleTopology().GetSegments())
+
+	zone := func(name string) *csi.Topology {
+		return &csi.Topology{Segments: map[string]string{zoneKey: name}}
+	}
+
+	// 节点不在 requisite 中
+	_, err = hp.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:                      "other-zone",
+		VolumeCapabilities:        []*csi.VolumeCapability{mountCapability()},
+		AccessibilityRequirements: &csi.TopologyRequirement{Requisite: []*csi.Topology{zone("zone-b")}},
+	})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err), "create in other zone: %v", err)
+
+	// preferred 中的第一个拓扑不包含节点时使用 requisite 中的其它拓扑
+	resp, err := hp.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "vol",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{zone("zone-b"), zone("zone-a")},
+			Preferred: []*csi.Topology{zone("zone-b"), zone("zone-a")},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.GetVolume().GetAccessibleTopology(), 1)
+	require.Equal(t, segments, resp.GetVolume().GetAccessibleTopology()[0].GetSegments())
+
+	for name, tc := range map[string]struct {
+		topology  *csi.Topology
+		available int64
+	}{
+		"any":        {nil, tib},
+		"node":       {&csi.Topology{Segments: map[string]string{TopologyKeyNode: "node"}}, tib},
+		"zone":       {zone("zone-a"), tib},
+		"zone+rack":  {&csi.Topology{Segments: map[string]string{zoneKey: "zone-a", rackKey: "r1"}}, tib},
+		"other zone": {zone("zone-b"), 0},
+		"other rack": {&csi.Topology{Segments: map[string]string{zoneKey: "zone-a", rackKey: "r2"}}, 0},
+		"other key":  {&csi.Topology{Segments: map[string]string{"example.com/disk": "ssd"}}, 0},
+	} {
+		t.Run(name, func(t *testing.T) {
+			capacity, err := hp.GetCapacity(ctx, &csi.GetCapacityRequest{AccessibleTopology: tc.topology})
+			require.NoError(t, err)
+			require.Equal(t, tc.available, capacity.GetAvailableCapacity())
+		})
+	}
+}
+
+func TestTopologyConfig(t *testing.T) {
+	labels := filepath.Join(t.TempDir(), "labels")
+	require.NoError(t, os.WriteFile(labels, []byte(`topology.kubernetes.io/zone="zone-b"`+"\n"), 0644))
+
+	for name, cfg := range map[string]Config{
+		"node key":      {NodeID: "node", TopologySegments: Segments{TopologyKeyNode: "other"}},
+		"missing label": {NodeID: "node", TopologyLabelsFile: labels, TopologyLabelKeys: StringArray{rackKey}},
+		"conflict":      {NodeID: "node", TopologySegments: Segments{zoneKey: "zone-a"}, TopologyLabelsFile: labels, TopologyLabelKeys: StringArray{zoneKey}},
+		"missing file":  {NodeID: "node", TopologyLabelsFile: filepath.Join(t.TempDir(), "none"), TopologyLabelKeys: StringArray{zoneKey}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := loadTopologySegments(cfg)
+			require.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package hostpath
+
+import (
+	"context"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	utilexec "k8s.io/utils/exec"
+)
+
+// tracerName 是驱动创建的 span 的 instrumentation scope
+const tracerName = "github.com/bearcat-panda/csi-demo/pkg/hostpath"
+
+// newOTLPTracerProvider 返回通过 OTLP gRPC 把 span 批量发送到 endpoint 的 TracerProvider
+func newOTLPTracerProvider(endpoint, serviceName string) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracegrpc.New(context.Background(),
+		otlptracegrpc.WithEndpoint(endpoint),
+		otlptracegrpc.WithInsecure(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter for %s: %v", endpoint, err)
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	), nil
+}
+
+// endSpan 记录错误并结束 span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+	span.End()
+}
+
+// lockState 获取 hp.mutex, 并用 span 记录等待的时间。在返回的函数释放 mutex 之前,
+// 写入状态的 span 属于 ctx 中的 trace。
+func (hp *hostpath) lockState(ctx context.Context) (unlock func()) {
+	_, span := hp.tracer.Start(ctx, "hostpath.lock")
+	hp.mutex.Lock()
+	span.End()
+	hp.lockCtx = ctx
+	return func() {
+		hp.lockCtx = nil
+		hp.mutex.Unlock()
+	}
+}
+
+// stateContext 返回持有 hp.mutex 的请求的 context. 调用者必须持有 hp.mutex。
+func (hp *hostpath) stateContext() context.Context {
+	if hp.lockCtx != nil {
+		return hp.lockCtx
+	}
+	return context.Background()
+}
+
+// runCommand 执行命令并用 span 记录执行的时间
+func runCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
+	_, span := tracer.Start(ctx, "exec "+name, trace.WithAttributes(attribute.StringSlice("hostpath.exec.args", args)))
+	out, err := utilexec.New().Command(name, args...).CombinedOutput()
+	endSpan(span, err)
+	return out, err
+}
+
+// traceGRPC 为每个 gRPC 调用创建 span, 调用者通过 metadata 传递的 trace 会被继续
+func (hp *hostpath) traceGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = propagation.TraceContext{}.Extract(ctx, metadataCarrier(md))
+
+	attrs := []attribute.KeyValue{
+		attribute.String("rpc.system", "grpc"),
+		attribute.String("rpc.method", info.FullMethod),
+	}
+	if r, ok := req.(interface{ GetVolumeId() string }); ok && r.GetVolumeId() != "" {
+		attrs = append(attrs, attribute.String("hostpath.volume.id", r.GetVolumeId()))
+	}
+	if r, ok := req.(interface{ GetSnapshotId() string }); ok && r.GetSnapshotId() != "" {
+		attrs = append(attrs, attribute.String("hostpath.snapshot.id", r.GetSnapshotId()))
+	}
+	ctx, span := hp.tracer.Start(ctx, info.FullMethod, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+
+	resp, err := handler(ctx, req)
+	span.SetAttributes(attribute.Int("rpc.grpc.status_code", int(status.Code(err))))
+	if r, ok := resp.(interface{ GetVolume() *csi.Volume }); ok && r.GetVolume() != nil {
+		span.SetAttributes(attribute.String("hostpath.volume.id", r.GetVolume().GetVolumeId()))
+	}
+	endSpan(span, err)
+	return resp, err
+}
+
+// injectTraceContext 把 trace 传递给节点代理和复制对等节点
+func injectTraceContext(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	propagation.TraceContext{}.Inject(ctx, metadataCarrier(md))
+	return invoker(metadata.NewOutgoingContext(ctx, md), method, req, reply, cc, opts...)
+}
+
+// metadataCarrier 让 propagation 读写 gRPC metadata
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if values := metadata.MD(c).Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
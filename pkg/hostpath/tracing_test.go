@@ -0,0 +1,105 @@
+package hostpath
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// spanAttribute 返回 span 的属性, 不存在时返回空的值
+func spanAttribute(span tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, attr := range span.Attributes {
+		if attr.Key == key {
+			return attr.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	hp := newTestDriver(t, func(cfg *Config) {
+		cfg.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	})
+
+	source, err := hp.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "source",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 10 * mib},
+	})
+	require.NoError(t, err)
+	sourceID := source.GetVolume().GetVolumeId()
+	vol, err := hp.state.GetVolumeByID(sourceID)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(vol.VolPath, "data"), []byte("data"), 0644))
+	exporter.Reset()
+
+	// 调用者的 trace 通过 metadata 传递给驱动
+	parent := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{1},
+		TraceFlags: trace.FlagsSampled,
+	})
+	md := metadata.MD{}
+	propagation.TraceContext{}.Inject(trace.ContextWithSpanContext(context.Background(), parent), metadataCarrier(md))
+	ctx := metadata.NewIncomingContext(context.Background(), md)
+
+	const method = "/csi.v1.Controller/CreateVolume"
+	resp, err := hp.traceGRPC(ctx, &csi.CreateVolumeRequest{
+		Name:               "clone",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 10 * mib},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: sourceID}},
+		},
+	}, &grpc.UnaryServerInfo{FullMethod: method}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return hp.CreateVolume(ctx, req.(*csi.CreateVolumeRequest))
+	})
+	require.NoError(t, err)
+	cloneID := resp.(*csi.CreateVolumeResponse).GetVolume().GetVolumeId()
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		require.Equal(t, parent.TraceID(), span.SpanContext.TraceID(), "span %s", span.Name)
+		spans[span.Name] = span
+	}
+	require.Contains(t, spans, method)
+	rpc := spans[method]
+	require.Equal(t, parent.SpanID(), rpc.Parent.SpanID())
+	require.Equal(t, trace.SpanKindServer, rpc.SpanKind)
+	require.Equal(t, cloneID, spanAttribute(rpc, "hostpath.volume.id").AsString())
+	require.Equal(t, int64(0), spanAttribute(rpc, "rpc.grpc.status_code").AsInt64())
+
+	// 锁, 创建卷, 复制数据和写入状态都是 RPC 的子 span
+	for _, name := range []string{"hostpath.lock", "hostpath.createVolume", "hostpath.loadFromVolume", "state.UpdateVolume"} {
+		require.Contains(t, spans, name)
+		require.Equal(t, rpc.SpanContext.SpanID(), spans[name].Parent.SpanID(), "parent of %s", name)
+	}
+	create := spans["hostpath.createVolume"]
+	require.Equal(t, cloneID, spanAttribute(create, "hostpath.volume.id").AsString())
+	require.Equal(t, 10*mib, spanAttribute(create, "hostpath.volume.size_bytes").AsInt64())
+	require.Equal(t, "mount", spanAttribute(create, "hostpath.volume.access_type").AsString())
+	load := spans["hostpath.loadFromVolume"]
+	require.Equal(t, sourceID, spanAttribute(load, "hostpath.source_volume.id").AsString())
+	require.Equal(t, 10*mib, spanAttribute(load, "hostpath.copy.bytes").AsInt64())
+	require.Equal(t, cloneID, spanAttribute(spans["state.UpdateVolume"], "hostpath.volume.id").AsString())
+
+	// 没有持有锁的请求时, 状态写入属于新的 trace
+	exporter.Reset()
+	hp.mutex.Lock()
+	require.NoError(t, hp.state.UpdateVolume(vol))
+	hp.mutex.Unlock()
+	require.Len(t, exporter.GetSpans(), 1)
+	require.False(t, exporter.GetSpans()[0].Parent.IsValid())
+}
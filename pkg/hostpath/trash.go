@@ -0,0 +1,137 @@
+package hostpath
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+	"k8s.io/klog/v2"
+	"k8s.io/mount-utils"
+)
+
+// 检查回收站中过期条目的间隔
+const defaultTrashPurgeInterval = time.Minute
+
+// trashDir 返回回收站的目录
+func (hp *hostpath) trashDir() string {
+	return filepath.Join(hp.config.StateDir, state.TrashDirName)
+}
+
+// trashEnabled 返回删除的卷和快照是否先移到回收站
+func (hp *hostpath) trashEnabled() bool {
+	return hp.config.TrashRetention > 0
+}
+
+// trashVolume 把卷的记录和数据移到回收站. loop 卷只卸载, 数据是它的镜像文件。
+// project quota 留在目录上, 恢复的卷仍然有大小限制, 清理条目时才移除
+func (hp *hostpath) trashVolume(vol state.Volume) error {
+	dataPath := hp.getVolumePath(vol.VolID)
+	if vol.Quota == QuotaLoop {
+		if err := mount.CleanupMountPoint(vol.VolPath, mount.New(""), false); err != nil {
+			return fmt.Errorf("failed to unmount image of volume %s: %w", vol.VolID, err)
+		}
+		dataPath = hp.getLoopImagePath(vol.VolID)
+	}
+
+	vol.DeletionDeferred = false
+	entry, err := state.MoveToTrash(hp.trashDir(), state.TrashEntry{
+		DeletedAt: time.Now(),
+		Volume:    &vol,
+		DataName:  filepath.Base(dataPath),
+	}, dataPath)
+	if err != nil {
+		return err
+	}
+	klog.V(4).Infof("moved volume %s to trash %s", vol.VolID, entry.Dir)
+	return nil
+}
+
+// trashSnapshot 把快照的记录和文件移到回收站
+func (hp *hostpath) trashSnapshot(snapshot state.Snapshot) error {
+	snapshot.DeletionDeferred = false
+	entry, err := state.MoveToTrash(hp.trashDir(), state.TrashEntry{
+		DeletedAt: time.Now(),
+		Snapshot:  &snapshot,
+		DataName:  filepath.Base(snapshot.Path),
+	}, snapshot.Path)
+	if err != nil {
+		return err
+	}
+	klog.V(4).Infof("moved snapshot %s to trash %s", snapshot.Id, entry.Dir)
+	return nil
+}
+
+// trashedVolumes 返回回收站中的卷, VolPath 是回收站中的数据。
+// 它们的数据在被清理之前仍然占用容量
+func (hp *hostpath) trashedVolumes() []state.Volume {
+	entries, err := state.ListTrash(hp.trashDir())
+	if err != nil {
+		klog.Errorf("failed to list trash: %v", err)
+		return nil
+	}
+	var volumes []state.Volume
+	for _, entry := range entries {
+		if entry.Volume == nil {
+			continue
+		}
+		vol := *entry.Volume
+		vol.VolPath = entry.DataPath()
+		volumes = append(volumes, vol)
+	}
+	return volumes
+}
+
+// StartTrashPurger 周期性地删除回收站中超过 TrashRetention 的卷和快照, 直到 stopCh 被关闭。
+// 由 startBackgroundTasks 启动, 选主时只有 leader 清理回收站
+func (hp *hostpath) StartTrashPurger(stopCh <-chan struct{}) {
+	hp.background.wg.Add(1)
+	go func() {
+		defer hp.background.wg.Done()
+		ticker := time.NewTicker(defaultTrashPurgeInterval)
+		defer ticker.Stop()
+		for {
+			hp.purgeTrash(time.Now())
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// purgeTrash 删除在 now 之前已经过期的条目. TrashRetention 为零时回收站中
+// 剩下的条目也会被删除
+func (hp *hostpath) purgeTrash(now time.Time) {
+	hp.mutex.Lock()
+	defer hp.mutex.Unlock()
+
+	entries, err := state.ListTrash(hp.trashDir())
+	if err != nil {
+		klog.Errorf("failed to list trash: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		if entry.DeletedAt.Add(hp.config.TrashRetention).After(now) {
+			// 条目按删除时间排序, 后面的也还没有过期
+			break
+		}
+		if entry.Volume != nil && entry.Volume.Quota == QuotaProject {
+			// 条目的目录与卷的数据在同一个文件系统上, 数据不存在时也可以移除配额
+			vol := *entry.Volume
+			vol.VolPath = entry.Dir
+			if err := hp.teardownQuota(vol); err != nil {
+				klog.Errorf("failed to remove quota of %s %s in trash: %v", entry.Type, entry.ID(), err)
+			}
+		}
+		if err := entry.Remove(); err != nil {
+			klog.Errorf("failed to purge %s %s from trash: %v", entry.Type, entry.ID(), err)
+			continue
+		}
+		if entry.Volume != nil {
+			hp.usage.forget(entry.ID())
+		}
+		klog.V(4).Infof("purged %s %s from trash", entry.Type, entry.ID())
+	}
+}
@@ -0,0 +1,78 @@
+package hostpath
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrash(t *testing.T) {
+	hp := newTestDriver(t, func(cfg *Config) {
+		cfg.TrashRetention = time.Hour
+	})
+	ctx := context.Background()
+
+	vol, err := hp.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "vol",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: mib},
+	})
+	require.NoError(t, err)
+	volID := vol.GetVolume().GetVolumeId()
+	require.NoError(t, os.WriteFile(filepath.Join(hp.getVolumePath(volID), "data"), []byte("hello"), 0644))
+	snapshot, err := hp.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snap", SourceVolumeId: volID})
+	require.NoError(t, err)
+	hp.snapshotWG.Wait()
+	snapshotID := snapshot.GetSnapshot().GetSnapshotId()
+
+	_, err = hp.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: snapshotID})
+	require.NoError(t, err)
+	_, err = hp.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volID})
+	require.NoError(t, err)
+	require.Empty(t, hp.state.GetVolumes())
+	require.Empty(t, hp.state.GetSnapshots())
+	require.NoDirExists(t, hp.getVolumePath(volID))
+
+	// 记录和数据都在回收站中
+	entries, err := state.ListTrash(hp.trashDir())
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, snapshotID, entries[0].ID())
+	require.Equal(t, snapshotID+snapshotExt, entries[0].DataName)
+	require.FileExists(t, entries[0].DataPath())
+	require.Equal(t, volID, entries[1].ID())
+	require.Equal(t, "vol", entries[1].Name())
+	data, err := os.ReadFile(filepath.Join(entries[1].DataPath(), "data"))
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+	// 回收站中的卷仍然占用容量
+	kind := entries[1].Volume.Kind
+	require.Equal(t, mib, hp.sumVolumeSizes(kind), "trashed volume counts against capacity")
+
+	// 保留期之内不删除
+	hp.purgeTrash(time.Now().Add(30 * time.Minute))
+	entries, err = state.ListTrash(hp.trashDir())
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	hp.purgeTrash(time.Now().Add(2 * time.Hour))
+	entries, err = state.ListTrash(hp.trashDir())
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	require.Zero(t, hp.sumVolumeSizes(kind))
+
+	// 回收站中的卷保留 project quota, 它的 project id 不会分配给新卷
+	_, err = state.MoveToTrash(hp.trashDir(), state.TrashEntry{
+		DeletedAt: time.Now(),
+		Volume:    &state.Volume{VolID: "quota", Quota: QuotaProject, ProjectID: firstProjectID + 1},
+		DataName:  "quota",
+	}, hp.getVolumePath("quota"))
+	require.NoError(t, err)
+	require.Equal(t, firstProjectID+2, hp.nextProjectID())
+}
@@ -0,0 +1,91 @@
+package hostpath
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+)
+
+const (
+	// 后台重新计算卷实际分配的空间的间隔
+	defaultUsageRefreshInterval = 30 * time.Second
+)
+
+// allocatedUsage 缓存每个卷实际分配的数据块大小, 以卷id为键。
+// 容量检查只读取缓存, 不需要在持有 hp.mutex 时遍历所有卷的文件
+type allocatedUsage struct {
+	mutex sync.Mutex
+	bytes map[string]int64
+}
+
+func newAllocatedUsage() *allocatedUsage {
+	return &allocatedUsage{bytes: map[string]int64{}}
+}
+
+// get 返回卷实际分配的空间. 缓存中没有的卷, 例如刚刚创建的卷, 只计算这一个卷
+func (u *allocatedUsage) get(volume state.Volume) int64 {
+	u.mutex.Lock()
+	bytes, ok := u.bytes[volume.VolID]
+	u.mutex.Unlock()
+	if ok {
+		return bytes
+	}
+	bytes = volumeAllocatedBytes(volume)
+	u.set(volume.VolID, bytes)
+	return bytes
+}
+
+func (u *allocatedUsage) set(volID string, bytes int64) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.bytes[volID] = bytes
+}
+
+func (u *allocatedUsage) forget(volID string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	delete(u.bytes, volID)
+}
+
+// StartUsageRefresher 在后台定期重新计算所有卷实际分配的空间, 直到 stopCh 被关闭
+func (hp *hostpath) StartUsageRefresher(stopCh <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(defaultUsageRefreshInterval)
+		defer ticker.Stop()
+		for {
+			hp.refreshUsage()
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// refreshUsage 重新计算所有卷实际分配的空间. 只在复制卷列表时持有 hp.mutex,
+// 遍历文件时不阻塞其他请求。遍历期间创建的卷在下一次 get 时重新计算
+func (hp *hostpath) refreshUsage() {
+	hp.mutex.Lock()
+	volumes := append(hp.state.GetVolumes(), hp.trashedVolumes()...)
+	// 只有按实际分配计算容量或者配置了高水位时才需要
+	needed := hp.config.CapacityAccounting == AccountingAllocated || hp.config.CapacityHighWatermark > 0
+	hp.mutex.Unlock()
+	if !needed {
+		return
+	}
+
+	bytes := make(map[string]int64, len(volumes))
+	for _, volume := range volumes {
+		if volume.Remote {
+			continue
+		}
+		bytes[volume.VolID] = volumeAllocatedBytes(volume)
+	}
+
+	// 容量只按状态中的卷计算, 遍历期间删除的卷留下的缓存不会被使用
+	hp.usage.mutex.Lock()
+	defer hp.usage.mutex.Unlock()
+	hp.usage.bytes = bytes
+}
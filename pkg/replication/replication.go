@@ -0,0 +1,275 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package replication defines the gRPC API with which a hostpath
+// driver copies the data of a volume to a replica on a peer driver.
+//
+// A transfer works like rsync with fixed block boundaries: the source
+// asks the peer for checksums of the blocks of all files in the
+// replica, sends only the blocks which differ and finally tells the
+// peer which files exist, so that the peer can remove the others.
+//
+// The messages are plain Go structs which are encoded as JSON, so
+// the API does not need generated code.
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/bearcat-panda/csi-demo/pkg/state"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+// ServiceName is the full name of the replication gRPC service.
+const ServiceName = "hostpath.replication.v1.Replication"
+
+// FileType is the type of a file in a volume.
+type FileType string
+
+const (
+	Regular   FileType = "file"
+	Directory FileType = "dir"
+	Symlink   FileType = "symlink"
+)
+
+// RootPath is the path of the volume itself. For a block volume or
+// a block-backed mount volume it is the only file, for a mount volume
+// it is the root directory.
+const RootPath = "."
+
+// PrepareRequest creates the replica of a volume if it does not
+// exist yet.
+type PrepareRequest struct {
+	VolumeID string
+	Name     string
+	// SourceNode is the node ID of the source driver.
+	SourceNode   string
+	Size         int64
+	AccessType   state.AccessType
+	BlockBacked  bool
+	Parameters   map[string]string
+	Capabilities []state.VolumeCapability
+}
+
+// File describes a file of a volume. Paths are relative to the
+// volume root and use slashes.
+type File struct {
+	Path string
+	Type FileType
+	Mode uint32
+	// Size is the size of a regular file.
+	Size int64
+	// Target is the target of a symlink.
+	Target string
+}
+
+// ChecksumsRequest asks for the checksums of the blocks of all files
+// in a replica.
+type ChecksumsRequest struct {
+	VolumeID  string
+	BlockSize int64
+}
+
+// FileChecksums are the checksums of the blocks of a regular file.
+type FileChecksums struct {
+	File
+	Checksums [][]byte
+}
+
+type ChecksumsResponse struct {
+	Files []FileChecksums
+}
+
+// Block is the data of a block of a regular file.
+type Block struct {
+	Index int64
+	Data  []byte
+}
+
+// FileData creates or updates a file in the replica and writes
+// the given blocks. A large file may be split into several messages.
+type FileData struct {
+	File
+	Blocks []Block
+}
+
+// ApplyRequest applies changes to a replica. Directories are
+// listed before the files which they contain.
+type ApplyRequest struct {
+	VolumeID  string
+	BlockSize int64
+	Files     []FileData
+}
+
+// FinishRequest completes a transfer. All files which are not
+// listed are removed from the replica.
+type FinishRequest struct {
+	VolumeID string
+	Paths    []string
+	// SyncTime is the time at which the transfer started.
+	SyncTime time.Time
+}
+
+// PromoteRequest turns a replica into a writable volume.
+type PromoteRequest struct {
+	VolumeID string
+}
+
+// DeleteRequest deletes a replica. Promoted replicas are not deleted.
+type DeleteRequest struct {
+	VolumeID string
+}
+
+// Empty is the response of calls which return nothing.
+type Empty struct{}
+
+// ReplicationServer is the server API of a replication peer.
+type ReplicationServer interface {
+	Prepare(context.Context, *PrepareRequest) (*Empty, error)
+	Checksums(context.Context, *ChecksumsRequest) (*ChecksumsResponse, error)
+	Apply(context.Context, *ApplyRequest) (*Empty, error)
+	Finish(context.Context, *FinishRequest) (*Empty, error)
+	Promote(context.Context, *PromoteRequest) (*Empty, error)
+	Delete(context.Context, *DeleteRequest) (*Empty, error)
+}
+
+// ReplicationClient is the client API of a replication peer.
+type ReplicationClient interface {
+	Prepare(ctx context.Context, in *PrepareRequest, opts ...grpc.CallOption) (*Empty, error)
+	Checksums(ctx context.Context, in *ChecksumsRequest, opts ...grpc.CallOption) (*ChecksumsResponse, error)
+	Apply(ctx context.Context, in *ApplyRequest, opts ...grpc.CallOption) (*Empty, error)
+	Finish(ctx context.Context, in *FinishRequest, opts ...grpc.CallOption) (*Empty, error)
+	Promote(ctx context.Context, in *PromoteRequest, opts ...grpc.CallOption) (*Empty, error)
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*Empty, error)
+}
+
+type replicationClient struct {
+	cc grpc.ClientConnInterface
+}
+
+// NewReplicationClient returns a client for the replication peer
+// behind the connection.
+func NewReplicationClient(cc grpc.ClientConnInterface) ReplicationClient {
+	return &replicationClient{cc: cc}
+}
+
+func (c *replicationClient) Prepare(ctx context.Context, in *PrepareRequest, opts ...grpc.CallOption) (*Empty, error) {
+	return invoke[Empty](ctx, c.cc, "Prepare", in, opts)
+}
+
+func (c *replicationClient) Checksums(ctx context.Context, in *ChecksumsRequest, opts ...grpc.CallOption) (*ChecksumsResponse, error) {
+	return invoke[ChecksumsResponse](ctx, c.cc, "Checksums", in, opts)
+}
+
+func (c *replicationClient) Apply(ctx context.Context, in *ApplyRequest, opts ...grpc.CallOption) (*Empty, error) {
+	return invoke[Empty](ctx, c.cc, "Apply", in, opts)
+}
+
+func (c *replicationClient) Finish(ctx context.Context, in *FinishRequest, opts ...grpc.CallOption) (*Empty, error) {
+	return invoke[Empty](ctx, c.cc, "Finish", in, opts)
+}
+
+func (c *replicationClient) Promote(ctx context.Context, in *PromoteRequest, opts ...grpc.CallOption) (*Empty, error) {
+	return invoke[Empty](ctx, c.cc, "Promote", in, opts)
+}
+
+func (c *replicationClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*Empty, error) {
+	return invoke[Empty](ctx, c.cc, "Delete", in, opts)
+}
+
+func invoke[Resp any](ctx context.Context, cc grpc.ClientConnInterface, method string, in any, opts []grpc.CallOption) (*Resp, error) {
+	out := new(Resp)
+	opts = append([]grpc.CallOption{grpc.CallContentSubtype(codecName)}, opts...)
+	return out, cc.Invoke(ctx, fullMethod(method), in, out, opts...)
+}
+
+// RegisterReplicationServer registers the replication service with
+// the gRPC server.
+func RegisterReplicationServer(s grpc.ServiceRegistrar, srv ReplicationServer) {
+	s.RegisterService(&ReplicationServiceDesc, srv)
+}
+
+// ReplicationServiceDesc is the grpc.ServiceDesc of the replication
+// service.
+var ReplicationServiceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*ReplicationServer)(nil),
+	Methods: []grpc.MethodDesc{
+		unaryMethod("Prepare", ReplicationServer.Prepare),
+		unaryMethod("Checksums", ReplicationServer.Checksums),
+		unaryMethod("Apply", ReplicationServer.Apply),
+		unaryMethod("Finish", ReplicationServer.Finish),
+		unaryMethod("Promote", ReplicationServer.Promote),
+		unaryMethod("Delete", ReplicationServer.Delete),
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+func fullMethod(method string) string {
+	return "/" + ServiceName + "/" + method
+}
+
+// unaryMethod returns the description of a unary method which
+// decodes the request and calls the server implementation,
+// like the code generated by protoc-gen-go-grpc does.
+func unaryMethod[Req, Resp any](method string, call func(ReplicationServer, context.Context, *Req) (*Resp, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: method,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := new(Req)
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			if interceptor == nil {
+				return call(srv.(ReplicationServer), ctx, in)
+			}
+			info := &grpc.UnaryServerInfo{
+				Server:     srv,
+				FullMethod: fullMethod(method),
+			}
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return call(srv.(ReplicationServer), ctx, req.(*Req))
+			}
+			return interceptor(ctx, in, info, handler)
+		},
+	}
+}
+
+// codecName is the content subtype with which clients select the
+// JSON codec. The server picks the codec from the content type of
+// each request.
+const codecName = "json"
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return codecName
+}
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state
+
+import (
+	"sort"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Types of the records in a lineage tree.
+const (
+	LineageVolume   = "volume"
+	LineageSnapshot = "snapshot"
+)
+
+// LineageNode is a volume or snapshot in a lineage tree. The children
+// of a volume are its snapshots and clones, the children of a snapshot
+// are the volumes restored from it.
+type LineageNode struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// DeletedParent is the volume or snapshot from which the root
+	// of the tree was created, if it no longer exists.
+	DeletedParent string `json:"deletedParent,omitempty"`
+	// DeletionDeferred is true if the record was deleted and only
+	// kept for its dependents.
+	DeletionDeferred bool           `json:"deletionDeferred,omitempty"`
+	Selected         bool           `json:"selected,omitempty"`
+	Children         []*LineageNode `json:"children,omitempty"`
+}
+
+// Lineage returns the lineage tree which contains the volume or
+// snapshot with the given ID, starting at its oldest ancestor which
+// still exists. The node of the given ID is marked as selected.
+func Lineage(s State, id string) (*LineageNode, error) {
+	l := newLineage(s)
+	typ := LineageVolume
+	if _, ok := l.volumes[id]; !ok {
+		if _, ok := l.snapshots[id]; !ok {
+			return nil, status.Errorf(codes.NotFound, "no volume or snapshot with ID %q", id)
+		}
+		typ = LineageSnapshot
+	}
+
+	rootType, rootID := typ, id
+	seen := map[string]bool{id: true}
+	deletedParent := ""
+	for {
+		parentType, parentID := l.parent(rootType, rootID)
+		if parentID == "" || seen[parentID] {
+			break
+		}
+		if !l.exists(parentType, parentID) {
+			deletedParent = parentType + "/" + parentID
+			break
+		}
+		seen[parentID] = true
+		rootType, rootID = parentType, parentID
+	}
+
+	root := l.node(rootType, rootID, id, map[string]bool{})
+	root.DeletedParent = deletedParent
+	return root, nil
+}
+
+// SnapshotsOf returns the snapshots of a volume.
+func SnapshotsOf(s State, volID string) []Snapshot {
+	var snapshots []Snapshot
+	for _, snapshot := range s.GetSnapshots() {
+		if snapshot.VolID == volID {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	return snapshots
+}
+
+// RestoredFrom returns the volumes which were restored from a snapshot.
+func RestoredFrom(s State, snapshotID string) []Volume {
+	var volumes []Volume
+	for _, vol := range s.GetVolumes() {
+		if vol.ParentSnapID == snapshotID {
+			volumes = append(volumes, vol)
+		}
+	}
+	return volumes
+}
+
+// lineage indexes the relations between volumes and snapshots.
+type lineage struct {
+	volumes   map[string]Volume
+	snapshots map[string]Snapshot
+}
+
+func newLineage(s State) *lineage {
+	l := &lineage{volumes: map[string]Volume{}, snapshots: map[string]Snapshot{}}
+	for _, vol := range s.GetVolumes() {
+		l.volumes[vol.VolID] = vol
+	}
+	for _, snapshot := range s.GetSnapshots() {
+		l.snapshots[snapshot.Id] = snapshot
+	}
+	return l
+}
+
+// parent returns the type and ID of the volume or snapshot from which
+// a volume or snapshot was created.
+func (l *lineage) parent(typ, id string) (string, string) {
+	if typ == LineageSnapshot {
+		return LineageVolume, l.snapshots[id].VolID
+	}
+	vol := l.volumes[id]
+	switch {
+	case vol.ParentVolID != "":
+		return LineageVolume, vol.ParentVolID
+	case vol.ParentSnapID != "":
+		return LineageSnapshot, vol.ParentSnapID
+	default:
+		return "", ""
+	}
+}
+
+func (l *lineage) exists(typ, id string) bool {
+	if typ == LineageSnapshot {
+		_, ok := l.snapshots[id]
+		return ok
+	}
+	_, ok := l.volumes[id]
+	return ok
+}
+
+// node returns the subtree of a volume or snapshot.
+func (l *lineage) node(typ, id, selected string, visited map[string]bool) *LineageNode {
+	visited[id] = true
+	n := &LineageNode{Type: typ, ID: id, Selected: id == selected}
+	if typ == LineageSnapshot {
+		n.Name = l.snapshots[id].Name
+		n.DeletionDeferred = l.snapshots[id].DeletionDeferred
+	} else {
+		n.Name = l.volumes[id].VolName
+		n.DeletionDeferred = l.volumes[id].DeletionDeferred
+	}
+
+	var children []*LineageNode
+	if typ == LineageVolume {
+		for _, snapshot := range l.snapshots {
+			if snapshot.VolID == id && !visited[snapshot.Id] {
+				children = append(children, l.node(LineageSnapshot, snapshot.Id, selected, visited))
+			}
+		}
+	}
+	for _, vol := range l.volumes {
+		if visited[vol.VolID] {
+			continue
+		}
+		if (typ == LineageVolume && vol.ParentVolID == id) || (typ == LineageSnapshot && vol.ParentSnapID == id) {
+			children = append(children, l.node(LineageVolume, vol.VolID, selected, visited))
+		}
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].ID < children[j].ID })
+	n.Children = children
+	return n
+}
+
+// migrateParents moves snapshot IDs which older versions stored in
+// ParentVolID of restored volumes into ParentSnapID.
+func (r *resources) migrateParents() {
+	volumes := map[string]bool{}
+	for _, vol := range r.Volumes {
+		volumes[vol.VolID] = true
+	}
+	snapshots := map[string]bool{}
+	for _, snapshot := range r.Snapshots {
+		snapshots[snapshot.Id] = true
+	}
+	for i, vol := range r.Volumes {
+		if vol.ParentSnapID == "" && snapshots[vol.ParentVolID] && !volumes[vol.ParentVolID] {
+			r.Volumes[i].ParentSnapID = vol.ParentVolID
+			r.Volumes[i].ParentVolID = ""
+		}
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrLocked is returned by Lock when another process holds the lock.
+var ErrLocked = errors.New("state file is locked by another process")
+
+// lockRetryInterval is how often LockWithTimeout tries to take the lock.
+const lockRetryInterval = 100 * time.Millisecond
+
+// FileLock is an exclusive advisory lock on a state file.
+type FileLock struct {
+	file *os.File
+}
+
+// LockPath returns the path of the lock file which protects the
+// given state file.
+func LockPath(statefilePath string) string {
+	return statefilePath + ".lock"
+}
+
+// Lock takes an exclusive lock on the state file. It fails with
+// ErrLocked instead of waiting when another process holds the lock,
+// for example a running driver. The error includes the PID of that
+// process. The lock file contains the PID of the current holder.
+func Lock(statefilePath string) (*FileLock, error) {
+	path := LockPath(statefilePath)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open lock file: %w", err)
+	}
+	if err := unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			if pid := lockHolder(path); pid != 0 {
+				return nil, fmt.Errorf("%s is held by process %d: %w", path, pid, ErrLocked)
+			}
+			return nil, fmt.Errorf("%s: %w", path, ErrLocked)
+		}
+		return nil, fmt.Errorf("lock %s: %w", path, err)
+	}
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("write lock file: %w", err)
+	}
+	if _, err := file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("write lock file: %w", err)
+	}
+	return &FileLock{file: file}, nil
+}
+
+// LockWithTimeout is like Lock, but waits up to the given time for
+// another process to release the lock, for example the previous
+// driver instance during a rolling update. A zero timeout fails
+// immediately.
+func LockWithTimeout(statefilePath string, timeout time.Duration) (*FileLock, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		lock, err := Lock(statefilePath)
+		if err == nil || !errors.Is(err, ErrLocked) || !time.Now().Before(deadline) {
+			return lock, err
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+// lockHolder returns the PID recorded in the lock file, zero if unknown.
+func lockHolder(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// Unlock releases the lock.
+func (l *FileLock) Unlock() error {
+	return l.file.Close()
+}
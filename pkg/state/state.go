@@ -22,7 +22,9 @@ import (
 	"encoding/json"
 	"errors"
 	"os"
+	"path/filepath"
 	"sort"
+	"time"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -57,6 +59,101 @@ type Volume struct {
 	// Published contains the target paths where the volume
 	// was published.
 	Published Strings
+	// SnapshotSchedule is the interval specification (for example
+	// "@hourly") at which the driver takes snapshots of the volume
+	// on its own. Empty if no snapshots are scheduled.
+	SnapshotSchedule string
+	// SnapshotRetention is the retention policy (for example
+	// "24h:24,7d:7") applied to scheduled snapshots of the volume.
+	// Empty means that scheduled snapshots are kept forever.
+	SnapshotRetention string
+	// SharesExtents is true if the volume was cloned from a volume
+	// or snapshot with reflinks and initially shares its data blocks
+	// with that source.
+	SharesExtents bool
+	// ThinProvisioned is true for block volumes which are backed
+	// by a sparse file instead of preallocated space.
+	ThinProvisioned bool
+	// Quota is the mechanism ("project" or "loop") which limits
+	// the size of a mount volume. Empty if the size is not enforced.
+	Quota string
+	// ProjectID is the filesystem project ID of a mount volume
+	// with a project quota.
+	ProjectID uint32
+	// BlockBacked is true for mount volumes which are backed by
+	// a file attached as loop device. The filesystem is created
+	// when the volume is staged for the first time.
+	BlockBacked bool
+	// FsType is the filesystem type of a block-backed mount volume.
+	// Empty until the volume was formatted.
+	FsType string
+	// Parameters are the parameters with which the volume was created.
+	Parameters map[string]string
+	// Capabilities are the capabilities with which the volume was
+	// created. Nil for volumes created before they were recorded.
+	Capabilities []VolumeCapability
+	// AccessibleTopology contains the topology segments from which
+	// the volume is accessible.
+	AccessibleTopology []map[string]string
+	// Remote is true for the record which a controller in
+	// distributed mode keeps for a volume stored on the node
+	// agent NodeID. The data of the volume is not on this node.
+	Remote bool
+	// Replication describes the asynchronous replication of the
+	// volume to or from a peer driver. The role is empty if the
+	// volume is not replicated.
+	Replication Replication
+	// DeletionDeferred is true for a volume which was deleted while
+	// it still had snapshots. It is removed together with its last
+	// snapshot and cannot be found by name.
+	DeletionDeferred bool
+	// Encrypted is true for block volumes whose backing file is
+	// formatted with LUKS2. The decrypted device is opened while
+	// the volume is staged.
+	Encrypted bool
+}
+
+// ReplicationRole is the role of a volume in a replication.
+type ReplicationRole string
+
+const (
+	// ReplicationSource is a writable volume whose data is copied
+	// to a peer.
+	ReplicationSource ReplicationRole = "source"
+	// ReplicationReplica is a copy of a volume on a peer. It cannot
+	// be written until it was promoted.
+	ReplicationReplica ReplicationRole = "replica"
+	// ReplicationPromoted is a former replica which was turned into
+	// a writable volume. It no longer accepts data from its source.
+	ReplicationPromoted ReplicationRole = "promoted"
+)
+
+// Replication is the replication status of a volume.
+type Replication struct {
+	Role ReplicationRole
+	// Peer is the node ID of the replica for a source volume and
+	// the node ID of the source for a replica.
+	Peer string
+	// SyncTime is the time at which the last complete transfer
+	// started. All data written before that time is on the replica.
+	SyncTime time.Time
+	// Lag is the age of the data on the replica when the status was
+	// last updated, i.e. the time since SyncTime.
+	Lag time.Duration
+	// BytesTransferred is the amount of data that the last complete
+	// transfer had to send.
+	BytesTransferred int64
+	// Error is the error of the last transfer. Empty if it succeeded.
+	Error string
+}
+
+// VolumeCapability is the access mode and mount configuration
+// of a volume capability. The access type is the same for all
+// capabilities of a volume and stored in Volume.VolAccessType.
+type VolumeCapability struct {
+	AccessMode string
+	FsType     string
+	MountFlags []string
 }
 
 type Snapshot struct {
@@ -68,6 +165,36 @@ type Snapshot struct {
 	SizeBytes       int64
 	ReadyToUse      bool
 	GroupSnapshotID string
+	// Scheduled is true for snapshots which were taken by the
+	// driver's snapshot scheduler. Only those are subject to
+	// the retention policy of the source volume.
+	Scheduled bool
+	// BlockBacked is true if the snapshot was taken from a
+	// block-backed mount volume and contains the raw filesystem
+	// image instead of a tar archive.
+	BlockBacked bool
+	// FsType is the filesystem type of the block-backed mount
+	// volume at the time of the snapshot. Empty if the volume
+	// was never staged and thus not formatted.
+	FsType string
+	// NodeID is the node which stores the snapshot. Only set
+	// by a controller which provisions onto node agents.
+	NodeID string
+	// Remote is true for the record which a controller in
+	// distributed mode keeps for a snapshot stored on the node
+	// agent NodeID.
+	Remote bool
+	// DeletionDeferred is true for a snapshot which was deleted
+	// while volumes restored from it still existed. It is removed
+	// together with the last of them and cannot be found by name.
+	DeletionDeferred bool
+	// EncryptionKeyID identifies the key with which the snapshot
+	// file is encrypted. Empty if the snapshot is not encrypted.
+	EncryptionKeyID string
+	// Encrypted is true if the snapshot was taken from a LUKS2
+	// encrypted volume and contains its LUKS header. Volumes
+	// restored from it are encrypted as well.
+	Encrypted bool
 }
 
 type GroupSnapshot struct {
@@ -88,7 +215,8 @@ type State interface {
 	GetVolumeByID(volID string) (Volume, error)
 
 	// GetVolumeByName retrieves a volume by its name or returns
-	// an error including that name when not found.
+	// an error including that name when not found. Volumes whose
+	// deletion is deferred are ignored.
 	GetVolumeByName(volName string) (Volume, error)
 
 	// GetVolumes returns all currently existing volumes.
@@ -109,7 +237,8 @@ type State interface {
 	GetSnapshotByID(snapshotID string) (Snapshot, error)
 
 	// GetSnapshotByName retrieves a snapshot by its name or returns
-	// an error including that name when not found.
+	// an error including that name when not found. Snapshots whose
+	// deletion is deferred are ignored.
 	GetSnapshotByName(volName string) (Snapshot, error)
 
 	// GetSnapshots returns all currently existing snapshots.
@@ -144,6 +273,10 @@ type State interface {
 	// groupsnapshot ID. It is not an error when such a groupsnapshot does
 	// not exist.
 	DeleteGroupSnapshot(groupSnapshotID string) error
+
+	// Close releases the lock on the state file, if New took it.
+	// The state must not be used afterwards.
+	Close() error
 }
 
 type resources struct {
@@ -156,37 +289,110 @@ type state struct {
 	resources
 
 	statefilePath string
+	lock          *FileLock
 }
 
 var _ State = &state{}
 
+// Option changes how New opens the state file.
+type Option func(*options)
+
+type options struct {
+	lock        bool
+	lockTimeout time.Duration
+}
+
+// WithLock makes New take the lock on the state file before reading
+// it, so that no other process can change the file until Close is
+// called. New waits up to the given time for another process to
+// release the lock; a zero timeout fails immediately with an error
+// that names the process holding the lock.
+func WithLock(timeout time.Duration) Option {
+	return func(o *options) {
+		o.lock = true
+		o.lockTimeout = timeout
+	}
+}
+
 // New retrieves the complete state of the driver from the file if given
 // and then ensures that all changes are mirrored immediately in the
 // given file. If not given, the initial state is empty and changes
 // are not saved.
-func New(statefilePath string) (State, error) {
+func New(statefilePath string, opts ...Option) (State, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
 	s := &state{
 		statefilePath: statefilePath,
 	}
+	if o.lock {
+		lock, err := LockWithTimeout(statefilePath, o.lockTimeout)
+		if err != nil {
+			return nil, err
+		}
+		s.lock = lock
+	}
+	if err := s.restore(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
 
-	return s, s.restore()
+func (s *state) Close() error {
+	if s.lock == nil {
+		return nil
+	}
+	err := s.lock.Unlock()
+	s.lock = nil
+	return err
 }
 
 func (s *state) dump() error {
+	if s.statefilePath == "" {
+		return nil
+	}
 	data, err := json.Marshal(&s.resources)
 	if err != nil {
 		return status.Errorf(codes.Internal, "error encoding volumes and snapshots: %v", err)
 	}
-	if err := os.WriteFile(s.statefilePath, data, 0600); err != nil {
+	if err := writeFileAtomic(s.statefilePath, data); err != nil {
 		return status.Errorf(codes.Internal, "error writing state file: %v", err)
 	}
 	return nil
 }
 
+// writeFileAtomic replaces the file with a new one, so readers
+// which do not hold the state lock, like health checks, see either
+// the old or the new content but never a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
 func (s *state) restore() error {
 	s.Volumes = nil
 	s.Snapshots = nil
 
+	if s.statefilePath == "" {
+		return nil
+	}
 	data, err := os.ReadFile(s.statefilePath)
 	switch {
 	case errors.Is(err, os.ErrNotExist):
@@ -198,6 +404,7 @@ func (s *state) restore() error {
 	if err := json.Unmarshal(data, &s.resources); err != nil {
 		return status.Errorf(codes.Internal, "error encoding volumes and snapshots from state file %q: %v", s.statefilePath, err)
 	}
+	s.migrateParents()
 	return nil
 }
 
@@ -212,7 +419,7 @@ func (s *state) GetVolumeByID(volID string) (Volume, error) {
 
 func (s *state) GetVolumeByName(volName string) (Volume, error) {
 	for _, volume := range s.Volumes {
-		if volume.VolName == volName {
+		if volume.VolName == volName && !volume.DeletionDeferred {
 			return volume, nil
 		}
 	}
@@ -257,7 +464,7 @@ func (s *state) GetSnapshotByID(snapshotID string) (Snapshot, error) {
 
 func (s *state) GetSnapshotByName(name string) (Snapshot, error) {
 	for _, snapshot := range s.Snapshots {
-		if snapshot.Name == name {
+		if snapshot.Name == name && !snapshot.DeletionDeferred {
 			return snapshot, nil
 		}
 	}
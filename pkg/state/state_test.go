@@ -17,8 +17,11 @@ limitations under the License.
 package state
 
 import (
+	"fmt"
+	"os"
 	"path"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc/codes"
@@ -155,3 +158,89 @@ func TestVolumeGroupSnapshots(t *testing.T) {
 
 	require.Empty(t, s.GetGroupSnapshots(), "final groupsnapshots")
 }
+
+func TestLock(t *testing.T) {
+	statefileName := path.Join(t.TempDir(), "state.json")
+
+	lock, err := Lock(statefileName)
+	require.NoError(t, err, "first lock")
+	_, err = Lock(statefileName)
+	require.ErrorIs(t, err, ErrLocked, "second lock")
+	require.ErrorContains(t, err, fmt.Sprintf("held by process %d", os.Getpid()), "second lock")
+	start := time.Now()
+	_, err = LockWithTimeout(statefileName, 200*time.Millisecond)
+	require.ErrorIs(t, err, ErrLocked, "lock with timeout")
+	require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond, "lock with timeout")
+
+	require.NoError(t, lock.Unlock(), "unlock")
+	lock, err = Lock(statefileName)
+	require.NoError(t, err, "lock after unlock")
+	require.NoError(t, lock.Unlock(), "unlock")
+}
+
+func TestNewWithLock(t *testing.T) {
+	statefileName := path.Join(t.TempDir(), "state.json")
+
+	s, err := New(statefileName, WithLock(0))
+	require.NoError(t, err, "construct locked state")
+	require.NoError(t, s.UpdateVolume(Volume{VolID: "foo"}), "add volume")
+	_, err = New(statefileName, WithLock(0))
+	require.ErrorIs(t, err, ErrLocked, "construct second locked state")
+
+	// A second instance which waits gets the lock once the first one is closed.
+	first := s
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		first.Close()
+	}()
+	s, err = New(statefileName, WithLock(10*time.Second))
+	require.NoError(t, err, "wait for lock")
+	defer s.Close()
+	_, err = s.GetVolumeByID("foo")
+	require.NoError(t, err, "volume after restart")
+}
+
+func TestLineage(t *testing.T) {
+	tmp := t.TempDir()
+	statefileName := path.Join(tmp, "state.json")
+	// Older versions stored the snapshot ID of a restored volume in ParentVolID.
+	data := `{
+  "Volumes": [
+    {"VolID": "src", "VolName": "pvc-src"},
+    {"VolID": "clone", "ParentVolID": "src"},
+    {"VolID": "restored", "ParentVolID": "snap"},
+    {"VolID": "old", "ParentVolID": "gone", "DeletionDeferred": true, "VolName": "pvc-src"}
+  ],
+  "Snapshots": [{"Id": "snap", "VolID": "src"}]
+}`
+	require.NoError(t, os.WriteFile(statefileName, []byte(data), 0600))
+	s, err := New(statefileName)
+	require.NoError(t, err)
+
+	restored, err := s.GetVolumeByID("restored")
+	require.NoError(t, err)
+	require.Equal(t, "snap", restored.ParentSnapID, "migrated parent snapshot")
+	require.Empty(t, restored.ParentVolID)
+	vol, err := s.GetVolumeByName("pvc-src")
+	require.NoError(t, err)
+	require.Equal(t, "src", vol.VolID, "deferred volume is not found by name")
+
+	root, err := Lineage(s, "restored")
+	require.NoError(t, err)
+	require.Equal(t, &LineageNode{Type: LineageVolume, ID: "src", Name: "pvc-src", Children: []*LineageNode{
+		{Type: LineageVolume, ID: "clone"},
+		{Type: LineageSnapshot, ID: "snap", Children: []*LineageNode{
+			{Type: LineageVolume, ID: "restored", Selected: true},
+		}},
+	}}, root)
+	root, err = Lineage(s, "old")
+	require.NoError(t, err)
+	require.Equal(t, "volume/gone", root.DeletedParent)
+	require.True(t, root.DeletionDeferred)
+	_, err = Lineage(s, "unknown")
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	require.Len(t, SnapshotsOf(s, "src"), 1)
+	require.Len(t, RestoredFrom(s, "snap"), 1)
+	require.Empty(t, RestoredFrom(s, "src"))
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// TrashDirName is the directory in the state directory which
+	// holds deleted volumes and snapshots until they are purged.
+	TrashDirName = ".trash"
+
+	trashRecordFile = "record.json"
+	trashDataFile   = "data"
+)
+
+// TrashEntry is a deleted volume or snapshot in the trash. Each entry
+// is a directory with the state record and the data of the volume or
+// snapshot.
+type TrashEntry struct {
+	// Type is LineageVolume or LineageSnapshot.
+	Type      string
+	DeletedAt time.Time
+	Volume    *Volume   `json:",omitempty"`
+	Snapshot  *Snapshot `json:",omitempty"`
+	// DataName is the name of the data file or directory in the
+	// state directory, for example "<id>.snap".
+	DataName string
+	// Dir is the directory of the entry.
+	Dir string `json:"-"`
+}
+
+// ID returns the ID of the deleted volume or snapshot.
+func (e *TrashEntry) ID() string {
+	if e.Snapshot != nil {
+		return e.Snapshot.Id
+	}
+	return e.Volume.VolID
+}
+
+// Name returns the name of the deleted volume or snapshot.
+func (e *TrashEntry) Name() string {
+	if e.Snapshot != nil {
+		return e.Snapshot.Name
+	}
+	return e.Volume.VolName
+}
+
+// DataPath returns the file or directory with the data of the
+// volume or snapshot. It does not exist if the data was missing
+// when the volume or snapshot was deleted.
+func (e *TrashEntry) DataPath() string {
+	return filepath.Join(e.Dir, trashDataFile)
+}
+
+// Remove deletes the entry together with its data.
+func (e *TrashEntry) Remove() error {
+	return os.RemoveAll(e.Dir)
+}
+
+// MoveToTrash records a deleted volume or snapshot in the trash and
+// moves its data there. The data must be on the same filesystem as
+// the trash. Missing data is not an error. An older entry for the
+// same ID is replaced.
+func MoveToTrash(trashDir string, entry TrashEntry, dataPath string) (*TrashEntry, error) {
+	if (entry.Volume == nil) == (entry.Snapshot == nil) {
+		return nil, errors.New("trash entry needs either a volume or a snapshot")
+	}
+	entry.Type = LineageVolume
+	if entry.Snapshot != nil {
+		entry.Type = LineageSnapshot
+	}
+	entry.Dir = filepath.Join(trashDir, entry.Type+"-"+entry.ID())
+	if err := os.RemoveAll(entry.Dir); err != nil {
+		return nil, fmt.Errorf("remove old trash entry: %w", err)
+	}
+	if err := os.MkdirAll(entry.Dir, 0750); err != nil {
+		return nil, fmt.Errorf("create trash entry: %w", err)
+	}
+
+	data, err := json.Marshal(&entry)
+	if err != nil {
+		return nil, err
+	}
+	tmp := filepath.Join(entry.Dir, trashRecordFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return nil, fmt.Errorf("write trash record: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(entry.Dir, trashRecordFile)); err != nil {
+		return nil, fmt.Errorf("write trash record: %w", err)
+	}
+	if err := os.Rename(dataPath, entry.DataPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("move %s to trash: %w", dataPath, err)
+	}
+	return &entry, nil
+}
+
+// ListTrash returns the entries in the trash, oldest first. Entries
+// without a readable record, for example because the driver stopped
+// while writing them, are skipped.
+func ListTrash(trashDir string) ([]TrashEntry, error) {
+	dirs, err := os.ReadDir(trashDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []TrashEntry
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		path := filepath.Join(trashDir, dir.Name())
+		data, err := os.ReadFile(filepath.Join(path, trashRecordFile))
+		if err != nil {
+			continue
+		}
+		entry := TrashEntry{Dir: path}
+		if err := json.Unmarshal(data, &entry); err != nil || (entry.Volume == nil && entry.Snapshot == nil) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].DeletedAt.Before(entries[j].DeletedAt)
+	})
+	return entries, nil
+}